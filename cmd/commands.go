@@ -0,0 +1,230 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/vasyvasilie/gemini-chat-tg-bot/pkg/config"
+	"github.com/vasyvasilie/gemini-chat-tg-bot/pkg/storage"
+	"github.com/vasyvasilie/gemini-chat-tg-bot/pkg/storage/storagetest"
+)
+
+// commands are maintenance tasks run instead of the bot, e.g. `bot conformance`
+var commands = map[string]func(args []string) error{
+	"audit":       runAudit,
+	"conformance": runConformance,
+	"restore":     runRestore,
+	"stats":       runStats,
+}
+
+func runCommand(name string, args []string) error {
+	command, ok := commands[name]
+	if !ok {
+		var names []string
+		for name := range commands {
+			names = append(names, name)
+		}
+		slices.Sort(names)
+		return fmt.Errorf("unknown command %q, available: %s", name, strings.Join(names, ", "))
+	}
+	return command(args)
+}
+
+// runConformance checks that the given backends, or all of them, pass the storage conformance suite.
+func runConformance(args []string) error {
+	backends := args
+	if len(backends) == 0 {
+		backends = storage.Backends
+	}
+
+	dir, err := os.MkdirTemp("", "storage-conformance")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return err
+	}
+	keyring, err := storage.ParseKeyring(base64.StdEncoding.EncodeToString(key))
+	if err != nil {
+		return err
+	}
+
+	var failed []string
+	for _, backend := range backends {
+		opened := 0
+		path := func() string {
+			opened++
+			return filepath.Join(dir, fmt.Sprintf("%s-%d.db", backend, opened))
+		}
+
+		// every backend is checked as it is and with encrypted values
+		for _, keyring := range []*storage.Keyring{nil, keyring} {
+			name := backend
+			if keyring != nil {
+				name += " encrypted"
+			}
+
+			newEngine := func() (storage.Engine, error) {
+				engine, err := storage.OpenEngine(backend, path())
+				if err != nil || keyring == nil {
+					return engine, err
+				}
+				return storage.NewEncryptedEngine(engine, keyring), nil
+			}
+			errs := []error{
+				storagetest.TestEngine(newEngine),
+				storagetest.TestStore(func() (storage.Store, error) {
+					return storage.Open(backend, path(), keyring)
+				}),
+				storagetest.TestMigrations(newEngine),
+			}
+			if keyring != nil {
+				errs = append(errs, storagetest.TestEncryption(func() (storage.Engine, error) {
+					return storage.OpenEngine(backend, path())
+				}))
+			}
+
+			passed := true
+			for _, err := range errs {
+				if err != nil {
+					log.Printf("❌ %s: %v", name, err)
+					passed = false
+				}
+			}
+			if !passed {
+				failed = append(failed, name)
+				continue
+			}
+			log.Printf("✅ %s passed", name)
+		}
+	}
+
+	if len(failed) > 0 {
+		return fmt.Errorf("backends failed the conformance suite: %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// runRestore replaces the database with a backup, e.g. `bot restore bolt.db-20250101-000000.gz`.
+func runRestore(args []string) error {
+	flags := flag.NewFlagSet("restore", flag.ContinueOnError)
+	backend, path := storageFlags(flags)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return fmt.Errorf("usage: restore [-backend name] [-path file] <snapshot>")
+	}
+	if *path == "" {
+		return config.ErrMissingEnv("STORAGE_PATH")
+	}
+
+	keyring, err := loadKeyring()
+	if err != nil {
+		return err
+	}
+
+	report, err := storage.Restore(*backend, flags.Arg(0), *path, keyring)
+	if err != nil {
+		return err
+	}
+	log.Printf("✅ Restored %d records of schema version %d to %s", report.Records, report.Version, *path)
+	if report.Previous != "" {
+		log.Printf("The replaced database was moved to %s", report.Previous)
+	}
+	return nil
+}
+
+// runStats prints the same statistics as /dbstats, the bot has to be stopped for bolt.
+func runStats(args []string) error {
+	flags := flag.NewFlagSet("stats", flag.ContinueOnError)
+	backend, path := storageFlags(flags)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	keyring, err := loadKeyring()
+	if err != nil {
+		return err
+	}
+
+	store, err := storage.Open(*backend, *path, keyring)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	stats, err := store.Stats()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Database %s\n", stats)
+	return nil
+}
+
+// runAudit prints the newest audit entries, e.g. the users who deleted their data with /forgetme.
+func runAudit(args []string) error {
+	flags := flag.NewFlagSet("audit", flag.ContinueOnError)
+	backend, path := storageFlags(flags)
+	limit := flags.Int("limit", 20, "number of entries to print, 0 for all")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	keyring, err := loadKeyring()
+	if err != nil {
+		return err
+	}
+
+	store, err := storage.Open(*backend, *path, keyring)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	entries, err := store.ListAudit(*limit)
+	if err != nil {
+		return err
+	}
+	if len(entries) == 0 {
+		fmt.Println("No audit entries")
+	}
+	for _, entry := range entries {
+		fmt.Printf("%s %s: user %d, %s\n", entry.At.Format(time.DateTime), entry.Action, entry.UserID,
+			(&storage.UserDataReport{Buckets: entry.Records}).String())
+		if len(entry.RemoteFiles) > 0 {
+			fmt.Printf("  not deleted on Gemini: %s\n", strings.Join(entry.RemoteFiles, ", "))
+		}
+	}
+	return nil
+}
+
+// storageFlags default to the same environment variables as for the bot.
+func storageFlags(flags *flag.FlagSet) (backend, path *string) {
+	defaultBackend := os.Getenv("STORAGE_BACKEND")
+	if defaultBackend == "" {
+		defaultBackend = storage.BackendBolt
+	}
+	backend = flags.String("backend", defaultBackend, "storage backend")
+	path = flags.String("path", os.Getenv("STORAGE_PATH"), "database file")
+	return backend, path
+}
+
+func loadKeyring() (*storage.Keyring, error) {
+	keys, err := config.LoadEncryptionKeys()
+	if err != nil {
+		return nil, err
+	}
+	return storage.ParseKeyring(keys)
+}
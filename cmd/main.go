@@ -2,7 +2,10 @@ package main
 
 import (
 	"context"
+	"expvar"
+	"flag"
 	"log"
+	"net/http"
 	"os"
 	"os/signal"
 	"sync"
@@ -16,17 +19,41 @@ import (
 	"github.com/vasyvasilie/gemini-chat-tg-bot/pkg/storage"
 )
 
+var migrateDryRun = flag.Bool("migrate-dry-run", false, "report what the storage migrations would change and exit")
+
 func main() {
+	flag.Parse()
+	if flag.NArg() > 0 {
+		if err := runCommand(flag.Arg(0), flag.Args()[1:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	config, err := config.Load()
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	bolt, err := storage.NewStorage(config.StoragePath)
+	keyring, err := storage.ParseKeyring(config.EncryptionKeys)
 	if err != nil {
 		log.Fatal(err)
 	}
 
+	if *migrateDryRun {
+		if err := planMigrations(config.StorageBackend, config.StoragePath, keyring); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	store, err := storage.Open(config.StorageBackend, config.StoragePath, keyring)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer store.Close()
+	log.Printf("Storage: %s", store.Migration())
+
 	tgBot, err := telego.NewBot(config.BotToken, telego.WithDefaultLogger(config.Debug, true))
 	if err != nil {
 		log.Fatal(err)
@@ -35,12 +62,40 @@ func main() {
 	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 	defer cancel()
 
-	geminiClient, err := gemini.NewClient(ctx, config, bolt)
+	if keyring != nil {
+		log.Printf("Storage values are encrypted with key %s", keyring.CurrentKeyID())
+		go func() {
+			// values written in plaintext or with an older key are encrypted again
+			rotated, err := store.RotateKeys(ctx)
+			if err != nil {
+				log.Printf("Failed to rotate storage encryption keys: %v", err)
+				return
+			}
+			log.Printf("Encrypted %d storage values with the current key", rotated)
+		}()
+	}
+
+	geminiClient, err := gemini.NewClient(ctx, config, store)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	bot, err := botPkg.NewBot(ctx, config, bolt, tgBot, geminiClient)
+	expvar.Publish("gemini_queue", expvar.Func(func() any {
+		return geminiClient.QueueStats()
+	}))
+	expvar.Publish("gemini_keys", expvar.Func(func() any {
+		return geminiClient.KeyStats()
+	}))
+	if config.MetricsAddr != "" {
+		go func() {
+			// expvar serves the stats on /debug/vars
+			if err := http.ListenAndServe(config.MetricsAddr, nil); err != nil {
+				log.Printf("Metrics server stopped: %v", err)
+			}
+		}()
+	}
+
+	bot, err := botPkg.NewBot(ctx, config, store, tgBot, geminiClient)
 	if err != nil {
 		log.Fatalf("Failed to create bot handler: %v", err)
 	}
@@ -60,3 +115,21 @@ func main() {
 	wg.Wait()
 	log.Println("Bot stopped.")
 }
+
+func planMigrations(backend, path string, keyring *storage.Keyring) error {
+	engine, err := storage.OpenEngine(backend, path)
+	if err != nil {
+		return err
+	}
+	defer engine.Close()
+	if keyring != nil {
+		engine = storage.NewEncryptedEngine(engine, keyring)
+	}
+
+	report, err := storage.PlanMigrations(engine)
+	if err != nil {
+		return err
+	}
+	log.Printf("Storage: %s", report)
+	return nil
+}
@@ -0,0 +1,93 @@
+package audio
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"mime"
+	"os/exec"
+	"strconv"
+)
+
+const (
+	ffmpegBinary   string = "ffmpeg"
+	opusBitrate    string = "32k"
+	wavHeaderSize  int    = 44
+	pcmFormatCode  uint16 = 1
+	defaultPCMRate int    = 24000
+)
+
+var ErrNoEncoder = errors.New("ffmpeg not found in PATH, voice replies are encoded with it")
+
+// PCMRate returns the sample rate of a raw PCM MIME type such as
+// "audio/L16;codec=pcm;rate=24000", falling back to 24kHz used by Gemini.
+func PCMRate(mimeType string) int {
+	_, params, err := mime.ParseMediaType(mimeType)
+	if err != nil {
+		return defaultPCMRate
+	}
+
+	rate, err := strconv.Atoi(params["rate"])
+	if err != nil || rate <= 0 {
+		return defaultPCMRate
+	}
+	return rate
+}
+
+// PCMToWAV wraps little-endian PCM samples into a WAV container.
+func PCMToWAV(pcm []byte, sampleRate, channels, bitsPerSample int) []byte {
+	blockAlign := channels * bitsPerSample / 8
+	byteRate := sampleRate * blockAlign
+
+	buf := bytes.NewBuffer(make([]byte, 0, wavHeaderSize+len(pcm)))
+	buf.WriteString("RIFF")
+	_ = binary.Write(buf, binary.LittleEndian, uint32(wavHeaderSize-8+len(pcm)))
+	buf.WriteString("WAVE")
+
+	buf.WriteString("fmt ")
+	_ = binary.Write(buf, binary.LittleEndian, uint32(16))
+	_ = binary.Write(buf, binary.LittleEndian, pcmFormatCode)
+	_ = binary.Write(buf, binary.LittleEndian, uint16(channels))
+	_ = binary.Write(buf, binary.LittleEndian, uint32(sampleRate))
+	_ = binary.Write(buf, binary.LittleEndian, uint32(byteRate))
+	_ = binary.Write(buf, binary.LittleEndian, uint16(blockAlign))
+	_ = binary.Write(buf, binary.LittleEndian, uint16(bitsPerSample))
+
+	buf.WriteString("data")
+	_ = binary.Write(buf, binary.LittleEndian, uint32(len(pcm)))
+	buf.Write(pcm)
+
+	return buf.Bytes()
+}
+
+// CheckEncoder reports ErrNoEncoder if ToOpus cannot run.
+func CheckEncoder() error {
+	if _, err := exec.LookPath(ffmpegBinary); err != nil {
+		return ErrNoEncoder
+	}
+	return nil
+}
+
+// ToOpus encodes any audio ffmpeg understands into OGG/Opus, the format
+// Telegram expects for voice messages. There is no pure Go Opus encoder,
+// so ffmpeg has to be installed, see CheckEncoder.
+func ToOpus(ctx context.Context, input []byte) ([]byte, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, ffmpegBinary,
+		"-hide_banner", "-loglevel", "error",
+		"-i", "pipe:0",
+		"-c:a", "libopus", "-b:a", opusBitrate,
+		"-f", "ogg", "pipe:1",
+	)
+	cmd.Stdin = bytes.NewReader(input)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("ffmpeg failed: %w: %s", err, stderr.String())
+	}
+
+	return stdout.Bytes(), nil
+}
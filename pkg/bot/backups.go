@@ -0,0 +1,259 @@
+package bot
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mymmrac/telego"
+	th "github.com/mymmrac/telego/telegohandler"
+	tu "github.com/mymmrac/telego/telegoutil"
+
+	"github.com/vasyvasilie/gemini-chat-tg-bot/pkg/config"
+	"github.com/vasyvasilie/gemini-chat-tg-bot/pkg/storage"
+)
+
+const (
+	backupTimeLayout string      = "20060102-150405"
+	backupExt        string      = ".gz"
+	backupDirMode    os.FileMode = 0700
+
+	// bots cannot upload bigger documents to Telegram
+	maxDocumentSize int = 50 * 1024 * 1024
+)
+
+// backups saves gzipped snapshots of the database to a directory and keeps the newest of them.
+type backups struct {
+	storage  storage.Store
+	dir      string
+	name     string
+	interval time.Duration
+	keep     int
+
+	mu   sync.Mutex
+	last *scheduledBackup
+}
+
+type scheduledBackup struct {
+	at      time.Time
+	path    string
+	size    int64
+	removed int
+	err     error
+}
+
+func newBackups(config *config.Config, store storage.Store) *backups {
+	name := filepath.Base(config.StoragePath)
+	if config.StoragePath == "" {
+		name = config.StorageBackend
+	}
+	return &backups{
+		storage:  store,
+		dir:      config.BackupDir,
+		name:     name,
+		interval: config.BackupInterval,
+		keep:     config.BackupKeep,
+	}
+}
+
+func (b *backups) enabled() bool {
+	return b.dir != ""
+}
+
+func (b *backups) fileName(at time.Time) string {
+	return fmt.Sprintf("%s-%s%s", b.name, at.Format(backupTimeLayout), backupExt)
+}
+
+// run saves a backup whenever the interval has passed since the last one, restarts do not reset it.
+func (b *backups) run(ctx context.Context) {
+	for {
+		timer := time.NewTimer(b.untilNext())
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		b.save()
+	}
+}
+
+func (b *backups) untilNext() time.Duration {
+	b.mu.Lock()
+	last := b.last
+	b.mu.Unlock()
+
+	var lastAt time.Time
+	if last != nil {
+		lastAt = last.at
+	} else if saved, err := b.list(); err == nil && len(saved) > 0 {
+		if info, err := os.Stat(filepath.Join(b.dir, saved[len(saved)-1])); err == nil {
+			lastAt = info.ModTime()
+		}
+	}
+	return max(time.Until(lastAt.Add(b.interval)), 0)
+}
+
+func (b *backups) save() {
+	result := &scheduledBackup{at: time.Now()}
+	result.path, result.size, result.err = b.write(result.at)
+	if result.err == nil {
+		result.removed, result.err = b.rotate()
+	}
+
+	if result.err != nil {
+		log.Printf("Storage backup failed: %v", result.err)
+	} else {
+		log.Printf("Storage backup: %s", result)
+	}
+
+	b.mu.Lock()
+	b.last = result
+	b.mu.Unlock()
+}
+
+// write saves the backup under a temporary name first, so a partial file never looks like a backup.
+func (b *backups) write(at time.Time) (string, int64, error) {
+	if err := os.MkdirAll(b.dir, backupDirMode); err != nil {
+		return "", 0, fmt.Errorf("failed to create backup directory: %w", err)
+	}
+
+	path := filepath.Join(b.dir, b.fileName(at))
+	f, err := os.CreateTemp(b.dir, b.name+".tmp-*")
+	if err != nil {
+		return "", 0, err
+	}
+	defer os.Remove(f.Name())
+
+	if err := b.storage.Backup(f); err != nil {
+		f.Close()
+		return "", 0, err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return "", 0, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return "", 0, err
+	}
+	if err := f.Close(); err != nil {
+		return "", 0, err
+	}
+
+	if err := os.Rename(f.Name(), path); err != nil {
+		return "", 0, err
+	}
+	return path, info.Size(), nil
+}
+
+// list returns the saved backups, oldest first.
+func (b *backups) list() ([]string, error) {
+	entries, err := os.ReadDir(b.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.Type().IsRegular() && strings.HasPrefix(name, b.name+"-") && strings.HasSuffix(name, backupExt) {
+			names = append(names, name)
+		}
+	}
+	// the timestamps sort in time order
+	slices.Sort(names)
+	return names, nil
+}
+
+func (b *backups) rotate() (int, error) {
+	if b.keep == 0 {
+		return 0, nil
+	}
+
+	names, err := b.list()
+	if err != nil {
+		return 0, err
+	}
+
+	removed := 0
+	for len(names)-removed > b.keep {
+		if err := os.Remove(filepath.Join(b.dir, names[removed])); err != nil {
+			return removed, fmt.Errorf("failed to remove old backup: %w", err)
+		}
+		removed++
+	}
+	return removed, nil
+}
+
+// status describes the schedule and the last scheduled backup.
+func (b *backups) status() string {
+	if !b.enabled() {
+		return "Scheduled backups are off."
+	}
+
+	keep := "all of them are kept"
+	if b.keep > 0 {
+		keep = fmt.Sprintf("the newest %d are kept", b.keep)
+	}
+	text := fmt.Sprintf("Backups are saved to %s every %s, %s.", b.dir, b.interval, keep)
+
+	b.mu.Lock()
+	last := b.last
+	b.mu.Unlock()
+
+	switch {
+	case last == nil:
+		return text + "\nNo backup has been saved since the start."
+	case last.err != nil:
+		return fmt.Sprintf("%s\n❌ Last backup at %s failed: %v", text, last.at.Format(time.DateTime), last.err)
+	default:
+		return fmt.Sprintf("%s\nLast backup at %s %s.", text, last.at.Format(time.DateTime), last)
+	}
+}
+
+func (s *scheduledBackup) String() string {
+	text := fmt.Sprintf("saved %s (%.2fMB)", filepath.Base(s.path), float64(s.size)/bytesInMB)
+	if s.removed > 0 {
+		text += fmt.Sprintf(", removed %d old backups", s.removed)
+	}
+	return text
+}
+
+// Handler for /backup command
+func (b *botImpl) handlerBackup(ctx *th.Context, update telego.Update) error {
+	userID := update.Message.From.ID
+	if !b.isAdmin(userID) {
+		b.sendErrorMessage(ctx, userID, adminOnlyMsg)
+		return nil
+	}
+
+	_ = ctx.Bot().SendChatAction(ctx, tu.ChatAction(tu.ID(userID), telego.ChatActionUploadDocument))
+
+	var data bytes.Buffer
+	if err := b.storage.Backup(&data); err != nil {
+		log.Printf("Failed to back up the database: %v", err)
+		b.sendErrorMessage(ctx, userID, fmt.Sprintf("❌ Failed to back up the database: %v", err))
+		return err
+	}
+	if data.Len() > maxDocumentSize {
+		b.sendErrorMessage(ctx, userID, fmt.Sprintf(
+			"⚠️ The backup takes %.2fMB, more than Telegram lets bots send. Use scheduled backups instead.\n\n%s",
+			float64(data.Len())/bytesInMB, b.backups.status()))
+		return nil
+	}
+
+	_, err := ctx.Bot().SendDocument(ctx, tu.Document(tu.ID(userID),
+		tu.FileFromBytes(data.Bytes(), b.backups.fileName(time.Now()))).
+		WithCaption(fmt.Sprintf("💾 Database backup, %.2fMB compressed.\n\n%s",
+			float64(data.Len())/bytesInMB, b.backups.status())))
+	return err
+}
@@ -24,10 +24,16 @@ var _ Bot = &botImpl{}
 
 type botImpl struct {
 	config       *config.Config
-	storage      *storage.Storage
+	storage      storage.Store
 	tgBotHandler *th.BotHandler
 	tgBotAPI     *tgbotapi.BotAPI
 	geminiClient *gemini.Client
+	queue        *userQueue
+	inline       *inlineState
+	cancels      *cancelRegistry
+	indexer      *indexer
+	janitor      *janitor
+	backups      *backups
 }
 
 func (b *botImpl) SendLongMessage(ctx *th.Context, chatID telego.ChatID, text string) error {
@@ -59,7 +65,7 @@ func (b *botImpl) SendLongMessage(ctx *th.Context, chatID telego.ChatID, text st
 
 func NewBot(ctx context.Context,
 	config *config.Config,
-	bolt *storage.Storage,
+	bolt storage.Store,
 	tgBot *telego.Bot,
 	geminiClient *gemini.Client,
 ) (Bot, error) {
@@ -89,10 +95,31 @@ func NewBot(ctx context.Context,
 		tgBotHandler: tgBotHandler,
 		tgBotAPI:     tgBotAPI,
 		geminiClient: geminiClient,
+		queue:        newUserQueue(),
+		inline:       newInlineState(),
+		cancels:      newCancelRegistry(),
+		janitor:      newJanitor(config, bolt),
+		backups:      newBackups(config, bolt),
 	}
+	bot.indexer = newIndexer(bot.indexExchange)
 	bot.setupMiddlewares()
 	bot.setupHandlers()
 
+	go bot.indexer.run()
+
+	if bot.janitor.enabled() {
+		go bot.janitor.run(ctx)
+	}
+	if bot.backups.enabled() {
+		go bot.backups.run(ctx)
+	}
+
+	for adminID := range config.AdminUsers {
+		if err := bot.refreshCommands(ctx, tgBot, adminID); err != nil {
+			log.Printf("Failed to set admin commands for user %d: %v", adminID, err)
+		}
+	}
+
 	return bot, nil
 }
 
@@ -102,4 +129,5 @@ func (b *botImpl) Start() {
 
 func (b *botImpl) Stop() {
 	b.tgBotHandler.Stop()
+	b.indexer.stop()
 }
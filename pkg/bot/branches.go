@@ -0,0 +1,151 @@
+package bot
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/mymmrac/telego"
+	th "github.com/mymmrac/telego/telegohandler"
+	tu "github.com/mymmrac/telego/telegoutil"
+
+	"github.com/vasyvasilie/gemini-chat-tg-bot/pkg/gemini"
+	"github.com/vasyvasilie/gemini-chat-tg-bot/pkg/storage"
+)
+
+const (
+	prefixBranch        string = "v1_branch_"
+	branchSnippetLength int    = 40
+)
+
+// Handler for edited messages
+func (b *botImpl) handlerEditedMessage(ctx *th.Context, update telego.Update) error {
+	message := update.EditedMessage
+	userID := message.From.ID
+	if strings.HasPrefix(message.Text, "/") {
+		return nil
+	}
+
+	session, err := b.getUserSessionWithErrorHandling(ctx, userID)
+	if err != nil {
+		return err
+	}
+
+	return b.fork(ctx, session, userID, message.MessageID, storage.Message{
+		Role:      gemini.RoleUser,
+		Text:      message.Text,
+		MessageID: message.MessageID,
+	})
+}
+
+// fork starts a new branch at the prompt sent as the given message and regenerates the answer.
+// The previous branch stays in the conversation and can be picked with /branches.
+func (b *botImpl) fork(ctx *th.Context, session *UserSession, userID int64, messageID int, prompt storage.Message) error {
+	history, err := b.loadHistoryWithErrorHandling(ctx, session, userID)
+	if err != nil {
+		return err
+	}
+
+	turn := slices.IndexFunc(history, func(message storage.Message) bool {
+		return message.Role == gemini.RoleUser && message.MessageID == messageID
+	})
+	if turn == -1 {
+		b.sendErrorMessage(ctx, userID, "❎ This message is not part of the current conversation branch.")
+		return nil
+	}
+
+	log.Printf("Forking conversation %s of user %d at turn %d", session.SessionID, userID, turn)
+	b.sendSuccessMessage(ctx, userID, "🌿 Started a new branch from this message, see /branches to go back.")
+
+	session.setHistory(slices.Clip(history[:turn]), session.stored)
+	return b.chat(ctx, session, userID, prompt)
+}
+
+// Handler for /branches command
+func (b *botImpl) handlerBranches(ctx *th.Context, update telego.Update) error {
+	userID := update.Message.From.ID
+	session, err := b.getUserSessionWithErrorHandling(ctx, userID)
+	if err != nil {
+		return err
+	}
+
+	conversation, err := b.storage.GetConversation(userID, session.SessionID)
+	if errors.Is(err, storage.ErrConversationNotFound) {
+		b.sendSuccessMessage(ctx, userID, "🌿 The conversation is empty.")
+		return nil
+	}
+	if err != nil {
+		log.Printf("Failed to get conversation %s of user %d: %v", session.SessionID, userID, err)
+		b.sendErrorMessage(ctx, userID, "❌ Failed to list branches.")
+		return err
+	}
+
+	branches := conversation.Tree.Branches()
+	if len(branches) < 2 {
+		b.sendSuccessMessage(ctx, userID, "🌿 The conversation has a single branch. "+
+			"Edit or reply to one of your earlier messages to fork it.")
+		return nil
+	}
+
+	var rows [][]telego.InlineKeyboardButton
+	for i, branch := range branches {
+		label := fmt.Sprintf("🌿 %d. %s (%d)", i+1, lastPrompt(branch.Messages), len(branch.Messages))
+		if branch.Active {
+			label = fmt.Sprintf("▶️ %d. %s (%d)", i+1, lastPrompt(branch.Messages), len(branch.Messages))
+		}
+		rows = append(rows, tu.InlineKeyboardRow(tu.InlineKeyboardButton(label).
+			WithCallbackData(fmt.Sprintf("%s%d", prefixBranch, branch.Leaf))))
+	}
+
+	_, err = ctx.Bot().SendMessage(ctx, tu.Message(tu.ID(userID),
+		fmt.Sprintf("🌿 Branches of %s, by last prompt and number of messages:", conversationTitle(conversation))).
+		WithReplyMarkup(tu.InlineKeyboard(rows...)))
+	return err
+}
+
+func (b *botImpl) callbackBranch(ctx *th.Context, query telego.CallbackQuery) error {
+	chatID := query.Message.GetChat().ChatID()
+	userID := chatID.ID
+
+	if err := b.setupCallbackQuery(ctx, query, userID); err != nil {
+		return err
+	}
+
+	session, err := b.getUserSessionWithErrorHandling(ctx, userID)
+	if err != nil {
+		return err
+	}
+
+	leaf, err := strconv.Atoi(strings.TrimPrefix(query.Data, prefixBranch))
+	if err != nil {
+		return err
+	}
+
+	conversation, err := b.storage.SwitchBranch(userID, session.SessionID, leaf)
+	if errors.Is(err, storage.ErrConversationNotFound) || errors.Is(err, storage.ErrBranchNotFound) {
+		b.sendErrorMessage(ctx, userID, "❎ Branch not found.")
+		return nil
+	}
+	if err != nil {
+		log.Printf("Failed to switch branch of conversation %s for user %d: %v", session.SessionID, userID, err)
+		b.sendErrorMessage(ctx, userID, "❌ Failed to switch branch.")
+		return err
+	}
+
+	log.Printf("Switched conversation %s of user %d to branch %d", session.SessionID, userID, leaf)
+	b.sendSuccessMessage(ctx, userID, fmt.Sprintf("🌿 Switched to the branch ending with: %s",
+		truncateText(lastPrompt(conversation.History.Messages), findSnippetLength)))
+	return nil
+}
+
+func lastPrompt(messages []storage.Message) string {
+	for i := len(messages) - 1; i >= 0; i-- {
+		if messages[i].Role == gemini.RoleUser {
+			return truncateText(strings.Join(strings.Fields(messages[i].Text), " "), branchSnippetLength)
+		}
+	}
+	return ""
+}
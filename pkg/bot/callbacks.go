@@ -1,6 +1,7 @@
 package bot
 
 import (
+	"errors"
 	"fmt"
 	"log"
 	"slices"
@@ -12,11 +13,15 @@ import (
 	tu "github.com/mymmrac/telego/telegoutil"
 
 	"github.com/vasyvasilie/gemini-chat-tg-bot/pkg/gemini"
+	"github.com/vasyvasilie/gemini-chat-tg-bot/pkg/storage"
 )
 
 const (
 	prefixAddModelToFavorites   string = "v1_add_"
 	prefixSetModelFromFavorites string = "v1_setmodelfromfavorites_"
+	prefixRestoreSession        string = "v1_restore_"
+	// followed by the generation ID, see cancelRegistry
+	prefixStop string = "v1_stop_"
 )
 
 func (b *botImpl) setupCallbackQuery(ctx *th.Context, query telego.CallbackQuery, userID int64) error {
@@ -98,3 +103,32 @@ func (b *botImpl) callbackSetModelFromFavorites(ctx *th.Context, query telego.Ca
 	b.sendFormattedMessage(ctx, userID, fmt.Sprintf("✨ Your current model is: `%s`", fullModelName))
 	return nil
 }
+
+func (b *botImpl) callbackRestoreSession(ctx *th.Context, query telego.CallbackQuery) error {
+	chatID := query.Message.GetChat().ChatID()
+	userID := chatID.ID
+
+	if err := b.setupCallbackQuery(ctx, query, userID); err != nil {
+		return err
+	}
+
+	sessionID := strings.TrimPrefix(query.Data, prefixRestoreSession)
+	conversation, err := b.storage.GetConversation(userID, sessionID)
+	if errors.Is(err, storage.ErrConversationNotFound) {
+		b.sendErrorMessage(ctx, userID, "❎ Conversation not found, it was deleted.")
+		return nil
+	}
+	if err != nil {
+		log.Printf("Failed to load conversation %s for user %d: %v", sessionID, userID, err)
+		b.sendErrorMessage(ctx, userID, "❌ Failed to restore conversation.")
+		return err
+	}
+
+	if err = b.switchConversation(ctx, userID, conversation); err != nil {
+		return err
+	}
+
+	b.sendSuccessMessage(ctx, userID, fmt.Sprintf("♻️ Conversation %s restored (%d messages).",
+		conversationTitle(conversation), len(conversation.History.Messages)))
+	return nil
+}
@@ -0,0 +1,74 @@
+package bot
+
+import (
+	"context"
+	"sync"
+)
+
+// cancelRegistry keeps the cancel function of the running generation of each user.
+type cancelRegistry struct {
+	mu      sync.Mutex
+	next    uint64
+	running map[int64]cancelEntry
+}
+
+type cancelEntry struct {
+	id     uint64
+	cancel context.CancelFunc
+}
+
+func newCancelRegistry() *cancelRegistry {
+	return &cancelRegistry{running: make(map[int64]cancelEntry)}
+}
+
+// register stores cancel for the user and returns the ID of the generation and a function
+// that forgets and releases it once the generation is over.
+func (r *cancelRegistry) register(userID int64, cancel context.CancelFunc) (uint64, func()) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.next++
+	id := r.next
+	r.running[userID] = cancelEntry{id: id, cancel: cancel}
+
+	return id, func() {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+
+		if entry, ok := r.running[userID]; ok && entry.id == id {
+			delete(r.running, userID)
+		}
+		cancel()
+	}
+}
+
+// cancel stops the running generation of the user, if any.
+func (r *cancelRegistry) cancel(userID int64) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	entry, ok := r.running[userID]
+	if !ok {
+		return false
+	}
+
+	entry.cancel()
+	delete(r.running, userID)
+	return true
+}
+
+// cancelGeneration stops the running generation of the user only if it is the one with the ID,
+// so the Stop button of a finished generation does not stop the next one.
+func (r *cancelRegistry) cancelGeneration(userID int64, id uint64) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	entry, ok := r.running[userID]
+	if !ok || entry.id != id {
+		return false
+	}
+
+	entry.cancel()
+	delete(r.running, userID)
+	return true
+}
@@ -0,0 +1,403 @@
+package bot
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mymmrac/telego"
+	th "github.com/mymmrac/telego/telegohandler"
+	tu "github.com/mymmrac/telego/telegoutil"
+
+	"github.com/vasyvasilie/gemini-chat-tg-bot/pkg/export"
+	"github.com/vasyvasilie/gemini-chat-tg-bot/pkg/gemini"
+	"github.com/vasyvasilie/gemini-chat-tg-bot/pkg/storage"
+)
+
+const (
+	prefixChatsPage   string = "v1_chats_"
+	prefixChat        string = "v1_chat_"
+	prefixChatSwitch  string = "v1_chatswitch_"
+	prefixChatRename  string = "v1_chatrename_"
+	prefixChatArchive string = "v1_chatarchive_"
+	prefixChatDelete  string = "v1_chatdelete_"
+	chatsPageActive   string = "a"
+	chatsPageArchived string = "r"
+	chatsPageSize     int    = 5
+	titleLength       int    = 40
+	titleMaxTokens    int32  = 30
+	titleTimeout             = 30 * time.Second
+	titlePromptFormat string = "Write a short title, at most six words, for a conversation that starts with the message below. " +
+		"Answer with the title only, without quotes.\n\n%s"
+	untitledConversation string = "Untitled"
+)
+
+// Handler for /chats command
+func (b *botImpl) handlerChats(ctx *th.Context, update telego.Update) error {
+	userID := update.Message.From.ID
+
+	subcommand, title := splitFirstWord(commandArgs(update.Message.Text))
+	switch subcommand {
+	case "":
+		return b.sendChatsPage(ctx, userID, false, 0, 0)
+	case "archived":
+		return b.sendChatsPage(ctx, userID, true, 0, 0)
+	case "rename":
+		session, err := b.getUserSessionWithErrorHandling(ctx, userID)
+		if err != nil {
+			return err
+		}
+		return b.renameConversation(ctx, userID, session.SessionID, title)
+	default:
+		b.sendFormattedMessage(ctx, userID, "⚠️ Usage: `/chats`, `/chats archived` or `/chats rename title`")
+		return nil
+	}
+}
+
+func (b *botImpl) callbackChatsPage(ctx *th.Context, query telego.CallbackQuery) error {
+	userID := query.From.ID
+	if err := ctx.Bot().AnswerCallbackQuery(ctx, tu.CallbackQuery(query.ID)); err != nil {
+		log.Printf("Failed to answer callback: %v", err)
+	}
+
+	data := strings.TrimPrefix(query.Data, prefixChatsPage)
+	archived := strings.HasPrefix(data, chatsPageArchived)
+	page, _ := strconv.Atoi(data[min(1, len(data)):])
+
+	return b.sendChatsPage(ctx, userID, archived, page, query.Message.GetMessageID())
+}
+
+func (b *botImpl) callbackChat(ctx *th.Context, query telego.CallbackQuery) error {
+	userID := query.From.ID
+	if err := ctx.Bot().AnswerCallbackQuery(ctx, tu.CallbackQuery(query.ID)); err != nil {
+		log.Printf("Failed to answer callback: %v", err)
+	}
+
+	conversation, err := b.getConversationWithErrorHandling(ctx, userID, strings.TrimPrefix(query.Data, prefixChat))
+	if err != nil || conversation == nil {
+		return err
+	}
+
+	archive := "🗄 Archive"
+	if conversation.Archived {
+		archive = "📤 Unarchive"
+	}
+
+	text := fmt.Sprintf("💬 %s\n✨ Model: %s\n📅 Created: %s\n🕑 Updated: %s\n✉️ Messages: %d",
+		conversationTitle(conversation),
+		strings.TrimPrefix(conversation.Model, gemini.ModelPrefix),
+		conversation.CreatedAt.Format(dateTimeLayout),
+		conversation.UpdatedAt.Format(dateTimeLayout),
+		len(conversation.History.Messages),
+	)
+	keyboard := tu.InlineKeyboard(
+		tu.InlineKeyboardRow(
+			tu.InlineKeyboardButton("↪️ Switch").WithCallbackData(prefixChatSwitch+conversation.ID),
+			tu.InlineKeyboardButton("✏️ Rename").WithCallbackData(prefixChatRename+conversation.ID),
+		),
+		tu.InlineKeyboardRow(
+			tu.InlineKeyboardButton(archive).WithCallbackData(prefixChatArchive+conversation.ID),
+			tu.InlineKeyboardButton("🗑 Delete").WithCallbackData(prefixChatDelete+conversation.ID),
+		),
+		tu.InlineKeyboardRow(
+			tu.InlineKeyboardButton("📤 MD").
+				WithCallbackData(prefixExport+export.FormatMarkdown+"_"+conversation.ID),
+			tu.InlineKeyboardButton("📤 JSON").
+				WithCallbackData(prefixExport+export.FormatJSON+"_"+conversation.ID),
+			tu.InlineKeyboardButton("📤 HTML").
+				WithCallbackData(prefixExport+export.FormatHTML+"_"+conversation.ID),
+		),
+	)
+
+	_, err = ctx.Bot().SendMessage(ctx, tu.Message(tu.ID(userID), text).WithReplyMarkup(keyboard))
+	return err
+}
+
+func (b *botImpl) callbackChatSwitch(ctx *th.Context, query telego.CallbackQuery) error {
+	chatID := query.Message.GetChat().ChatID()
+	userID := chatID.ID
+
+	if err := b.setupCallbackQuery(ctx, query, userID); err != nil {
+		return err
+	}
+
+	conversation, err := b.getConversationWithErrorHandling(ctx, userID, strings.TrimPrefix(query.Data, prefixChatSwitch))
+	if err != nil || conversation == nil {
+		return err
+	}
+
+	if err = b.switchConversation(ctx, userID, conversation); err != nil {
+		return err
+	}
+
+	b.sendSuccessMessage(ctx, userID, fmt.Sprintf("↪️ Switched to %s (%d messages).",
+		conversationTitle(conversation), len(conversation.History.Messages)))
+	return nil
+}
+
+func (b *botImpl) callbackChatRename(ctx *th.Context, query telego.CallbackQuery) error {
+	chatID := query.Message.GetChat().ChatID()
+	userID := chatID.ID
+
+	if err := b.setupCallbackQuery(ctx, query, userID); err != nil {
+		return err
+	}
+
+	session, err := b.getUserSessionWithErrorHandling(ctx, userID)
+	if err != nil {
+		return err
+	}
+
+	session.PendingRename = strings.TrimPrefix(query.Data, prefixChatRename)
+	if err = b.saveUserSessionWithErrorHandling(ctx, session, userID); err != nil {
+		return err
+	}
+
+	b.sendSuccessMessage(ctx, userID, "✏️ Send the new title.")
+	return nil
+}
+
+func (b *botImpl) callbackChatArchive(ctx *th.Context, query telego.CallbackQuery) error {
+	chatID := query.Message.GetChat().ChatID()
+	userID := chatID.ID
+
+	if err := b.setupCallbackQuery(ctx, query, userID); err != nil {
+		return err
+	}
+
+	conversation, err := b.getConversationWithErrorHandling(ctx, userID, strings.TrimPrefix(query.Data, prefixChatArchive))
+	if err != nil || conversation == nil {
+		return err
+	}
+
+	conversation.Archived = !conversation.Archived
+	if err = b.storage.SaveConversation(conversation); err != nil {
+		log.Printf("Failed to archive conversation %s of user %d: %v", conversation.ID, userID, err)
+		b.sendErrorMessage(ctx, userID, "❌ Failed to update conversation.")
+		return err
+	}
+
+	if !conversation.Archived {
+		b.sendSuccessMessage(ctx, userID, fmt.Sprintf("📤 %s is back in /chats.", conversationTitle(conversation)))
+		return nil
+	}
+
+	if err = b.leaveConversation(ctx, userID, conversation.ID); err != nil {
+		return err
+	}
+	b.sendSuccessMessage(ctx, userID, fmt.Sprintf("🗄 %s archived, see /chats archived.", conversationTitle(conversation)))
+	return nil
+}
+
+func (b *botImpl) callbackChatDelete(ctx *th.Context, query telego.CallbackQuery) error {
+	chatID := query.Message.GetChat().ChatID()
+	userID := chatID.ID
+
+	if err := b.setupCallbackQuery(ctx, query, userID); err != nil {
+		return err
+	}
+
+	id := strings.TrimPrefix(query.Data, prefixChatDelete)
+	err := b.storage.DeleteConversation(userID, id)
+	if errors.Is(err, storage.ErrConversationNotFound) {
+		b.sendErrorMessage(ctx, userID, "❎ Conversation not found.")
+		return nil
+	}
+	if err != nil {
+		log.Printf("Failed to delete conversation %s of user %d: %v", id, userID, err)
+		b.sendErrorMessage(ctx, userID, "❌ Failed to delete conversation.")
+		return err
+	}
+
+	if err = b.leaveConversation(ctx, userID, id); err != nil {
+		return err
+	}
+
+	log.Printf("Deleted conversation %s of user %d", id, userID)
+	b.sendSuccessMessage(ctx, userID, "🗑 Conversation deleted.")
+	return nil
+}
+
+func (b *botImpl) sendChatsPage(ctx *th.Context, userID int64, archived bool, page, messageID int) error {
+	session, err := b.getUserSessionWithErrorHandling(ctx, userID)
+	if err != nil {
+		return err
+	}
+
+	all, err := b.storage.ListConversations(userID)
+	if err != nil {
+		log.Printf("Failed to list conversations for user %d: %v", userID, err)
+		b.sendErrorMessage(ctx, userID, "❌ Failed to list conversations.")
+		return err
+	}
+
+	var conversations []storage.Conversation
+	for _, conversation := range all {
+		if conversation.Archived == archived {
+			conversations = append(conversations, conversation)
+		}
+	}
+
+	kind, text, other, otherLabel := chatsPageActive, "💬 Your conversations:", chatsPageArchived, "🗄 Archived"
+	if archived {
+		kind, text, other, otherLabel = chatsPageArchived, "🗄 Archived conversations:", chatsPageActive, "💬 Active"
+	}
+	if len(conversations) == 0 {
+		text = "💬 No conversations yet."
+		if archived {
+			text = "🗄 No archived conversations."
+		}
+	}
+
+	pages := max((len(conversations)+chatsPageSize-1)/chatsPageSize, 1)
+	page = min(max(page, 0), pages-1)
+
+	var rows [][]telego.InlineKeyboardButton
+	for _, conversation := range conversations[page*chatsPageSize : min((page+1)*chatsPageSize, len(conversations))] {
+		label := fmt.Sprintf("💬 %s", conversationTitle(&conversation))
+		if conversation.ID == session.SessionID {
+			label = fmt.Sprintf("▶️ %s", conversationTitle(&conversation))
+		}
+		rows = append(rows, tu.InlineKeyboardRow(
+			tu.InlineKeyboardButton(label).WithCallbackData(prefixChat+conversation.ID)))
+	}
+
+	var navigation []telego.InlineKeyboardButton
+	if page > 0 {
+		navigation = append(navigation, tu.InlineKeyboardButton("◀️").
+			WithCallbackData(fmt.Sprintf("%s%s%d", prefixChatsPage, kind, page-1)))
+	}
+	navigation = append(navigation, tu.InlineKeyboardButton(otherLabel).
+		WithCallbackData(fmt.Sprintf("%s%s0", prefixChatsPage, other)))
+	if page < pages-1 {
+		navigation = append(navigation, tu.InlineKeyboardButton("▶️").
+			WithCallbackData(fmt.Sprintf("%s%s%d", prefixChatsPage, kind, page+1)))
+	}
+	rows = append(rows, navigation)
+
+	if pages > 1 {
+		text = fmt.Sprintf("%s (page %d/%d)", text, page+1, pages)
+	}
+
+	if messageID != 0 {
+		_, err = ctx.Bot().EditMessageText(ctx, tu.EditMessageText(tu.ID(userID), messageID, text).
+			WithReplyMarkup(tu.InlineKeyboard(rows...)))
+		return err
+	}
+
+	_, err = ctx.Bot().SendMessage(ctx, tu.Message(tu.ID(userID), text).WithReplyMarkup(tu.InlineKeyboard(rows...)))
+	return err
+}
+
+func (b *botImpl) getConversationWithErrorHandling(ctx *th.Context, userID int64, id string) (*storage.Conversation, error) {
+	conversation, err := b.storage.GetConversation(userID, id)
+	if errors.Is(err, storage.ErrConversationNotFound) {
+		b.sendErrorMessage(ctx, userID, "❎ Conversation not found.")
+		return nil, nil
+	}
+	if err != nil {
+		log.Printf("Failed to get conversation %s of user %d: %v", id, userID, err)
+		b.sendErrorMessage(ctx, userID, "❌ Failed to get conversation.")
+		return nil, err
+	}
+
+	return conversation, nil
+}
+
+// switchConversation makes the conversation the active one together with its model.
+func (b *botImpl) switchConversation(ctx *th.Context, userID int64, conversation *storage.Conversation) error {
+	if conversation.Archived {
+		conversation.Archived = false
+		if err := b.storage.SaveConversation(conversation); err != nil {
+			log.Printf("Failed to unarchive conversation %s of user %d: %v", conversation.ID, userID, err)
+		}
+	}
+
+	session, err := b.getUserSessionWithErrorHandling(ctx, userID)
+	if err != nil {
+		return err
+	}
+
+	session.SessionID = conversation.ID
+	session.setHistory(conversation.History.Messages, len(conversation.History.Messages))
+	if conversation.Model != "" {
+		session.ModelName = conversation.Model
+	}
+	if err = b.saveUserSessionWithErrorHandling(ctx, session, userID); err != nil {
+		return err
+	}
+
+	log.Printf("Switched user %d to conversation %s", userID, conversation.ID)
+	return nil
+}
+
+// leaveConversation starts a new conversation if the given one is active.
+func (b *botImpl) leaveConversation(ctx *th.Context, userID int64, id string) error {
+	session, err := b.getUserSessionWithErrorHandling(ctx, userID)
+	if err != nil {
+		return err
+	}
+	if session.SessionID != id {
+		return nil
+	}
+
+	session.SessionID = newSessionID()
+	session.setHistory(nil, 0)
+	return b.saveUserSessionWithErrorHandling(ctx, session, userID)
+}
+
+func (b *botImpl) renameConversation(ctx *th.Context, userID int64, id, title string) error {
+	title = strings.TrimSpace(title)
+	if title == "" {
+		b.sendFormattedMessage(ctx, userID, "⚠️ Please specify a title.\nUsage: `/chats rename title`")
+		return nil
+	}
+
+	err := b.storage.RenameConversation(userID, id, truncateText(title, titleLength))
+	if errors.Is(err, storage.ErrConversationNotFound) {
+		b.sendErrorMessage(ctx, userID, "❎ Conversation not found, send a message to start it first.")
+		return nil
+	}
+	if err != nil {
+		log.Printf("Failed to rename conversation %s of user %d: %v", id, userID, err)
+		b.sendErrorMessage(ctx, userID, "❌ Failed to rename conversation.")
+		return err
+	}
+
+	b.sendSuccessMessage(ctx, userID, fmt.Sprintf("✅ Conversation renamed to %s.", truncateText(title, titleLength)))
+	return nil
+}
+
+// titleConversation names the conversation after its first exchange.
+func (b *botImpl) titleConversation(userID int64, sessionID, prompt string) {
+	ctx, cancel := context.WithTimeout(context.Background(), titleTimeout)
+	defer cancel()
+
+	title := truncateText(strings.Join(strings.Fields(prompt), " "), titleLength)
+	response, err := b.geminiClient.GenerateContent(ctx, gemini.Request{
+		UserID:          userID,
+		Model:           b.config.InlineModel,
+		Prompt:          fmt.Sprintf(titlePromptFormat, truncateText(prompt, findSnippetLength)),
+		MaxOutputTokens: titleMaxTokens,
+	})
+	if err != nil {
+		log.Printf("Failed to generate title for user %d: %v", userID, err)
+	} else if generated := strings.Trim(strings.TrimSpace(response.Text), `"*`); generated != "" {
+		title = truncateText(generated, titleLength)
+	}
+
+	if err = b.storage.RenameConversation(userID, sessionID, title); err != nil {
+		log.Printf("Failed to save title of conversation %s for user %d: %v", sessionID, userID, err)
+	}
+}
+
+func conversationTitle(conversation *storage.Conversation) string {
+	if conversation.Title == "" {
+		return untitledConversation
+	}
+	return conversation.Title
+}
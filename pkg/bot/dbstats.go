@@ -0,0 +1,60 @@
+package bot
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/mymmrac/telego"
+	th "github.com/mymmrac/telego/telegohandler"
+	tu "github.com/mymmrac/telego/telegoutil"
+)
+
+const (
+	prefixCompact string = "v1_compact"
+)
+
+// Handler for /dbstats command
+func (b *botImpl) handlerDBStats(ctx *th.Context, update telego.Update) error {
+	userID := update.Message.From.ID
+	if !b.isAdmin(userID) {
+		b.sendErrorMessage(ctx, userID, adminOnlyMsg)
+		return nil
+	}
+
+	stats, err := b.storage.Stats()
+	if err != nil {
+		log.Printf("Failed to get database stats: %v", err)
+		b.sendErrorMessage(ctx, userID, "❌ Failed to get database statistics.")
+		return err
+	}
+
+	keyboard := tu.InlineKeyboard(tu.InlineKeyboardRow(
+		tu.InlineKeyboardButton("🗜 Compact").WithCallbackData(prefixCompact)))
+	_, err = ctx.Bot().SendMessage(ctx, tu.Message(tu.ID(userID),
+		fmt.Sprintf("📊 Database %s\n\n%s", stats, b.janitor.status())).WithReplyMarkup(keyboard))
+	return err
+}
+
+func (b *botImpl) callbackCompact(ctx *th.Context, query telego.CallbackQuery) error {
+	userID := query.From.ID
+	if err := ctx.Bot().AnswerCallbackQuery(ctx, tu.CallbackQuery(query.ID)); err != nil {
+		log.Printf("Failed to answer callback: %v", err)
+	}
+	if !b.isAdmin(userID) {
+		b.sendErrorMessage(ctx, userID, adminOnlyMsg)
+		return nil
+	}
+
+	b.sendSuccessMessage(ctx, userID, "🗜 Compacting the database, requests wait until it is done...")
+	report, err := b.storage.Compact()
+	if err != nil {
+		log.Printf("Failed to compact database: %v", err)
+		b.sendErrorMessage(ctx, userID, fmt.Sprintf("❌ Failed to compact the database: %v", err))
+		return err
+	}
+
+	log.Printf("Compacted the database from %d to %d bytes", report.Before, report.After)
+	b.sendSuccessMessage(ctx, userID, fmt.Sprintf("🗜 Compacted the database from %.2fMB to %.2fMB.",
+		float64(report.Before)/bytesInMB, float64(report.After)/bytesInMB))
+	return nil
+}
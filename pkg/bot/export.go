@@ -0,0 +1,78 @@
+package bot
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+
+	"github.com/mymmrac/telego"
+	th "github.com/mymmrac/telego/telegohandler"
+	tu "github.com/mymmrac/telego/telegoutil"
+
+	"github.com/vasyvasilie/gemini-chat-tg-bot/pkg/export"
+	"github.com/vasyvasilie/gemini-chat-tg-bot/pkg/storage"
+)
+
+const (
+	// followed by the format and the conversation ID, e.g. v1_export_md_<id>
+	prefixExport string = "v1_export_"
+)
+
+// Handler for /export command
+func (b *botImpl) handlerExport(ctx *th.Context, update telego.Update) error {
+	userID := update.Message.From.ID
+
+	format, _ := splitFirstWord(commandArgs(update.Message.Text))
+	if format == "" {
+		format = export.FormatMarkdown
+	}
+	if !slices.Contains(export.Formats, format) {
+		b.sendFormattedMessage(ctx, userID, fmt.Sprintf("⚠️ Usage: `/export [%s]`, pick other conversations in /chats.",
+			strings.Join(export.Formats, "|")))
+		return nil
+	}
+
+	session, err := b.getUserSessionWithErrorHandling(ctx, userID)
+	if err != nil {
+		return err
+	}
+
+	return b.sendExport(ctx, userID, session.SessionID, format)
+}
+
+func (b *botImpl) callbackExport(ctx *th.Context, query telego.CallbackQuery) error {
+	userID := query.From.ID
+	if err := ctx.Bot().AnswerCallbackQuery(ctx, tu.CallbackQuery(query.ID)); err != nil {
+		log.Printf("Failed to answer callback: %v", err)
+	}
+
+	format, id, _ := strings.Cut(strings.TrimPrefix(query.Data, prefixExport), "_")
+	return b.sendExport(ctx, userID, id, format)
+}
+
+func (b *botImpl) sendExport(ctx *th.Context, userID int64, id, format string) error {
+	conversation, err := b.storage.GetConversation(userID, id)
+	if errors.Is(err, storage.ErrConversationNotFound) {
+		b.sendErrorMessage(ctx, userID, "❎ Nothing to export, the conversation is empty.")
+		return nil
+	}
+	if err != nil {
+		log.Printf("Failed to get conversation %s of user %d: %v", id, userID, err)
+		b.sendErrorMessage(ctx, userID, "❌ Failed to export conversation.")
+		return err
+	}
+
+	data, fileName, err := export.Render(format, conversation)
+	if err != nil {
+		log.Printf("Failed to export conversation %s of user %d: %v", id, userID, err)
+		b.sendErrorMessage(ctx, userID, "❌ Failed to export conversation.")
+		return err
+	}
+
+	_ = ctx.Bot().SendChatAction(ctx, tu.ChatAction(tu.ID(userID), telego.ChatActionUploadDocument))
+	_, err = ctx.Bot().SendDocument(ctx, tu.Document(tu.ID(userID), tu.FileFromBytes(data, fileName)).
+		WithCaption(fmt.Sprintf("📤 %s", conversationTitle(conversation))))
+	return err
+}
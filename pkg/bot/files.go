@@ -0,0 +1,245 @@
+package bot
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/mymmrac/telego"
+	th "github.com/mymmrac/telego/telegohandler"
+	tu "github.com/mymmrac/telego/telegoutil"
+
+	"github.com/vasyvasilie/gemini-chat-tg-bot/pkg/storage"
+)
+
+const (
+	prefixDeleteFile string = "v1_deletefile_"
+
+	remoteFilePrefix string = "files/"
+	photoFileName    string = "photo.jpg"
+	photoMIMEType    string = "image/jpeg"
+	videoFileName    string = "video.mp4"
+	videoMIMEType    string = "video/mp4"
+	// bots cannot download bigger files from Telegram
+	maxDownloadSize int64 = 20 * 1024 * 1024
+	// the Files API keeps uploads for two days
+	remoteFileRetention time.Duration = 48 * time.Hour
+)
+
+var ErrFileTooBig = errors.New("file is too big to download")
+
+// Handler for /files command
+func (b *botImpl) handlerFiles(ctx *th.Context, update telego.Update) error {
+	userID := update.Message.From.ID
+
+	subcommand, name := splitFirstWord(commandArgs(update.Message.Text))
+	switch subcommand {
+	case "":
+		return b.listRemoteFiles(ctx, userID)
+	case "delete":
+		return b.deleteRemoteFile(ctx, userID, name)
+	default:
+		b.sendFormattedMessage(ctx, userID, "⚠️ Usage: `/files` or `/files delete name`")
+		return nil
+	}
+}
+
+func (b *botImpl) callbackDeleteFile(ctx *th.Context, query telego.CallbackQuery) error {
+	chatID := query.Message.GetChat().ChatID()
+	userID := chatID.ID
+
+	if err := b.setupCallbackQuery(ctx, query, userID); err != nil {
+		return err
+	}
+
+	return b.deleteRemoteFile(ctx, userID, strings.TrimPrefix(query.Data, prefixDeleteFile))
+}
+
+func (b *botImpl) listRemoteFiles(ctx *th.Context, userID int64) error {
+	files, err := b.storage.ListRemoteFiles(userID)
+	if err != nil {
+		log.Printf("Failed to list files for user %d: %v", userID, err)
+		b.sendErrorMessage(ctx, userID, "❌ Failed to list files.")
+		return err
+	}
+
+	now := time.Now()
+	var sb strings.Builder
+	var rows [][]telego.InlineKeyboardButton
+	for _, file := range files {
+		if now.After(file.ExpiresAt) {
+			// the api has already removed it
+			if err = b.storage.DeleteRemoteFile(userID, file.Name); err != nil {
+				log.Printf("Failed to prune expired file %s of user %d: %v", file.Name, userID, err)
+			}
+			continue
+		}
+
+		id := strings.TrimPrefix(file.Name, remoteFilePrefix)
+		sb.WriteString(fmt.Sprintf("\n📎 %s (%.1fMB), `%s`, expires %s",
+			escapeMarkdown(file.DisplayName), float64(file.SizeBytes)/1024/1024, id, file.ExpiresAt.Format(dateTimeLayout)))
+		rows = append(rows, tu.InlineKeyboardRow(
+			tu.InlineKeyboardButton(fmt.Sprintf("🗑 %s", file.DisplayName)).
+				WithCallbackData(prefixDeleteFile+id)))
+	}
+
+	if len(rows) == 0 {
+		b.sendSuccessMessage(ctx, userID, "📎 No uploaded files.")
+		return nil
+	}
+
+	_, err = ctx.Bot().SendMessage(ctx, tu.Message(tu.ID(userID), "📎 Uploaded files:"+sb.String()).
+		WithParseMode(telego.ModeMarkdown).
+		WithReplyMarkup(tu.InlineKeyboard(rows...)))
+	return err
+}
+
+func (b *botImpl) deleteRemoteFile(ctx *th.Context, userID int64, id string) error {
+	if id == "" {
+		b.sendFormattedMessage(ctx, userID, "⚠️ Please specify a file.\nUsage: `/files delete name`")
+		return nil
+	}
+
+	name := remoteFilePrefix + strings.TrimPrefix(id, remoteFilePrefix)
+	file, err := b.storage.GetRemoteFile(userID, name)
+	if errors.Is(err, storage.ErrFileNotFound) {
+		b.sendErrorMessage(ctx, userID, "❎ File not found.")
+		return nil
+	}
+	if err != nil {
+		log.Printf("Failed to get file %s of user %d: %v", name, userID, err)
+		b.sendErrorMessage(ctx, userID, "❌ Failed to delete file.")
+		return err
+	}
+
+	if time.Now().Before(file.ExpiresAt) {
+		if err = b.geminiClient.DeleteFile(ctx, file.KeyID, file.Name); err != nil {
+			log.Printf("Failed to delete remote file %s of user %d: %v", name, userID, err)
+		}
+	}
+
+	if err = b.storage.DeleteRemoteFile(userID, name); err != nil {
+		log.Printf("Failed to delete file %s of user %d: %v", name, userID, err)
+		b.sendErrorMessage(ctx, userID, "❌ Failed to delete file.")
+		return err
+	}
+
+	log.Printf("Deleted file %s of user %d", name, userID)
+	b.sendSuccessMessage(ctx, userID, fmt.Sprintf("✅ Deleted %s.", file.DisplayName))
+	return nil
+}
+
+// messageAttachments downloads the media of the message. Small files are sent inline,
+// bigger ones are uploaded through the Files API and referenced by name.
+func (b *botImpl) messageAttachments(ctx *th.Context, userID int64, message *telego.Message) ([]storage.Attachment, error) {
+	var fileID, name, mimeType string
+	var size int64
+	action := telego.ChatActionUploadDocument
+	switch {
+	case len(message.Photo) > 0:
+		photo := message.Photo[len(message.Photo)-1]
+		fileID, name, mimeType, size = photo.FileID, photoFileName, photoMIMEType, int64(photo.FileSize)
+		action = telego.ChatActionUploadPhoto
+	case message.Video != nil:
+		video := message.Video
+		fileID, name, mimeType, size = video.FileID, cmp.Or(video.FileName, videoFileName), cmp.Or(video.MimeType, videoMIMEType), video.FileSize
+		action = telego.ChatActionUploadVideo
+	case message.Animation != nil:
+		// animations are silent mp4 clips
+		animation := message.Animation
+		fileID, name, mimeType, size = animation.FileID, cmp.Or(animation.FileName, videoFileName), cmp.Or(animation.MimeType, videoMIMEType), animation.FileSize
+		action = telego.ChatActionUploadVideo
+	case message.VideoNote != nil:
+		videoNote := message.VideoNote
+		fileID, name, mimeType, size = videoNote.FileID, videoFileName, videoMIMEType, int64(videoNote.FileSize)
+		action = telego.ChatActionUploadVideoNote
+	case message.Document != nil:
+		document := message.Document
+		fileID, name, mimeType, size = document.FileID, document.FileName, document.MimeType, document.FileSize
+	default:
+		return nil, nil
+	}
+
+	if size > maxDownloadSize {
+		return nil, ErrFileTooBig
+	}
+
+	// downloading and processing a video takes a while, keep the user informed
+	stopAction := keepChatAction(ctx, userID, action)
+	defer stopAction()
+
+	data, err := downloadFile(ctx, fileID)
+	if err != nil {
+		return nil, err
+	}
+
+	if mimeType == "" {
+		mimeType = http.DetectContentType(data)
+	}
+	attachment := storage.Attachment{Name: name, MIMEType: mimeType}
+
+	if len(data) <= b.config.FilesAPIThreshold {
+		attachment.Data = data
+		return []storage.Attachment{attachment}, nil
+	}
+
+	status := newPlaceholder(ctx, userID)
+	defer status.remove()
+	status.set(fmt.Sprintf("📤 Uploading %s…", name))
+
+	uploaded, err := b.geminiClient.UploadFile(ctx, data, mimeType, name)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	remote := &storage.RemoteFile{
+		UserID:      userID,
+		Name:        uploaded.Name,
+		DisplayName: name,
+		URI:         uploaded.URI,
+		MIMEType:    uploaded.MIMEType,
+		SizeBytes:   uploaded.SizeBytes,
+		KeyID:       uploaded.KeyID,
+		CreatedAt:   now,
+		ExpiresAt:   uploaded.ExpiresAt,
+	}
+	if remote.ExpiresAt.IsZero() {
+		remote.ExpiresAt = now.Add(remoteFileRetention)
+	}
+	if err = b.storage.SaveRemoteFile(remote); err != nil {
+		return nil, err
+	}
+	log.Printf("Uploaded file %s for user %d", uploaded.Name, userID)
+
+	attachment.FileName = uploaded.Name
+	return []storage.Attachment{attachment}, nil
+}
+
+// downloadFile fetches a file the user sent to the bot from Telegram.
+func downloadFile(ctx *th.Context, fileID string) ([]byte, error) {
+	file, err := ctx.Bot().GetFile(ctx, &telego.GetFileParams{FileID: fileID})
+	if err != nil {
+		return nil, fmt.Errorf("cannot get file: %w", err)
+	}
+
+	data, err := tu.DownloadFile(ctx.Bot().FileDownloadURL(file.FilePath))
+	if err != nil {
+		return nil, fmt.Errorf("cannot download file: %w", err)
+	}
+	return data, nil
+}
+
+// historyAttachments keeps only references in the history, inline data is too big to store.
+func historyAttachments(attachments []storage.Attachment) []storage.Attachment {
+	var kept []storage.Attachment
+	for _, attachment := range attachments {
+		attachment.Data = nil
+		kept = append(kept, attachment)
+	}
+	return kept
+}
@@ -1,10 +1,14 @@
 package bot
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"log"
+	"slices"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/mymmrac/telego"
 	th "github.com/mymmrac/telego/telegohandler"
@@ -14,6 +18,16 @@ import (
 	"github.com/vasyvasilie/gemini-chat-tg-bot/pkg/storage"
 )
 
+const (
+	findResultsLimit  int    = 3
+	findSnippetLength int    = 300
+	dateTimeLayout    string = "2006-01-02 15:04"
+	keyErrorLength    int    = 200
+	adminOnlyMsg      string = "⛔ This command is available to admins only."
+	// generations taking longer get a Stop button
+	stopButtonDelay time.Duration = 3 * time.Second
+)
+
 // Handler for /new command
 func (b *botImpl) handlerNew(ctx *th.Context, update telego.Update) error {
 	userID := update.Message.From.ID
@@ -22,13 +36,14 @@ func (b *botImpl) handlerNew(ctx *th.Context, update telego.Update) error {
 		return err
 	}
 
-	session.History = []storage.Message{}
+	session.SessionID = newSessionID()
+	session.setHistory(nil, 0)
 	if err = b.saveUserSessionWithErrorHandling(ctx, session, userID); err != nil {
 		return err
 	}
 
 	log.Printf("Started new session for user %d with model %s", userID, session.ModelName)
-	b.sendSuccessMessage(ctx, userID, "✅ New chat session started. Your history has been cleared.")
+	b.sendSuccessMessage(ctx, userID, "✅ New chat session started. The previous one is kept in /chats.")
 	return nil
 }
 
@@ -90,7 +105,7 @@ func (b *botImpl) handlerSetModel(ctx *th.Context, update telego.Update) error {
 
 	log.Printf("Set model for user %d to %s", userID, modelName)
 	b.sendFormattedMessage(ctx, userID,
-		fmt.Sprintf("✅ Model successfully changed to `%s`. A new chat session has been started.", modelName))
+		fmt.Sprintf("✅ Model changed to `%s` for this conversation, its history is kept.", modelName))
 	return nil
 }
 
@@ -106,21 +121,6 @@ func (b *botImpl) handlerCurrentModel(ctx *th.Context, update telego.Update) err
 	return nil
 }
 
-// Handler for /currentmodel command
-func (b *botImpl) handlerDBSize(ctx *th.Context, update telego.Update) error {
-	userID := update.Message.From.ID
-
-	dbSize, err := b.storage.GetDBSize()
-	if err != nil {
-		return err
-	}
-
-	_, _ = ctx.Bot().SendMessage(ctx, tu.Message(tu.ID(userID),
-		fmt.Sprintf("✨ DB size is: `%.2fMB`", dbSize)).
-		WithParseMode(telego.ModeMarkdown))
-	return nil
-}
-
 // Handler for /addmodeltofavorites command
 func (b *botImpl) handlerAddModelToFavorites(ctx *th.Context, update telego.Update) error {
 	userID := update.Message.From.ID
@@ -178,6 +178,126 @@ func (b *botImpl) handlerClearFavorites(ctx *th.Context, update telego.Update) e
 	return nil
 }
 
+// Handler for /find command
+func (b *botImpl) handlerFind(ctx *th.Context, update telego.Update) error {
+	userID := update.Message.From.ID
+	parts := strings.Fields(update.Message.Text)
+	if len(parts) < 2 {
+		b.sendFormattedMessage(ctx, userID,
+			"⚠️ Please specify a search query.\nUsage: `/find query`")
+		return nil
+	}
+	query := strings.Join(parts[1:], " ")
+
+	_ = ctx.Bot().SendChatAction(ctx, &telego.SendChatActionParams{
+		ChatID: tu.ID(userID),
+		Action: telego.ChatActionTyping,
+	})
+
+	vectors, err := b.geminiClient.EmbedTexts(ctx, userID, gemini.TaskTypeRetrievalQuery, []string{query})
+	if err != nil {
+		log.Printf("Failed to embed query for user %d: %v", userID, err)
+		b.sendErrorMessage(ctx, userID, "❌ Failed to search past conversations.")
+		return err
+	}
+
+	matches, err := b.storage.SearchExchanges(userID, vectors[0], findResultsLimit)
+	if err != nil {
+		log.Printf("Failed to search exchanges for user %d: %v", userID, err)
+		b.sendErrorMessage(ctx, userID, "❌ Failed to search past conversations.")
+		return err
+	}
+
+	if len(matches) == 0 {
+		b.sendSuccessMessage(ctx, userID, "🔎 Nothing found.")
+		return nil
+	}
+
+	for _, match := range matches {
+		text := fmt.Sprintf("🔎 %s (%.0f%% match)\n\n👤 %s\n\n🤖 %s",
+			match.Timestamp.Format(dateTimeLayout),
+			match.Score*100,
+			truncateText(match.Prompt, findSnippetLength),
+			truncateText(match.Answer, findSnippetLength),
+		)
+		keyboard := tu.InlineKeyboard(tu.InlineKeyboardRow(
+			tu.InlineKeyboardButton("♻️ Restore conversation").
+				WithCallbackData(fmt.Sprintf("%s%s", prefixRestoreSession, match.SessionID))))
+		if _, err = ctx.Bot().SendMessage(ctx, tu.Message(tu.ID(userID), text).WithReplyMarkup(keyboard)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Handler for /keys command
+func (b *botImpl) handlerKeys(ctx *th.Context, update telego.Update) error {
+	userID := update.Message.From.ID
+	if !b.isAdmin(userID) {
+		b.sendErrorMessage(ctx, userID, adminOnlyMsg)
+		return nil
+	}
+
+	var sb strings.Builder
+	sb.WriteString("🔑 Gemini API keys:\n")
+	for _, key := range b.geminiClient.KeyStats() {
+		sb.WriteString(fmt.Sprintf("\n%s: %d requests, %d errors, %d rate limited",
+			key.Name, key.Requests, key.Errors, key.RateLimited))
+		if key.Cooldown > 0 {
+			sb.WriteString(fmt.Sprintf(", cooling down %s", key.Cooldown))
+		}
+		if key.LastError != "" {
+			sb.WriteString(fmt.Sprintf("\n  last error: %s", truncateText(key.LastError, keyErrorLength)))
+		}
+	}
+
+	b.sendSuccessMessage(ctx, userID, sb.String())
+	return nil
+}
+
+// Handler for /code command
+func (b *botImpl) handlerCode(ctx *th.Context, update telego.Update) error {
+	userID := update.Message.From.ID
+	session, err := b.getUserSessionWithErrorHandling(ctx, userID)
+	if err != nil {
+		return err
+	}
+
+	switch arg, _ := splitFirstWord(commandArgs(update.Message.Text)); arg {
+	case "on", "off":
+		session.CodeExecution = arg == "on"
+	case "":
+		session.CodeExecution = !session.CodeExecution
+	default:
+		b.sendFormattedMessage(ctx, userID, "⚠️ Usage: `/code on|off`")
+		return nil
+	}
+
+	if err = b.saveUserSessionWithErrorHandling(ctx, session, userID); err != nil {
+		return err
+	}
+
+	log.Printf("Set code execution for user %d to %t", userID, session.CodeExecution)
+	if session.CodeExecution {
+		b.sendSuccessMessage(ctx, userID, "🧮 Code execution is on, Gemini can run Python to answer.")
+	} else {
+		b.sendSuccessMessage(ctx, userID, "🧮 Code execution is off.")
+	}
+	return nil
+}
+
+func (b *botImpl) callbackStop(ctx *th.Context, query telego.CallbackQuery) error {
+	userID := query.From.ID
+	text := "⏹ Stopping…"
+	id, err := strconv.ParseUint(strings.TrimPrefix(query.Data, prefixStop), 10, 64)
+	if err != nil || !b.cancels.cancelGeneration(userID, id) {
+		text = "Nothing to stop."
+	}
+
+	return ctx.Bot().AnswerCallbackQuery(ctx, tu.CallbackQuery(query.ID).WithText(text))
+}
+
 // Handler for all other messages
 func (b *botImpl) handlerAnyMessage(ctx *th.Context, update telego.Update) error {
 	userID := update.Message.From.ID
@@ -186,18 +306,125 @@ func (b *botImpl) handlerAnyMessage(ctx *th.Context, update telego.Update) error
 		return err
 	}
 
+	text := update.Message.Text
+	if text == "" {
+		text = update.Message.Caption
+	}
+
+	if session.PendingImport {
+		session.PendingImport = false
+		if err = b.saveUserSessionWithErrorHandling(ctx, session, userID); err != nil {
+			return err
+		}
+		if update.Message.Document != nil {
+			return b.importConversations(ctx, session, userID, update.Message.Document)
+		}
+		b.sendSuccessMessage(ctx, userID, "📥 Import canceled, send /import again to import a file.")
+	}
+
+	if session.PendingRename != "" && text != "" {
+		id := session.PendingRename
+		session.PendingRename = ""
+		if err = b.saveUserSessionWithErrorHandling(ctx, session, userID); err != nil {
+			return err
+		}
+		return b.renameConversation(ctx, userID, id, text)
+	}
+
+	attachments, err := b.messageAttachments(ctx, userID, update.Message)
+	if errors.Is(err, ErrFileTooBig) {
+		b.sendErrorMessage(ctx, userID, "❌ File is too big, Telegram allows bots to download up to 20MB.")
+		return nil
+	}
+	if err != nil {
+		log.Printf("Failed to process attachment of user %d: %v", userID, err)
+		b.sendErrorMessage(ctx, userID, "❌ Failed to process attachment.")
+		return err
+	}
+
+	if session.PendingPrompt != "" {
+		name := session.PendingPrompt
+		session.PendingPrompt = ""
+		if err = b.saveUserSessionWithErrorHandling(ctx, session, userID); err != nil {
+			return err
+		}
+
+		text, err = b.renderPromptWithErrorHandling(ctx, userID, name, nil, text)
+		if err != nil {
+			return nil
+		}
+	}
+
+	prompt := storage.Message{
+		Role:        gemini.RoleUser,
+		Text:        text,
+		Attachments: attachments,
+		MessageID:   update.Message.MessageID,
+	}
+
+	// replying to an earlier prompt asks it again differently
+	if reply := update.Message.ReplyToMessage; reply != nil && reply.From != nil && reply.From.ID == userID {
+		return b.fork(ctx, session, userID, reply.MessageID, prompt)
+	}
+
+	return b.chat(ctx, session, userID, prompt)
+}
+
+// chat sends the prompt to Gemini within the user's session and delivers the answer.
+func (b *botImpl) chat(ctx *th.Context, session *UserSession, userID int64, prompt storage.Message) error {
+	history, err := b.loadHistoryWithErrorHandling(ctx, session, userID)
+	if err != nil {
+		return err
+	}
+
+	text := prompt.Text
+	prompt.Timestamp = time.Now()
 	_ = ctx.Bot().SendChatAction(ctx, &telego.SendChatActionParams{
 		ChatID: tu.ID(userID),
 		Action: telego.ChatActionTyping,
 	})
 
-	text := update.Message.Text
-	history := storage.ConversationHistory{Messages: session.History}
-	response, err := b.geminiClient.GenerateContent(ctx, history, session.ModelName, text)
+	genCtx, cancel := context.WithCancel(ctx)
+	generation, release := b.cancels.register(userID, cancel)
+	defer release()
+
+	status := newPlaceholder(ctx, userID)
+	status.keyboard = tu.InlineKeyboard(tu.InlineKeyboardRow(
+		tu.InlineKeyboardButton("⏹ Stop").WithCallbackData(fmt.Sprintf("%s%d", prefixStop, generation))))
+	defer status.remove()
+
+	stopButton := time.AfterFunc(stopButtonDelay, func() {
+		status.set("✍️ Generating…")
+	})
+	defer stopButton.Stop()
+
+	response, err := b.geminiClient.GenerateContent(genCtx, gemini.Request{
+		UserID:        userID,
+		Model:         session.ModelName,
+		History:       history,
+		Prompt:        text,
+		Attachments:   prompt.Attachments,
+		CodeExecution: session.CodeExecution,
+		OnQueue: func(position int) {
+			status.set(fmt.Sprintf("⏳ You are #%d in line.", position+1))
+		},
+	})
+	stopButton.Stop()
+	if errors.Is(err, context.Canceled) && ctx.Err() == nil {
+		log.Printf("Generation stopped by user %d", userID)
+		status.remove()
+		if response == nil || response.Text == "" {
+			b.sendSuccessMessage(ctx, userID, "⏹ Stopped.")
+			return nil
+		}
+		// keep what was generated before the stop
+		err = nil
+		defer b.sendSuccessMessage(ctx, userID, "⏹ Stopped, the partial answer is kept in history.")
+	}
 	if err != nil {
 		log.Printf("Failed to get response from Gemini for user %d: %v", userID, err)
 
-		key, logErr := b.storage.LogGeminiError(userID, session.ModelName, text, err.Error(), session.History)
+		key, logErr := b.storage.LogGeminiError(userID, session.ModelName, text, prompt.Attachments, err.Error(), history)
 		if logErr != nil {
 			log.Printf("Cannot save error for user %d: %v", userID, logErr)
 		}
@@ -216,24 +443,54 @@ func (b *botImpl) handlerAnyMessage(ctx *th.Context, update telego.Update) error
 		return err
 	}
 
-	session.History = append(session.History, storage.Message{Role: gemini.RoleUser, Text: text})
-	session.History = append(session.History, storage.Message{Role: gemini.RoleModel, Text: response})
-	if err = b.saveUserSessionWithErrorHandling(ctx, session, userID); err != nil {
+	// the exchange follows the branch the prompt was sent on, also when the session is reloaded to retry
+	sessionID := session.SessionID
+	turn := len(history)
+	prompt.Attachments = historyAttachments(prompt.Attachments)
+	answer := storage.Message{Role: gemini.RoleModel, Text: response.Text, Model: session.ModelName, Timestamp: time.Now()}
+	if err = b.updateUserSessionWithErrorHandling(ctx, session, userID, func(s *UserSession) error {
+		if s.SessionID != sessionID {
+			return fmt.Errorf("%w: switched to %s", ErrConversationChanged, s.SessionID)
+		}
+		current, err := b.loadHistory(s)
+		if err != nil {
+			return err
+		}
+		if len(current) < turn || !slices.EqualFunc(current[:turn], history, storage.SameMessage) {
+			return fmt.Errorf("%w: the messages before turn %d of %s", ErrConversationChanged, turn, sessionID)
+		}
+
+		s.setHistory(append(slices.Clip(current[:turn]), prompt, answer), min(s.stored, turn))
+		return nil
+	}); err == nil {
+		b.indexer.add(exchange{userID: userID, sessionID: session.SessionID, turn: turn,
+			nodes: session.appended[len(session.appended)-2:], prompt: text, answer: response.Text})
+		if turn == 0 {
+			go b.titleConversation(userID, session.SessionID, text)
+		}
+	} else if !errors.Is(err, ErrConversationChanged) {
 		return err
 	}
+	// the answer is still delivered when the conversation changed meanwhile
 
-	key, err := b.storage.SaveResponse(userID, response)
+	key, err := b.storage.SaveResponse(userID, response.Text)
 	if err != nil {
 		return err
 	}
 
-	err = b.SendLongMessage(ctx, tu.ID(userID), response)
+	err = b.sendResponse(ctx, userID, response)
 	if err == nil {
+		if session.VoiceReplies {
+			if err = b.sendVoiceReply(ctx, session, userID, response.Text); err != nil {
+				log.Printf("Failed to send voice reply to user %d: %v", userID, err)
+				b.sendErrorMessage(ctx, userID, "❌ Failed to send voice reply.")
+			}
+		}
 		return nil
 	}
 
 	log.Printf("Failed to send message to user %d: %v", userID, err)
 	_, err = ctx.Bot().SendMessage(ctx, tu.Message(tu.ID(userID),
-		fmt.Sprintf("❌ Failed to send response message, response hash: %s", key)))
+		fmt.Sprintf("❌ Failed to send response message, response ID: %s\nGet it with /response %s", key, key)))
 	return err
 }
@@ -2,11 +2,14 @@ package bot
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"log"
 	"slices"
 	"strings"
+	"time"
 
 	"github.com/mymmrac/telego"
 	th "github.com/mymmrac/telego/telegohandler"
@@ -20,11 +23,38 @@ type UserSession struct {
 	UserID         int64
 	ModelName      string
 	FavoriteModels []string
-	History        []storage.Message
+	SessionID      string
+	PendingPrompt  string
+	VoiceReplies   bool
+	Voice          string
+	VoiceLanguage  string
+	CodeExecution  bool
+	PendingRename  string
+	PendingImport  bool
+	Version        uint64
+	// history is the active branch of the conversation, read on first use, see loadHistory.
+	// Its first stored messages are in storage already, saving the session appends the rest.
+	history       []storage.Message
+	stored        int
+	historyLoaded bool
+	// appended are the nodes of the conversation tree the last save stored messages as
+	appended []int
 }
 
+const (
+	maxSaveAttempts int = 3
+	// Telegram shows a chat action for five seconds
+	chatActionInterval time.Duration = 4 * time.Second
+	indexTimeout       time.Duration = 30 * time.Second
+)
+
 var (
 	ErrModelNotFound = errors.New("model not found")
+	// ErrConversationChanged stops an update of a session whose conversation was switched or edited meanwhile
+	ErrConversationChanged = errors.New("conversation changed")
+
+	// markdownEscaper makes text safe to send with telego.ModeMarkdown
+	markdownEscaper = strings.NewReplacer("_", "\\_", "*", "\\*", "`", "\\`", "[", "\\[")
 )
 
 func (b *botImpl) getUserSessionWithErrorHandling(ctx *th.Context, userID int64) (*UserSession, error) {
@@ -37,21 +67,108 @@ func (b *botImpl) getUserSessionWithErrorHandling(ctx *th.Context, userID int64)
 	return session, nil
 }
 
+func (b *botImpl) loadHistoryWithErrorHandling(ctx *th.Context, session *UserSession, userID int64) ([]storage.Message, error) {
+	history, err := b.loadHistory(session)
+	if err != nil {
+		log.Printf("Failed to load conversation %s of user %d: %v", session.SessionID, userID, err)
+		_, _ = ctx.Bot().SendMessage(ctx, tu.Message(tu.ID(userID), "❌ Failed to load the conversation."))
+		return nil, err
+	}
+	return history, nil
+}
+
 func (b *botImpl) saveUserSessionWithErrorHandling(ctx *th.Context, session *UserSession, userID int64) error {
+	if err := b.saveUserSession(session); err != nil {
+		log.Printf("Failed to save session for user %d: %v", userID, err)
+		_, _ = ctx.Bot().SendMessage(ctx, tu.Message(tu.ID(userID), "❌ Failed to save session."))
+		return err
+	}
+	return nil
+}
+
+// updateUserSessionWithErrorHandling applies mutate and saves the session. When the stored
+// session was changed in the meantime, mutate is replayed on a freshly loaded copy, so it has
+// to read what it changes from the session it is given. An error of mutate stops the update.
+func (b *botImpl) updateUserSessionWithErrorHandling(ctx *th.Context, session *UserSession, userID int64,
+	mutate func(*UserSession) error,
+) error {
+	for attempt := 1; ; attempt++ {
+		err := mutate(session)
+		if errors.Is(err, ErrConversationChanged) {
+			log.Printf("Not saving session for user %d: %v", userID, err)
+			b.sendErrorMessage(ctx, userID, "⚠️ The conversation was changed while the answer was generated, it is not saved.")
+			return err
+		}
+		if err == nil {
+			err = b.saveUserSession(session)
+		}
+		if err == nil {
+			return nil
+		}
+
+		if !errors.Is(err, storage.ErrVersionConflict) || attempt == maxSaveAttempts {
+			log.Printf("Failed to save session for user %d: %v", userID, err)
+			_, _ = ctx.Bot().SendMessage(ctx, tu.Message(tu.ID(userID), "❌ Failed to save session."))
+			return err
+		}
+
+		log.Printf("Session of user %d changed concurrently, retrying (attempt %d)", userID, attempt)
+		fresh, err := b.getUserSession(userID)
+		if err != nil {
+			log.Printf("Failed to reload session for user %d: %v", userID, err)
+			_, _ = ctx.Bot().SendMessage(ctx, tu.Message(tu.ID(userID), "❌ Failed to save session."))
+			return err
+		}
+		*session = *fresh
+	}
+}
+
+func (b *botImpl) saveUserSession(session *UserSession) error {
 	settings := &storage.UserSettings{
 		UserID:         session.UserID,
 		ModelName:      session.ModelName,
 		FavoriteModels: session.FavoriteModels,
-		History:        storage.ConversationHistory{Messages: session.History},
+		SessionID:      session.SessionID,
+		PendingPrompt:  session.PendingPrompt,
+		VoiceReplies:   session.VoiceReplies,
+		Voice:          session.Voice,
+		VoiceLanguage:  session.VoiceLanguage,
+		CodeExecution:  session.CodeExecution,
+		PendingRename:  session.PendingRename,
+		PendingImport:  session.PendingImport,
+		Version:        session.Version,
 	}
-	if err := b.storage.SaveUserSettings(session.UserID, settings); err != nil {
-		log.Printf("Failed to save session for user %d: %v", userID, err)
-		_, _ = ctx.Bot().SendMessage(ctx, tu.Message(tu.ID(userID), "❌ Failed to save session."))
+	appended, err := b.storage.SaveSession(settings, session.stored, session.history[session.stored:])
+	if err != nil {
 		return err
 	}
+	session.Version = settings.Version
+	session.appended = appended
+	session.stored = len(session.history)
 	return nil
 }
 
+// loadHistory returns the active branch of the session's conversation, only the first call reads it.
+func (b *botImpl) loadHistory(session *UserSession) ([]storage.Message, error) {
+	if session.historyLoaded {
+		return session.history, nil
+	}
+
+	history, err := b.storage.GetMessages(session.UserID, session.SessionID, 0, 0)
+	if err != nil && !errors.Is(err, storage.ErrConversationNotFound) {
+		return nil, err
+	}
+	session.setHistory(history, len(history))
+	return history, nil
+}
+
+// setHistory replaces the history of the session, its first stored messages are in storage already.
+func (s *UserSession) setHistory(history []storage.Message, stored int) {
+	s.history = history
+	s.stored = min(stored, len(history))
+	s.historyLoaded = true
+}
+
 func (b *botImpl) sendErrorMessage(ctx *th.Context, userID int64, message string) {
 	_, _ = ctx.Bot().SendMessage(ctx, tu.Message(tu.ID(userID), message))
 }
@@ -65,7 +182,7 @@ func (b *botImpl) sendFormattedMessage(ctx *th.Context, userID int64, message st
 }
 
 func (b *botImpl) getModelsAndHandleErrors(ctx *th.Context, userID int64) ([]string, error) {
-	models, err := b.geminiClient.ListModels(ctx)
+	models, err := b.geminiClient.ListModels(ctx, userID)
 	if err != nil {
 		log.Printf("Failed to list models for user %d: %v", userID, err)
 		b.sendErrorMessage(ctx, userID, "❌ Sorry, I couldn't retrieve the list of models.")
@@ -89,11 +206,24 @@ func (b *botImpl) createModelKeyboard(models []string, prefix string) [][]telego
 func (b *botImpl) getUserSession(userID int64) (*UserSession, error) {
 	settings, err := b.storage.GetUserSettings(userID)
 	if err == nil {
+		sessionID := settings.SessionID
+		if sessionID == "" {
+			sessionID = newSessionID()
+		}
+
 		return &UserSession{
 			UserID:         settings.UserID,
 			ModelName:      settings.ModelName,
 			FavoriteModels: settings.FavoriteModels,
-			History:        settings.History.Messages,
+			SessionID:      sessionID,
+			PendingPrompt:  settings.PendingPrompt,
+			VoiceReplies:   settings.VoiceReplies,
+			Voice:          settings.Voice,
+			VoiceLanguage:  settings.VoiceLanguage,
+			CodeExecution:  settings.CodeExecution,
+			PendingRename:  settings.PendingRename,
+			PendingImport:  settings.PendingImport,
+			Version:        settings.Version,
 		}, nil
 	}
 
@@ -104,6 +234,7 @@ func (b *botImpl) getUserSession(userID int64) (*UserSession, error) {
 	settings = &storage.UserSettings{
 		UserID:    userID,
 		ModelName: b.config.DefaultModel,
+		SessionID: newSessionID(),
 	}
 	if err = b.storage.SaveUserSettings(userID, settings); err != nil {
 		return nil, err
@@ -112,11 +243,13 @@ func (b *botImpl) getUserSession(userID int64) (*UserSession, error) {
 	return &UserSession{
 		UserID:    userID,
 		ModelName: b.config.DefaultModel,
+		SessionID: settings.SessionID,
+		Version:   settings.Version,
 	}, nil
 }
 
 func (b *botImpl) setSessionModel(session *UserSession, modelName string) error {
-	models, err := b.geminiClient.ListModels(context.Background())
+	models, err := b.geminiClient.ListModels(context.Background(), session.UserID)
 	if err != nil {
 		return err
 	}
@@ -134,3 +267,89 @@ func (b *botImpl) setSessionModel(session *UserSession, modelName string) error
 
 	return ErrModelNotFound
 }
+
+// indexExchange stores embeddings of a prompt and its answer so the exchange can be found by /find.
+// The indexer runs it for one queued exchange at a time.
+func (b *botImpl) indexExchange(e exchange) {
+	ctx, cancel := context.WithTimeout(context.Background(), indexTimeout)
+	defer cancel()
+
+	vectors, err := b.geminiClient.EmbedTexts(ctx, e.userID, gemini.TaskTypeRetrievalDocument, []string{e.prompt, e.answer})
+	if err != nil {
+		log.Printf("Failed to embed exchange for user %d: %v", e.userID, err)
+		return
+	}
+
+	now := time.Now()
+	embeddings := []storage.Embedding{
+		{
+			UserID:    e.userID,
+			SessionID: e.sessionID,
+			Turn:      e.turn,
+			Node:      e.nodes[0],
+			Role:      gemini.RoleUser,
+			Text:      e.prompt,
+			Timestamp: now,
+			Vector:    vectors[0],
+		},
+		{
+			UserID:    e.userID,
+			SessionID: e.sessionID,
+			Turn:      e.turn + 1,
+			Node:      e.nodes[1],
+			Role:      gemini.RoleModel,
+			Text:      e.answer,
+			Timestamp: now,
+			Vector:    vectors[1],
+		},
+	}
+	if err = b.storage.SaveEmbeddings(e.userID, embeddings); err != nil {
+		log.Printf("Failed to save embeddings for user %d: %v", e.userID, err)
+	}
+}
+
+func (b *botImpl) isAdmin(userID int64) bool {
+	_, ok := b.config.AdminUsers[userID]
+	return ok
+}
+
+func newSessionID() string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func truncateText(text string, limit int) string {
+	runes := []rune(text)
+	if len(runes) <= limit {
+		return text
+	}
+	return string(runes[:limit]) + "…"
+}
+
+// escapeMarkdown escapes text set by users, such as file names, outside the entities of a Markdown message.
+func escapeMarkdown(text string) string {
+	return markdownEscaper.Replace(text)
+}
+
+// keepChatAction repeats the chat action until the returned function is called.
+func keepChatAction(ctx *th.Context, userID int64, action string) func() {
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(chatActionInterval)
+		defer ticker.Stop()
+
+		for {
+			_ = ctx.Bot().SendChatAction(ctx, tu.ChatAction(tu.ID(userID), action))
+			select {
+			case <-done:
+				return
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+
+	return func() { close(done) }
+}
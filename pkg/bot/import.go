@@ -0,0 +1,139 @@
+package bot
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/mymmrac/telego"
+	th "github.com/mymmrac/telego/telegohandler"
+
+	"github.com/vasyvasilie/gemini-chat-tg-bot/pkg/export"
+	"github.com/vasyvasilie/gemini-chat-tg-bot/pkg/gemini"
+	"github.com/vasyvasilie/gemini-chat-tg-bot/pkg/storage"
+)
+
+const (
+	maxImportSize int64 = 10 * 1024 * 1024
+	// a ChatGPT export holds every conversation of the account
+	maxImportConversations int = 100
+)
+
+// Handler for /import command
+func (b *botImpl) handlerImport(ctx *th.Context, update telego.Update) error {
+	userID := update.Message.From.ID
+	session, err := b.getUserSessionWithErrorHandling(ctx, userID)
+	if err != nil {
+		return err
+	}
+
+	session.PendingImport = true
+	if err = b.saveUserSessionWithErrorHandling(ctx, session, userID); err != nil {
+		return err
+	}
+
+	b.sendSuccessMessage(ctx, userID, "📥 Send the conversation file as a document: a JSON file from /export, "+
+		"conversations.json from a ChatGPT export or MyActivity.json with Gemini Apps from Google Takeout.")
+	return nil
+}
+
+// importConversations stores the conversations of the file and switches to the latest one.
+func (b *botImpl) importConversations(ctx *th.Context, session *UserSession, userID int64, document *telego.Document) error {
+	if document.FileSize > maxImportSize {
+		b.sendErrorMessage(ctx, userID, fmt.Sprintf("❌ The file is too big, up to %dMB can be imported.", maxImportSize/1024/1024))
+		return nil
+	}
+
+	stopAction := keepChatAction(ctx, userID, telego.ChatActionTyping)
+	defer stopAction()
+
+	data, err := downloadFile(ctx, document.FileID)
+	if err != nil {
+		log.Printf("Failed to download import file of user %d: %v", userID, err)
+		b.sendErrorMessage(ctx, userID, "❌ Failed to download the file.")
+		return err
+	}
+
+	documents, err := export.Import(data)
+	if errors.Is(err, export.ErrUnknownImport) || errors.Is(err, export.ErrEmptyImport) {
+		log.Printf("Rejected import file %s of user %d: %v", document.FileName, userID, err)
+		b.sendErrorMessage(ctx, userID, fmt.Sprintf("❎ Cannot import %s: %v.", document.FileName, err))
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	skipped := max(len(documents)-maxImportConversations, 0)
+	documents = documents[:len(documents)-skipped]
+
+	var latest *storage.Conversation
+	for _, imported := range documents {
+		conversation := newImportedConversation(imported, userID, session.ModelName)
+		if err = b.storage.SaveConversation(conversation); err != nil {
+			log.Printf("Failed to save imported conversation of user %d: %v", userID, err)
+			b.sendErrorMessage(ctx, userID, "❌ Failed to save the imported conversation.")
+			return err
+		}
+		if latest == nil || conversation.UpdatedAt.After(latest.UpdatedAt) {
+			latest = conversation
+		}
+	}
+
+	if err = b.switchConversation(ctx, userID, latest); err != nil {
+		return err
+	}
+
+	log.Printf("Imported %d conversations for user %d", len(documents), userID)
+	text := fmt.Sprintf("✅ Imported %d conversations, switched to %s. Find the others in /chats.",
+		len(documents), conversationTitle(latest))
+	if len(documents) == 1 {
+		text = fmt.Sprintf("✅ Imported and switched to %s, continue chatting with %s.",
+			conversationTitle(latest), strings.TrimPrefix(latest.Model, gemini.ModelPrefix))
+	}
+	if skipped > 0 {
+		text += fmt.Sprintf(" %d more were skipped, at most %d are imported at once.", skipped, maxImportConversations)
+	}
+	b.sendSuccessMessage(ctx, userID, text)
+	return nil
+}
+
+func newImportedConversation(document *export.Document, userID int64, model string) *storage.Conversation {
+	now := time.Now()
+	conversation := &storage.Conversation{
+		ID:        newSessionID(),
+		UserID:    userID,
+		Title:     truncateText(document.Title, titleLength),
+		Model:     model,
+		CreatedAt: document.CreatedAt,
+		UpdatedAt: document.UpdatedAt,
+	}
+	// only our own exports name a model the conversation can continue with
+	if strings.HasPrefix(document.Model, gemini.ModelPrefix+"gemini") {
+		conversation.Model = document.Model
+	}
+	if conversation.CreatedAt.IsZero() {
+		conversation.CreatedAt = now
+	}
+	if conversation.UpdatedAt.IsZero() {
+		conversation.UpdatedAt = now
+	}
+
+	for _, message := range document.Messages {
+		role := gemini.RoleUser
+		if message.Role != gemini.RoleUser {
+			role = gemini.RoleModel
+		}
+		conversation.History.Messages = append(conversation.History.Messages, storage.Message{
+			Role:      role,
+			Text:      message.Text,
+			Model:     message.Model,
+			Timestamp: message.Timestamp,
+		})
+	}
+	conversation.Tree.Merge(conversation.History.Messages)
+
+	return conversation
+}
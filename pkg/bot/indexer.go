@@ -0,0 +1,105 @@
+package bot
+
+import (
+	"log"
+	"sync"
+)
+
+// exchanges waiting beyond this are not indexed, /find misses them
+const indexQueueSize int = 100
+
+// exchange is a prompt and its answer, turn is the position of the prompt in the conversation
+// and nodes are the nodes of both in its tree.
+type exchange struct {
+	// seq orders the exchanges as they are queued, see indexer.forget
+	seq       uint64
+	userID    int64
+	sessionID string
+	turn      int
+	nodes     []int
+	prompt    string
+	answer    string
+}
+
+// indexer stores the embeddings of exchanges for /find one at a time in the background.
+// stop waits for the queued exchanges, so none are lost on shutdown.
+type indexer struct {
+	index func(exchange)
+	queue chan exchange
+	done  chan struct{}
+	// indexing is held while an exchange is indexed
+	indexing sync.Mutex
+
+	mu      sync.Mutex
+	stopped bool
+	seq     uint64
+	// forgotten keeps the last seq queued for a user when their data was deleted
+	forgotten map[int64]uint64
+}
+
+func newIndexer(index func(exchange)) *indexer {
+	return &indexer{
+		index: index,
+		queue: make(chan exchange, indexQueueSize),
+		done:  make(chan struct{}),
+
+		forgotten: make(map[int64]uint64),
+	}
+}
+
+// run indexes the queued exchanges until stop is called.
+func (i *indexer) run() {
+	defer close(i.done)
+	for e := range i.queue {
+		i.indexing.Lock()
+		i.mu.Lock()
+		forgotten := e.seq <= i.forgotten[e.userID]
+		i.mu.Unlock()
+		if !forgotten {
+			i.index(e)
+		}
+		i.indexing.Unlock()
+	}
+}
+
+// add queues the exchange, it is dropped when the queue is full or the indexer stopped.
+func (i *indexer) add(e exchange) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if i.stopped {
+		log.Printf("Not indexing turn %d of session %s of user %d, the bot is stopping", e.turn, e.sessionID, e.userID)
+		return
+	}
+	i.seq++
+	e.seq = i.seq
+	select {
+	case i.queue <- e:
+	default:
+		log.Printf("Not indexing turn %d of session %s of user %d, %d exchanges are waiting",
+			e.turn, e.sessionID, e.userID, indexQueueSize)
+	}
+}
+
+// forget drops the queued exchanges of the user and waits for the one being indexed,
+// so that no embeddings of the user are saved after their data is deleted.
+func (i *indexer) forget(userID int64) {
+	i.mu.Lock()
+	i.forgotten[userID] = i.seq
+	i.mu.Unlock()
+
+	i.indexing.Lock()
+	defer i.indexing.Unlock()
+}
+
+// stop waits until the queued exchanges are indexed.
+func (i *indexer) stop() {
+	i.mu.Lock()
+	if !i.stopped {
+		i.stopped = true
+		close(i.queue)
+	}
+	i.mu.Unlock()
+
+	<-i.done
+}
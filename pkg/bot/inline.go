@@ -0,0 +1,165 @@
+package bot
+
+import (
+	"context"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mymmrac/telego"
+	th "github.com/mymmrac/telego/telegohandler"
+	tu "github.com/mymmrac/telego/telegoutil"
+
+	"github.com/vasyvasilie/gemini-chat-tg-bot/pkg/gemini"
+)
+
+const (
+	// wait for the user to stop typing before asking Gemini
+	inlineDebounce        time.Duration = 800 * time.Millisecond
+	inlineTimeout         time.Duration = 15 * time.Second
+	inlineCacheTTL        time.Duration = 5 * time.Minute
+	inlineMaxOutputTokens int32         = 512
+	inlineTitleLength     int           = 60
+	inlineResultID        string        = "answer"
+)
+
+// inlineState keeps the latest query of every user and recent answers by query text.
+type inlineState struct {
+	mu      sync.Mutex
+	latest  map[int64]string
+	answers map[string]inlineAnswer
+}
+
+type inlineAnswer struct {
+	// userID asked the question first, the answer is forgotten with their data
+	userID  int64
+	text    string
+	expires time.Time
+}
+
+func newInlineState() *inlineState {
+	return &inlineState{
+		latest:  make(map[int64]string),
+		answers: make(map[string]inlineAnswer),
+	}
+}
+
+func (s *inlineState) track(userID int64, queryID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.latest[userID] = queryID
+}
+
+// superseded reports whether the user typed something else after queryID.
+func (s *inlineState) superseded(userID int64, queryID string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.latest[userID] != queryID
+}
+
+func (s *inlineState) cached(query string) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	answer, ok := s.answers[query]
+	if !ok || time.Now().After(answer.expires) {
+		return "", false
+	}
+	return answer.text, true
+}
+
+func (s *inlineState) store(userID int64, query, text string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	for q, answer := range s.answers {
+		if now.After(answer.expires) {
+			delete(s.answers, q)
+		}
+	}
+	s.answers[query] = inlineAnswer{userID: userID, text: text, expires: now.Add(inlineCacheTTL)}
+}
+
+// forget drops the cached answers to the questions of the user.
+func (s *inlineState) forget(userID int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.latest, userID)
+	for q, answer := range s.answers {
+		if answer.userID == userID {
+			delete(s.answers, q)
+		}
+	}
+}
+
+// Handler for inline queries (@bot question)
+func (b *botImpl) handlerInlineQuery(ctx *th.Context, query telego.InlineQuery) error {
+	userID := query.From.ID
+	text := strings.TrimSpace(query.Query)
+	if text == "" {
+		return nil
+	}
+
+	if answer, ok := b.inline.cached(text); ok {
+		return b.answerInlineQuery(ctx, query.ID, answer)
+	}
+
+	b.inline.track(userID, query.ID)
+	select {
+	case <-time.After(inlineDebounce):
+	case <-ctx.Done():
+		return nil
+	}
+	if b.inline.superseded(userID, query.ID) {
+		return nil
+	}
+
+	genCtx, cancel := context.WithTimeout(ctx, inlineTimeout)
+	defer cancel()
+
+	answer, err := b.geminiClient.GenerateContent(genCtx, gemini.Request{
+		UserID:          userID,
+		Model:           b.config.InlineModel,
+		Prompt:          text,
+		MaxOutputTokens: inlineMaxOutputTokens,
+	})
+	if err != nil {
+		log.Printf("Failed to get inline answer from Gemini for user %d: %v", userID, err)
+		return err
+	}
+
+	b.inline.store(userID, text, answer.Text)
+	if b.inline.superseded(userID, query.ID) {
+		return nil
+	}
+
+	return b.answerInlineQuery(ctx, query.ID, answer.Text)
+}
+
+func (b *botImpl) answerInlineQuery(ctx *th.Context, queryID, answer string) error {
+	plainText, annotations := parseMarkupInternal(answer)
+	messages, err := prepareTelegramMessages(plainText, annotations)
+	if err != nil {
+		return err
+	}
+
+	// an inline result is a single message, longer answers are cut to the first chunk
+	content := tu.TextMessage(messages[0].Text)
+	for _, a := range messages[0].Annotations {
+		content.Entities = append(content.Entities, telego.MessageEntity{
+			Type:   llmSupportedPrefixes[a.Tag],
+			Offset: a.UOffset,
+			Length: a.Ulength,
+		})
+	}
+
+	result := tu.ResultArticle(inlineResultID, "✨ Gemini: "+truncateText(plainText, inlineTitleLength), content).
+		WithDescription(truncateText(plainText, findSnippetLength))
+
+	return ctx.Bot().AnswerInlineQuery(ctx, tu.InlineQuery(queryID, result).
+		WithCacheTime(int(inlineCacheTTL.Seconds())).
+		WithIsPersonal())
+}
@@ -0,0 +1,124 @@
+package bot
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/vasyvasilie/gemini-chat-tg-bot/pkg/config"
+	"github.com/vasyvasilie/gemini-chat-tg-bot/pkg/storage"
+)
+
+const bytesInMB float64 = 1024 * 1024
+
+// janitor prunes responses and error logs by the retention policy and compacts the database.
+type janitor struct {
+	storage  storage.Store
+	policy   storage.RetentionPolicy
+	interval time.Duration
+	compact  bool
+
+	mu   sync.Mutex
+	last *cleanup
+}
+
+type cleanup struct {
+	at        time.Time
+	pruned    *storage.PruneReport
+	compacted *storage.CompactReport
+	err       error
+}
+
+func newJanitor(config *config.Config, store storage.Store) *janitor {
+	return &janitor{
+		storage: store,
+		policy: storage.RetentionPolicy{
+			MaxAge:     config.RetentionMaxAge,
+			MaxPerUser: config.RetentionMaxPerUser,
+		},
+		interval: config.JanitorInterval,
+		compact:  config.JanitorCompact,
+	}
+}
+
+func (j *janitor) enabled() bool {
+	return j.policy.Enabled() || j.compact
+}
+
+// run cleans up right away and then every interval until ctx is done.
+func (j *janitor) run(ctx context.Context) {
+	ticker := time.NewTicker(j.interval)
+	defer ticker.Stop()
+
+	for {
+		j.clean()
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (j *janitor) clean() {
+	result := &cleanup{at: time.Now()}
+	result.pruned, result.err = j.storage.Prune(j.policy)
+	if result.err == nil && j.compact {
+		result.compacted, result.err = j.storage.Compact()
+	}
+
+	if result.err != nil {
+		log.Printf("Storage cleanup failed: %v", result.err)
+	} else {
+		log.Printf("Storage cleanup: %s", result)
+	}
+
+	j.mu.Lock()
+	j.last = result
+	j.mu.Unlock()
+}
+
+// status describes the retention policy and the last cleanup.
+func (j *janitor) status() string {
+	if !j.enabled() {
+		return "🧹 Retention is off, responses and error logs are kept forever."
+	}
+
+	var limits []string
+	if j.policy.MaxAge > 0 {
+		limits = append(limits, fmt.Sprintf("for %s", j.policy.MaxAge))
+	}
+	if j.policy.MaxPerUser > 0 {
+		limits = append(limits, fmt.Sprintf("up to %d per user", j.policy.MaxPerUser))
+	}
+	if len(limits) == 0 {
+		limits = append(limits, "forever")
+	}
+	text := fmt.Sprintf("🧹 Responses and error logs are kept %s, cleanup runs every %s.",
+		strings.Join(limits, " and "), j.interval)
+
+	j.mu.Lock()
+	last := j.last
+	j.mu.Unlock()
+
+	switch {
+	case last == nil:
+		return text + "\nNo cleanup has run yet."
+	case last.err != nil:
+		return fmt.Sprintf("%s\n❌ Last cleanup at %s failed: %v", text, last.at.Format(time.DateTime), last.err)
+	default:
+		return fmt.Sprintf("%s\nLast cleanup at %s %s.", text, last.at.Format(time.DateTime), last)
+	}
+}
+
+func (c *cleanup) String() string {
+	text := fmt.Sprintf("removed %d responses and %d error logs", c.pruned.Responses, c.pruned.Errors)
+	if c.compacted != nil {
+		text += fmt.Sprintf(", compacted the database from %.2fMB to %.2fMB",
+			float64(c.compacted.Before)/bytesInMB, float64(c.compacted.After)/bytesInMB)
+	}
+	return text
+}
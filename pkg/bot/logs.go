@@ -0,0 +1,320 @@
+package bot
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mymmrac/telego"
+	th "github.com/mymmrac/telego/telegohandler"
+	tu "github.com/mymmrac/telego/telegoutil"
+
+	"github.com/vasyvasilie/gemini-chat-tg-bot/pkg/export"
+	"github.com/vasyvasilie/gemini-chat-tg-bot/pkg/gemini"
+	"github.com/vasyvasilie/gemini-chat-tg-bot/pkg/storage"
+)
+
+const (
+	// followed by the model ID and the error key, model names do not fit in the 64 bytes
+	// of callback data, see replayModelID
+	prefixReplay string = "v2_replay_"
+	// followed by the error ID
+	prefixErrorLog string = "v1_errorlog_"
+
+	errorRequestLength   int           = 1000
+	errorsListLimit      int           = 20
+	errorsListTextLength int           = 100
+	defaultErrorsPeriod  time.Duration = time.Hour
+	// bytes of the model name hash in replay buttons
+	replayModelIDSize int = 4
+)
+
+// Handler for /response command
+func (b *botImpl) handlerResponse(ctx *th.Context, update telego.Update) error {
+	userID := update.Message.From.ID
+
+	key := commandArgs(update.Message.Text)
+	if key == "" {
+		b.sendFormattedMessage(ctx, userID, "⚠️ Usage: `/response id`, the ID is sent when a response fails to arrive.")
+		return nil
+	}
+
+	response, err := b.storage.GetResponse(key)
+	if errors.Is(err, storage.ErrResponseNotFound) || (err == nil && response.UserID != userID && !b.isAdmin(userID)) {
+		b.sendErrorMessage(ctx, userID, "❎ Response not found.")
+		return nil
+	}
+	if err != nil {
+		log.Printf("Failed to get response %s for user %d: %v", key, userID, err)
+		b.sendErrorMessage(ctx, userID, "❌ Failed to get response.")
+		return err
+	}
+
+	if err = b.SendLongMessage(ctx, tu.ID(userID), response.Text); err == nil {
+		return nil
+	}
+
+	log.Printf("Failed to send response %s to user %d, sending it as a document: %v", key, userID, err)
+	_, err = ctx.Bot().SendDocument(ctx, tu.Document(tu.ID(userID),
+		tu.FileFromBytes([]byte(response.Text), fmt.Sprintf("response-%s.md", key))).
+		WithCaption("📄 The response could not be formatted, here it is as Markdown."))
+	return err
+}
+
+// Handler for /error command
+func (b *botImpl) handlerError(ctx *th.Context, update telego.Update) error {
+	userID := update.Message.From.ID
+	if !b.isAdmin(userID) {
+		b.sendErrorMessage(ctx, userID, adminOnlyMsg)
+		return nil
+	}
+
+	key := commandArgs(update.Message.Text)
+	if key == "" {
+		b.sendFormattedMessage(ctx, userID, "⚠️ Usage: `/error key`, the key is sent with Gemini API errors and listed by /errors.")
+		return nil
+	}
+
+	return b.sendErrorLog(ctx, userID, key)
+}
+
+// Handler for /errors command
+func (b *botImpl) handlerErrors(ctx *th.Context, update telego.Update) error {
+	userID := update.Message.From.ID
+	if !b.isAdmin(userID) {
+		b.sendErrorMessage(ctx, userID, adminOnlyMsg)
+		return nil
+	}
+
+	query := storage.RecordQuery{Limit: errorsListLimit}
+	period := defaultErrorsPeriod
+	args := strings.Fields(commandArgs(update.Message.Text))
+	var err error
+	if len(args) > 0 {
+		period, err = time.ParseDuration(args[0])
+	}
+	if err == nil && len(args) > 1 {
+		query.UserID, err = strconv.ParseInt(args[1], 10, 64)
+	}
+	if err != nil || period <= 0 || len(args) > 2 {
+		b.sendFormattedMessage(ctx, userID, "⚠️ Usage: `/errors [period] [user ID]`, e.g. `/errors 24h`, the last hour by default.")
+		return nil
+	}
+	query.From = time.Now().Add(-period)
+
+	errorLogs, err := b.storage.ListErrors(query)
+	if err != nil {
+		log.Printf("Failed to list errors: %v", err)
+		b.sendErrorMessage(ctx, userID, "❌ Failed to list errors.")
+		return err
+	}
+	if len(errorLogs) == 0 {
+		b.sendSuccessMessage(ctx, userID, fmt.Sprintf("✅ No errors in the last %s.", period))
+		return nil
+	}
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "🐞 Errors in the last %s, newest first", period)
+	if len(errorLogs) == errorsListLimit {
+		fmt.Fprintf(&sb, ", only the last %d", errorsListLimit)
+	}
+	sb.WriteString(":")
+
+	var rows [][]telego.InlineKeyboardButton
+	for _, errorLog := range errorLogs {
+		model := strings.TrimPrefix(errorLog.Model, gemini.ModelPrefix)
+		fmt.Fprintf(&sb, "\n\n📅 %s 👤 %d ✨ %s\n❌ %s",
+			errorLog.Timestamp.Format(dateTimeLayout), errorLog.UserID, model,
+			truncateText(errorLog.Error, errorsListTextLength))
+		rows = append(rows, tu.InlineKeyboardRow(
+			tu.InlineKeyboardButton(fmt.Sprintf("🐞 %s %s", errorLog.Timestamp.Format(time.TimeOnly), model)).
+				WithCallbackData(prefixErrorLog+errorLog.ID)))
+	}
+
+	_, err = ctx.Bot().SendMessage(ctx, tu.Message(tu.ID(userID), sb.String()).
+		WithReplyMarkup(tu.InlineKeyboard(rows...)))
+	return err
+}
+
+func (b *botImpl) callbackErrorLog(ctx *th.Context, query telego.CallbackQuery) error {
+	userID := query.From.ID
+	if err := ctx.Bot().AnswerCallbackQuery(ctx, tu.CallbackQuery(query.ID)); err != nil {
+		log.Printf("Failed to answer callback: %v", err)
+	}
+	if !b.isAdmin(userID) {
+		b.sendErrorMessage(ctx, userID, adminOnlyMsg)
+		return nil
+	}
+
+	return b.sendErrorLog(ctx, userID, strings.TrimPrefix(query.Data, prefixErrorLog))
+}
+
+// sendErrorLog shows the logged request with buttons to replay it, and its history as a document.
+func (b *botImpl) sendErrorLog(ctx *th.Context, userID int64, key string) error {
+	errorLog, err := b.getErrorLogWithErrorHandling(ctx, userID, key)
+	if err != nil || errorLog == nil {
+		return err
+	}
+
+	session, err := b.getUserSessionWithErrorHandling(ctx, userID)
+	if err != nil {
+		return err
+	}
+
+	rows := [][]telego.InlineKeyboardButton{tu.InlineKeyboardRow(
+		tu.InlineKeyboardButton(fmt.Sprintf("🔁 Replay with %s", strings.TrimPrefix(errorLog.Model, gemini.ModelPrefix))).
+			WithCallbackData(prefixReplay + replayModelID(errorLog.Model) + "_" + key))}
+	for _, model := range session.FavoriteModels {
+		if model == errorLog.Model {
+			continue
+		}
+		rows = append(rows, tu.InlineKeyboardRow(
+			tu.InlineKeyboardButton(fmt.Sprintf("🔀 %s", strings.TrimPrefix(model, gemini.ModelPrefix))).
+				WithCallbackData(prefixReplay+replayModelID(model)+"_"+key)))
+	}
+
+	attachments := fmt.Sprintf("%d", len(errorLog.Attachments))
+	if unreplayable := errorLog.Unreplayable(); unreplayable > 0 {
+		attachments += fmt.Sprintf(", %d sent inline are not kept and cannot be replayed", unreplayable)
+	}
+	text := fmt.Sprintf("🐞 Error %s\n👤 User: %d\n✨ Model: %s\n📅 %s\n✉️ History: %d messages\n📎 Attachments: %s\n\n❌ %s\n\n💬 %s",
+		key,
+		errorLog.UserID,
+		strings.TrimPrefix(errorLog.Model, gemini.ModelPrefix),
+		errorLog.Timestamp.Format(dateTimeLayout),
+		len(errorLog.History),
+		attachments,
+		truncateText(errorLog.Error, keyErrorLength),
+		truncateText(errorLog.RequestText, errorRequestLength),
+	)
+	if _, err = ctx.Bot().SendMessage(ctx, tu.Message(tu.ID(userID), text).
+		WithReplyMarkup(tu.InlineKeyboard(rows...))); err != nil {
+		return err
+	}
+
+	if len(errorLog.History) == 0 {
+		return nil
+	}
+	data, _, err := export.Render(export.FormatMarkdown, &storage.Conversation{
+		ID:        key,
+		UserID:    errorLog.UserID,
+		Title:     fmt.Sprintf("Error %s", key),
+		Model:     errorLog.Model,
+		CreatedAt: errorLog.Timestamp,
+		UpdatedAt: errorLog.Timestamp,
+		History:   storage.ConversationHistory{Messages: errorLog.History},
+	})
+	if err != nil {
+		log.Printf("Failed to render history of error %s: %v", key, err)
+		return err
+	}
+	_, err = ctx.Bot().SendDocument(ctx, tu.Document(tu.ID(userID),
+		tu.FileFromBytes(data, fmt.Sprintf("error-%s.md", key))).
+		WithCaption("📜 History sent with the request"))
+	return err
+}
+
+// callbackReplay sends the logged request again, the answer goes to the admin and is not saved.
+func (b *botImpl) callbackReplay(ctx *th.Context, query telego.CallbackQuery) error {
+	userID := query.From.ID
+	if err := ctx.Bot().AnswerCallbackQuery(ctx, tu.CallbackQuery(query.ID)); err != nil {
+		log.Printf("Failed to answer callback: %v", err)
+	}
+	if !b.isAdmin(userID) {
+		b.sendErrorMessage(ctx, userID, adminOnlyMsg)
+		return nil
+	}
+
+	modelID, key, _ := strings.Cut(strings.TrimPrefix(query.Data, prefixReplay), "_")
+	errorLog, err := b.getErrorLogWithErrorHandling(ctx, userID, key)
+	if err != nil || errorLog == nil {
+		return err
+	}
+
+	model, err := b.resolveReplayModel(ctx, userID, errorLog, modelID)
+	if err != nil || model == "" {
+		return err
+	}
+	modelName := strings.TrimPrefix(model, gemini.ModelPrefix)
+
+	status := newPlaceholder(ctx, userID)
+	status.set(fmt.Sprintf("🔁 Replaying error %s with %s…", key, modelName))
+	defer status.remove()
+
+	// the request runs as the user who sent it, so their uploaded files are found
+	response, err := b.geminiClient.GenerateContent(ctx, gemini.Request{
+		UserID:      errorLog.UserID,
+		Model:       model,
+		History:     errorLog.History,
+		Prompt:      errorLog.RequestText,
+		Attachments: errorLog.Attachments,
+	})
+	if err != nil {
+		log.Printf("Replay of error %s with %s failed: %v", key, model, err)
+		b.sendErrorMessage(ctx, userID, fmt.Sprintf("❌ Replay with %s failed: %s",
+			modelName, truncateText(err.Error(), keyErrorLength)))
+		return nil
+	}
+
+	log.Printf("Replay of error %s with %s succeeded", key, model)
+	status.remove()
+	b.sendSuccessMessage(ctx, userID, fmt.Sprintf("✅ Replay with %s succeeded:", modelName))
+	return b.sendResponse(ctx, userID, response)
+}
+
+// replayModelID is a short ID of the model for replay buttons, it stays valid when the favorites change.
+func replayModelID(model string) string {
+	sum := sha256.Sum256([]byte(model))
+	return hex.EncodeToString(sum[:replayModelIDSize])
+}
+
+// resolveReplayModel finds the model of a replay button among the logged model, the favorites
+// of the admin and the models of the api. An empty model means it is gone and the admin was told.
+func (b *botImpl) resolveReplayModel(ctx *th.Context, userID int64, errorLog *storage.ErrorLog, modelID string) (string, error) {
+	if replayModelID(errorLog.Model) == modelID {
+		return errorLog.Model, nil
+	}
+
+	session, err := b.getUserSessionWithErrorHandling(ctx, userID)
+	if err != nil {
+		return "", err
+	}
+	for _, model := range session.FavoriteModels {
+		if replayModelID(model) == modelID {
+			return model, nil
+		}
+	}
+
+	// removed from the favorites since the buttons were sent
+	models, err := b.getModelsAndHandleErrors(ctx, userID)
+	if err != nil {
+		return "", err
+	}
+	for _, model := range models {
+		if replayModelID(model) == modelID {
+			return model, nil
+		}
+	}
+
+	b.sendErrorMessage(ctx, userID, "❎ The model is no longer available, send /error again.")
+	return "", nil
+}
+
+func (b *botImpl) getErrorLogWithErrorHandling(ctx *th.Context, userID int64, key string) (*storage.ErrorLog, error) {
+	errorLog, err := b.storage.GetErrorLog(key)
+	if errors.Is(err, storage.ErrErrorLogNotFound) {
+		b.sendErrorMessage(ctx, userID, "❎ Error not found, it may have been pruned.")
+		return nil, nil
+	}
+	if err != nil {
+		log.Printf("Failed to get error log %s: %v", key, err)
+		b.sendErrorMessage(ctx, userID, "❌ Failed to get error log.")
+		return nil, err
+	}
+	return errorLog, nil
+}
@@ -1,10 +1,13 @@
 package bot
 
 import (
+	"fmt"
 	"log"
+	"strings"
 
 	"github.com/mymmrac/telego"
 	th "github.com/mymmrac/telego/telegohandler"
+	tu "github.com/mymmrac/telego/telegoutil"
 )
 
 const (
@@ -13,14 +16,24 @@ const (
 
 func (b *botImpl) setupMiddlewares() {
 	b.tgBotHandler.Use(b.middlewareAccess)
+	b.tgBotHandler.Use(b.middlewareSerialize)
 }
 
 func (b *botImpl) middlewareAccess(ctx *th.Context, update telego.Update) error {
-	if update.Message == nil {
+	var userID int64
+	switch {
+	case update.Message != nil:
+		userID = update.Message.From.ID
+	case update.EditedMessage != nil:
+		userID = update.EditedMessage.From.ID
+	case update.CallbackQuery != nil:
+		userID = update.CallbackQuery.From.ID
+	case update.InlineQuery != nil:
+		userID = update.InlineQuery.From.ID
+	default:
 		return ctx.Next(update)
 	}
 
-	userID := update.Message.From.ID
 	if _, ok := b.config.AllowedUsers[userID]; !ok {
 		log.Printf(unauthorizedMsg, userID)
 		return nil
@@ -28,3 +41,61 @@ func (b *botImpl) middlewareAccess(ctx *th.Context, update telego.Update) error
 
 	return ctx.Next(update)
 }
+
+// middlewareSerialize processes messages and callbacks of a user one by one,
+// so concurrent updates never work on the same stale session.
+func (b *botImpl) middlewareSerialize(ctx *th.Context, update telego.Update) error {
+	var userID int64
+	switch {
+	case update.Message != nil:
+		userID = update.Message.From.ID
+	case update.EditedMessage != nil:
+		userID = update.EditedMessage.From.ID
+	case update.CallbackQuery != nil && strings.HasPrefix(update.CallbackQuery.Data, prefixStop):
+		// must reach the running generation instead of waiting for it
+		return ctx.Next(update)
+	case update.CallbackQuery != nil:
+		userID = update.CallbackQuery.From.ID
+	default:
+		return ctx.Next(update)
+	}
+
+	if abortsGeneration(update) && b.cancels.cancel(userID) {
+		log.Printf("Canceled running generation of user %d", userID)
+	}
+
+	ticket, position := b.queue.enter(userID)
+	defer b.queue.leave(ticket)
+
+	if position > 0 && update.Message != nil {
+		_, _ = ctx.Bot().SendMessage(ctx, tu.Message(tu.ID(userID),
+			fmt.Sprintf("⏳ Your message is queued (position %d).", position)).
+			WithReplyParameters(&telego.ReplyParameters{MessageID: update.Message.MessageID}))
+	}
+
+	if err := b.queue.wait(ctx, ticket); err != nil {
+		return err
+	}
+
+	return ctx.Next(update)
+}
+
+// abortsGeneration reports whether the update starts over, so waiting for the running answer is pointless.
+func abortsGeneration(update telego.Update) bool {
+	if update.CallbackQuery != nil {
+		for _, prefix := range []string{prefixSetModelFromFavorites, prefixChatSwitch, prefixChatArchive, prefixChatDelete} {
+			if strings.HasPrefix(update.CallbackQuery.Data, prefix) {
+				return true
+			}
+		}
+		return false
+	}
+
+	if update.Message == nil {
+		return false
+	}
+
+	command, _ := splitFirstWord(update.Message.Text)
+	command, _, _ = strings.Cut(command, "@")
+	return command == "/new" || command == "/setmodel"
+}
@@ -0,0 +1,158 @@
+package bot
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mymmrac/telego"
+	th "github.com/mymmrac/telego/telegohandler"
+	tu "github.com/mymmrac/telego/telegoutil"
+)
+
+const (
+	// followed by the step and the time /forgetme was sent
+	prefixForgetMe       string = "v1_forgetme_"
+	prefixForgetMeCancel string = "v1_forgetmecancel"
+
+	forgetMeStepConfirm string        = "1"
+	forgetMeStepDelete  string        = "2"
+	forgetMeTimeout     time.Duration = 10 * time.Minute
+)
+
+// Handler for /mydata command
+func (b *botImpl) handlerMyData(ctx *th.Context, update telego.Update) error {
+	userID := update.Message.From.ID
+
+	_ = ctx.Bot().SendChatAction(ctx, tu.ChatAction(tu.ID(userID), telego.ChatActionUploadDocument))
+
+	var data bytes.Buffer
+	report, err := b.storage.ExportUserData(userID, &data)
+	if err != nil {
+		log.Printf("Failed to export data of user %d: %v", userID, err)
+		b.sendErrorMessage(ctx, userID, "❌ Failed to export your data.")
+		return err
+	}
+	if data.Len() > maxDocumentSize {
+		b.sendErrorMessage(ctx, userID, fmt.Sprintf(
+			"⚠️ Your data takes %.2fMB, more than Telegram lets bots send. Delete some conversations in /chats and try again.",
+			float64(data.Len())/bytesInMB))
+		return nil
+	}
+
+	log.Printf("Exported data of user %d: %s", userID, report)
+	_, err = ctx.Bot().SendDocument(ctx, tu.Document(tu.ID(userID),
+		tu.FileFromBytes(data.Bytes(), fmt.Sprintf("mydata-%d-%s.zip", userID, time.Now().Format(time.DateOnly)))).
+		WithCaption(fmt.Sprintf("📦 Everything stored for you, %d records: %s.\n\nFiles uploaded to Gemini are not included, see /files.",
+			report.Records(), report)))
+	return err
+}
+
+// Handler for /forgetme command
+func (b *botImpl) handlerForgetMe(ctx *th.Context, update telego.Update) error {
+	userID := update.Message.From.ID
+
+	keyboard := tu.InlineKeyboard(tu.InlineKeyboardRow(
+		tu.InlineKeyboardButton("🗑 Delete my data").
+			WithCallbackData(fmt.Sprintf("%s%s_%d", prefixForgetMe, forgetMeStepConfirm, time.Now().Unix())),
+		tu.InlineKeyboardButton("❎ Cancel").WithCallbackData(prefixForgetMeCancel),
+	))
+	_, err := ctx.Bot().SendMessage(ctx, tu.Message(tu.ID(userID),
+		"⚠️ This deletes everything stored for you: settings, conversations, saved responses, errors, "+
+			"prompt templates and uploaded files. It cannot be undone, send /mydata first to keep a copy.").
+		WithReplyMarkup(keyboard))
+	return err
+}
+
+func (b *botImpl) callbackForgetMe(ctx *th.Context, query telego.CallbackQuery) error {
+	chatID := query.Message.GetChat().ChatID()
+	userID := chatID.ID
+
+	if err := b.setupCallbackQuery(ctx, query, userID); err != nil {
+		return err
+	}
+
+	step, sent, _ := strings.Cut(strings.TrimPrefix(query.Data, prefixForgetMe), "_")
+	sentAt, err := strconv.ParseInt(sent, 10, 64)
+	if err != nil {
+		return err
+	}
+	if time.Since(time.Unix(sentAt, 0)) > forgetMeTimeout {
+		b.sendErrorMessage(ctx, userID, "⌛ The confirmation expired, send /forgetme again.")
+		return nil
+	}
+
+	if step == forgetMeStepConfirm {
+		keyboard := tu.InlineKeyboard(tu.InlineKeyboardRow(
+			tu.InlineKeyboardButton("🗑 Yes, delete everything").
+				WithCallbackData(fmt.Sprintf("%s%s_%s", prefixForgetMe, forgetMeStepDelete, sent)),
+			tu.InlineKeyboardButton("❎ Cancel").WithCallbackData(prefixForgetMeCancel),
+		))
+		_, err = ctx.Bot().SendMessage(ctx, tu.Message(tu.ID(userID),
+			"❗️ Are you sure? Your data will be deleted for good.").
+			WithReplyMarkup(keyboard))
+		return err
+	}
+
+	return b.forgetUser(ctx, userID)
+}
+
+func (b *botImpl) callbackForgetMeCancel(ctx *th.Context, query telego.CallbackQuery) error {
+	chatID := query.Message.GetChat().ChatID()
+	userID := chatID.ID
+
+	if err := b.setupCallbackQuery(ctx, query, userID); err != nil {
+		return err
+	}
+
+	b.sendSuccessMessage(ctx, userID, "👍 Nothing was deleted.")
+	return nil
+}
+
+// forgetUser deletes the files the user uploaded to Gemini, the cached inline answers
+// to their questions and every stored record of them.
+func (b *botImpl) forgetUser(ctx *th.Context, userID int64) error {
+	b.cancels.cancel(userID)
+
+	files, err := b.storage.ListRemoteFiles(userID)
+	if err != nil {
+		log.Printf("Failed to list files of user %d: %v", userID, err)
+		b.sendErrorMessage(ctx, userID, "❌ Failed to delete your data.")
+		return err
+	}
+	now := time.Now()
+	var remoteFiles []string
+	for _, file := range files {
+		if now.After(file.ExpiresAt) {
+			continue
+		}
+		if err = b.geminiClient.DeleteFile(ctx, file.KeyID, file.Name); err != nil {
+			log.Printf("Failed to delete remote file %s of user %d: %v", file.Name, userID, err)
+			remoteFiles = append(remoteFiles, file.Name)
+		}
+	}
+
+	b.inline.forget(userID)
+	b.indexer.forget(userID)
+
+	report, err := b.storage.DeleteUserData(userID, remoteFiles)
+	if err != nil {
+		log.Printf("Failed to delete data of user %d: %v", userID, err)
+		b.sendErrorMessage(ctx, userID, "❌ Failed to delete your data.")
+		return err
+	}
+
+	log.Printf("Audit: deleted all data of user %d on their request, %d records: %s, %d files left on Gemini",
+		userID, report.Records(), report, len(remoteFiles))
+	message := fmt.Sprintf("✅ Deleted %d records, only a note of the deletion is kept. Send a message to start over.",
+		report.Records())
+	if len(remoteFiles) > 0 {
+		message += fmt.Sprintf("\n\n⚠️ %d uploaded files could not be deleted from Gemini, it removes them "+
+			"within %.0f hours of the upload.", len(remoteFiles), remoteFileRetention.Hours())
+	}
+	b.sendSuccessMessage(ctx, userID, message)
+	return nil
+}
@@ -0,0 +1,72 @@
+package bot
+
+import (
+	"log"
+	"sync"
+
+	"github.com/mymmrac/telego"
+	th "github.com/mymmrac/telego/telegohandler"
+	tu "github.com/mymmrac/telego/telegoutil"
+)
+
+// placeholder is a service message that is sent lazily, edited in place
+// and removed once the real answer is delivered.
+type placeholder struct {
+	mu        sync.Mutex
+	ctx       *th.Context
+	chatID    telego.ChatID
+	messageID int
+	// keyboard is attached to every version of the message
+	keyboard *telego.InlineKeyboardMarkup
+	// removed placeholders stay removed, a late set from a timer does nothing
+	removed bool
+}
+
+func newPlaceholder(ctx *th.Context, userID int64) *placeholder {
+	return &placeholder{ctx: ctx, chatID: tu.ID(userID)}
+}
+
+func (p *placeholder) set(text string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.removed {
+		return
+	}
+	if p.messageID == 0 {
+		params := tu.Message(p.chatID, text)
+		if p.keyboard != nil {
+			params = params.WithReplyMarkup(p.keyboard)
+		}
+		msg, err := p.ctx.Bot().SendMessage(p.ctx, params)
+		if err != nil {
+			log.Printf("Failed to send placeholder to chat %d: %v", p.chatID.ID, err)
+			return
+		}
+		p.messageID = msg.MessageID
+		return
+	}
+
+	params := tu.EditMessageText(p.chatID, p.messageID, text)
+	if p.keyboard != nil {
+		params = params.WithReplyMarkup(p.keyboard)
+	}
+	if _, err := p.ctx.Bot().EditMessageText(p.ctx, params); err != nil {
+		log.Printf("Failed to edit placeholder in chat %d: %v", p.chatID.ID, err)
+	}
+}
+
+func (p *placeholder) remove() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.removed = true
+	if p.messageID == 0 {
+		return
+	}
+
+	if err := p.ctx.Bot().DeleteMessage(p.ctx, tu.Delete(p.chatID, p.messageID)); err != nil {
+		log.Printf("Failed to delete placeholder in chat %d: %v", p.chatID.ID, err)
+	}
+	p.messageID = 0
+}
@@ -0,0 +1,454 @@
+package bot
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/mymmrac/telego"
+	th "github.com/mymmrac/telego/telegohandler"
+	tu "github.com/mymmrac/telego/telegoutil"
+
+	"github.com/vasyvasilie/gemini-chat-tg-bot/pkg/gemini"
+	"github.com/vasyvasilie/gemini-chat-tg-bot/pkg/storage"
+)
+
+const (
+	prefixSelectPrompt string = "v1_prompt_"
+
+	promptDateLayout        string = "2006-01-02"
+	promptDescriptionLength int    = 60
+	promptPlaceholderInput  string = "input"
+	promptPlaceholderDate   string = "date"
+	promptUsage             string = "📝 Prompt templates:\n" +
+		"`/prompt` pick a template for the next message\n" +
+		"`/prompt list` show templates\n" +
+		"`/prompt save name text` save a template, use `{{input}}`, `{{date}}` or any `{{custom}}` placeholder\n" +
+		"`/prompt use name [key=value ...] input` run a template\n" +
+		"`/prompt share name` share a template with everyone\n" +
+		"`/prompt command name on|off` expose a template as `/name`\n" +
+		"`/prompt delete name` delete a template"
+)
+
+var (
+	// template names double as bot commands, so they follow the command rules
+	promptNameRe     = regexp.MustCompile(`^[a-z0-9_]{1,32}$`)
+	promptVariableRe = regexp.MustCompile(`^(\w+)=(\S*)$`)
+	placeholderRe    = regexp.MustCompile(`\{\{\s*(\w+)\s*\}\}`)
+)
+
+// Handler for /prompt command
+func (b *botImpl) handlerPrompt(ctx *th.Context, update telego.Update) error {
+	userID := update.Message.From.ID
+	subcommand, args := splitFirstWord(commandArgs(update.Message.Text))
+
+	switch subcommand {
+	case "":
+		return b.sendPromptPicker(ctx, userID)
+	case "list":
+		return b.listPrompts(ctx, userID)
+	case "save":
+		name, text := splitFirstWord(args)
+		return b.savePrompt(ctx, userID, name, text)
+	case "use":
+		name, rest := splitFirstWord(args)
+		variables, input := parsePromptVariables(rest)
+		prompt, err := b.renderPromptWithErrorHandling(ctx, userID, name, variables, input)
+		if err != nil {
+			return nil
+		}
+
+		session, err := b.getUserSessionWithErrorHandling(ctx, userID)
+		if err != nil {
+			return err
+		}
+		return b.chat(ctx, session, userID, storage.Message{
+			Role:      gemini.RoleUser,
+			Text:      prompt,
+			MessageID: update.Message.MessageID,
+		})
+	case "share":
+		name, _ := splitFirstWord(args)
+		return b.sharePrompt(ctx, userID, name)
+	case "command":
+		name, flag := splitFirstWord(args)
+		return b.setPromptCommand(ctx, userID, name, flag)
+	case "delete":
+		name, _ := splitFirstWord(args)
+		return b.deletePrompt(ctx, userID, name)
+	default:
+		b.sendFormattedMessage(ctx, userID, promptUsage)
+		return nil
+	}
+}
+
+// Handler for slash commands created from prompt templates
+func (b *botImpl) handlerPromptCommand(ctx *th.Context, update telego.Update) error {
+	userID := update.Message.From.ID
+	command, _ := splitFirstWord(update.Message.Text)
+	name, _, _ := strings.Cut(strings.TrimPrefix(command, "/"), "@")
+
+	template, err := b.storage.GetPrompt(userID, name)
+	if err != nil || !template.Command {
+		// not a template, let Gemini see the text as is
+		return b.handlerAnyMessage(ctx, update)
+	}
+
+	variables, input := parsePromptVariables(commandArgs(update.Message.Text))
+	prompt, err := b.renderPromptWithErrorHandling(ctx, userID, name, variables, input)
+	if err != nil {
+		return nil
+	}
+
+	session, err := b.getUserSessionWithErrorHandling(ctx, userID)
+	if err != nil {
+		return err
+	}
+	return b.chat(ctx, session, userID, storage.Message{
+		Role:      gemini.RoleUser,
+		Text:      prompt,
+		MessageID: update.Message.MessageID,
+	})
+}
+
+func (b *botImpl) callbackSelectPrompt(ctx *th.Context, query telego.CallbackQuery) error {
+	chatID := query.Message.GetChat().ChatID()
+	userID := chatID.ID
+
+	if err := b.setupCallbackQuery(ctx, query, userID); err != nil {
+		return err
+	}
+
+	session, err := b.getUserSessionWithErrorHandling(ctx, userID)
+	if err != nil {
+		return err
+	}
+
+	name := strings.TrimPrefix(query.Data, prefixSelectPrompt)
+	if _, err = b.storage.GetPrompt(userID, name); err != nil {
+		log.Printf("Failed to get prompt %s for user %d: %v", name, userID, err)
+		b.sendErrorMessage(ctx, userID, "❎ Template not found.")
+		return nil
+	}
+
+	session.PendingPrompt = name
+	if err = b.saveUserSessionWithErrorHandling(ctx, session, userID); err != nil {
+		return err
+	}
+
+	b.sendFormattedMessage(ctx, userID, fmt.Sprintf("📝 Template `%s` selected. Send the input text.", name))
+	return nil
+}
+
+func (b *botImpl) sendPromptPicker(ctx *th.Context, userID int64) error {
+	templates, err := b.storage.ListPrompts(userID)
+	if err != nil {
+		log.Printf("Failed to list prompts for user %d: %v", userID, err)
+		b.sendErrorMessage(ctx, userID, "❌ Failed to list templates.")
+		return err
+	}
+
+	if len(templates) == 0 {
+		b.sendFormattedMessage(ctx, userID, "❎ No templates yet.\n\n"+promptUsage)
+		return nil
+	}
+
+	var rows [][]telego.InlineKeyboardButton
+	for _, template := range templates {
+		rows = append(rows, tu.InlineKeyboardRow(
+			tu.InlineKeyboardButton(promptLabel(template)).
+				WithCallbackData(fmt.Sprintf("%s%s", prefixSelectPrompt, template.Name))))
+	}
+
+	_, err = ctx.Bot().SendMessage(ctx, tu.Message(tu.ID(userID), "📝 Pick a template for the next message.").
+		WithReplyMarkup(tu.InlineKeyboard(rows...)))
+	return err
+}
+
+func (b *botImpl) listPrompts(ctx *th.Context, userID int64) error {
+	templates, err := b.storage.ListPrompts(userID)
+	if err != nil {
+		log.Printf("Failed to list prompts for user %d: %v", userID, err)
+		b.sendErrorMessage(ctx, userID, "❌ Failed to list templates.")
+		return err
+	}
+
+	if len(templates) == 0 {
+		b.sendSuccessMessage(ctx, userID, "❎ No templates yet.")
+		return nil
+	}
+
+	var sb strings.Builder
+	sb.WriteString("📝 Templates:\n")
+	for _, template := range templates {
+		sb.WriteString(fmt.Sprintf("\n%s\n%s\n", promptLabel(template), truncateText(template.Text, findSnippetLength)))
+	}
+
+	b.sendSuccessMessage(ctx, userID, sb.String())
+	return nil
+}
+
+func (b *botImpl) savePrompt(ctx *th.Context, userID int64, name, text string) error {
+	if !b.validPromptName(ctx, userID, name) {
+		return nil
+	}
+
+	if text == "" {
+		b.sendFormattedMessage(ctx, userID, "⚠️ Please specify the template text.\nUsage: `/prompt save name text`")
+		return nil
+	}
+
+	template := &storage.PromptTemplate{
+		Name:      name,
+		Text:      text,
+		OwnerID:   userID,
+		CreatedAt: time.Now(),
+	}
+	if existing, err := b.storage.GetPrompt(userID, name); err == nil && !existing.Shared {
+		template.Command = existing.Command
+		template.CreatedAt = existing.CreatedAt
+	}
+
+	if err := b.storage.SavePrompt(template); err != nil {
+		log.Printf("Failed to save prompt %s for user %d: %v", name, userID, err)
+		b.sendErrorMessage(ctx, userID, "❌ Failed to save template.")
+		return err
+	}
+
+	log.Printf("Saved prompt %s for user %d", name, userID)
+	b.sendFormattedMessage(ctx, userID, fmt.Sprintf("✅ Template `%s` saved.", name))
+	return nil
+}
+
+func (b *botImpl) sharePrompt(ctx *th.Context, userID int64, name string) error {
+	template, err := b.storage.GetPrompt(userID, name)
+	if err != nil || template.Shared {
+		b.sendErrorMessage(ctx, userID, "❎ Personal template not found.")
+		return nil
+	}
+
+	_, err = b.storage.SharePrompt(userID, name)
+	if errors.Is(err, storage.ErrPromptNameTaken) {
+		b.sendErrorMessage(ctx, userID, "❎ Another user already shares a template with this name, rename yours first.")
+		return nil
+	}
+	if err != nil {
+		log.Printf("Failed to share prompt %s of user %d: %v", name, userID, err)
+		b.sendErrorMessage(ctx, userID, "❌ Failed to share template.")
+		return err
+	}
+
+	if template.Command {
+		if err = b.refreshCommands(ctx, ctx.Bot(), userID); err != nil {
+			log.Printf("Failed to set commands for user %d: %v", userID, err)
+		}
+	}
+
+	log.Printf("User %d shared prompt %s", userID, name)
+	b.sendFormattedMessage(ctx, userID, fmt.Sprintf("✅ Template `%s` is now shared with everyone.", name))
+	return nil
+}
+
+func (b *botImpl) setPromptCommand(ctx *th.Context, userID int64, name, flag string) error {
+	if flag != "on" && flag != "off" {
+		b.sendFormattedMessage(ctx, userID, "⚠️ Usage: `/prompt command name on|off`")
+		return nil
+	}
+
+	template, err := b.storage.GetPrompt(userID, name)
+	if err != nil || template.Shared {
+		b.sendErrorMessage(ctx, userID, "❎ Personal template not found.")
+		return nil
+	}
+
+	template.Command = flag == "on"
+	if err = b.storage.SavePrompt(template); err != nil {
+		log.Printf("Failed to save prompt %s for user %d: %v", name, userID, err)
+		b.sendErrorMessage(ctx, userID, "❌ Failed to save template.")
+		return err
+	}
+
+	if err = b.refreshCommands(ctx, ctx.Bot(), userID); err != nil {
+		log.Printf("Failed to set commands for user %d: %v", userID, err)
+		b.sendErrorMessage(ctx, userID, "❌ Failed to update the command list.")
+		return err
+	}
+
+	if template.Command {
+		b.sendFormattedMessage(ctx, userID, fmt.Sprintf("✅ Template is available as `/%s`.", name))
+	} else {
+		b.sendFormattedMessage(ctx, userID, fmt.Sprintf("✅ Command `/%s` removed.", name))
+	}
+	return nil
+}
+
+func (b *botImpl) deletePrompt(ctx *th.Context, userID int64, name string) error {
+	err := b.storage.DeletePrompt(userID, name)
+	if errors.Is(err, storage.ErrPromptNotFound) {
+		b.sendErrorMessage(ctx, userID, "❎ Template not found.")
+		return nil
+	}
+	if err != nil {
+		log.Printf("Failed to delete prompt %s for user %d: %v", name, userID, err)
+		b.sendErrorMessage(ctx, userID, "❌ Failed to delete template.")
+		return err
+	}
+
+	if err = b.refreshCommands(ctx, ctx.Bot(), userID); err != nil {
+		log.Printf("Failed to set commands for user %d: %v", userID, err)
+	}
+
+	log.Printf("Deleted prompt %s for user %d", name, userID)
+	b.sendFormattedMessage(ctx, userID, fmt.Sprintf("✅ Template `%s` deleted.", name))
+	return nil
+}
+
+func (b *botImpl) validPromptName(ctx *th.Context, userID int64, name string) bool {
+	if !promptNameRe.MatchString(name) {
+		b.sendErrorMessage(ctx, userID,
+			"⚠️ Template name must be 1-32 lowercase letters, digits or underscores.")
+		return false
+	}
+
+	if slices.Contains(reservedCommands(), name) {
+		b.sendErrorMessage(ctx, userID, "⚠️ Template name clashes with a bot command.")
+		return false
+	}
+
+	return true
+}
+
+// renderPromptWithErrorHandling fills the template placeholders and reports missing values to the user.
+func (b *botImpl) renderPromptWithErrorHandling(ctx *th.Context, userID int64, name string,
+	variables map[string]string, input string,
+) (string, error) {
+	template, err := b.storage.GetPrompt(userID, name)
+	if err != nil {
+		log.Printf("Failed to get prompt %s for user %d: %v", name, userID, err)
+		b.sendErrorMessage(ctx, userID, "❎ Template not found.")
+		return "", err
+	}
+
+	prompt, missing := renderPrompt(template.Text, input, variables)
+	if len(missing) > 0 {
+		b.sendFormattedMessage(ctx, userID, fmt.Sprintf(
+			"⚠️ Missing values for `%s`.\nUsage: `/prompt use %s key=value ... input`",
+			strings.Join(missing, "`, `"), name))
+		return "", fmt.Errorf("missing placeholders %v", missing)
+	}
+
+	return prompt, nil
+}
+
+// refreshCommands sets the command list of the user's chat: the common commands,
+// admin commands for admins and the user's templates exposed as commands.
+func (b *botImpl) refreshCommands(ctx context.Context, tgBot *telego.Bot, userID int64) error {
+	commands := slices.Clone(botCommands)
+	if b.isAdmin(userID) {
+		commands = append(commands, adminBotCommands...)
+	}
+
+	templates, err := b.storage.ListPrompts(userID)
+	if err != nil {
+		return err
+	}
+	for _, template := range templates {
+		if template.Shared || !template.Command {
+			continue
+		}
+		commands = append(commands, telego.BotCommand{
+			Command:     template.Name,
+			Description: "📝 " + truncateText(template.Text, promptDescriptionLength),
+		})
+	}
+
+	return tgBot.SetMyCommands(ctx, &telego.SetMyCommandsParams{
+		Commands: commands,
+		Scope:    tu.ScopeChat(tu.ID(userID)),
+	})
+}
+
+func renderPrompt(text, input string, variables map[string]string) (string, []string) {
+	var missing []string
+	hasInput := false
+	prompt := placeholderRe.ReplaceAllStringFunc(text, func(placeholder string) string {
+		name := placeholderRe.FindStringSubmatch(placeholder)[1]
+		switch name {
+		case promptPlaceholderInput:
+			hasInput = true
+			return input
+		case promptPlaceholderDate:
+			return time.Now().Format(promptDateLayout)
+		}
+
+		if value, ok := variables[name]; ok {
+			return value
+		}
+		if !slices.Contains(missing, name) {
+			missing = append(missing, name)
+		}
+		return placeholder
+	})
+
+	if !hasInput && input != "" {
+		prompt += "\n\n" + input
+	}
+
+	return prompt, missing
+}
+
+// parsePromptVariables splits leading key=value pairs from the rest of the input.
+func parsePromptVariables(text string) (map[string]string, string) {
+	variables := make(map[string]string)
+	for {
+		word, rest := splitFirstWord(text)
+		match := promptVariableRe.FindStringSubmatch(word)
+		if match == nil {
+			return variables, text
+		}
+		variables[match[1]] = match[2]
+		text = rest
+	}
+}
+
+func promptLabel(template storage.PromptTemplate) string {
+	if template.Shared {
+		return "🌐 " + template.Name
+	}
+	if template.Command {
+		return "📝 /" + template.Name
+	}
+	return "📝 " + template.Name
+}
+
+// commandArgs returns the message text after the command, keeping line breaks.
+func commandArgs(text string) string {
+	idx := strings.IndexFunc(text, unicode.IsSpace)
+	if idx == -1 {
+		return ""
+	}
+	return strings.TrimSpace(text[idx:])
+}
+
+func splitFirstWord(text string) (string, string) {
+	text = strings.TrimSpace(text)
+	idx := strings.IndexFunc(text, unicode.IsSpace)
+	if idx == -1 {
+		return text, ""
+	}
+	return text[:idx], strings.TrimSpace(text[idx:])
+}
+
+func reservedCommands() []string {
+	commands := []string{"start", "prompt"}
+	for _, command := range slices.Concat(botCommands, adminBotCommands) {
+		commands = append(commands, command.Command)
+	}
+	return commands
+}
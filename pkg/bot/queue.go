@@ -0,0 +1,70 @@
+package bot
+
+import (
+	"context"
+	"slices"
+	"sync"
+)
+
+// userQueue runs updates of the same user one at a time in arrival order.
+type userQueue struct {
+	mu      sync.Mutex
+	waiters map[int64][]chan struct{}
+}
+
+type queueTicket struct {
+	userID int64
+	turn   chan struct{}
+}
+
+func newUserQueue() *userQueue {
+	return &userQueue{waiters: make(map[int64][]chan struct{})}
+}
+
+// enter puts the caller at the end of the user's queue and returns
+// the number of updates ahead of it.
+func (q *userQueue) enter(userID int64) (*queueTicket, int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	ticket := &queueTicket{userID: userID, turn: make(chan struct{})}
+	position := len(q.waiters[userID])
+	q.waiters[userID] = append(q.waiters[userID], ticket.turn)
+	if position == 0 {
+		close(ticket.turn)
+	}
+
+	return ticket, position
+}
+
+func (q *userQueue) wait(ctx context.Context, ticket *queueTicket) error {
+	select {
+	case <-ticket.turn:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// leave removes the ticket from the queue and lets the next update run.
+func (q *userQueue) leave(ticket *queueTicket) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	waiters := q.waiters[ticket.userID]
+	idx := slices.Index(waiters, ticket.turn)
+	if idx == -1 {
+		return
+	}
+
+	waiters = slices.Delete(waiters, idx, idx+1)
+	if len(waiters) == 0 {
+		delete(q.waiters, ticket.userID)
+		return
+	}
+
+	q.waiters[ticket.userID] = waiters
+	if idx == 0 {
+		close(waiters[0])
+	}
+}
@@ -0,0 +1,75 @@
+package bot
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf16"
+
+	"github.com/hashicorp/go-multierror"
+	"github.com/mymmrac/telego"
+	th "github.com/mymmrac/telego/telegohandler"
+	tu "github.com/mymmrac/telego/telegoutil"
+
+	"github.com/vasyvasilie/gemini-chat-tg-bot/pkg/gemini"
+)
+
+const (
+	// leaves room for the header of a code block within the Telegram message limit
+	maxCodeBlockLength int    = 4000
+	imageFileName      string = "image.png"
+)
+
+// sendResponse delivers the answer, code, execution results and images are sent as separate messages.
+func (b *botImpl) sendResponse(ctx *th.Context, userID int64, response *gemini.Response) error {
+	if !response.Rich() {
+		return b.SendLongMessage(ctx, tu.ID(userID), response.Text)
+	}
+
+	var multiErr error
+	for _, part := range response.Parts {
+		var err error
+		switch part.Kind {
+		case gemini.PartText:
+			if strings.TrimSpace(part.Text) != "" {
+				err = b.SendLongMessage(ctx, tu.ID(userID), part.Text)
+			}
+		case gemini.PartCode:
+			err = b.sendCodeBlock(ctx, userID, fmt.Sprintf("🧮 %s", part.Language), part.Text, part.Language)
+		case gemini.PartCodeResult:
+			header := "✅ Output"
+			if part.Outcome != "" && part.Outcome != "OUTCOME_OK" {
+				header = fmt.Sprintf("❌ %s", strings.TrimPrefix(part.Outcome, "OUTCOME_"))
+			}
+			err = b.sendCodeBlock(ctx, userID, header, part.Text, "")
+		case gemini.PartImage:
+			_, err = ctx.Bot().SendPhoto(ctx, tu.Photo(tu.ID(userID), tu.FileFromBytes(part.Data, imageFileName)))
+		}
+		if err != nil {
+			multiErr = multierror.Append(multiErr, err)
+		}
+	}
+
+	return multiErr
+}
+
+func (b *botImpl) sendCodeBlock(ctx *th.Context, userID int64, header, code, language string) error {
+	code = truncateText(strings.TrimSpace(code), maxCodeBlockLength)
+	if code == "" {
+		code = "(empty)"
+	}
+
+	header += "\n"
+	_, err := ctx.Bot().SendMessage(ctx, tu.Message(tu.ID(userID), header+code).
+		WithEntities(telego.MessageEntity{
+			Type:     telego.EntityTypePre,
+			Offset:   utf16Length(header),
+			Length:   utf16Length(code),
+			Language: language,
+		}))
+	return err
+}
+
+// Telegram measures entities in UTF-16 code units
+func utf16Length(text string) int {
+	return len(utf16.Encode([]rune(text)))
+}
@@ -8,13 +8,33 @@ import (
 // user friendly ordered
 var botCommands = []telego.BotCommand{
 	{Command: "new", Description: "Start a new chat session"},
+	{Command: "chats", Description: "Switch, rename, archive or delete conversations"},
+	{Command: "branches", Description: "Switch between branches of the conversation"},
+	{Command: "export", Description: "Export the conversation (e.g. /export html)"},
+	{Command: "import", Description: "Import a conversation from JSON, ChatGPT or Gemini"},
 	{Command: "currentmodel", Description: "Show the currently selected model"},
 	{Command: "selectmodel", Description: "Select model from favorites"},
-	{Command: "dbsize", Description: "Show db size"},
 	{Command: "listmodels", Description: "Show available models plain text"},
 	{Command: "setmodel", Description: "Set a model (e.g. /setmodel model-name)"},
 	{Command: "addmodeltofavorites", Description: "Add model to favorites"},
 	{Command: "clearfavorites", Description: "Clear favorites"},
+	{Command: "find", Description: "Search past conversations (e.g. /find query)"},
+	{Command: "prompt", Description: "Prompt templates (e.g. /prompt use name input)"},
+	{Command: "voice", Description: "Voice replies settings"},
+	{Command: "files", Description: "List or delete uploaded files"},
+	{Command: "code", Description: "Toggle code execution (e.g. /code on)"},
+	{Command: "response", Description: "Send a saved response again (e.g. /response id)"},
+	{Command: "mydata", Description: "Export everything stored for you"},
+	{Command: "forgetme", Description: "Delete everything stored for you"},
+}
+
+// shown to admins in addition to botCommands
+var adminBotCommands = []telego.BotCommand{
+	{Command: "keys", Description: "Show Gemini API keys usage"},
+	{Command: "dbstats", Description: "Show database statistics"},
+	{Command: "backup", Description: "Send a backup of the database"},
+	{Command: "error", Description: "Show and replay a Gemini error (e.g. /error key)"},
+	{Command: "errors", Description: "List recent Gemini errors (e.g. /errors 24h)"},
 }
 
 func (b *botImpl) setupHandlers() {
@@ -24,13 +44,55 @@ func (b *botImpl) setupHandlers() {
 	b.tgBotHandler.Handle(b.handlerListModels, th.CommandEqual("listmodels"))
 	b.tgBotHandler.Handle(b.handlerSetModel, th.CommandEqual("setmodel"))
 	b.tgBotHandler.Handle(b.handlerCurrentModel, th.CommandEqual("currentmodel"))
-	b.tgBotHandler.Handle(b.handlerDBSize, th.CommandEqual("dbsize"))
 	b.tgBotHandler.Handle(b.handlerAddModelToFavorites, th.CommandEqual("addmodeltofavorites"))
 	b.tgBotHandler.Handle(b.handlerSelectModel, th.CommandEqual("selectmodel"))
 	b.tgBotHandler.Handle(b.handlerClearFavorites, th.CommandEqual("clearfavorites"))
+	b.tgBotHandler.Handle(b.handlerFind, th.CommandEqual("find"))
+	b.tgBotHandler.Handle(b.handlerKeys, th.CommandEqual("keys"))
+	b.tgBotHandler.Handle(b.handlerDBStats, th.CommandEqual("dbstats"))
+	b.tgBotHandler.Handle(b.handlerBackup, th.CommandEqual("backup"))
+	b.tgBotHandler.Handle(b.handlerResponse, th.CommandEqual("response"))
+	b.tgBotHandler.Handle(b.handlerMyData, th.CommandEqual("mydata"))
+	b.tgBotHandler.Handle(b.handlerForgetMe, th.CommandEqual("forgetme"))
+	b.tgBotHandler.Handle(b.handlerError, th.CommandEqual("error"))
+	b.tgBotHandler.Handle(b.handlerErrors, th.CommandEqual("errors"))
+	b.tgBotHandler.Handle(b.handlerPrompt, th.CommandEqual("prompt"))
+	b.tgBotHandler.Handle(b.handlerVoice, th.CommandEqual("voice"))
+	b.tgBotHandler.Handle(b.handlerFiles, th.CommandEqual("files"))
+	b.tgBotHandler.Handle(b.handlerCode, th.CommandEqual("code"))
+	b.tgBotHandler.Handle(b.handlerChats, th.CommandEqual("chats"))
+	b.tgBotHandler.Handle(b.handlerBranches, th.CommandEqual("branches"))
+	b.tgBotHandler.Handle(b.handlerExport, th.CommandEqual("export"))
+	b.tgBotHandler.Handle(b.handlerImport, th.CommandEqual("import"))
+	b.tgBotHandler.Handle(b.handlerPromptCommand, th.AnyCommand())
 	b.tgBotHandler.Handle(b.handlerAnyMessage, th.AnyMessage())
+	b.tgBotHandler.Handle(b.handlerEditedMessage, th.AnyEditedMessageWithText())
+
+	// inline queries
+	b.tgBotHandler.HandleInlineQuery(b.handlerInlineQuery, th.AnyInlineQuery())
 
 	// callbacks
 	b.tgBotHandler.HandleCallbackQuery(b.callbackAddModelToFavorites, th.CallbackDataPrefix(prefixAddModelToFavorites))
 	b.tgBotHandler.HandleCallbackQuery(b.callbackSetModelFromFavorites, th.CallbackDataPrefix(prefixSetModelFromFavorites))
+	b.tgBotHandler.HandleCallbackQuery(b.callbackRestoreSession, th.CallbackDataPrefix(prefixRestoreSession))
+	b.tgBotHandler.HandleCallbackQuery(b.callbackSelectPrompt, th.CallbackDataPrefix(prefixSelectPrompt))
+	b.tgBotHandler.HandleCallbackQuery(b.callbackVoiceToggle, th.CallbackDataEqual(prefixVoiceToggle))
+	b.tgBotHandler.HandleCallbackQuery(b.callbackVoiceMenu, th.CallbackDataPrefix(prefixVoiceMenu))
+	b.tgBotHandler.HandleCallbackQuery(b.callbackVoiceName, th.CallbackDataPrefix(prefixVoiceName))
+	b.tgBotHandler.HandleCallbackQuery(b.callbackVoiceLanguage, th.CallbackDataPrefix(prefixVoiceLanguage))
+	b.tgBotHandler.HandleCallbackQuery(b.callbackDeleteFile, th.CallbackDataPrefix(prefixDeleteFile))
+	b.tgBotHandler.HandleCallbackQuery(b.callbackStop, th.CallbackDataPrefix(prefixStop))
+	b.tgBotHandler.HandleCallbackQuery(b.callbackChatsPage, th.CallbackDataPrefix(prefixChatsPage))
+	b.tgBotHandler.HandleCallbackQuery(b.callbackChat, th.CallbackDataPrefix(prefixChat))
+	b.tgBotHandler.HandleCallbackQuery(b.callbackChatSwitch, th.CallbackDataPrefix(prefixChatSwitch))
+	b.tgBotHandler.HandleCallbackQuery(b.callbackChatRename, th.CallbackDataPrefix(prefixChatRename))
+	b.tgBotHandler.HandleCallbackQuery(b.callbackChatArchive, th.CallbackDataPrefix(prefixChatArchive))
+	b.tgBotHandler.HandleCallbackQuery(b.callbackChatDelete, th.CallbackDataPrefix(prefixChatDelete))
+	b.tgBotHandler.HandleCallbackQuery(b.callbackBranch, th.CallbackDataPrefix(prefixBranch))
+	b.tgBotHandler.HandleCallbackQuery(b.callbackExport, th.CallbackDataPrefix(prefixExport))
+	b.tgBotHandler.HandleCallbackQuery(b.callbackCompact, th.CallbackDataEqual(prefixCompact))
+	b.tgBotHandler.HandleCallbackQuery(b.callbackReplay, th.CallbackDataPrefix(prefixReplay))
+	b.tgBotHandler.HandleCallbackQuery(b.callbackErrorLog, th.CallbackDataPrefix(prefixErrorLog))
+	b.tgBotHandler.HandleCallbackQuery(b.callbackForgetMe, th.CallbackDataPrefix(prefixForgetMe))
+	b.tgBotHandler.HandleCallbackQuery(b.callbackForgetMeCancel, th.CallbackDataEqual(prefixForgetMeCancel))
 }
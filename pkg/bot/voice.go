@@ -0,0 +1,251 @@
+package bot
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/mymmrac/telego"
+	th "github.com/mymmrac/telego/telegohandler"
+	tu "github.com/mymmrac/telego/telegoutil"
+
+	"github.com/vasyvasilie/gemini-chat-tg-bot/pkg/audio"
+	"github.com/vasyvasilie/gemini-chat-tg-bot/pkg/gemini"
+)
+
+const (
+	prefixVoiceToggle   string = "v1_voicetoggle"
+	prefixVoiceMenu     string = "v1_voicemenu_"
+	prefixVoiceName     string = "v1_voicename_"
+	prefixVoiceLanguage string = "v1_voicelang_"
+
+	voiceMenuVoices    string = "voices"
+	voiceMenuLanguages string = "languages"
+	voiceLanguageAuto  string = "auto"
+	voiceMaxLength     int    = 3000
+	voiceColumns       int    = 3
+	pcmChannels        int    = 1
+	pcmBitsPerSample   int    = 16
+	voiceUsage         string = "🔊 Voice replies:\n" +
+		"`/voice on|off` read answers aloud\n" +
+		"`/voice name Kore` choose a voice\n" +
+		"`/voice lang en-US` choose a language, `auto` to detect it"
+)
+
+var (
+	voiceLanguages  = []string{voiceLanguageAuto, "en-US", "ru-RU", "de-DE", "fr-FR", "es-ES", "it-IT", "pt-BR", "ja-JP", "hi-IN"}
+	voiceLanguageRe = regexp.MustCompile(`^[a-z]{2,3}(-[A-Z]{2})?$`)
+	fencedCodeRe    = regexp.MustCompile("(?s)```.*?```")
+)
+
+// Handler for /voice command
+func (b *botImpl) handlerVoice(ctx *th.Context, update telego.Update) error {
+	userID := update.Message.From.ID
+	session, err := b.getUserSessionWithErrorHandling(ctx, userID)
+	if err != nil {
+		return err
+	}
+
+	subcommand, value := splitFirstWord(commandArgs(update.Message.Text))
+	switch subcommand {
+	case "":
+		return b.sendVoiceSettings(ctx, session, userID)
+	case "on", "off":
+		session.VoiceReplies = subcommand == "on"
+	case "name":
+		idx := slices.IndexFunc(gemini.Voices, func(voice string) bool {
+			return strings.EqualFold(voice, value)
+		})
+		if idx == -1 {
+			b.sendFormattedMessage(ctx, userID,
+				fmt.Sprintf("⚠️ Unknown voice. Available voices:\n`%s`", strings.Join(gemini.Voices, "`, `")))
+			return nil
+		}
+		session.Voice = gemini.Voices[idx]
+	case "lang":
+		if value != voiceLanguageAuto && !voiceLanguageRe.MatchString(value) {
+			b.sendFormattedMessage(ctx, userID, "⚠️ Please specify a language code like `en-US` or `auto`.")
+			return nil
+		}
+		session.VoiceLanguage = voiceLanguageSetting(value)
+	default:
+		b.sendFormattedMessage(ctx, userID, voiceUsage)
+		return nil
+	}
+
+	if err = b.saveUserSessionWithErrorHandling(ctx, session, userID); err != nil {
+		return err
+	}
+
+	return b.sendVoiceSettings(ctx, session, userID)
+}
+
+func (b *botImpl) callbackVoiceToggle(ctx *th.Context, query telego.CallbackQuery) error {
+	return b.updateVoiceSettings(ctx, query, func(session *UserSession) {
+		session.VoiceReplies = !session.VoiceReplies
+	})
+}
+
+func (b *botImpl) callbackVoiceName(ctx *th.Context, query telego.CallbackQuery) error {
+	voice := strings.TrimPrefix(query.Data, prefixVoiceName)
+	return b.updateVoiceSettings(ctx, query, func(session *UserSession) {
+		if slices.Contains(gemini.Voices, voice) {
+			session.Voice = voice
+		}
+	})
+}
+
+func (b *botImpl) callbackVoiceLanguage(ctx *th.Context, query telego.CallbackQuery) error {
+	language := strings.TrimPrefix(query.Data, prefixVoiceLanguage)
+	return b.updateVoiceSettings(ctx, query, func(session *UserSession) {
+		if slices.Contains(voiceLanguages, language) {
+			session.VoiceLanguage = voiceLanguageSetting(language)
+		}
+	})
+}
+
+func (b *botImpl) callbackVoiceMenu(ctx *th.Context, query telego.CallbackQuery) error {
+	chatID := query.Message.GetChat().ChatID()
+	userID := chatID.ID
+
+	if err := b.setupCallbackQuery(ctx, query, userID); err != nil {
+		return err
+	}
+
+	var text, prefix string
+	var options []string
+	switch strings.TrimPrefix(query.Data, prefixVoiceMenu) {
+	case voiceMenuVoices:
+		text, prefix, options = "🗣 Choose a voice.", prefixVoiceName, gemini.Voices
+	case voiceMenuLanguages:
+		text, prefix, options = "🌐 Choose a language.", prefixVoiceLanguage, voiceLanguages
+	default:
+		return nil
+	}
+
+	var buttons []telego.InlineKeyboardButton
+	for _, option := range options {
+		buttons = append(buttons, tu.InlineKeyboardButton(option).
+			WithCallbackData(fmt.Sprintf("%s%s", prefix, option)))
+	}
+
+	_, err := ctx.Bot().SendMessage(ctx, tu.Message(chatID, text).
+		WithReplyMarkup(tu.InlineKeyboard(tu.InlineKeyboardCols(voiceColumns, buttons...)...)))
+	return err
+}
+
+func (b *botImpl) updateVoiceSettings(ctx *th.Context, query telego.CallbackQuery, update func(*UserSession)) error {
+	chatID := query.Message.GetChat().ChatID()
+	userID := chatID.ID
+
+	if err := b.setupCallbackQuery(ctx, query, userID); err != nil {
+		return err
+	}
+
+	session, err := b.getUserSessionWithErrorHandling(ctx, userID)
+	if err != nil {
+		return err
+	}
+
+	update(session)
+	if err = b.saveUserSessionWithErrorHandling(ctx, session, userID); err != nil {
+		return err
+	}
+
+	return b.sendVoiceSettings(ctx, session, userID)
+}
+
+func (b *botImpl) sendVoiceSettings(ctx *th.Context, session *UserSession, userID int64) error {
+	state, toggle := "off", "🔊 Turn on"
+	if session.VoiceReplies {
+		state, toggle = "on", "🔇 Turn off"
+	}
+
+	language := session.VoiceLanguage
+	if language == "" {
+		language = voiceLanguageAuto
+	}
+
+	text := fmt.Sprintf("🔊 Voice replies: %s\n🗣 Voice: %s\n🌐 Language: %s",
+		state, voiceName(session), language)
+	if session.VoiceReplies {
+		if err := audio.CheckEncoder(); err != nil {
+			log.Printf("Voice replies of user %d are turned on but cannot be sent: %v", userID, err)
+			text += "\n\n⚠️ Voice messages cannot be encoded on this server yet, answers come as text only."
+		}
+	}
+	keyboard := tu.InlineKeyboard(
+		tu.InlineKeyboardRow(tu.InlineKeyboardButton(toggle).WithCallbackData(prefixVoiceToggle)),
+		tu.InlineKeyboardRow(
+			tu.InlineKeyboardButton("🗣 Voice").WithCallbackData(prefixVoiceMenu+voiceMenuVoices),
+			tu.InlineKeyboardButton("🌐 Language").WithCallbackData(prefixVoiceMenu+voiceMenuLanguages),
+		),
+	)
+
+	_, err := ctx.Bot().SendMessage(ctx, tu.Message(tu.ID(userID), text).WithReplyMarkup(keyboard))
+	return err
+}
+
+// sendVoiceReply reads the answer aloud and sends it as a voice message. Without an encoder
+// nothing is synthesized, the answer was sent as text already.
+func (b *botImpl) sendVoiceReply(ctx *th.Context, session *UserSession, userID int64, text string) error {
+	if err := audio.CheckEncoder(); err != nil {
+		log.Printf("Sending the answer to user %d as text only: %v", userID, err)
+		return nil
+	}
+
+	text = speechText(text)
+	if text == "" {
+		return nil
+	}
+
+	_ = ctx.Bot().SendChatAction(ctx, tu.ChatAction(tu.ID(userID), telego.ChatActionRecordVoice))
+
+	speech, err := b.geminiClient.Synthesize(ctx, gemini.SpeechRequest{
+		UserID:   userID,
+		Text:     text,
+		Voice:    voiceName(session),
+		Language: session.VoiceLanguage,
+	})
+	if err != nil {
+		return err
+	}
+
+	data := speech.Data
+	if strings.HasPrefix(speech.MIMEType, "audio/L16") || strings.HasPrefix(speech.MIMEType, "audio/pcm") {
+		data = audio.PCMToWAV(data, audio.PCMRate(speech.MIMEType), pcmChannels, pcmBitsPerSample)
+	}
+
+	_ = ctx.Bot().SendChatAction(ctx, tu.ChatAction(tu.ID(userID), telego.ChatActionUploadVoice))
+
+	voice, err := audio.ToOpus(ctx, data)
+	if err != nil {
+		return err
+	}
+
+	_, err = ctx.Bot().SendVoice(ctx, tu.Voice(tu.ID(userID), tu.FileFromBytes(voice, "answer.ogg")))
+	return err
+}
+
+// speechText drops code blocks and markup, reading them aloud is useless.
+func speechText(text string) string {
+	text = fencedCodeRe.ReplaceAllString(text, "\n(code block skipped)\n")
+	plainText, _ := parseMarkupInternal(text)
+	return truncateText(strings.TrimSpace(plainText), voiceMaxLength)
+}
+
+func voiceName(session *UserSession) string {
+	if session.Voice == "" {
+		return gemini.DefaultVoice
+	}
+	return session.Voice
+}
+
+func voiceLanguageSetting(language string) string {
+	if language == voiceLanguageAuto {
+		return ""
+	}
+	return language
+}
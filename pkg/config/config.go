@@ -5,19 +5,68 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"time"
 )
 
 const (
-	defaultModel string = "models/gemini-2.0-flash-lite"
+	defaultModel          string = "models/gemini-2.0-flash-lite"
+	defaultEmbeddingModel string = "models/gemini-embedding-001"
+	defaultTTSModel       string = "models/gemini-2.5-flash-preview-tts"
+
+	// free tier limits of the default model
+	defaultGeminiMaxConcurrent int = 4
+	defaultGeminiRPM           int = 30
+	defaultGeminiTPM           int = 1000000
+
+	defaultGeminiKeyCooldown time.Duration = time.Minute
+
+	// attachments above this size are sent through the Files API
+	defaultFilesAPIThresholdKB int = 1024
+
+	defaultJanitorInterval time.Duration = time.Hour
+
+	defaultBackupInterval time.Duration = 24 * time.Hour
+	defaultBackupKeep     int           = 7
+
+	defaultStorageBackend string = "bolt"
+	// keeps nothing on disk, so it needs no path
+	memoryStorageBackend string = "memory"
 )
 
 type Config struct {
-	BotToken     string
-	GeminiApiKey string
-	AllowedUsers map[int64]struct{}
-	StoragePath  string
-	DefaultModel string
-	Debug        bool
+	BotToken       string
+	GeminiApiKeys  []string
+	AllowedUsers   map[int64]struct{}
+	AdminUsers     map[int64]struct{}
+	StoragePath    string
+	StorageBackend string
+	DefaultModel   string
+	EmbeddingModel string
+	InlineModel    string
+	TTSModel       string
+	Debug          bool
+
+	GeminiMaxConcurrent int
+	GeminiRPM           int
+	GeminiTPM           int
+	GeminiKeyCooldown   time.Duration
+	MetricsAddr         string
+	FilesAPIThreshold   int
+
+	// responses and error logs older than RetentionMaxAge or beyond the
+	// RetentionMaxPerUser newest ones of a user are pruned, zero keeps them
+	RetentionMaxAge     time.Duration
+	RetentionMaxPerUser int
+	JanitorInterval     time.Duration
+	JanitorCompact      bool
+
+	// BackupDir enables scheduled backups, only the BackupKeep newest ones are kept, zero keeps all
+	BackupDir      string
+	BackupInterval time.Duration
+	BackupKeep     int
+
+	// EncryptionKeys are the base64 master keys, current first, empty to store values in plaintext
+	EncryptionKeys string
 }
 
 func Load() (*Config, error) {
@@ -26,8 +75,13 @@ func Load() (*Config, error) {
 		return nil, ErrMissingEnv("BOT_API_TOKEN")
 	}
 
-	geminiApiKey := os.Getenv("GEMINI_API_KEY")
-	if geminiApiKey == "" {
+	var geminiApiKeys []string
+	for _, key := range strings.Split(os.Getenv("GEMINI_API_KEY"), ",") {
+		if key = strings.TrimSpace(key); key != "" {
+			geminiApiKeys = append(geminiApiKeys, key)
+		}
+	}
+	if len(geminiApiKeys) == 0 {
 		return nil, ErrMissingEnv("GEMINI_API_KEY")
 	}
 
@@ -36,11 +90,86 @@ func Load() (*Config, error) {
 		return nil, ErrMissingEnv("ALLOWED_USERS")
 	}
 
+	storageBackend := os.Getenv("STORAGE_BACKEND")
+	if storageBackend == "" {
+		storageBackend = defaultStorageBackend
+	}
+
 	storagePath := os.Getenv("STORAGE_PATH")
-	if storagePath == "" {
+	if storagePath == "" && storageBackend != memoryStorageBackend {
 		return nil, ErrMissingEnv("STORAGE_PATH")
 	}
 
+	embeddingModel := os.Getenv("EMBEDDING_MODEL")
+	if embeddingModel == "" {
+		embeddingModel = defaultEmbeddingModel
+	}
+
+	geminiMaxConcurrent, err := getEnvInt("GEMINI_MAX_CONCURRENT", defaultGeminiMaxConcurrent)
+	if err != nil {
+		return nil, err
+	}
+
+	geminiRPM, err := getEnvInt("GEMINI_RPM", defaultGeminiRPM)
+	if err != nil {
+		return nil, err
+	}
+
+	geminiTPM, err := getEnvInt("GEMINI_TPM", defaultGeminiTPM)
+	if err != nil {
+		return nil, err
+	}
+
+	geminiKeyCooldown, err := getEnvDuration("GEMINI_KEY_COOLDOWN", defaultGeminiKeyCooldown)
+	if err != nil {
+		return nil, err
+	}
+
+	filesAPIThresholdKB, err := getEnvInt("FILES_API_THRESHOLD_KB", defaultFilesAPIThresholdKB)
+	if err != nil {
+		return nil, err
+	}
+
+	retentionMaxAge, err := getEnvDuration("RETENTION_MAX_AGE", 0)
+	if err != nil {
+		return nil, err
+	}
+
+	retentionMaxPerUser, err := getEnvInt("RETENTION_MAX_PER_USER", 0)
+	if err != nil {
+		return nil, err
+	}
+
+	janitorInterval, err := getEnvDuration("JANITOR_INTERVAL", defaultJanitorInterval)
+	if err != nil || janitorInterval == 0 {
+		return nil, ErrInvalidEnv("JANITOR_INTERVAL")
+	}
+
+	backupInterval, err := getEnvDuration("BACKUP_INTERVAL", defaultBackupInterval)
+	if err != nil || backupInterval == 0 {
+		return nil, ErrInvalidEnv("BACKUP_INTERVAL")
+	}
+
+	backupKeep, err := getEnvInt("BACKUP_KEEP", defaultBackupKeep)
+	if err != nil {
+		return nil, err
+	}
+
+	encryptionKeys, err := LoadEncryptionKeys()
+	if err != nil {
+		return nil, err
+	}
+
+	inlineModel := os.Getenv("INLINE_MODEL")
+	if inlineModel == "" {
+		inlineModel = defaultModel
+	}
+
+	ttsModel := os.Getenv("TTS_MODEL")
+	if ttsModel == "" {
+		ttsModel = defaultTTSModel
+	}
+
 	var debug bool
 	if debugEnv := os.Getenv("TG_BOT_DEBUG"); debugEnv == "true" {
 		debug = true
@@ -55,24 +184,108 @@ func Load() (*Config, error) {
 		allowedUsers[userID] = struct{}{}
 	}
 
+	// admins are always allowed to use the bot
+	adminUsers := make(map[int64]struct{})
+	if adminUsersStr := os.Getenv("ADMIN_USERS"); adminUsersStr != "" {
+		for _, userIDStr := range strings.Split(adminUsersStr, ",") {
+			userID, err := strconv.ParseInt(userIDStr, 10, 64)
+			if err != nil {
+				return nil, ErrInvalidUserID(userIDStr)
+			}
+			adminUsers[userID] = struct{}{}
+			allowedUsers[userID] = struct{}{}
+		}
+	}
+
 	return &Config{
-		BotToken:     botToken,
-		GeminiApiKey: geminiApiKey,
-		AllowedUsers: allowedUsers,
-		StoragePath:  storagePath,
-		DefaultModel: defaultModel,
-		Debug:        debug,
+		BotToken:       botToken,
+		GeminiApiKeys:  geminiApiKeys,
+		AllowedUsers:   allowedUsers,
+		AdminUsers:     adminUsers,
+		StoragePath:    storagePath,
+		StorageBackend: storageBackend,
+		DefaultModel:   defaultModel,
+		EmbeddingModel: embeddingModel,
+		InlineModel:    inlineModel,
+		TTSModel:       ttsModel,
+		Debug:          debug,
+
+		GeminiMaxConcurrent: geminiMaxConcurrent,
+		GeminiRPM:           geminiRPM,
+		GeminiTPM:           geminiTPM,
+		GeminiKeyCooldown:   geminiKeyCooldown,
+		MetricsAddr:         os.Getenv("METRICS_ADDR"),
+		FilesAPIThreshold:   filesAPIThresholdKB * 1024,
+
+		RetentionMaxAge:     retentionMaxAge,
+		RetentionMaxPerUser: retentionMaxPerUser,
+		JanitorInterval:     janitorInterval,
+		JanitorCompact:      os.Getenv("JANITOR_COMPACT") == "true",
+
+		BackupDir:      os.Getenv("BACKUP_DIR"),
+		BackupInterval: backupInterval,
+		BackupKeep:     backupKeep,
+
+		EncryptionKeys: encryptionKeys,
 	}, nil
 }
 
+// LoadEncryptionKeys reads the keys from ENCRYPTION_KEY or the file in ENCRYPTION_KEY_FILE.
+func LoadEncryptionKeys() (string, error) {
+	keyFile := os.Getenv("ENCRYPTION_KEY_FILE")
+	if keyFile == "" {
+		return os.Getenv("ENCRYPTION_KEY"), nil
+	}
+
+	data, err := os.ReadFile(keyFile)
+	if err != nil {
+		return "", fmt.Errorf("failed to read ENCRYPTION_KEY_FILE: %w", err)
+	}
+	return string(data), nil
+}
+
+// getEnvInt reads a non-negative integer, zero disables the corresponding limit.
+func getEnvInt(key string, fallback int) (int, error) {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback, nil
+	}
+
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		return 0, ErrInvalidEnv(key)
+	}
+	return n, nil
+}
+
+// getEnvDuration reads a non-negative duration such as 90m or 720h.
+func getEnvDuration(key string, fallback time.Duration) (time.Duration, error) {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback, nil
+	}
+
+	d, err := time.ParseDuration(value)
+	if err != nil || d < 0 {
+		return 0, ErrInvalidEnv(key)
+	}
+	return d, nil
+}
+
 type ErrMissingEnv string
 
 func (e ErrMissingEnv) Error() string {
 	return fmt.Sprintf("%s environment variable not set", string(e))
 }
 
+type ErrInvalidEnv string
+
+func (e ErrInvalidEnv) Error() string {
+	return fmt.Sprintf("invalid value of %s environment variable", string(e))
+}
+
 type ErrInvalidUserID string
 
 func (e ErrInvalidUserID) Error() string {
-	return fmt.Sprintf("invalid user ID in ALLOWED_USERS: %s", string(e))
+	return fmt.Sprintf("invalid user ID in ALLOWED_USERS or ADMIN_USERS: %s", string(e))
 }
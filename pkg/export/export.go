@@ -0,0 +1,243 @@
+package export
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/vasyvasilie/gemini-chat-tg-bot/pkg/storage"
+)
+
+const (
+	FormatMarkdown string = "md"
+	FormatJSON     string = "json"
+	FormatHTML     string = "html"
+
+	// DocumentVersion identifies the JSON layout, bumped on incompatible changes
+	DocumentVersion int    = 1
+	timeLayout      string = "2006-01-02 15:04"
+	fileNameLength  int    = 40
+)
+
+var (
+	Formats = []string{FormatMarkdown, FormatJSON, FormatHTML}
+
+	ErrUnknownFormat = errors.New("unknown export format")
+
+	fencedCodeRe = regexp.MustCompile("(?s)```([\\w+-]*)\\n?(.*?)```")
+	inlineCodeRe = regexp.MustCompile("`([^`\\n]+)`")
+	boldRe       = regexp.MustCompile(`\*\*([^*\n]+)\*\*`)
+	italicRe     = regexp.MustCompile(`__([^_\n]+)__`)
+	strikeRe     = regexp.MustCompile(`~~([^~\n]+)~~`)
+	fileNameRe   = regexp.MustCompile(`[^\pL\pN]+`)
+	// a rough tokenizer good enough to color most languages without a parser
+	tokenRe = regexp.MustCompile(`(?m)(//.*$|#.*$|/\*(?s:.*?)\*/)|("(?:[^"\\\n]|\\.)*"|'(?:[^'\\\n]|\\.)*')|\b(\d+(?:\.\d+)?)\b|` +
+		`\b(func|def|class|return|if|else|elif|for|while|in|import|from|package|var|let|const|type|struct|interface|` +
+		`switch|case|break|continue|try|catch|except|raise|throw|new|go|defer|async|await|nil|null|None|true|false|True|False)\b`)
+	tokenClasses = []string{"tok-comment", "tok-string", "tok-number", "tok-keyword"}
+)
+
+// Document is the JSON export of a conversation, it can be imported back.
+type Document struct {
+	Version   int
+	Title     string
+	Model     string
+	CreatedAt time.Time
+	UpdatedAt time.Time
+	Messages  []Message
+}
+
+type Message struct {
+	Role        string
+	Text        string
+	Model       string    `json:",omitempty"`
+	Timestamp   time.Time `json:",omitzero"`
+	Attachments []string  `json:",omitempty"`
+}
+
+// Render exports the active branch of the conversation and suggests a file name.
+func Render(format string, conversation *storage.Conversation) ([]byte, string, error) {
+	document := NewDocument(conversation)
+	fileName := fileNameRe.ReplaceAllString(strings.ToLower(document.Title), "-")
+	fileName = strings.Trim(string([]rune(fileName)[:min(len([]rune(fileName)), fileNameLength)]), "-")
+	if fileName == "" {
+		fileName = "conversation"
+	}
+	fileName += "." + format
+
+	switch format {
+	case FormatMarkdown:
+		return renderMarkdown(document), fileName, nil
+	case FormatJSON:
+		data, err := json.MarshalIndent(document, "", "  ")
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to marshal conversation: %w", err)
+		}
+		return data, fileName, nil
+	case FormatHTML:
+		return renderHTML(document), fileName, nil
+	default:
+		return nil, "", ErrUnknownFormat
+	}
+}
+
+func NewDocument(conversation *storage.Conversation) *Document {
+	document := &Document{
+		Version:   DocumentVersion,
+		Title:     conversation.Title,
+		Model:     conversation.Model,
+		CreatedAt: conversation.CreatedAt,
+		UpdatedAt: conversation.UpdatedAt,
+	}
+	if document.Title == "" {
+		document.Title = "Untitled"
+	}
+
+	for _, msg := range conversation.History.Messages {
+		message := Message{Role: msg.Role, Text: msg.Text, Model: msg.Model, Timestamp: msg.Timestamp}
+		for _, attachment := range msg.Attachments {
+			message.Attachments = append(message.Attachments, attachment.Name)
+		}
+		document.Messages = append(document.Messages, message)
+	}
+
+	return document
+}
+
+func renderMarkdown(document *Document) []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "# %s\n\n", document.Title)
+	fmt.Fprintf(&buf, "- Model: `%s`\n- Created: %s\n- Updated: %s\n",
+		document.Model, document.CreatedAt.Format(timeLayout), document.UpdatedAt.Format(timeLayout))
+
+	for _, message := range document.Messages {
+		fmt.Fprintf(&buf, "\n## %s\n\n", heading(message))
+		for _, name := range message.Attachments {
+			fmt.Fprintf(&buf, "📎 `%s`\n\n", name)
+		}
+		buf.WriteString(strings.TrimSpace(message.Text))
+		buf.WriteString("\n")
+	}
+
+	return buf.Bytes()
+}
+
+func renderHTML(document *Document) []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "<!DOCTYPE html>\n<html lang=\"en\">\n<head>\n<meta charset=\"utf-8\">\n"+
+		"<meta name=\"viewport\" content=\"width=device-width, initial-scale=1\">\n<title>%s</title>\n<style>%s</style>\n</head>\n<body>\n",
+		html.EscapeString(document.Title), stylesheet)
+	fmt.Fprintf(&buf, "<h1>%s</h1>\n<p class=\"meta\">Model <code>%s</code> · created %s · updated %s</p>\n",
+		html.EscapeString(document.Title), html.EscapeString(document.Model),
+		document.CreatedAt.Format(timeLayout), document.UpdatedAt.Format(timeLayout))
+
+	for _, message := range document.Messages {
+		fmt.Fprintf(&buf, "<section class=\"message %s\">\n<h2>%s</h2>\n",
+			html.EscapeString(message.Role), html.EscapeString(heading(message)))
+		for _, name := range message.Attachments {
+			fmt.Fprintf(&buf, "<p class=\"attachment\">📎 %s</p>\n", html.EscapeString(name))
+		}
+		buf.WriteString(markdownToHTML(message.Text))
+		buf.WriteString("</section>\n")
+	}
+
+	buf.WriteString("</body>\n</html>\n")
+	return buf.Bytes()
+}
+
+// markdownToHTML converts the markup Gemini uses: fenced code, inline code, bold, italic and strikethrough.
+func markdownToHTML(text string) string {
+	var sb strings.Builder
+	last := 0
+	for _, match := range fencedCodeRe.FindAllStringSubmatchIndex(text, -1) {
+		sb.WriteString(paragraphsToHTML(text[last:match[0]]))
+
+		language := text[match[2]:match[3]]
+		class := ""
+		if language != "" {
+			class = fmt.Sprintf(" class=\"language-%s\"", html.EscapeString(language))
+		}
+		fmt.Fprintf(&sb, "<pre><code%s>%s</code></pre>\n", class,
+			highlight(strings.TrimRight(text[match[4]:match[5]], "\n")))
+		last = match[1]
+	}
+	sb.WriteString(paragraphsToHTML(text[last:]))
+
+	return sb.String()
+}
+
+// highlight escapes the code and wraps comments, strings, numbers and keywords in styled spans.
+func highlight(code string) string {
+	var sb strings.Builder
+	last := 0
+	for _, match := range tokenRe.FindAllStringSubmatchIndex(code, -1) {
+		sb.WriteString(html.EscapeString(code[last:match[0]]))
+		for group, class := range tokenClasses {
+			if start := match[2+group*2]; start != -1 {
+				fmt.Fprintf(&sb, "<span class=\"%s\">%s</span>", class, html.EscapeString(code[start:match[3+group*2]]))
+				break
+			}
+		}
+		last = match[1]
+	}
+	sb.WriteString(html.EscapeString(code[last:]))
+
+	return sb.String()
+}
+
+func paragraphsToHTML(text string) string {
+	var sb strings.Builder
+	for _, paragraph := range strings.Split(text, "\n\n") {
+		paragraph = strings.TrimSpace(paragraph)
+		if paragraph == "" {
+			continue
+		}
+
+		paragraph = html.EscapeString(paragraph)
+		paragraph = inlineCodeRe.ReplaceAllString(paragraph, "<code>$1</code>")
+		paragraph = boldRe.ReplaceAllString(paragraph, "<strong>$1</strong>")
+		paragraph = italicRe.ReplaceAllString(paragraph, "<em>$1</em>")
+		paragraph = strikeRe.ReplaceAllString(paragraph, "<del>$1</del>")
+		paragraph = strings.ReplaceAll(paragraph, "\n", "<br>\n")
+		fmt.Fprintf(&sb, "<p>%s</p>\n", paragraph)
+	}
+	return sb.String()
+}
+
+func heading(message Message) string {
+	title := "👤 User"
+	if message.Role != "user" {
+		title = "🤖 Gemini"
+		if message.Model != "" {
+			title = fmt.Sprintf("🤖 %s", strings.TrimPrefix(message.Model, "models/"))
+		}
+	}
+	if !message.Timestamp.IsZero() {
+		title = fmt.Sprintf("%s · %s", title, message.Timestamp.Format(timeLayout))
+	}
+	return title
+}
+
+const stylesheet = `
+body { max-width: 860px; margin: 2rem auto; padding: 0 1rem; font: 16px/1.6 -apple-system, "Segoe UI", Roboto, sans-serif; color: #1f2328; }
+h1 { margin-bottom: 0.25rem; }
+h2 { font-size: 0.95rem; color: #59636e; margin: 0 0 0.5rem; }
+.meta { color: #59636e; margin-top: 0; }
+.message { border-left: 4px solid #d1d9e0; padding: 0.5rem 1rem; margin: 1.5rem 0; }
+.message.user { border-color: #0969da; background: #f6f8fa; }
+.message.model { border-color: #8250df; }
+.attachment { color: #59636e; font-style: italic; }
+code { font: 0.9em ui-monospace, SFMono-Regular, Menlo, Consolas, monospace; background: #eff1f3; padding: 0.1em 0.3em; border-radius: 4px; }
+pre { background: #0d1117; color: #e6edf3; padding: 1rem; border-radius: 6px; overflow-x: auto; line-height: 1.45; }
+pre code { background: none; padding: 0; color: inherit; }
+.tok-comment { color: #8b949e; font-style: italic; }
+.tok-string { color: #a5d6ff; }
+.tok-number { color: #79c0ff; }
+.tok-keyword { color: #ff7b72; }
+pre code[class*="language-"]::before { content: attr(class); display: block; color: #7d8590; font-size: 0.8em; margin-bottom: 0.5rem; }
+`
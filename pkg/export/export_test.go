@@ -0,0 +1,156 @@
+package export
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/vasyvasilie/gemini-chat-tg-bot/pkg/storage"
+)
+
+func testConversation() *storage.Conversation {
+	created := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	return &storage.Conversation{
+		Title:     "Go <script>alert(1)</script> & maps",
+		Model:     "models/gemini-pro",
+		CreatedAt: created,
+		UpdatedAt: created.Add(time.Hour),
+		History: storage.ConversationHistory{Messages: []storage.Message{
+			{Role: "user", Text: "How do I <b>loop</b>?\n", Timestamp: created,
+				Attachments: []storage.Attachment{{Name: `"><img src=x onerror=alert(1)>.go`, Data: []byte("data")}}},
+			{Role: "model", Text: "Use **for**:\n```go\nfor i := 0; i < 3; i++ {}\n```", Model: "models/gemini-pro", Timestamp: created.Add(time.Minute)},
+		}},
+	}
+}
+
+func TestRenderMarkdown(t *testing.T) {
+	data, fileName, err := Render(FormatMarkdown, testConversation())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fileName != "go-script-alert-1-script-maps.md" {
+		t.Errorf("got file name %q", fileName)
+	}
+
+	want := "# Go <script>alert(1)</script> & maps\n\n" +
+		"- Model: `models/gemini-pro`\n- Created: 2024-05-01 10:00\n- Updated: 2024-05-01 11:00\n" +
+		"\n## 👤 User · 2024-05-01 10:00\n\n" +
+		"📎 `\"><img src=x onerror=alert(1)>.go`\n\n" +
+		"How do I <b>loop</b>?\n" +
+		"\n## 🤖 gemini-pro · 2024-05-01 10:01\n\n" +
+		"Use **for**:\n```go\nfor i := 0; i < 3; i++ {}\n```\n"
+	if string(data) != want {
+		t.Errorf("got\n%s\nwant\n%s", data, want)
+	}
+}
+
+func TestRenderJSON(t *testing.T) {
+	data, fileName, err := Render(FormatJSON, testConversation())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(fileName, ".json") {
+		t.Errorf("got file name %q", fileName)
+	}
+	if strings.Contains(string(data), "ZGF0YQ") {
+		t.Error("attachment data was exported")
+	}
+
+	var document Document
+	if err := json.Unmarshal(data, &document); err != nil {
+		t.Fatal(err)
+	}
+	conversation := testConversation()
+	if document.Version != DocumentVersion || document.Title != conversation.Title || document.Model != conversation.Model ||
+		!document.CreatedAt.Equal(conversation.CreatedAt) || len(document.Messages) != 2 {
+		t.Fatalf("got document %+v", document)
+	}
+	if message := document.Messages[0]; message.Text != conversation.History.Messages[0].Text ||
+		len(message.Attachments) != 1 || message.Attachments[0] != conversation.History.Messages[0].Attachments[0].Name {
+		t.Errorf("got message %+v, want the text and the attachment name", message)
+	}
+}
+
+func TestRenderHTML(t *testing.T) {
+	data, fileName, err := Render(FormatHTML, testConversation())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(fileName, ".html") {
+		t.Errorf("got file name %q", fileName)
+	}
+
+	page := string(data)
+	for _, want := range []string{
+		"<title>Go &lt;script&gt;alert(1)&lt;/script&gt; &amp; maps</title>",
+		"<h1>Go &lt;script&gt;alert(1)&lt;/script&gt; &amp; maps</h1>",
+		"<p class=\"attachment\">📎 &#34;&gt;&lt;img src=x onerror=alert(1)&gt;.go</p>",
+		"<p>How do I &lt;b&gt;loop&lt;/b&gt;?</p>",
+		"<section class=\"message model\">\n<h2>🤖 gemini-pro · 2024-05-01 10:01</h2>",
+		"<p>Use <strong>for</strong>:</p>",
+		"<pre><code class=\"language-go\">",
+	} {
+		if !strings.Contains(page, want) {
+			t.Errorf("page does not contain %q:\n%s", want, page)
+		}
+	}
+	for _, injected := range []string{"<script>", "<img", "<b>"} {
+		if strings.Contains(page, injected) {
+			t.Errorf("page contains unescaped %q", injected)
+		}
+	}
+}
+
+func TestRenderUnknownFormat(t *testing.T) {
+	if _, _, err := Render("pdf", testConversation()); !errors.Is(err, ErrUnknownFormat) {
+		t.Errorf("got %v, want %v", err, ErrUnknownFormat)
+	}
+}
+
+func TestRenderUntitled(t *testing.T) {
+	data, fileName, err := Render(FormatMarkdown, &storage.Conversation{Title: "🎉"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fileName != "conversation.md" || !strings.HasPrefix(string(data), "# 🎉\n") {
+		t.Errorf("got %q for %q", fileName, data)
+	}
+	if _, fileName, _ = Render(FormatMarkdown, &storage.Conversation{}); fileName != "untitled.md" {
+		t.Errorf("got file name %q for a conversation without title", fileName)
+	}
+}
+
+func TestMarkdownToHTML(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		text string
+		want string
+	}{
+		{"paragraphs", "one\ntwo\n\nthree", "<p>one<br>\ntwo</p>\n<p>three</p>\n"},
+		{"inline markup", "**bold** __italic__ ~~gone~~ `code`",
+			"<p><strong>bold</strong> <em>italic</em> <del>gone</del> <code>code</code></p>\n"},
+		{"html in text", `<script>alert("x")</script> & <a href="javascript:x">link</a>`,
+			"<p>&lt;script&gt;alert(&#34;x&#34;)&lt;/script&gt; &amp; &lt;a href=&#34;javascript:x&#34;&gt;link&lt;/a&gt;</p>\n"},
+		{"html in inline code", "`<img src=x onerror=alert(1)>`", "<p><code>&lt;img src=x onerror=alert(1)&gt;</code></p>\n"},
+		{"html in bold", "**<b onmouseover=x>**", "<p><strong>&lt;b onmouseover=x&gt;</strong></p>\n"},
+		{"fenced code", "before\n```python\n# note\nx = \"s\" + 1\n```\nafter",
+			"<p>before</p>\n<pre><code class=\"language-python\"><span class=\"tok-comment\"># note</span>\n" +
+				"x = <span class=\"tok-string\">&#34;s&#34;</span> + <span class=\"tok-number\">1</span></code></pre>\n<p>after</p>\n"},
+		{"html in fenced code", "```\n</code></pre><script>x()</script>\n```",
+			"<pre><code>&lt;/code&gt;&lt;/pre&gt;&lt;script&gt;x()&lt;/script&gt;</code></pre>\n"},
+		{"html after code language", "```x\"><script>\ncode\n```",
+			"<pre><code class=\"language-x\">&#34;&gt;&lt;script&gt;\ncode</code></pre>\n"},
+		{"keywords", "```go\nreturn nil\n```",
+			"<pre><code class=\"language-go\"><span class=\"tok-keyword\">return</span> <span class=\"tok-keyword\">nil</span></code></pre>\n"},
+		{"unclosed fence", "```go\nfunc", "<p>```go<br>\nfunc</p>\n"},
+		{"empty", "", ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := markdownToHTML(tc.text); got != tc.want {
+				t.Errorf("got %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
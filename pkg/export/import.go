@@ -0,0 +1,310 @@
+package export
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	roleUser  string = "user"
+	roleModel string = "model"
+
+	takeoutPromptPrefix string = "Prompted "
+	takeoutTitle        string = "Gemini import"
+)
+
+var (
+	ErrUnknownImport = errors.New("unknown conversation file format")
+	ErrEmptyImport   = errors.New("no messages found in the conversation file")
+
+	htmlBreakRe = regexp.MustCompile(`(?i)<br\s*/?>|</p>|</li>|</h\d>|</pre>`)
+	htmlTagRe   = regexp.MustCompile(`<[^>]*>`)
+)
+
+// chatGPTConversation is an entry of conversations.json from a ChatGPT data export.
+type chatGPTConversation struct {
+	Title       string                 `json:"title"`
+	CreateTime  float64                `json:"create_time"`
+	UpdateTime  float64                `json:"update_time"`
+	CurrentNode string                 `json:"current_node"`
+	Mapping     map[string]chatGPTNode `json:"mapping"`
+}
+
+type chatGPTNode struct {
+	Parent  string `json:"parent"`
+	Message *struct {
+		Author struct {
+			Role string `json:"role"`
+		} `json:"author"`
+		CreateTime float64 `json:"create_time"`
+		Content    struct {
+			ContentType string            `json:"content_type"`
+			Parts       []json.RawMessage `json:"parts"`
+			Text        string            `json:"text"`
+		} `json:"content"`
+	} `json:"message"`
+}
+
+// takeoutActivity is an entry of MyActivity.json from a Google Takeout export of Gemini Apps.
+type takeoutActivity struct {
+	Header        string    `json:"header"`
+	Title         string    `json:"title"`
+	Time          time.Time `json:"time"`
+	AttachedFiles []string  `json:"attachedFiles"`
+	SafeHTMLItem  []struct {
+		HTML string `json:"html"`
+	} `json:"safeHtmlItem"`
+}
+
+// Import parses a conversation file: our JSON export, a ChatGPT conversations.json
+// or a Google Takeout Gemini activity file. Content that cannot be carried over is
+// replaced with a text placeholder.
+func Import(data []byte) ([]*Document, error) {
+	data = bytes.TrimSpace(data)
+	if len(data) == 0 {
+		return nil, ErrEmptyImport
+	}
+
+	var documents []*Document
+	var err error
+	switch data[0] {
+	case '{':
+		documents, err = importObject(data)
+	case '[':
+		documents, err = importArray(data)
+	default:
+		return nil, ErrUnknownImport
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var imported []*Document
+	for _, document := range documents {
+		if len(document.Messages) > 0 {
+			imported = append(imported, document)
+		}
+	}
+	if len(imported) == 0 {
+		return nil, ErrEmptyImport
+	}
+
+	return imported, nil
+}
+
+func importObject(data []byte) ([]*Document, error) {
+	var probe struct {
+		Version  int
+		Messages json.RawMessage
+		Mapping  json.RawMessage `json:"mapping"`
+	}
+	if err := json.Unmarshal(data, &probe); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrUnknownImport, err)
+	}
+
+	switch {
+	case probe.Version > 0 && probe.Messages != nil:
+		if probe.Version > DocumentVersion {
+			return nil, fmt.Errorf("%w: export version %d is newer than supported", ErrUnknownImport, probe.Version)
+		}
+		document := &Document{}
+		if err := json.Unmarshal(data, document); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrUnknownImport, err)
+		}
+		for i := range document.Messages {
+			document.Messages[i] = normalizeMessage(document.Messages[i])
+		}
+		return []*Document{document}, nil
+	case probe.Mapping != nil:
+		var conversation chatGPTConversation
+		if err := json.Unmarshal(data, &conversation); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrUnknownImport, err)
+		}
+		return []*Document{importChatGPT(conversation)}, nil
+	default:
+		return nil, ErrUnknownImport
+	}
+}
+
+func importArray(data []byte) ([]*Document, error) {
+	var probe []struct {
+		Mapping json.RawMessage `json:"mapping"`
+		Header  string          `json:"header"`
+	}
+	if err := json.Unmarshal(data, &probe); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrUnknownImport, err)
+	}
+	if len(probe) == 0 {
+		return nil, ErrEmptyImport
+	}
+
+	switch {
+	case probe[0].Mapping != nil:
+		var conversations []chatGPTConversation
+		if err := json.Unmarshal(data, &conversations); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrUnknownImport, err)
+		}
+		documents := make([]*Document, 0, len(conversations))
+		for _, conversation := range conversations {
+			documents = append(documents, importChatGPT(conversation))
+		}
+		return documents, nil
+	case probe[0].Header != "":
+		var activities []takeoutActivity
+		if err := json.Unmarshal(data, &activities); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrUnknownImport, err)
+		}
+		return []*Document{importTakeout(activities)}, nil
+	default:
+		return nil, ErrUnknownImport
+	}
+}
+
+// importChatGPT follows the active branch from the current node back to the root.
+func importChatGPT(conversation chatGPTConversation) *Document {
+	document := &Document{
+		Version:   DocumentVersion,
+		Title:     conversation.Title,
+		CreatedAt: unixTime(conversation.CreateTime),
+		UpdatedAt: unixTime(conversation.UpdateTime),
+	}
+
+	visited := make(map[string]bool)
+	for id := conversation.CurrentNode; id != "" && !visited[id]; id = conversation.Mapping[id].Parent {
+		visited[id] = true
+		message := conversation.Mapping[id].Message
+		if message == nil {
+			continue
+		}
+
+		var role string
+		switch message.Author.Role {
+		case "user":
+			role = roleUser
+		case "assistant":
+			role = roleModel
+		default:
+			// system prompts and tool calls have no counterpart in Gemini history
+			continue
+		}
+
+		text := chatGPTText(message.Content.ContentType, message.Content.Parts, message.Content.Text)
+		if strings.TrimSpace(text) == "" {
+			continue
+		}
+		document.Messages = append(document.Messages, Message{
+			Role:      role,
+			Text:      text,
+			Timestamp: unixTime(message.CreateTime),
+		})
+	}
+
+	// collected from the leaf up
+	for i, j := 0, len(document.Messages)-1; i < j; i, j = i+1, j-1 {
+		document.Messages[i], document.Messages[j] = document.Messages[j], document.Messages[i]
+	}
+
+	return document
+}
+
+func chatGPTText(contentType string, parts []json.RawMessage, text string) string {
+	switch contentType {
+	case "text", "multimodal_text":
+		var texts []string
+		for _, part := range parts {
+			var s string
+			if err := json.Unmarshal(part, &s); err == nil {
+				texts = append(texts, s)
+				continue
+			}
+
+			var object struct {
+				ContentType string `json:"content_type"`
+			}
+			_ = json.Unmarshal(part, &object)
+			texts = append(texts, placeholder(object.ContentType))
+		}
+		return strings.Join(texts, "\n")
+	case "code":
+		return fmt.Sprintf("```\n%s\n```", text)
+	default:
+		return placeholder(contentType)
+	}
+}
+
+// importTakeout joins the prompts and answers of the activity log into one conversation.
+func importTakeout(activities []takeoutActivity) *Document {
+	sort.Slice(activities, func(i, j int) bool {
+		return activities[i].Time.Before(activities[j].Time)
+	})
+
+	document := &Document{Version: DocumentVersion, Title: takeoutTitle}
+	for _, activity := range activities {
+		if !strings.HasPrefix(activity.Title, takeoutPromptPrefix) {
+			continue
+		}
+
+		prompt := strings.TrimPrefix(activity.Title, takeoutPromptPrefix)
+		for _, name := range activity.AttachedFiles {
+			prompt += "\n" + placeholder("file "+name)
+		}
+		document.Messages = append(document.Messages, Message{Role: roleUser, Text: prompt, Timestamp: activity.Time})
+
+		var answer []string
+		for _, item := range activity.SafeHTMLItem {
+			answer = append(answer, htmlToText(item.HTML))
+		}
+		if len(answer) > 0 {
+			document.Messages = append(document.Messages, Message{
+				Role:      roleModel,
+				Text:      strings.Join(answer, "\n\n"),
+				Timestamp: activity.Time,
+			})
+		}
+
+		if document.CreatedAt.IsZero() {
+			document.CreatedAt = activity.Time
+		}
+		document.UpdatedAt = activity.Time
+	}
+
+	return document
+}
+
+func normalizeMessage(message Message) Message {
+	if message.Role != roleUser {
+		message.Role = roleModel
+	}
+	for _, name := range message.Attachments {
+		message.Text += "\n" + placeholder("file "+name)
+	}
+	message.Attachments = nil
+	return message
+}
+
+func htmlToText(s string) string {
+	s = htmlBreakRe.ReplaceAllString(s, "\n")
+	s = htmlTagRe.ReplaceAllString(s, "")
+	return strings.TrimSpace(html.UnescapeString(s))
+}
+
+func placeholder(kind string) string {
+	if kind == "" {
+		kind = "content"
+	}
+	return fmt.Sprintf("[%s not imported]", strings.ReplaceAll(kind, "_", " "))
+}
+
+func unixTime(seconds float64) time.Time {
+	if seconds == 0 {
+		return time.Time{}
+	}
+	return time.Unix(int64(seconds), int64((seconds-float64(int64(seconds)))*1e9))
+}
@@ -0,0 +1,176 @@
+package export
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/vasyvasilie/gemini-chat-tg-bot/pkg/storage"
+)
+
+const chatGPTConversationJSON = `{
+	"title": "Branches",
+	"create_time": 1700000000.5,
+	"update_time": 1700000100,
+	"current_node": "answer2",
+	"mapping": {
+		"root": {"parent": "", "message": null},
+		"system": {"parent": "root", "message": {"author": {"role": "system"}, "content": {"content_type": "text", "parts": ["be nice"]}}},
+		"prompt": {"parent": "system", "message": {"author": {"role": "user"}, "create_time": 1700000001,
+			"content": {"content_type": "multimodal_text", "parts": [{"content_type": "image_asset_pointer"}, "what is this?"]}}},
+		"answer1": {"parent": "prompt", "message": {"author": {"role": "assistant"}, "content": {"content_type": "text", "parts": ["old answer"]}}},
+		"answer2": {"parent": "code", "message": {"author": {"role": "assistant"}, "create_time": 1700000003,
+			"content": {"content_type": "text", "parts": ["a cat"]}}},
+		"code": {"parent": "prompt", "message": {"author": {"role": "assistant"}, "create_time": 1700000002,
+			"content": {"content_type": "code", "text": "print(1)"}}}
+	}
+}`
+
+const takeoutJSON = `[
+	{"header": "Gemini Apps", "title": "Prompted second", "time": "2024-05-01T10:05:00Z",
+		"safeHtmlItem": [{"html": "<p>line one</p><p>line&nbsp;two &amp; <b>more</b></p>"}]},
+	{"header": "Gemini Apps", "title": "Used an extension", "time": "2024-05-01T10:03:00Z"},
+	{"header": "Gemini Apps", "title": "Prompted first", "time": "2024-05-01T10:00:00Z",
+		"attachedFiles": ["photo.png"], "safeHtmlItem": [{"html": "answer<br/>with a break"}]},
+	{"header": "Gemini Apps", "title": "Prompted unanswered", "time": "2024-05-01T10:10:00Z"}
+]`
+
+func TestImport(t *testing.T) {
+	created := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	exported, _, err := Render(FormatJSON, &storage.Conversation{
+		Title:     "Exported",
+		Model:     "models/gemini",
+		CreatedAt: created,
+		UpdatedAt: created,
+		History: storage.ConversationHistory{Messages: []storage.Message{
+			{Role: "user", Text: "hi", Timestamp: created, Attachments: []storage.Attachment{{Name: "a.txt"}}},
+			{Role: "model", Text: "hello", Model: "models/gemini", Timestamp: created},
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name  string
+		data  string
+		title []string
+		want  [][]Message
+	}{
+		{
+			name:  "own export",
+			data:  string(exported),
+			title: []string{"Exported"},
+			want: [][]Message{{
+				{Role: roleUser, Text: "hi\n[file a.txt not imported]", Timestamp: created},
+				{Role: roleModel, Text: "hello", Model: "models/gemini", Timestamp: created},
+			}},
+		},
+		{
+			name:  "own export with unknown roles",
+			data:  `{"Version": 1, "Title": "Roles", "Messages": [{"Role": "user", "Text": "q"}, {"Role": "assistant", "Text": "a"}]}`,
+			title: []string{"Roles"},
+			want:  [][]Message{{{Role: roleUser, Text: "q"}, {Role: roleModel, Text: "a"}}},
+		},
+		{
+			name:  "chatgpt conversation",
+			data:  chatGPTConversationJSON,
+			title: []string{"Branches"},
+			want: [][]Message{{
+				{Role: roleUser, Text: "[image asset pointer not imported]\nwhat is this?", Timestamp: time.Unix(1700000001, 0)},
+				{Role: roleModel, Text: "```\nprint(1)\n```", Timestamp: time.Unix(1700000002, 0)},
+				{Role: roleModel, Text: "a cat", Timestamp: time.Unix(1700000003, 0)},
+			}},
+		},
+		{
+			name: "chatgpt export without empty conversations",
+			data: `[
+				{"title": "Only system", "current_node": "s", "mapping": {"s": {"message": {"author": {"role": "system"}, "content": {"content_type": "text", "parts": ["x"]}}}}},
+				{"title": "Audio", "current_node": "a", "mapping": {"a": {"message": {"author": {"role": "user"}, "content": {"content_type": "audio_transcription"}}}}},
+				{"title": "Cycle", "current_node": "b", "mapping": {
+					"a": {"parent": "b", "message": {"author": {"role": "user"}, "content": {"content_type": "text", "parts": ["q"]}}},
+					"b": {"parent": "a", "message": {"author": {"role": "assistant"}, "content": {"content_type": "text", "parts": ["a"]}}}
+				}}
+			]`,
+			title: []string{"Audio", "Cycle"},
+			want: [][]Message{
+				{{Role: roleUser, Text: "[audio transcription not imported]"}},
+				{{Role: roleUser, Text: "q"}, {Role: roleModel, Text: "a"}},
+			},
+		},
+		{
+			name:  "takeout activity",
+			data:  takeoutJSON,
+			title: []string{takeoutTitle},
+			want: [][]Message{{
+				{Role: roleUser, Text: "first\n[file photo.png not imported]", Timestamp: created},
+				{Role: roleModel, Text: "answer\nwith a break", Timestamp: created},
+				{Role: roleUser, Text: "second", Timestamp: created.Add(5 * time.Minute)},
+				{Role: roleModel, Text: "line one\nline\u00a0two & more", Timestamp: created.Add(5 * time.Minute)},
+				{Role: roleUser, Text: "unanswered", Timestamp: created.Add(10 * time.Minute)},
+			}},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			documents, err := Import([]byte(tc.data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(documents) != len(tc.want) {
+				t.Fatalf("got %d documents, want %d", len(documents), len(tc.want))
+			}
+			for i, document := range documents {
+				if document.Title != tc.title[i] {
+					t.Errorf("got title %q, want %q", document.Title, tc.title[i])
+				}
+				if !equalMessages(document.Messages, tc.want[i]) {
+					t.Errorf("got messages %+v, want %+v", document.Messages, tc.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestImportMalformed(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		data string
+		want error
+	}{
+		{"empty", "", ErrEmptyImport},
+		{"blank", " \n\t", ErrEmptyImport},
+		{"plain text", "hello", ErrUnknownImport},
+		{"truncated object", `{"Version": 1, "Messages": [`, ErrUnknownImport},
+		{"truncated array", `[{"mapping": {}`, ErrUnknownImport},
+		{"unknown object", `{"foo": "bar"}`, ErrUnknownImport},
+		{"unknown array", `[{"foo": "bar"}]`, ErrUnknownImport},
+		{"array of numbers", `[1, 2]`, ErrUnknownImport},
+		{"empty array", `[]`, ErrEmptyImport},
+		{"newer export", `{"Version": 99, "Messages": []}`, ErrUnknownImport},
+		{"export with bad messages", `{"Version": 1, "Messages": "hi"}`, ErrUnknownImport},
+		{"export without messages", `{"Version": 1, "Messages": []}`, ErrEmptyImport},
+		{"chatgpt with bad mapping", `{"mapping": []}`, ErrUnknownImport},
+		{"chatgpt with missing node", `{"current_node": "x", "mapping": {}}`, ErrEmptyImport},
+		{"takeout without prompts", `[{"header": "Gemini Apps", "title": "Used an extension"}]`, ErrEmptyImport},
+		{"takeout with bad time", `[{"header": "Gemini Apps", "title": "Prompted hi", "time": "yesterday"}]`, ErrUnknownImport},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if documents, err := Import([]byte(tc.data)); !errors.Is(err, tc.want) {
+				t.Errorf("got %v, %v, want %v", documents, err, tc.want)
+			}
+		})
+	}
+}
+
+func equalMessages(got, want []Message) bool {
+	if len(got) != len(want) {
+		return false
+	}
+	for i := range got {
+		if got[i].Role != want[i].Role || got[i].Text != want[i].Text || got[i].Model != want[i].Model ||
+			!got[i].Timestamp.Equal(want[i].Timestamp) || len(got[i].Attachments) != len(want[i].Attachments) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,103 @@
+package gemini
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"google.golang.org/genai"
+)
+
+var (
+	fileUploadTimeout  = 5 * time.Minute
+	fileStatusInterval = 2 * time.Second
+	ErrFileProcessing  = errors.New("gemini api error: file processing failed")
+)
+
+// UploadedFile is a file stored by the Files API, ready to be referenced in requests.
+type UploadedFile struct {
+	Name      string
+	URI       string
+	MIMEType  string
+	SizeBytes int64
+	// KeyID is the key the file belongs to, only this key can read it.
+	KeyID     string
+	ExpiresAt time.Time
+}
+
+// UploadFile uploads data through the Files API and waits until the file is processed.
+func (c *Client) UploadFile(ctx context.Context, data []byte, mimeType, displayName string) (*UploadedFile, error) {
+	ctxWithTimeout, cancel := context.WithTimeout(ctx, fileUploadTimeout)
+	defer cancel()
+
+	var file *genai.File
+	var keyID string
+	err := c.keys.do(func(key *apiKey) error {
+		var err error
+		file, err = key.ai.Files.Upload(ctxWithTimeout, bytes.NewReader(data), &genai.UploadFileConfig{
+			MIMEType:    mimeType,
+			DisplayName: displayName,
+		})
+		keyID = key.id
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("cannot upload file: %w", err)
+	}
+
+	for file.State != genai.FileStateActive {
+		if file.State == genai.FileStateFailed {
+			if file.Error != nil {
+				return nil, fmt.Errorf("%w: %s", ErrFileProcessing, file.Error.Message)
+			}
+			return nil, ErrFileProcessing
+		}
+
+		select {
+		case <-ctxWithTimeout.Done():
+			return nil, fmt.Errorf("cannot upload file: %w", ctxWithTimeout.Err())
+		case <-time.After(fileStatusInterval):
+		}
+
+		name := file.Name
+		err = c.keys.doWith(keyID, func(key *apiKey) error {
+			var err error
+			file, err = key.ai.Files.Get(ctxWithTimeout, name, nil)
+			return err
+		})
+		if err != nil {
+			return nil, fmt.Errorf("cannot get file status: %w", err)
+		}
+	}
+
+	uploaded := &UploadedFile{
+		Name:      file.Name,
+		URI:       file.URI,
+		MIMEType:  file.MIMEType,
+		KeyID:     keyID,
+		ExpiresAt: file.ExpirationTime,
+	}
+	if file.SizeBytes != nil {
+		uploaded.SizeBytes = *file.SizeBytes
+	}
+
+	return uploaded, nil
+}
+
+// DeleteFile removes an uploaded file with the key it belongs to.
+func (c *Client) DeleteFile(ctx context.Context, keyID, name string) error {
+	ctxWithTimeout, cancel := context.WithTimeout(ctx, requestTimeout)
+	defer cancel()
+
+	err := c.keys.doWith(keyID, func(key *apiKey) error {
+		_, err := key.ai.Files.Delete(ctxWithTimeout, name, nil)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("cannot delete file: %w", err)
+	}
+
+	return nil
+}
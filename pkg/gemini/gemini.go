@@ -4,13 +4,15 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"slices"
+	"strings"
 	"time"
 
-	"google.golang.org/api/googleapi"
 	"google.golang.org/api/iterator"
 	"google.golang.org/genai"
 
 	"github.com/vasyvasilie/gemini-chat-tg-bot/pkg/config"
+	"github.com/vasyvasilie/gemini-chat-tg-bot/pkg/limiter"
 	"github.com/vasyvasilie/gemini-chat-tg-bot/pkg/storage"
 )
 
@@ -18,101 +20,359 @@ const (
 	ModelPrefix string = "models/"
 	RoleUser    string = "user"
 	RoleModel   string = "model"
+
+	TaskTypeRetrievalDocument string = "RETRIEVAL_DOCUMENT"
+	TaskTypeRetrievalQuery    string = "RETRIEVAL_QUERY"
+
+	PartText       string = "text"
+	PartCode       string = "code"
+	PartCodeResult string = "code_result"
+	PartImage      string = "image"
+)
+
+const (
+	// rough averages for estimating request size before the api reports usage
+	charsPerToken       int = 4
+	tokensPerAttachment int = 1000
 )
 
 var (
 	requestTimeout            = 30 * time.Second
 	GeminiTooManyRequestError = errors.New("gemini api error: 429 Too Many Requests")
 	GeminiEmptyAnswer         = errors.New("gemini api error: empty answer")
+	ErrUnknownKey             = errors.New("api key of the uploaded file is not configured")
 )
 
 type Client struct {
 	config  *config.Config
-	ai      *genai.Client
-	storage *storage.Storage
+	keys    *keyPool
+	storage storage.Store
+	limiter *limiter.Limiter
 }
 
-func NewClient(ctx context.Context, config *config.Config, storage *storage.Storage) (*Client, error) {
-	ai, err := genai.NewClient(ctx, &genai.ClientConfig{
-		APIKey:  config.GeminiApiKey,
-		Backend: genai.BackendGeminiAPI,
-	})
+type Request struct {
+	UserID  int64
+	Model   string
+	History []storage.Message
+	Prompt  string
+	// Attachments are sent together with the prompt.
+	Attachments []storage.Attachment
+	// CodeExecution lets the model run the code it writes.
+	CodeExecution bool
+	// MaxOutputTokens limits the answer length, zero keeps the model default.
+	MaxOutputTokens int32
+	// OnQueue is called with the number of requests ahead while the request waits for a free slot.
+	OnQueue func(position int)
+}
+
+// Response is the model answer. Text holds the whole answer as markdown,
+// Parts keep it split by kind for richer rendering.
+type Response struct {
+	Text  string
+	Parts []ResponsePart
+}
+
+type ResponsePart struct {
+	Kind string
+	// Text is the text, the code or the output of the code depending on Kind
+	Text     string
+	Language string
+	Outcome  string
+	MIMEType string
+	Data     []byte
+}
+
+// Rich reports whether the answer has parts other than text.
+func (r *Response) Rich() bool {
+	for _, part := range r.Parts {
+		if part.Kind != PartText {
+			return true
+		}
+	}
+	return false
+}
+
+func NewClient(ctx context.Context, config *config.Config, storage storage.Store) (*Client, error) {
+	keys, err := newKeyPool(ctx, config.GeminiApiKeys, config.GeminiKeyCooldown)
 	if err != nil {
-		return nil, fmt.Errorf("cannot create new gemini client: %w", err)
+		return nil, err
 	}
 
 	return &Client{
 		config:  config,
-		ai:      ai,
+		keys:    keys,
 		storage: storage,
+		limiter: limiter.New(limiter.Config{
+			MaxConcurrent:     config.GeminiMaxConcurrent,
+			RequestsPerMinute: config.GeminiRPM,
+			TokensPerMinute:   config.GeminiTPM,
+		}),
 	}, nil
 }
 
-func (c *Client) GenerateContent(ctx context.Context, history storage.ConversationHistory, model, prompt string) (string, error) {
-	requestContent := prepareRequest(history.Messages, prompt)
+func (c *Client) QueueStats() limiter.Stats {
+	return c.limiter.Stats()
+}
+
+func (c *Client) KeyStats() []KeyStats {
+	return c.keys.stats()
+}
+
+// GenerateContent streams the answer. When ctx is canceled midway the partial
+// answer is returned together with context.Canceled.
+func (c *Client) GenerateContent(ctx context.Context, req Request) (*Response, error) {
+	prompt := storage.Message{Role: RoleUser, Text: req.Prompt, Attachments: req.Attachments}
+	requestContent, keyID := c.prepareRequest(req.UserID, append(slices.Clone(req.History), prompt))
+
+	permit, err := c.limiter.Acquire(ctx, req.UserID, estimateTokens(req.History, prompt), req.OnQueue)
+	if err != nil {
+		return nil, err
+	}
 
 	ctxWithTimeout, cancel := context.WithTimeout(ctx, requestTimeout)
 	defer cancel()
 
-	resp, err := c.ai.Models.GenerateContent(ctxWithTimeout, model, requestContent, nil)
+	generateConfig := &genai.GenerateContentConfig{MaxOutputTokens: req.MaxOutputTokens}
+	if req.CodeExecution {
+		generateConfig.Tools = []*genai.Tool{{CodeExecution: &genai.ToolCodeExecution{}}}
+	}
+
+	var parts []*genai.Part
+	var usedTokens int
+	err = c.keys.doWith(keyID, func(key *apiKey) error {
+		parts, usedTokens = nil, 0
+		for chunk, err := range key.ai.Models.GenerateContentStream(ctxWithTimeout, req.Model, requestContent, generateConfig) {
+			if err != nil {
+				return err
+			}
+			if chunk.UsageMetadata != nil {
+				usedTokens = int(chunk.UsageMetadata.TotalTokenCount)
+			}
+			for _, cand := range chunk.Candidates {
+				if cand.Content != nil {
+					parts = append(parts, cand.Content.Parts...)
+				}
+			}
+		}
+		return nil
+	})
+	permit.Release(usedTokens)
+
+	response := parseResponse(&genai.GenerateContentResponse{
+		Candidates: []*genai.Candidate{{Content: &genai.Content{Parts: parts}}},
+	})
 	if err != nil {
-		if googleErr, ok := err.(*googleapi.Error); ok && googleErr.Code == 429 {
-			return "", GeminiTooManyRequestError
+		if errors.Is(ctx.Err(), context.Canceled) {
+			return response, context.Canceled
+		}
+		if errors.Is(err, GeminiTooManyRequestError) || isQuotaError(err) {
+			return nil, GeminiTooManyRequestError
 		}
 
-		return "", fmt.Errorf("gemini api error: %w", err)
+		return nil, fmt.Errorf("gemini api error: %w", err)
 	}
 
-	var responseText string
+	if len(response.Text) == 0 && len(response.Parts) == 0 {
+		return nil, GeminiEmptyAnswer
+	}
+
+	return response, nil
+}
+
+func parseResponse(resp *genai.GenerateContentResponse) *Response {
+	response := &Response{}
+	var sb strings.Builder
 	for _, cand := range resp.Candidates {
-		if cand.Content != nil {
-			for _, part := range cand.Content.Parts {
-				responseText += part.Text
-			}
+		if cand.Content == nil {
+			continue
 		}
-	}
 
-	if len(responseText) == 0 {
-		return "", GeminiEmptyAnswer
+		for _, part := range cand.Content.Parts {
+			switch {
+			case part.ExecutableCode != nil:
+				language := strings.ToLower(string(part.ExecutableCode.Language))
+				response.Parts = append(response.Parts, ResponsePart{
+					Kind:     PartCode,
+					Text:     part.ExecutableCode.Code,
+					Language: language,
+				})
+				sb.WriteString(fmt.Sprintf("\n```%s\n%s\n```\n", language, strings.TrimSpace(part.ExecutableCode.Code)))
+			case part.CodeExecutionResult != nil:
+				response.Parts = append(response.Parts, ResponsePart{
+					Kind:    PartCodeResult,
+					Text:    part.CodeExecutionResult.Output,
+					Outcome: string(part.CodeExecutionResult.Outcome),
+				})
+				sb.WriteString(fmt.Sprintf("\n```\n%s\n```\n", strings.TrimSpace(part.CodeExecutionResult.Output)))
+			case part.InlineData != nil && strings.HasPrefix(part.InlineData.MIMEType, "image/"):
+				response.Parts = append(response.Parts, ResponsePart{
+					Kind:     PartImage,
+					MIMEType: part.InlineData.MIMEType,
+					Data:     part.InlineData.Data,
+				})
+			case part.Text != "" && !part.Thought:
+				// merge consecutive text parts of a streamed answer
+				if n := len(response.Parts); n > 0 && response.Parts[n-1].Kind == PartText {
+					response.Parts[n-1].Text += part.Text
+				} else {
+					response.Parts = append(response.Parts, ResponsePart{Kind: PartText, Text: part.Text})
+				}
+				sb.WriteString(part.Text)
+			}
+		}
 	}
 
-	return responseText, nil
+	response.Text = strings.TrimSpace(sb.String())
+	return response
 }
 
-func (c *Client) ListModels(ctx context.Context) ([]string, error) {
+// ListModels lists the models of the api, the request counts against the limits like any other of the user.
+func (c *Client) ListModels(ctx context.Context, userID int64) ([]string, error) {
+	permit, err := c.limiter.Acquire(ctx, userID, 0, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer permit.Release(0)
+
 	var models []string
-	for m, err := range c.ai.Models.All(ctx) {
-		if err == iterator.Done {
-			break
-		}
-		if err != nil {
-			return nil, fmt.Errorf("cannot list models: %w", err)
+	err = c.keys.do(func(key *apiKey) error {
+		models = nil
+		for m, err := range key.ai.Models.All(ctx) {
+			if err == iterator.Done {
+				break
+			}
+			if err != nil {
+				return err
+			}
+			models = append(models, m.Name)
 		}
-		models = append(models, m.Name)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("cannot list models: %w", err)
 	}
 
 	return models, nil
 }
 
-func prepareRequest(history []storage.Message, prompt string) []*genai.Content {
+// EmbedTexts returns a vector per text, the request waits for the limiter like the chat requests of the user.
+func (c *Client) EmbedTexts(ctx context.Context, userID int64, taskType string, texts []string) ([][]float32, error) {
+	contents := make([]*genai.Content, 0, len(texts))
+	tokens := 1
+	for _, text := range texts {
+		contents = append(contents, &genai.Content{
+			Parts: []*genai.Part{{Text: text}},
+			Role:  RoleUser,
+		})
+		tokens += len(text) / charsPerToken
+	}
+
+	permit, err := c.limiter.Acquire(ctx, userID, tokens, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer permit.Release(0)
+
+	ctxWithTimeout, cancel := context.WithTimeout(ctx, requestTimeout)
+	defer cancel()
+
+	var resp *genai.EmbedContentResponse
+	err = c.keys.do(func(key *apiKey) error {
+		var err error
+		resp, err = key.ai.Models.EmbedContent(ctxWithTimeout, c.config.EmbeddingModel, contents,
+			&genai.EmbedContentConfig{TaskType: taskType})
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("gemini api error: %w", err)
+	}
+
+	if len(resp.Embeddings) != len(texts) {
+		return nil, fmt.Errorf("gemini api error: got %d embeddings for %d texts", len(resp.Embeddings), len(texts))
+	}
+
+	vectors := make([][]float32, 0, len(resp.Embeddings))
+	for _, embedding := range resp.Embeddings {
+		vectors = append(vectors, embedding.Values)
+	}
+
+	return vectors, nil
+}
+
+func estimateTokens(history []storage.Message, prompt storage.Message) int {
+	var tokens int
+	for _, msg := range append(slices.Clone(history), prompt) {
+		tokens += len(msg.Text)/charsPerToken + len(msg.Attachments)*tokensPerAttachment
+	}
+	return tokens + 1
+}
+
+// prepareRequest converts the messages to genai contents. Uploaded files can only be read
+// with the key they were uploaded with, so the key of the latest file is returned and files
+// of other keys, deleted or expired files are replaced with a note.
+func (c *Client) prepareRequest(userID int64, messages []storage.Message) ([]*genai.Content, string) {
+	type filePart struct {
+		part  *genai.Part
+		name  string
+		keyID string
+	}
+
+	var keyID string
+	var files []filePart
 	content := []*genai.Content{}
+	now := time.Now()
 
-	for _, msg := range history {
+	for _, msg := range messages {
 		role := RoleUser
 		if msg.Role == RoleModel {
 			role = RoleModel
 		}
 
+		var parts []*genai.Part
+		for _, attachment := range msg.Attachments {
+			if attachment.FileName == "" {
+				if len(attachment.Data) == 0 {
+					// inline data is not kept in the history
+					parts = append(parts, &genai.Part{Text: unavailableFileNote(attachment.Name)})
+					continue
+				}
+				parts = append(parts, genai.NewPartFromBytes(attachment.Data, attachment.MIMEType))
+				continue
+			}
+
+			part := &genai.Part{}
+			parts = append(parts, part)
+
+			file, err := c.storage.GetRemoteFile(userID, attachment.FileName)
+			if err != nil || now.After(file.ExpiresAt) {
+				part.Text = unavailableFileNote(attachment.Name)
+				continue
+			}
+
+			part.FileData = &genai.FileData{FileURI: file.URI, MIMEType: file.MIMEType}
+			files = append(files, filePart{part: part, name: attachment.Name, keyID: file.KeyID})
+			keyID = file.KeyID
+		}
+
+		if msg.Text != "" || len(parts) == 0 {
+			parts = append(parts, &genai.Part{Text: msg.Text})
+		}
+
 		content = append(content, &genai.Content{
-			Parts: []*genai.Part{{Text: msg.Text}},
+			Parts: parts,
 			Role:  role,
 		})
 	}
 
-	content = append(content, &genai.Content{
-		Parts: []*genai.Part{{Text: prompt}},
-		Role:  RoleUser,
-	})
+	for _, file := range files {
+		if file.keyID != keyID {
+			*file.part = genai.Part{Text: unavailableFileNote(file.name)}
+		}
+	}
+
+	return content, keyID
+}
 
-	return content
+func unavailableFileNote(name string) string {
+	return fmt.Sprintf("[file %q is no longer available]", name)
 }
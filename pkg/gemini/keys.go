@@ -0,0 +1,205 @@
+package gemini
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"google.golang.org/api/googleapi"
+	"google.golang.org/genai"
+)
+
+const (
+	statusResourceExhausted string = "RESOURCE_EXHAUSTED"
+	maskedKeyLength         int    = 4
+	keyIDLength             int    = 8
+)
+
+type apiKey struct {
+	// id is a stable fingerprint of the key, safe to persist
+	id   string
+	name string
+	ai   *genai.Client
+
+	requests      uint64
+	errors        uint64
+	rateLimited   uint64
+	lastError     string
+	cooldownUntil time.Time
+}
+
+// KeyStats describes the usage and health of a single API key.
+type KeyStats struct {
+	Name        string
+	Requests    uint64
+	Errors      uint64
+	RateLimited uint64
+	LastError   string
+	Cooldown    time.Duration
+}
+
+// keyPool hands out the least used key that is not cooling down after a quota error.
+type keyPool struct {
+	mu       sync.Mutex
+	keys     []*apiKey
+	cooldown time.Duration
+	// rotates the starting point so equally used keys are taken in turn
+	next int
+}
+
+func newKeyPool(ctx context.Context, keys []string, cooldown time.Duration) (*keyPool, error) {
+	pool := &keyPool{cooldown: cooldown}
+	for _, key := range keys {
+		ai, err := genai.NewClient(ctx, &genai.ClientConfig{
+			APIKey:  key,
+			Backend: genai.BackendGeminiAPI,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("cannot create new gemini client: %w", err)
+		}
+
+		sum := sha256.Sum256([]byte(key))
+		pool.keys = append(pool.keys, &apiKey{
+			id:   hex.EncodeToString(sum[:])[:keyIDLength],
+			name: maskKey(key),
+			ai:   ai,
+		})
+	}
+
+	return pool, nil
+}
+
+// do runs fn with an available key and retries with the next key when the
+// current one hits a rate limit or quota error.
+func (p *keyPool) do(fn func(key *apiKey) error) error {
+	tried := make(map[*apiKey]bool)
+	for {
+		key := p.pick(tried)
+		if key == nil {
+			return GeminiTooManyRequestError
+		}
+
+		err := fn(key)
+		p.report(key, err)
+		if err == nil || !isQuotaError(err) {
+			return err
+		}
+		tried[key] = true
+	}
+}
+
+// doWith runs fn with the key of the given id, which is needed for requests
+// that reference uploaded files. An empty id lets the pool pick any key.
+func (p *keyPool) doWith(keyID string, fn func(key *apiKey) error) error {
+	if keyID == "" {
+		return p.do(fn)
+	}
+
+	p.mu.Lock()
+	var key *apiKey
+	for _, k := range p.keys {
+		if k.id == keyID {
+			key = k
+			break
+		}
+	}
+	if key == nil {
+		p.mu.Unlock()
+		return ErrUnknownKey
+	}
+	if time.Now().Before(key.cooldownUntil) {
+		p.mu.Unlock()
+		return GeminiTooManyRequestError
+	}
+	key.requests++
+	p.mu.Unlock()
+
+	err := fn(key)
+	p.report(key, err)
+	return err
+}
+
+func (p *keyPool) pick(exclude map[*apiKey]bool) *apiKey {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	var best *apiKey
+	for i := range p.keys {
+		key := p.keys[(p.next+i)%len(p.keys)]
+		if exclude[key] || now.Before(key.cooldownUntil) {
+			continue
+		}
+		if best == nil || key.requests < best.requests {
+			best = key
+		}
+	}
+	p.next = (p.next + 1) % len(p.keys)
+
+	if best != nil {
+		best.requests++
+	}
+	return best
+}
+
+func (p *keyPool) report(key *apiKey, err error) {
+	if err == nil || errors.Is(err, context.Canceled) {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	key.errors++
+	key.lastError = err.Error()
+	if isQuotaError(err) {
+		key.rateLimited++
+		key.cooldownUntil = time.Now().Add(p.cooldown)
+	}
+}
+
+func (p *keyPool) stats() []KeyStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	stats := make([]KeyStats, 0, len(p.keys))
+	for _, key := range p.keys {
+		stats = append(stats, KeyStats{
+			Name:        key.name,
+			Requests:    key.requests,
+			Errors:      key.errors,
+			RateLimited: key.rateLimited,
+			LastError:   key.lastError,
+			Cooldown:    max(key.cooldownUntil.Sub(now), 0).Round(time.Second),
+		})
+	}
+
+	return stats
+}
+
+func isQuotaError(err error) bool {
+	var apiErr genai.APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.Code == http.StatusTooManyRequests || apiErr.Status == statusResourceExhausted
+	}
+
+	var googleErr *googleapi.Error
+	if errors.As(err, &googleErr) {
+		return googleErr.Code == http.StatusTooManyRequests
+	}
+
+	return false
+}
+
+func maskKey(key string) string {
+	if len(key) <= maskedKeyLength {
+		return "…"
+	}
+	return "…" + key[len(key)-maskedKeyLength:]
+}
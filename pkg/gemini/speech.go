@@ -0,0 +1,101 @@
+package gemini
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"google.golang.org/genai"
+)
+
+const (
+	DefaultVoice string = "Kore"
+
+	modalityAudio string = "AUDIO"
+)
+
+// Voices are the prebuilt voices of Gemini text-to-speech models.
+var Voices = []string{
+	"Zephyr", "Puck", "Charon", "Kore", "Fenrir", "Leda",
+	"Orus", "Aoede", "Callirrhoe", "Autonoe", "Enceladus", "Iapetus",
+	"Umbriel", "Algieba", "Despina", "Erinome", "Algenib", "Rasalgethi",
+	"Laomedeia", "Achernar", "Alnilam", "Schedar", "Gacrux", "Pulcherrima",
+	"Achird", "Zubenelgenubi", "Vindemiatrix", "Sadachbia", "Sadaltager", "Sulafat",
+}
+
+type SpeechRequest struct {
+	UserID int64
+	Text   string
+	Voice  string
+	// Language is a hint such as en-US, the model detects the language when empty.
+	Language string
+}
+
+type Audio struct {
+	Data     []byte
+	MIMEType string
+}
+
+// Synthesize reads the text aloud with the configured text-to-speech model.
+func (c *Client) Synthesize(ctx context.Context, req SpeechRequest) (*Audio, error) {
+	prompt := req.Text
+	if req.Language != "" {
+		prompt = fmt.Sprintf("Read aloud in %s:\n%s", req.Language, req.Text)
+	}
+
+	permit, err := c.limiter.Acquire(ctx, req.UserID, len(prompt)/charsPerToken+1, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	ctxWithTimeout, cancel := context.WithTimeout(ctx, requestTimeout)
+	defer cancel()
+
+	generateConfig := &genai.GenerateContentConfig{
+		ResponseModalities: []string{modalityAudio},
+		SpeechConfig: &genai.SpeechConfig{
+			VoiceConfig: &genai.VoiceConfig{
+				PrebuiltVoiceConfig: &genai.PrebuiltVoiceConfig{VoiceName: req.Voice},
+			},
+		},
+	}
+	content := []*genai.Content{{Parts: []*genai.Part{{Text: prompt}}, Role: RoleUser}}
+
+	var resp *genai.GenerateContentResponse
+	err = c.keys.do(func(key *apiKey) error {
+		resp, err = key.ai.Models.GenerateContent(ctxWithTimeout, c.config.TTSModel, content, generateConfig)
+		return err
+	})
+	if err != nil {
+		permit.Release(0)
+		if isQuotaError(err) {
+			return nil, GeminiTooManyRequestError
+		}
+		return nil, fmt.Errorf("gemini api error: %w", err)
+	}
+
+	var usedTokens int
+	if resp.UsageMetadata != nil {
+		usedTokens = int(resp.UsageMetadata.TotalTokenCount)
+	}
+	permit.Release(usedTokens)
+
+	audio := &Audio{}
+	for _, cand := range resp.Candidates {
+		if cand.Content == nil {
+			continue
+		}
+		for _, part := range cand.Content.Parts {
+			if part.InlineData != nil && strings.HasPrefix(part.InlineData.MIMEType, "audio/") {
+				audio.Data = append(audio.Data, part.InlineData.Data...)
+				audio.MIMEType = part.InlineData.MIMEType
+			}
+		}
+	}
+
+	if len(audio.Data) == 0 {
+		return nil, GeminiEmptyAnswer
+	}
+
+	return audio, nil
+}
@@ -0,0 +1,320 @@
+package limiter
+
+import (
+	"context"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	window time.Duration = time.Minute
+)
+
+// Config holds the limits, zero value of a field disables that limit.
+type Config struct {
+	MaxConcurrent     int
+	RequestsPerMinute int
+	TokensPerMinute   int
+}
+
+// Stats is a snapshot of the limiter state for monitoring.
+type Stats struct {
+	QueueDepth    int
+	Active        int
+	Admitted      uint64
+	LastWaitMs    int64
+	AverageWaitMs int64
+	MaxWaitMs     int64
+}
+
+// Limiter admits requests under concurrency, request and token rate limits.
+// Waiting requests are served round-robin across users, so a burst of one
+// user cannot starve the others.
+type Limiter struct {
+	config Config
+	clock  clock
+
+	mu       sync.Mutex
+	active   int
+	requests []time.Time
+	tokens   []*tokenUsage
+	queues   map[int64][]*waiter
+	// users with waiting requests in round-robin order, next is served first
+	users []int64
+	next  int
+	timer timer
+
+	admitted  uint64
+	totalWait time.Duration
+	lastWait  time.Duration
+	maxWait   time.Duration
+}
+
+// clock is the time source of the limiter, tests replace it to move time by hand.
+type clock interface {
+	Now() time.Time
+	AfterFunc(d time.Duration, f func()) timer
+}
+
+type timer interface {
+	Stop() bool
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) AfterFunc(d time.Duration, f func()) timer {
+	return time.AfterFunc(d, f)
+}
+
+type tokenUsage struct {
+	at     time.Time
+	tokens int
+}
+
+type waiter struct {
+	userID    int64
+	tokens    int
+	enqueued  time.Time
+	ready     chan struct{}
+	positions chan int
+	position  int
+	usage     *tokenUsage
+}
+
+// Permit is held while the request is running.
+type Permit struct {
+	limiter *Limiter
+	usage   *tokenUsage
+	once    sync.Once
+}
+
+func New(config Config) *Limiter {
+	return &Limiter{
+		config: config,
+		clock:  realClock{},
+		queues: make(map[int64][]*waiter),
+	}
+}
+
+// Acquire blocks until the request of the user estimated at tokens may run.
+// While waiting, notify is called with the number of requests ahead whenever it changes.
+func (l *Limiter) Acquire(ctx context.Context, userID int64, tokens int, notify func(position int)) (*Permit, error) {
+	w := &waiter{
+		userID:    userID,
+		tokens:    tokens,
+		enqueued:  l.clock.Now(),
+		ready:     make(chan struct{}),
+		positions: make(chan int, 1),
+		position:  -1,
+	}
+
+	l.mu.Lock()
+	l.queues[userID] = append(l.queues[userID], w)
+	if len(l.queues[userID]) == 1 {
+		l.users = append(l.users, userID)
+	}
+	l.dispatch()
+	l.mu.Unlock()
+
+	for {
+		select {
+		case <-w.ready:
+			return &Permit{limiter: l, usage: w.usage}, nil
+		case position := <-w.positions:
+			if notify != nil {
+				notify(position)
+			}
+		case <-ctx.Done():
+			l.mu.Lock()
+			select {
+			case <-w.ready:
+				// admitted concurrently, give the slot back
+				l.mu.Unlock()
+				(&Permit{limiter: l, usage: w.usage}).Release(0)
+			default:
+				l.remove(w)
+				l.dispatch()
+				l.mu.Unlock()
+			}
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// Release frees the slot and replaces the token estimate with the actual usage,
+// a non-positive value keeps the estimate.
+func (p *Permit) Release(usedTokens int) {
+	p.once.Do(func() {
+		l := p.limiter
+		l.mu.Lock()
+		defer l.mu.Unlock()
+
+		l.active--
+		if usedTokens > 0 {
+			p.usage.tokens = usedTokens
+		}
+		l.dispatch()
+	})
+}
+
+func (l *Limiter) Stats() Stats {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	stats := Stats{
+		Active:     l.active,
+		Admitted:   l.admitted,
+		LastWaitMs: l.lastWait.Milliseconds(),
+		MaxWaitMs:  l.maxWait.Milliseconds(),
+	}
+	for _, queue := range l.queues {
+		stats.QueueDepth += len(queue)
+	}
+	if l.admitted > 0 {
+		stats.AverageWaitMs = (l.totalWait / time.Duration(l.admitted)).Milliseconds()
+	}
+
+	return stats
+}
+
+// dispatch admits waiting requests while limits allow it. Must be called with mu held.
+func (l *Limiter) dispatch() {
+	now := l.clock.Now()
+	l.expire(now)
+
+	for len(l.users) > 0 {
+		if l.next >= len(l.users) {
+			l.next = 0
+		}
+		userID := l.users[l.next]
+		w := l.queues[userID][0]
+
+		if wait := l.blockedFor(w, now); wait != 0 {
+			if wait > 0 {
+				l.schedule(wait)
+			}
+			break
+		}
+
+		l.remove(w)
+		if _, ok := l.queues[userID]; ok {
+			l.next++
+		}
+		l.active++
+		l.requests = append(l.requests, now)
+		w.usage = &tokenUsage{at: now, tokens: w.tokens}
+		l.tokens = append(l.tokens, w.usage)
+
+		wait := now.Sub(w.enqueued)
+		l.admitted++
+		l.totalWait += wait
+		l.lastWait = wait
+		l.maxWait = max(l.maxWait, wait)
+		close(w.ready)
+	}
+
+	l.notifyPositions()
+}
+
+// blockedFor returns 0 when the waiter can run now, a positive duration after which
+// a rate limit frees up, or a negative value when only a release can unblock it.
+func (l *Limiter) blockedFor(w *waiter, now time.Time) time.Duration {
+	if l.config.MaxConcurrent > 0 && l.active >= l.config.MaxConcurrent {
+		return -1
+	}
+
+	if l.config.RequestsPerMinute > 0 && len(l.requests) >= l.config.RequestsPerMinute {
+		return max(l.requests[0].Add(window).Sub(now), time.Millisecond)
+	}
+
+	if l.config.TokensPerMinute > 0 && len(l.tokens) > 0 {
+		var used int
+		for _, usage := range l.tokens {
+			used += usage.tokens
+		}
+		if used+w.tokens > l.config.TokensPerMinute {
+			return max(l.tokens[0].at.Add(window).Sub(now), time.Millisecond)
+		}
+	}
+
+	return 0
+}
+
+func (l *Limiter) expire(now time.Time) {
+	cutoff := now.Add(-window)
+	for len(l.requests) > 0 && l.requests[0].Before(cutoff) {
+		l.requests = l.requests[1:]
+	}
+
+	for len(l.tokens) > 0 && l.tokens[0].at.Before(cutoff) {
+		l.tokens = l.tokens[1:]
+	}
+}
+
+func (l *Limiter) schedule(wait time.Duration) {
+	if l.timer != nil {
+		l.timer.Stop()
+	}
+	l.timer = l.clock.AfterFunc(wait, func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		l.dispatch()
+	})
+}
+
+// remove drops the waiter from its user queue. Must be called with mu held.
+func (l *Limiter) remove(w *waiter) {
+	queue := l.queues[w.userID]
+	idx := slices.Index(queue, w)
+	if idx == -1 {
+		return
+	}
+
+	queue = slices.Delete(queue, idx, idx+1)
+	if len(queue) > 0 {
+		l.queues[w.userID] = queue
+		return
+	}
+
+	delete(l.queues, w.userID)
+	userIdx := slices.Index(l.users, w.userID)
+	l.users = slices.Delete(l.users, userIdx, userIdx+1)
+	if userIdx < l.next {
+		l.next--
+	}
+}
+
+// notifyPositions sends the round-robin position to every waiter whose position changed.
+func (l *Limiter) notifyPositions() {
+	position := 0
+	for round := 0; ; round++ {
+		found := false
+		for i := range l.users {
+			userID := l.users[(l.next+i)%len(l.users)]
+			queue := l.queues[userID]
+			if round >= len(queue) {
+				continue
+			}
+			found = true
+
+			w := queue[round]
+			if w.position != position {
+				w.position = position
+				select {
+				case <-w.positions:
+				default:
+				}
+				w.positions <- position
+			}
+			position++
+		}
+		if !found {
+			return
+		}
+	}
+}
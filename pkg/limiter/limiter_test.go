@@ -0,0 +1,287 @@
+package limiter
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+// waitTimeout bounds how long a test waits for a goroutine, the limiter itself never sleeps on the fake clock
+const waitTimeout time.Duration = 5 * time.Second
+
+type fakeClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []*fakeTimer
+}
+
+type fakeTimer struct {
+	clock   *fakeClock
+	at      time.Time
+	f       func()
+	stopped bool
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) AfterFunc(d time.Duration, f func()) timer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := &fakeTimer{clock: c, at: c.now.Add(d), f: f}
+	c.timers = append(c.timers, t)
+	return t
+}
+
+func (t *fakeTimer) Stop() bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	stopped := t.stopped
+	t.stopped = true
+	return !stopped
+}
+
+// Advance moves the time forward and runs the timers that are due, including the ones they start.
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	c.now = c.now.Add(d)
+	c.mu.Unlock()
+
+	for {
+		c.mu.Lock()
+		idx := slices.IndexFunc(c.timers, func(t *fakeTimer) bool { return !t.stopped && !t.at.After(c.now) })
+		if idx == -1 {
+			c.mu.Unlock()
+			return
+		}
+		t := c.timers[idx]
+		t.stopped = true
+		c.timers = slices.Delete(c.timers, idx, idx+1)
+		c.mu.Unlock()
+
+		t.f()
+	}
+}
+
+func newTestLimiter(config Config) (*Limiter, *fakeClock) {
+	clock := newFakeClock()
+	l := New(config)
+	l.clock = clock
+	return l, clock
+}
+
+type acquired struct {
+	name   string
+	permit *Permit
+	err    error
+}
+
+// acquireAsync queues a request and waits until the limiter has either admitted or queued it.
+func acquireAsync(t *testing.T, l *Limiter, name string, userID int64, tokens int, notify func(int), results chan<- acquired) {
+	t.Helper()
+
+	before := l.Stats()
+	go func() {
+		permit, err := l.Acquire(context.Background(), userID, tokens, notify)
+		results <- acquired{name: name, permit: permit, err: err}
+	}()
+	waitFor(t, func() bool {
+		stats := l.Stats()
+		return stats.QueueDepth > before.QueueDepth || stats.Admitted > before.Admitted
+	})
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(waitTimeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for the limiter")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func receive(t *testing.T, results <-chan acquired) acquired {
+	t.Helper()
+
+	select {
+	case result := <-results:
+		if result.err != nil {
+			t.Fatalf("%s: %v", result.name, result.err)
+		}
+		return result
+	case <-time.After(waitTimeout):
+		t.Fatal("timed out waiting for a permit")
+		return acquired{}
+	}
+}
+
+func expectBlocked(t *testing.T, results <-chan acquired) {
+	t.Helper()
+
+	select {
+	case result := <-results:
+		t.Fatalf("%s was admitted, want it to wait", result.name)
+	default:
+	}
+}
+
+func TestFairOrder(t *testing.T) {
+	l, _ := newTestLimiter(Config{MaxConcurrent: 1})
+	results := make(chan acquired, 4)
+
+	acquireAsync(t, l, "running", 1, 0, nil, results)
+	running := receive(t, results)
+
+	// the second request of user 1 waits behind the first request of user 2
+	acquireAsync(t, l, "1a", 1, 0, nil, results)
+	acquireAsync(t, l, "1b", 1, 0, nil, results)
+	acquireAsync(t, l, "2a", 2, 0, nil, results)
+	expectBlocked(t, results)
+
+	var order []string
+	running.permit.Release(0)
+	for range 3 {
+		result := receive(t, results)
+		order = append(order, result.name)
+		expectBlocked(t, results)
+		result.permit.Release(0)
+	}
+	if want := []string{"1a", "2a", "1b"}; !slices.Equal(order, want) {
+		t.Errorf("got order %v, want %v", order, want)
+	}
+	if stats := l.Stats(); stats.Active != 0 || stats.QueueDepth != 0 || stats.Admitted != 4 {
+		t.Errorf("got stats %+v, want 4 admitted and nothing left", stats)
+	}
+}
+
+func TestQueuePositions(t *testing.T) {
+	l, _ := newTestLimiter(Config{MaxConcurrent: 1})
+	results := make(chan acquired, 4)
+
+	var mu sync.Mutex
+	positions := make(map[string]int)
+	notify := func(name string) func(int) {
+		return func(position int) {
+			mu.Lock()
+			defer mu.Unlock()
+			positions[name] = position
+		}
+	}
+	expect := func(want map[string]int) {
+		t.Helper()
+		waitFor(t, func() bool {
+			mu.Lock()
+			defer mu.Unlock()
+			for name, position := range want {
+				if got, ok := positions[name]; !ok || got != position {
+					return false
+				}
+			}
+			return true
+		})
+	}
+
+	acquireAsync(t, l, "running", 1, 0, nil, results)
+	running := receive(t, results)
+
+	acquireAsync(t, l, "1a", 1, 0, notify("1a"), results)
+	acquireAsync(t, l, "1b", 1, 0, notify("1b"), results)
+	expect(map[string]int{"1a": 0, "1b": 1})
+
+	// a new user takes the place after the first request of user 1
+	acquireAsync(t, l, "2a", 2, 0, notify("2a"), results)
+	expect(map[string]int{"1a": 0, "2a": 1, "1b": 2})
+
+	running.permit.Release(0)
+	first := receive(t, results)
+	if first.name != "1a" {
+		t.Fatalf("got %s first, want 1a", first.name)
+	}
+	expect(map[string]int{"2a": 0, "1b": 1})
+	first.permit.Release(0)
+	receive(t, results).permit.Release(0)
+	receive(t, results).permit.Release(0)
+}
+
+func TestCancelWhileWaiting(t *testing.T) {
+	l, _ := newTestLimiter(Config{MaxConcurrent: 1})
+	results := make(chan acquired, 1)
+
+	acquireAsync(t, l, "running", 1, 0, nil, results)
+	running := receive(t, results)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		_, err := l.Acquire(ctx, 2, 0, nil)
+		done <- err
+	}()
+	waitFor(t, func() bool { return l.Stats().QueueDepth == 1 })
+	cancel()
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Fatalf("got %v, want %v", err, context.Canceled)
+	}
+	if stats := l.Stats(); stats.QueueDepth != 0 {
+		t.Errorf("got %d waiting after cancel, want 0", stats.QueueDepth)
+	}
+	running.permit.Release(0)
+	if stats := l.Stats(); stats.Active != 0 || stats.Admitted != 1 {
+		t.Errorf("got stats %+v, want the canceled request never admitted", stats)
+	}
+}
+
+func TestRequestsPerMinute(t *testing.T) {
+	l, clock := newTestLimiter(Config{RequestsPerMinute: 2})
+	results := make(chan acquired, 3)
+
+	for _, name := range []string{"first", "second"} {
+		acquireAsync(t, l, name, 1, 0, nil, results)
+		receive(t, results).permit.Release(0)
+	}
+	clock.Advance(30 * time.Second)
+	acquireAsync(t, l, "third", 1, 0, nil, results)
+	expectBlocked(t, results)
+
+	// the first two requests leave the window a minute after they were admitted
+	clock.Advance(29 * time.Second)
+	expectBlocked(t, results)
+	clock.Advance(time.Second + time.Millisecond)
+	receive(t, results).permit.Release(0)
+
+	if stats := l.Stats(); stats.LastWaitMs != (30*time.Second + time.Millisecond).Milliseconds() {
+		t.Errorf("got last wait %dms, want the 30s the third request waited", stats.LastWaitMs)
+	}
+}
+
+func TestTokensPerMinute(t *testing.T) {
+	l, clock := newTestLimiter(Config{TokensPerMinute: 100})
+	results := make(chan acquired, 3)
+
+	// the usage reported on release replaces the estimate
+	acquireAsync(t, l, "estimated", 1, 60, nil, results)
+	receive(t, results).permit.Release(30)
+	acquireAsync(t, l, "fits", 2, 60, nil, results)
+	fits := receive(t, results)
+
+	acquireAsync(t, l, "over", 1, 20, nil, results)
+	expectBlocked(t, results)
+	// releasing without usage keeps the estimate of 60
+	fits.permit.Release(0)
+	expectBlocked(t, results)
+
+	clock.Advance(time.Minute + time.Millisecond)
+	receive(t, results).permit.Release(0)
+}
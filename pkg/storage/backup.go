@@ -0,0 +1,222 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+var ErrInvalidSnapshot = errors.New("invalid snapshot")
+
+// checker is implemented by the engines that can verify the integrity of their file.
+type checker interface {
+	Check() error
+}
+
+type RestoreReport struct {
+	Version int
+	Records int
+	// Previous is where the replaced database was moved, empty if there was none
+	Previous string
+}
+
+// Backup writes a gzip compressed snapshot of the database to w while the bot keeps running.
+func (s *Storage) Backup(w io.Writer) error {
+	if s.db.Path() == "" {
+		return errNoSnapshot
+	}
+
+	snapshot, err := os.CreateTemp(filepath.Dir(s.db.Path()), filepath.Base(s.db.Path())+".snapshot-*")
+	if err != nil {
+		return fmt.Errorf("failed to create snapshot file: %w", err)
+	}
+	snapshot.Close()
+	defer os.Remove(snapshot.Name())
+
+	if err := s.db.Snapshot(snapshot.Name()); err != nil {
+		return fmt.Errorf("failed to take snapshot: %w", err)
+	}
+
+	f, err := os.Open(snapshot.Name())
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	gz := gzip.NewWriter(w)
+	if _, err := io.Copy(gz, f); err != nil {
+		return fmt.Errorf("failed to compress snapshot: %w", err)
+	}
+	return gz.Close()
+}
+
+// Restore replaces the database at path with a snapshot taken by Backup or a plain copy of the database.
+// The snapshot is checked first, so a broken one never replaces the data. The bot must be stopped.
+func Restore(backend, snapshot, path string, keyring *Keyring) (*RestoreReport, error) {
+	if backend == BackendMemory {
+		return nil, errNoSnapshot
+	}
+
+	staging := path + ".restore"
+	if err := unpackSnapshot(snapshot, staging); err != nil {
+		os.Remove(staging)
+		return nil, err
+	}
+
+	report, err := checkSnapshot(backend, staging, keyring)
+	if err != nil {
+		removeDatabase(staging)
+		return nil, fmt.Errorf("%w: %v", ErrInvalidSnapshot, err)
+	}
+
+	if _, err := os.Stat(path); err == nil {
+		if err := ensureClosed(backend, path); err != nil {
+			removeDatabase(staging)
+			return nil, err
+		}
+
+		report.Previous = fmt.Sprintf("%s.pre-restore-%s.bak", path, time.Now().Format(backupTimeLayout))
+		if _, err := os.Stat(report.Previous); err == nil {
+			removeDatabase(staging)
+			return nil, fmt.Errorf("%s already exists, try again in a second", report.Previous)
+		}
+		if err := moveDatabase(path, report.Previous); err != nil {
+			removeDatabase(staging)
+			return nil, fmt.Errorf("failed to move current database aside: %w", err)
+		}
+	}
+
+	if err := moveDatabase(staging, path); err != nil {
+		return nil, fmt.Errorf("failed to move restored database into place: %w", err)
+	}
+	return report, nil
+}
+
+// ensureClosed fails if the database is open elsewhere. Bolt refuses to open a locked file,
+// sqlite removes its write-ahead log when the last connection closes.
+func ensureClosed(backend, path string) error {
+	engine, err := OpenEngine(backend, path)
+	if err != nil {
+		return fmt.Errorf("failed to open %s, is the bot stopped? %w", path, err)
+	}
+	if err := engine.Close(); err != nil {
+		return err
+	}
+
+	if _, err := os.Stat(path + "-wal"); err == nil {
+		return fmt.Errorf("%s is still open, is the bot stopped?", path)
+	}
+	return nil
+}
+
+// unpackSnapshot copies the snapshot to path, decompressing it if it is gzipped.
+func unpackSnapshot(snapshot, path string) error {
+	in, err := os.Open(snapshot)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	var r io.Reader = bufio.NewReader(in)
+	magic, err := r.(*bufio.Reader).Peek(2)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidSnapshot, err)
+	}
+	if bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrInvalidSnapshot, err)
+		}
+		defer gz.Close()
+		r = gz
+	}
+
+	out, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, defaultFileMode)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, r); err != nil {
+		out.Close()
+		// a truncated or corrupt archive
+		if errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, gzip.ErrChecksum) || errors.Is(err, gzip.ErrHeader) {
+			return fmt.Errorf("%w: %v", ErrInvalidSnapshot, err)
+		}
+		return fmt.Errorf("failed to unpack snapshot: %w", err)
+	}
+	return out.Close()
+}
+
+// checkSnapshot opens the snapshot and reads every record, which also decrypts them with the keyring.
+func checkSnapshot(backend, path string, keyring *Keyring) (*RestoreReport, error) {
+	engine, err := OpenEngine(backend, path)
+	if err != nil {
+		return nil, err
+	}
+	defer engine.Close()
+
+	if c, ok := engine.(checker); ok {
+		if err := c.Check(); err != nil {
+			return nil, err
+		}
+	}
+	if keyring != nil {
+		engine = NewEncryptedEngine(engine, keyring)
+	}
+
+	version, fresh, err := schemaVersion(engine)
+	if err != nil {
+		return nil, err
+	}
+	if fresh {
+		return nil, errors.New("the snapshot holds no data")
+	}
+
+	report := &RestoreReport{Version: version}
+	err = engine.View(func(tx Tx) error {
+		for _, name := range buckets {
+			bucket := tx.Bucket([]byte(name))
+			if bucket == nil {
+				continue
+			}
+			if err := bucket.ForEachPrefix(nil, func(k, v []byte) error {
+				report.Records++
+				return nil
+			}); err != nil {
+				return fmt.Errorf("failed to read bucket %s: %w", name, err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	// the schema version alone is what a new database holds
+	if report.Records <= 1 {
+		return nil, errors.New("the snapshot holds no data")
+	}
+	return report, nil
+}
+
+// sqlite keeps uncommitted pages next to the database, they belong to it
+var databaseSuffixes = []string{"", "-wal", "-shm"}
+
+func moveDatabase(from, to string) error {
+	for _, suffix := range databaseSuffixes {
+		if err := os.Rename(from+suffix, to+suffix); err != nil && (suffix == "" || !errors.Is(err, os.ErrNotExist)) {
+			return err
+		}
+	}
+	return nil
+}
+
+func removeDatabase(path string) {
+	for _, suffix := range databaseSuffixes {
+		os.Remove(path + suffix)
+	}
+}
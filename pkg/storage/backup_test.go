@@ -0,0 +1,166 @@
+package storage_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/vasyvasilie/gemini-chat-tg-bot/pkg/storage"
+)
+
+// TestRestore restores a backup over the live database, and checks that broken snapshots leave it alone.
+func TestRestore(t *testing.T) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatal(err)
+	}
+	keyring, err := storage.ParseKeyring(base64.StdEncoding.EncodeToString(key))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, backend := range []string{storage.BackendBolt, storage.BackendSQLite} {
+		for _, keyring := range []*storage.Keyring{nil, keyring} {
+			name := backend
+			if keyring != nil {
+				name += " encrypted"
+			}
+
+			t.Run(name, func(t *testing.T) {
+				dir := t.TempDir()
+				path := filepath.Join(dir, "bot.db")
+				store, err := storage.Open(backend, path, keyring)
+				if err != nil {
+					t.Fatal(err)
+				}
+				before, err := store.SaveResponse(1, "before")
+				if err != nil {
+					t.Fatal(err)
+				}
+				var backup bytes.Buffer
+				if err := store.Backup(&backup); err != nil {
+					t.Fatal(err)
+				}
+				after, err := store.SaveResponse(1, "after")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := store.Close(); err != nil {
+					t.Fatal(err)
+				}
+
+				snapshot := writeSnapshot(t, dir, "backup.gz", backup.Bytes())
+				if _, err := gzip.NewReader(bytes.NewReader(backup.Bytes())); err != nil {
+					t.Fatalf("backup is not gzipped: %v", err)
+				}
+
+				t.Run("broken snapshots", func(t *testing.T) {
+					live, err := os.ReadFile(path)
+					if err != nil {
+						t.Fatal(err)
+					}
+					var truncated bytes.Buffer
+					gz := gzip.NewWriter(&truncated)
+					if _, err := gz.Write(live); err != nil {
+						t.Fatal(err)
+					}
+					if err := gz.Close(); err != nil {
+						t.Fatal(err)
+					}
+
+					otherKey := make([]byte, 32)
+					if _, err := rand.Read(otherKey); err != nil {
+						t.Fatal(err)
+					}
+					otherKeyring, err := storage.ParseKeyring(base64.StdEncoding.EncodeToString(otherKey))
+					if err != nil {
+						t.Fatal(err)
+					}
+					empty := filepath.Join(dir, "empty.db")
+					emptyStore, err := storage.Open(backend, empty, nil)
+					if err != nil {
+						t.Fatal(err)
+					}
+					if err := emptyStore.Close(); err != nil {
+						t.Fatal(err)
+					}
+
+					type brokenSnapshot struct {
+						name     string
+						snapshot string
+						keyring  *storage.Keyring
+					}
+					cases := []brokenSnapshot{
+						{"empty file", writeSnapshot(t, dir, "empty", nil), keyring},
+						{"garbage", writeSnapshot(t, dir, "garbage", bytes.Repeat([]byte("garbage "), 1024)), keyring},
+						{"truncated gzip", writeSnapshot(t, dir, "truncated.gz", truncated.Bytes()[:truncated.Len()/2]), keyring},
+						{"database without data", empty, keyring},
+					}
+					if keyring != nil {
+						cases = append(cases, brokenSnapshot{"another key", snapshot, otherKeyring})
+					}
+					for _, tc := range cases {
+						if _, err := storage.Restore(backend, tc.snapshot, path, tc.keyring); !errors.Is(err, storage.ErrInvalidSnapshot) {
+							t.Errorf("%s: got %v, want %v", tc.name, err, storage.ErrInvalidSnapshot)
+						}
+					}
+
+					if got, err := os.ReadFile(path); err != nil || !bytes.Equal(got, live) {
+						t.Fatalf("a broken snapshot changed the live database: %v", err)
+					}
+					matches, err := filepath.Glob(path + ".*")
+					if err != nil {
+						t.Fatal(err)
+					}
+					if len(matches) != 0 {
+						t.Fatalf("a broken snapshot left %v behind", matches)
+					}
+				})
+
+				report, err := storage.Restore(backend, snapshot, path, keyring)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if report.Records == 0 || report.Version == 0 || report.Previous == "" {
+					t.Fatalf("got report %+v, want the records of the backup and the replaced database", report)
+				}
+
+				restored, err := storage.Open(backend, path, keyring)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer restored.Close()
+				if response, err := restored.GetResponse(before); err != nil || response.Text != "before" {
+					t.Errorf("got %+v, %v for the response saved before the backup", response, err)
+				}
+				if _, err := restored.GetResponse(after); !errors.Is(err, storage.ErrResponseNotFound) {
+					t.Errorf("got %v for the response saved after the backup, want %v", err, storage.ErrResponseNotFound)
+				}
+
+				previous, err := storage.Open(backend, report.Previous, keyring)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer previous.Close()
+				if _, err := previous.GetResponse(after); err != nil {
+					t.Errorf("the replaced database lost the response saved after the backup: %v", err)
+				}
+			})
+		}
+	}
+}
+
+func writeSnapshot(t *testing.T, dir, name string, data []byte) string {
+	t.Helper()
+
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
@@ -0,0 +1,256 @@
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"sync"
+
+	"go.etcd.io/bbolt"
+)
+
+const (
+	// bolt commits the copied data in transactions of this size while compacting
+	compactTxMaxSize int64 = 64 * 1024 * 1024
+)
+
+type boltEngine struct {
+	// mu lets Compact replace db while no transaction runs
+	mu   sync.RWMutex
+	db   *bbolt.DB
+	path string
+	// err is set when Compact closed db and could not reopen it, every later call returns it
+	err error
+}
+
+type boltTx struct {
+	tx *bbolt.Tx
+}
+
+type boltBucket struct {
+	bucket *bbolt.Bucket
+}
+
+func NewBoltEngine(path string) (Engine, error) {
+	db, err := bbolt.Open(path, defaultFileMode, &bbolt.Options{Timeout: defaultTimeout})
+	if err != nil {
+		return nil, err
+	}
+	return &boltEngine{db: db, path: path}, nil
+}
+
+func (e *boltEngine) View(fn func(tx Tx) error) error {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	if e.err != nil {
+		return e.err
+	}
+	return e.db.View(func(tx *bbolt.Tx) error {
+		return fn(&boltTx{tx: tx})
+	})
+}
+
+func (e *boltEngine) Update(fn func(tx Tx) error) error {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	if e.err != nil {
+		return e.err
+	}
+	return e.db.Update(func(tx *bbolt.Tx) error {
+		return fn(&boltTx{tx: tx})
+	})
+}
+
+func (e *boltEngine) Size() (int64, error) {
+	fileStat, err := os.Stat(e.path)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get database file stats: %w", err)
+	}
+	return fileStat.Size(), nil
+}
+
+func (e *boltEngine) Path() string {
+	return e.path
+}
+
+func (e *boltEngine) Snapshot(path string) error {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	if e.err != nil {
+		return e.err
+	}
+	return e.db.View(func(tx *bbolt.Tx) error {
+		return tx.CopyFile(path, defaultFileMode)
+	})
+}
+
+// Check walks every page of the file and reports the first inconsistency.
+func (e *boltEngine) Check() error {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	if e.err != nil {
+		return e.err
+	}
+	return e.db.View(func(tx *bbolt.Tx) error {
+		// the channel is drained, the check must finish before the transaction ends
+		var first error
+		for err := range tx.Check() {
+			if first == nil {
+				first = err
+			}
+		}
+		return first
+	})
+}
+
+func (e *boltEngine) PageStats(bucketNames []string) (*PageStats, error) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	if e.err != nil {
+		return nil, e.err
+	}
+
+	dbStats := e.db.Stats()
+	stats := &PageStats{
+		PageSize:     e.db.Info().PageSize,
+		FreePages:    dbStats.FreePageN,
+		PendingPages: dbStats.PendingPageN,
+		Buckets:      make(map[string]BucketPages),
+	}
+	err := e.db.View(func(tx *bbolt.Tx) error {
+		stats.Pages = int(tx.Size()) / stats.PageSize
+		for _, name := range bucketNames {
+			bucket := tx.Bucket([]byte(name))
+			if bucket == nil {
+				continue
+			}
+			bucketStats := bucket.Stats()
+			stats.Buckets[name] = BucketPages{
+				LeafPages:   bucketStats.LeafPageN,
+				BranchPages: bucketStats.BranchPageN,
+				Inuse:       bucketStats.LeafInuse + bucketStats.BranchInuse,
+				Inline:      bucketStats.InlineBucketN > 0 && bucketStats.LeafPageN == 0,
+			}
+		}
+		return nil
+	})
+	return stats, err
+}
+
+// Compact copies the data into a new file and swaps it with the database, bolt never shrinks a file by itself.
+// Transactions wait until the swap is done.
+func (e *boltEngine) Compact() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.err != nil {
+		return e.err
+	}
+
+	compactPath := e.path + ".compact"
+	// a file left by a compaction that crashed already holds the buckets bolt would copy
+	if err := os.Remove(compactPath); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove %s: %w", compactPath, err)
+	}
+	compacted, err := bbolt.Open(compactPath, defaultFileMode, &bbolt.Options{Timeout: defaultTimeout})
+	if err != nil {
+		return err
+	}
+	if err := bbolt.Compact(compacted, e.db, compactTxMaxSize); err != nil {
+		compacted.Close()
+		os.Remove(compactPath)
+		return err
+	}
+	if err := compacted.Close(); err != nil {
+		os.Remove(compactPath)
+		return err
+	}
+
+	if err := e.db.Close(); err != nil {
+		os.Remove(compactPath)
+		return err
+	}
+	renameErr := os.Rename(compactPath, e.path)
+	// the old file is reopened if the swap failed
+	db, err := bbolt.Open(e.path, defaultFileMode, &bbolt.Options{Timeout: defaultTimeout})
+	if err != nil {
+		e.err = fmt.Errorf("failed to reopen database after compaction: %w", err)
+		return e.err
+	}
+	e.db = db
+	if renameErr != nil {
+		os.Remove(compactPath)
+		return renameErr
+	}
+	return nil
+}
+
+func (e *boltEngine) Close() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	// db was already closed by Compact
+	if e.err != nil {
+		return nil
+	}
+	return e.db.Close()
+}
+
+func (t *boltTx) Bucket(name []byte) Bucket {
+	bucket := t.tx.Bucket(name)
+	if bucket == nil {
+		return nil
+	}
+	return &boltBucket{bucket: bucket}
+}
+
+func (t *boltTx) CreateBucketIfNotExists(name []byte) (Bucket, error) {
+	bucket, err := t.tx.CreateBucketIfNotExists(name)
+	if err != nil {
+		return nil, err
+	}
+	return &boltBucket{bucket: bucket}, nil
+}
+
+func (b *boltBucket) Get(key []byte) []byte {
+	return b.bucket.Get(key)
+}
+
+func (b *boltBucket) Put(key, value []byte) error {
+	return b.bucket.Put(key, value)
+}
+
+func (b *boltBucket) Delete(key []byte) error {
+	return b.bucket.Delete(key)
+}
+
+func (b *boltBucket) ForEachPrefix(prefix []byte, fn func(k, v []byte) error) error {
+	// modifying the bucket invalidates the cursor, so the matches are collected first
+	var keys, values [][]byte
+	c := b.bucket.Cursor()
+	for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+		keys = append(keys, bytes.Clone(k))
+		values = append(values, bytes.Clone(v))
+	}
+
+	for i := range keys {
+		if err := fn(keys[i], values[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *boltBucket) ForEachRange(start, end []byte, fn func(k, v []byte) error) error {
+	var keys, values [][]byte
+	c := b.bucket.Cursor()
+	for k, v := c.Seek(start); k != nil && (end == nil || bytes.Compare(k, end) < 0); k, v = c.Next() {
+		keys = append(keys, bytes.Clone(k))
+		values = append(values, bytes.Clone(v))
+	}
+
+	for i := range keys {
+		if err := fn(keys[i], values[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,40 @@
+package storage_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/vasyvasilie/gemini-chat-tg-bot/pkg/storage"
+)
+
+// TestBoltCompactLeftover compacts over a copy of the database that a crashed compaction left behind.
+func TestBoltCompactLeftover(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bot.db")
+	engine, err := storage.OpenEngine(storage.BackendBolt, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := storage.NewStorage(engine)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	responseID, err := store.SaveResponse(1, "answer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := engine.Snapshot(path + ".compact"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := store.Compact(); err != nil {
+		t.Fatalf("failed to compact over a leftover file: %v", err)
+	}
+	if _, err := os.Stat(path + ".compact"); !os.IsNotExist(err) {
+		t.Errorf("got %v for the compaction file, want it gone", err)
+	}
+	if response, err := store.GetResponse(responseID); err != nil || response.Text != "answer" {
+		t.Errorf("got %+v, %v after compacting, want the saved response", response, err)
+	}
+}
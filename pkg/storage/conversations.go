@@ -0,0 +1,578 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const (
+	conversationsBucket string = "conversations"
+	// messagesBucket keeps the nodes of the conversation trees, see messageKey
+	messagesBucket        string = "messages"
+	defaultConversationID string = "default"
+	defaultTitleLength    int    = 40
+)
+
+var (
+	ErrConversationNotFound = errors.New("conversation not found")
+	ErrBranchNotFound       = errors.New("branch not found")
+)
+
+// Conversation is one of the user's chats, its ID is the session ID used across the bot.
+type Conversation struct {
+	ID        string
+	UserID    int64
+	Title     string
+	Model     string
+	Archived  bool
+	CreatedAt time.Time
+	UpdatedAt time.Time
+	// History is the active branch of Tree
+	History ConversationHistory
+	Tree    HistoryTree
+}
+
+// conversationRecord is what the conversations bucket keeps, the messages of the tree are stored
+// one per key in the messages bucket so that a new turn only writes the new messages.
+type conversationRecord struct {
+	ID        string
+	UserID    int64
+	Title     string
+	Model     string
+	Archived  bool
+	CreatedAt time.Time
+	UpdatedAt time.Time
+	// Head is the last node of the active branch and Length the number of its messages
+	Head   int
+	Length int
+	// Nodes is the number of stored nodes, the next one is stored under this sequence number
+	Nodes int
+}
+
+// SaveConversation stores the conversation. Nodes are never changed once stored,
+// so only the ones added to the tree since the conversation was read are written.
+func (s *Storage) SaveConversation(conversation *Conversation) error {
+	return s.db.Update(func(tx Tx) error {
+		return putConversation(tx, conversation)
+	})
+}
+
+// AppendMessages adds the messages to the active branch of the conversation after its first
+// `after` messages and sets the model, creating the conversation on first use. When after is
+// short of the branch the new messages start another one. Only the nodes between the head and
+// the fork point are read, so appending a turn costs the same however long the conversation is.
+func (s *Storage) AppendMessages(userID int64, id, model string, after int, messages []Message) error {
+	return s.db.Update(func(tx Tx) error {
+		_, err := appendMessages(tx, userID, id, model, after, messages)
+		return err
+	})
+}
+
+func (s *Storage) GetConversation(userID int64, id string) (*Conversation, error) {
+	var conversation *Conversation
+	err := s.db.View(func(tx Tx) error {
+		var err error
+		conversation, err = getConversation(tx, userID, id)
+		return err
+	})
+
+	return conversation, err
+}
+
+// GetMessages pages through the active branch from the end: it returns up to limit messages
+// before the offset newest ones, oldest first, limit zero returns all of them. Only the skipped
+// and returned messages are read.
+func (s *Storage) GetMessages(userID int64, id string, offset, limit int) ([]Message, error) {
+	var messages []Message
+	err := s.db.View(func(tx Tx) error {
+		record, err := getRecord(tx, userID, id)
+		if err != nil {
+			return err
+		}
+
+		if limit == 0 {
+			limit = record.Length
+		}
+		node := record.Head
+		for i := 0; node != noNode && i < offset+limit; i++ {
+			stored, err := getNode(tx, record, node)
+			if err != nil {
+				return err
+			}
+			if i >= offset {
+				messages = append(messages, stored.Message)
+			}
+			node = stored.Parent
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	slices.Reverse(messages)
+	return messages, nil
+}
+
+// ListConversations returns the user's conversations, recently updated first.
+// Their messages are not read, History and Tree are left empty.
+func (s *Storage) ListConversations(userID int64) ([]Conversation, error) {
+	var conversations []Conversation
+	err := s.db.View(func(tx Tx) error {
+		bucket := tx.Bucket([]byte(conversationsBucket))
+		if bucket == nil {
+			return fmt.Errorf("bucket %s not found", conversationsBucket)
+		}
+
+		prefix := []byte(strconv.FormatInt(userID, 10) + "/")
+		if err := bucket.ForEachPrefix(prefix, func(k, v []byte) error {
+			var record conversationRecord
+			if err := json.Unmarshal(v, &record); err != nil {
+				return fmt.Errorf("failed to unmarshal conversation %s: %w", k, err)
+			}
+			conversations = append(conversations, *record.conversation(newHistoryTree()))
+			return nil
+		}); err != nil {
+			return err
+		}
+
+		return nil
+	})
+
+	sort.Slice(conversations, func(i, j int) bool {
+		return conversations[i].UpdatedAt.After(conversations[j].UpdatedAt)
+	})
+
+	return conversations, err
+}
+
+// RenameConversation sets the title of an existing conversation.
+func (s *Storage) RenameConversation(userID int64, id, title string) error {
+	return s.db.Update(func(tx Tx) error {
+		record, err := getRecord(tx, userID, id)
+		if err != nil {
+			return err
+		}
+
+		record.Title = title
+		return putRecord(tx, record)
+	})
+}
+
+// SwitchBranch makes the branch ending at leaf the active one.
+func (s *Storage) SwitchBranch(userID int64, id string, leaf int) (*Conversation, error) {
+	var conversation *Conversation
+	err := s.db.Update(func(tx Tx) error {
+		record, err := getRecord(tx, userID, id)
+		if err != nil {
+			return err
+		}
+		tree, err := getTree(tx, record)
+		if err != nil {
+			return err
+		}
+		if leaf < 0 || leaf >= len(tree.Nodes) {
+			return ErrBranchNotFound
+		}
+
+		tree.Head = leaf
+		record.Head = leaf
+		record.Length = len(tree.Path(leaf))
+		record.UpdatedAt = time.Now()
+		conversation = record.conversation(tree)
+		return putRecord(tx, record)
+	})
+
+	return conversation, err
+}
+
+// DeleteConversation deletes the conversation with its messages and their embeddings.
+func (s *Storage) DeleteConversation(userID int64, id string) error {
+	return s.db.Update(func(tx Tx) error {
+		bucket := tx.Bucket([]byte(conversationsBucket))
+		if bucket == nil {
+			return fmt.Errorf("bucket %s not found", conversationsBucket)
+		}
+
+		key := conversationKey(userID, id)
+		if bucket.Get(key) == nil {
+			return ErrConversationNotFound
+		}
+
+		if err := bucket.Delete(key); err != nil {
+			return fmt.Errorf("failed to delete conversation %s: %w", key, err)
+		}
+
+		if err := deleteNodes(tx, userID, id); err != nil {
+			return err
+		}
+		return deleteEmbeddings(tx, userID, id)
+	})
+}
+
+// migrateHistory moves the single history once kept in the user settings into a default conversation.
+func migrateHistory(tx Tx, step *MigrationStep) error {
+	users := tx.Bucket([]byte(usersBucket))
+	if users == nil {
+		return fmt.Errorf("bucket %s not found", usersBucket)
+	}
+
+	type migration struct {
+		key      []byte
+		settings UserSettings
+	}
+
+	var migrations []migration
+	if err := users.ForEachPrefix(nil, func(k, v []byte) error {
+		var settings UserSettings
+		if err := json.Unmarshal(v, &settings); err != nil {
+			return fmt.Errorf("failed to unmarshal user settings for ID %s: %w", k, err)
+		}
+		if len(settings.History.Messages) > 0 {
+			migrations = append(migrations, migration{key: bytes.Clone(k), settings: settings})
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	for _, m := range migrations {
+		settings := m.settings
+		if settings.SessionID == "" {
+			settings.SessionID = defaultConversationID
+		}
+
+		title := settings.History.Messages[0].Text
+		if runes := []rune(title); len(runes) > defaultTitleLength {
+			title = string(runes[:defaultTitleLength]) + "…"
+		}
+
+		if err := putConversation(tx, &Conversation{
+			ID:        settings.SessionID,
+			UserID:    settings.UserID,
+			Title:     title,
+			Model:     settings.ModelName,
+			CreatedAt: now,
+			UpdatedAt: now,
+			History:   settings.History,
+			Tree:      newHistoryTree(),
+		}); err != nil {
+			return err
+		}
+
+		step.changed("moved %d messages of user %d into conversation %s",
+			len(settings.History.Messages), settings.UserID, settings.SessionID)
+
+		settings.History = ConversationHistory{}
+		data, err := json.Marshal(settings)
+		if err != nil {
+			return fmt.Errorf("failed to marshal user settings: %w", err)
+		}
+		if err := users.Put(m.key, data); err != nil {
+			return fmt.Errorf("failed to save user settings for ID %s: %w", m.key, err)
+		}
+	}
+
+	return nil
+}
+
+// splitConversations moves the messages of every conversation out of its record into
+// the messages bucket, records of older builds kept the whole tree and the active branch.
+func splitConversations(tx Tx, step *MigrationStep) error {
+	bucket := tx.Bucket([]byte(conversationsBucket))
+	if bucket == nil {
+		return fmt.Errorf("bucket %s not found", conversationsBucket)
+	}
+
+	return bucket.ForEachPrefix(nil, func(k, v []byte) error {
+		var legacy struct {
+			Conversation
+			// only set in the records of this layout
+			Nodes *int
+		}
+		legacy.Tree = newHistoryTree()
+		if err := json.Unmarshal(v, &legacy); err != nil {
+			return fmt.Errorf("failed to unmarshal conversation %s: %w", k, err)
+		}
+		if legacy.Nodes != nil {
+			return nil
+		}
+
+		conversation := legacy.Conversation
+		if len(conversation.Tree.Nodes) == 0 {
+			// stored before branching existed
+			conversation.Tree.Merge(conversation.History.Messages)
+		}
+		if err := putConversation(tx, &conversation); err != nil {
+			return err
+		}
+
+		step.changed("moved %d messages of conversation %s of user %d",
+			len(conversation.Tree.Nodes), conversation.ID, conversation.UserID)
+		return nil
+	})
+}
+
+func getConversation(tx Tx, userID int64, id string) (*Conversation, error) {
+	record, err := getRecord(tx, userID, id)
+	if err != nil {
+		return nil, err
+	}
+
+	tree, err := getTree(tx, record)
+	if err != nil {
+		return nil, err
+	}
+	return record.conversation(tree), nil
+}
+
+// putConversation stores the record and the nodes of the tree that are not stored yet.
+func putConversation(tx Tx, conversation *Conversation) error {
+	if len(conversation.Tree.Nodes) == 0 && len(conversation.History.Messages) > 0 {
+		conversation.Tree = newHistoryTree()
+		conversation.Tree.Merge(conversation.History.Messages)
+	}
+
+	record := &conversationRecord{
+		ID:        conversation.ID,
+		UserID:    conversation.UserID,
+		Title:     conversation.Title,
+		Model:     conversation.Model,
+		Archived:  conversation.Archived,
+		CreatedAt: conversation.CreatedAt,
+		UpdatedAt: conversation.UpdatedAt,
+		Head:      conversation.Tree.Head,
+		Length:    len(conversation.Tree.Path(conversation.Tree.Head)),
+	}
+	stored, err := getRecord(tx, conversation.UserID, conversation.ID)
+	if err == nil {
+		record.Nodes = stored.Nodes
+	} else if !errors.Is(err, ErrConversationNotFound) {
+		return err
+	}
+
+	if record.Nodes < len(conversation.Tree.Nodes) {
+		if err := putNodes(tx, record, conversation.Tree.Nodes[record.Nodes:]); err != nil {
+			return err
+		}
+	}
+	return putRecord(tx, record)
+}
+
+// appendMessages returns the nodes the messages are stored as, see AppendMessages.
+func appendMessages(tx Tx, userID int64, id, model string, after int, messages []Message) ([]int, error) {
+	record, err := getRecord(tx, userID, id)
+	if errors.Is(err, ErrConversationNotFound) {
+		if len(messages) == 0 {
+			// nothing worth listing yet
+			return nil, nil
+		}
+		record = &conversationRecord{ID: id, UserID: userID, CreatedAt: time.Now(), Head: noNode}
+	} else if err != nil {
+		return nil, err
+	}
+
+	var ids []int
+	if len(messages) > 0 {
+		if after < 0 || after > record.Length {
+			return nil, fmt.Errorf("cannot append after %d messages to conversation %s of %d", after, id, record.Length)
+		}
+
+		parent := record.Head
+		for range record.Length - after {
+			stored, err := getNode(tx, record, parent)
+			if err != nil {
+				return nil, err
+			}
+			parent = stored.Parent
+		}
+
+		nodes := make([]HistoryNode, 0, len(messages))
+		for _, message := range messages {
+			nodes = append(nodes, HistoryNode{Parent: parent, Message: message})
+			parent = record.Nodes + len(nodes) - 1
+			ids = append(ids, parent)
+		}
+		if err := putNodes(tx, record, nodes); err != nil {
+			return nil, err
+		}
+		record.Head = parent
+		record.Length = after + len(messages)
+	}
+
+	record.Model = model
+	record.UpdatedAt = time.Now()
+	return ids, putRecord(tx, record)
+}
+
+// branchNodes returns the nodes of the active branch of the conversation, oldest first.
+func branchNodes(tx Tx, record *conversationRecord) ([]int, error) {
+	nodes := make([]int, 0, record.Length)
+	for node := record.Head; node != noNode; {
+		stored, err := getNode(tx, record, node)
+		if err != nil {
+			return nil, err
+		}
+		nodes = append(nodes, node)
+		node = stored.Parent
+	}
+	slices.Reverse(nodes)
+	return nodes, nil
+}
+
+func getRecord(tx Tx, userID int64, id string) (*conversationRecord, error) {
+	bucket := tx.Bucket([]byte(conversationsBucket))
+	if bucket == nil {
+		return nil, fmt.Errorf("bucket %s not found", conversationsBucket)
+	}
+
+	data := bucket.Get(conversationKey(userID, id))
+	if data == nil {
+		return nil, ErrConversationNotFound
+	}
+
+	record := &conversationRecord{}
+	if err := json.Unmarshal(data, record); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal conversation %s: %w", id, err)
+	}
+	return record, nil
+}
+
+func putRecord(tx Tx, record *conversationRecord) error {
+	bucket := tx.Bucket([]byte(conversationsBucket))
+	if bucket == nil {
+		return fmt.Errorf("bucket %s not found", conversationsBucket)
+	}
+
+	data, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("failed to marshal conversation: %w", err)
+	}
+
+	key := conversationKey(record.UserID, record.ID)
+	if err := bucket.Put(key, data); err != nil {
+		return fmt.Errorf("failed to save conversation %s: %w", key, err)
+	}
+
+	return nil
+}
+
+// getTree reads every node of the conversation, they are kept in sequence order.
+func getTree(tx Tx, record *conversationRecord) (HistoryTree, error) {
+	tree := newHistoryTree()
+	bucket := tx.Bucket([]byte(messagesBucket))
+	if bucket == nil {
+		return tree, fmt.Errorf("bucket %s not found", messagesBucket)
+	}
+
+	if err := bucket.ForEachPrefix(messagePrefix(record.UserID, record.ID), func(k, v []byte) error {
+		var node HistoryNode
+		if err := json.Unmarshal(v, &node); err != nil {
+			return fmt.Errorf("failed to unmarshal message %s: %w", k, err)
+		}
+		tree.Nodes = append(tree.Nodes, node)
+		return nil
+	}); err != nil {
+		return tree, err
+	}
+	if len(tree.Nodes) != record.Nodes {
+		return tree, fmt.Errorf("conversation %s has %d of %d messages", record.ID, len(tree.Nodes), record.Nodes)
+	}
+
+	tree.Head = record.Head
+	return tree, nil
+}
+
+func getNode(tx Tx, record *conversationRecord, node int) (*HistoryNode, error) {
+	bucket := tx.Bucket([]byte(messagesBucket))
+	if bucket == nil {
+		return nil, fmt.Errorf("bucket %s not found", messagesBucket)
+	}
+
+	key := messageKey(record.UserID, record.ID, node)
+	data := bucket.Get(key)
+	if data == nil {
+		return nil, fmt.Errorf("message %s not found", key)
+	}
+
+	stored := &HistoryNode{}
+	if err := json.Unmarshal(data, stored); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal message %s: %w", key, err)
+	}
+	return stored, nil
+}
+
+// putNodes stores the nodes after the ones of the record and counts them in.
+func putNodes(tx Tx, record *conversationRecord, nodes []HistoryNode) error {
+	bucket := tx.Bucket([]byte(messagesBucket))
+	if bucket == nil {
+		return fmt.Errorf("bucket %s not found", messagesBucket)
+	}
+
+	for _, node := range nodes {
+		data, err := json.Marshal(node)
+		if err != nil {
+			return fmt.Errorf("failed to marshal message: %w", err)
+		}
+
+		key := messageKey(record.UserID, record.ID, record.Nodes)
+		if err := bucket.Put(key, data); err != nil {
+			return fmt.Errorf("failed to save message %s: %w", key, err)
+		}
+		record.Nodes++
+	}
+
+	return nil
+}
+
+func deleteNodes(tx Tx, userID int64, id string) error {
+	bucket := tx.Bucket([]byte(messagesBucket))
+	if bucket == nil {
+		return fmt.Errorf("bucket %s not found", messagesBucket)
+	}
+
+	return bucket.ForEachPrefix(messagePrefix(userID, id), func(k, v []byte) error {
+		if err := bucket.Delete(k); err != nil {
+			return fmt.Errorf("failed to delete message %s: %w", k, err)
+		}
+		return nil
+	})
+}
+
+func (r *conversationRecord) conversation(tree HistoryTree) *Conversation {
+	conversation := &Conversation{
+		ID:        r.ID,
+		UserID:    r.UserID,
+		Title:     r.Title,
+		Model:     r.Model,
+		Archived:  r.Archived,
+		CreatedAt: r.CreatedAt,
+		UpdatedAt: r.UpdatedAt,
+		Tree:      tree,
+	}
+	if len(tree.Nodes) > 0 {
+		conversation.History = ConversationHistory{Messages: tree.Path(tree.Head)}
+	}
+	return conversation
+}
+
+func conversationKey(userID int64, id string) []byte {
+	return []byte(strconv.FormatInt(userID, 10) + "/" + id)
+}
+
+// messagePrefix is followed by the sequence number of the node, see messageKey.
+func messagePrefix(userID int64, id string) []byte {
+	return append(conversationKey(userID, id), '/')
+}
+
+// messageKey zero-pads the sequence number, so the nodes of a conversation sort in order.
+func messageKey(userID int64, id string, node int) []byte {
+	return fmt.Appendf(messagePrefix(userID, id), "%010d", node)
+}
@@ -0,0 +1,156 @@
+package storage_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/vasyvasilie/gemini-chat-tg-bot/pkg/storage"
+)
+
+const (
+	benchUserID       int64  = 1
+	benchConversation string = "bench"
+	benchModel        string = "models/gemini"
+	// about a paragraph per message
+	benchMessageLength int = 500
+	benchPageSize      int = 20
+	// benchBlobBucket holds the conversations of the blob layout, see BenchmarkAppendMessagesBlob
+	benchBlobBucket string = "bench"
+)
+
+var benchTurnCounts = []int{100, 1000, 10000}
+
+// BenchmarkAppendMessages saves a turn to conversations of growing length, e.g.
+// `go test -bench AppendMessages ./pkg/storage/`. Only the new messages are written,
+// so the time per turn should not depend on the length.
+func BenchmarkAppendMessages(b *testing.B) {
+	for _, backend := range storage.Backends {
+		for _, turns := range benchTurnCounts {
+			b.Run(fmt.Sprintf("%s/%d turns", backend, turns), func(b *testing.B) {
+				store, length := openBenchStore(b, backend, turns)
+
+				for b.Loop() {
+					if err := store.AppendMessages(benchUserID, benchConversation, benchModel, length, benchTurn(length)); err != nil {
+						b.Fatal(err)
+					}
+					length += 2
+				}
+			})
+		}
+	}
+}
+
+// BenchmarkAppendMessagesBlob is the baseline for BenchmarkAppendMessages: the layout before messages
+// got their own keys kept the whole conversation in one record, which every turn read and wrote back.
+func BenchmarkAppendMessagesBlob(b *testing.B) {
+	for _, backend := range storage.Backends {
+		for _, turns := range benchTurnCounts {
+			b.Run(fmt.Sprintf("%s/%d turns", backend, turns), func(b *testing.B) {
+				engine, history := openBenchBlob(b, backend, turns)
+
+				for b.Loop() {
+					history = append(history, benchTurn(len(history))...)
+					if err := engine.Update(func(tx storage.Tx) error {
+						bucket := tx.Bucket([]byte(benchBlobBucket))
+						var conversation storage.Conversation
+						if err := json.Unmarshal(bucket.Get([]byte(benchConversation)), &conversation); err != nil {
+							return err
+						}
+
+						conversation.Tree.Merge(history)
+						conversation.History = storage.ConversationHistory{Messages: history}
+						data, err := json.Marshal(conversation)
+						if err != nil {
+							return err
+						}
+						return bucket.Put([]byte(benchConversation), data)
+					}); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
+
+// BenchmarkGetMessages reads the newest page of a long conversation.
+func BenchmarkGetMessages(b *testing.B) {
+	for _, backend := range storage.Backends {
+		b.Run(backend, func(b *testing.B) {
+			store, _ := openBenchStore(b, backend, 10000)
+
+			for b.Loop() {
+				if _, err := store.GetMessages(benchUserID, benchConversation, 0, benchPageSize); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// openBenchStore opens a store holding a conversation of the given number of turns and returns its length.
+func openBenchStore(b *testing.B, backend string, turns int) (storage.Store, int) {
+	b.Helper()
+
+	store, err := storage.Open(backend, filepath.Join(b.TempDir(), "bench.db"), nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() { _ = store.Close() })
+
+	var history []storage.Message
+	for len(history) < 2*turns {
+		history = append(history, benchTurn(len(history))...)
+	}
+	if err := store.AppendMessages(benchUserID, benchConversation, benchModel, 0, history); err != nil {
+		b.Fatal(err)
+	}
+	return store, len(history)
+}
+
+// openBenchBlob opens an engine holding a conversation of the given number of turns in one record
+// and returns its history.
+func openBenchBlob(b *testing.B, backend string, turns int) (storage.Engine, []storage.Message) {
+	b.Helper()
+
+	engine, err := storage.OpenEngine(backend, filepath.Join(b.TempDir(), "bench.db"))
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() { _ = engine.Close() })
+
+	var history []storage.Message
+	for len(history) < 2*turns {
+		history = append(history, benchTurn(len(history))...)
+	}
+	conversation := storage.Conversation{ID: benchConversation, UserID: benchUserID, Model: benchModel,
+		History: storage.ConversationHistory{Messages: history}, Tree: storage.HistoryTree{Head: -1}}
+	conversation.Tree.Merge(history)
+	data, err := json.Marshal(conversation)
+	if err != nil {
+		b.Fatal(err)
+	}
+	if err := engine.Update(func(tx storage.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists([]byte(benchBlobBucket))
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(benchConversation), data)
+	}); err != nil {
+		b.Fatal(err)
+	}
+	return engine, history
+}
+
+// benchTurn returns a prompt and its answer following the given number of messages.
+func benchTurn(length int) []storage.Message {
+	text := strings.Repeat("lorem ipsum ", benchMessageLength/len("lorem ipsum "))
+	return []storage.Message{
+		{Role: "user", Text: text, MessageID: length/2 + 1, Timestamp: time.Now()},
+		{Role: "model", Text: text, Model: benchModel, Timestamp: time.Now()},
+	}
+}
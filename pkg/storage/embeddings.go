@@ -0,0 +1,257 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const (
+	embeddingsBucket string = "embeddings"
+	// roleUser is the role of prompts, gemini.RoleUser
+	roleUser string = "user"
+)
+
+// Embedding is a single conversation turn together with its vector.
+type Embedding struct {
+	UserID    int64
+	SessionID string
+	// Turn is the position of the message in its branch, Node is the message in the conversation tree
+	Turn int
+	Node int
+	// Parent is the node before Node, SaveEmbeddings sets it
+	Parent    int
+	Role      string
+	Text      string
+	Timestamp time.Time
+	Vector    []float32
+}
+
+// ExchangeMatch is a prompt/answer pair found by SearchExchanges.
+type ExchangeMatch struct {
+	SessionID string
+	Turn      int
+	Timestamp time.Time
+	Prompt    string
+	Answer    string
+	Score     float64
+}
+
+func (s *Storage) SaveEmbeddings(userID int64, embeddings []Embedding) error {
+	return s.db.Update(func(tx Tx) error {
+		bucket := tx.Bucket([]byte(embeddingsBucket))
+		if bucket == nil {
+			return fmt.Errorf("bucket %s not found", embeddingsBucket)
+		}
+
+		for _, embedding := range embeddings {
+			node, err := getNode(tx, &conversationRecord{ID: embedding.SessionID, UserID: userID}, embedding.Node)
+			if err != nil {
+				return err
+			}
+			embedding.Parent = node.Parent
+
+			data, err := json.Marshal(embedding)
+			if err != nil {
+				return fmt.Errorf("failed to marshal embedding: %w", err)
+			}
+
+			key := embeddingKey(userID, embedding.SessionID, embedding.Node)
+			if err := bucket.Put(key, data); err != nil {
+				return fmt.Errorf("failed to save embedding with key %s: %w", key, err)
+			}
+		}
+
+		return nil
+	})
+}
+
+// SearchExchanges ranks the user's past prompt/answer pairs by cosine similarity
+// of their best matching turn to the query vector.
+func (s *Storage) SearchExchanges(userID int64, query []float32, limit int) ([]ExchangeMatch, error) {
+	exchanges := []ExchangeMatch{}
+	err := s.db.View(func(tx Tx) error {
+		bucket := tx.Bucket([]byte(embeddingsBucket))
+		if bucket == nil {
+			return fmt.Errorf("bucket %s not found", embeddingsBucket)
+		}
+
+		// an exchange per answer, branches forked at a prompt have answers of their own
+		prompts := make(map[string]ExchangeMatch)
+		prefix := []byte(strconv.FormatInt(userID, 10) + "/")
+		if err := bucket.ForEachPrefix(prefix, func(k, v []byte) error {
+			var embedding Embedding
+			if err := json.Unmarshal(v, &embedding); err != nil {
+				return fmt.Errorf("failed to unmarshal embedding %s: %w", k, err)
+			}
+
+			score := cosineSimilarity(query, embedding.Vector)
+			if embedding.Role == roleUser {
+				prompts[fmt.Sprintf("%s/%d", embedding.SessionID, embedding.Node)] = ExchangeMatch{
+					SessionID: embedding.SessionID,
+					Turn:      embedding.Turn,
+					Timestamp: embedding.Timestamp,
+					Prompt:    embedding.Text,
+					Score:     score,
+				}
+				return nil
+			}
+
+			// keys sort by node, the prompt comes before its answers
+			exchange, ok := prompts[fmt.Sprintf("%s/%d", embedding.SessionID, embedding.Parent)]
+			if !ok {
+				exchange = ExchangeMatch{SessionID: embedding.SessionID, Turn: embedding.Turn - 1,
+					Timestamp: embedding.Timestamp, Score: score}
+			}
+			exchange.Answer = embedding.Text
+			exchange.Score = max(exchange.Score, score)
+			exchanges = append(exchanges, exchange)
+			return nil
+		}); err != nil {
+			return err
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(exchanges, func(i, j int) bool {
+		return exchanges[i].Score > exchanges[j].Score
+	})
+	if len(exchanges) > limit {
+		exchanges = exchanges[:limit]
+	}
+
+	return exchanges, nil
+}
+
+func deleteEmbeddings(tx Tx, userID int64, sessionID string) error {
+	bucket := tx.Bucket([]byte(embeddingsBucket))
+	if bucket == nil {
+		return fmt.Errorf("bucket %s not found", embeddingsBucket)
+	}
+
+	return bucket.ForEachPrefix(embeddingPrefix(userID, sessionID), func(k, v []byte) error {
+		if err := bucket.Delete(k); err != nil {
+			return fmt.Errorf("failed to delete embedding %s: %w", k, err)
+		}
+		return nil
+	})
+}
+
+// embeddingPrefix is followed by the node of the message, see embeddingKey.
+func embeddingPrefix(userID int64, sessionID string) []byte {
+	return []byte(fmt.Sprintf("%d/%s/", userID, sessionID))
+}
+
+// embeddingKey zero-pads the node like messageKey, so the embeddings of a conversation sort by node.
+func embeddingKey(userID int64, sessionID string, node int) []byte {
+	return fmt.Appendf(embeddingPrefix(userID, sessionID), "%010d", node)
+}
+
+func cosineSimilarity(a, b []float32) float64 {
+	if len(a) != len(b) || len(a) == 0 {
+		return 0
+	}
+
+	var dot, normA, normB float64
+	for i := range a {
+		dot += float64(a[i]) * float64(b[i])
+		normA += float64(a[i]) * float64(a[i])
+		normB += float64(b[i]) * float64(b[i])
+	}
+	if normA == 0 || normB == 0 {
+		return 0
+	}
+
+	return dot / (math.Sqrt(normA) * math.Sqrt(normB))
+}
+
+// keyEmbeddings moves the embeddings keyed by turn to the key of their message node. The node is looked up
+// on the active branch of the conversation, embeddings of deleted conversations or of other branches are dropped.
+func keyEmbeddings(tx Tx, step *MigrationStep) error {
+	bucket := tx.Bucket([]byte(embeddingsBucket))
+	if bucket == nil {
+		return fmt.Errorf("bucket %s not found", embeddingsBucket)
+	}
+
+	type legacy struct {
+		key       []byte
+		embedding Embedding
+	}
+
+	var found []legacy
+	if err := bucket.ForEachPrefix(nil, func(k, v []byte) error {
+		// the keys by turn end with six digits
+		if len(k)-bytes.LastIndexByte(k, '/')-1 != 6 {
+			return nil
+		}
+		var embedding Embedding
+		if err := json.Unmarshal(v, &embedding); err != nil {
+			return fmt.Errorf("failed to unmarshal embedding %s: %w", k, err)
+		}
+		found = append(found, legacy{key: bytes.Clone(k), embedding: embedding})
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	// the node IDs of the active branch by conversation
+	branches := make(map[string][]int)
+	moved, dropped := 0, 0
+	for _, l := range found {
+		if err := bucket.Delete(l.key); err != nil {
+			return fmt.Errorf("failed to delete embedding %s: %w", l.key, err)
+		}
+
+		embedding := l.embedding
+		id := string(conversationKey(embedding.UserID, embedding.SessionID))
+		branch, ok := branches[id]
+		if !ok {
+			record, err := getRecord(tx, embedding.UserID, embedding.SessionID)
+			if err == nil {
+				branch, err = branchNodes(tx, record)
+			}
+			if err != nil && !errors.Is(err, ErrConversationNotFound) {
+				return err
+			}
+			branches[id] = branch
+		}
+
+		if embedding.Turn >= len(branch) {
+			dropped++
+			continue
+		}
+		node, err := getNode(tx, &conversationRecord{ID: embedding.SessionID, UserID: embedding.UserID}, branch[embedding.Turn])
+		if err != nil {
+			return err
+		}
+		if node.Message.Text != embedding.Text {
+			dropped++
+			continue
+		}
+
+		embedding.Node, embedding.Parent = branch[embedding.Turn], node.Parent
+		data, err := json.Marshal(embedding)
+		if err != nil {
+			return fmt.Errorf("failed to marshal embedding: %w", err)
+		}
+		key := embeddingKey(embedding.UserID, embedding.SessionID, embedding.Node)
+		if err := bucket.Put(key, data); err != nil {
+			return fmt.Errorf("failed to save embedding with key %s: %w", key, err)
+		}
+		moved++
+	}
+
+	if moved > 0 || dropped > 0 {
+		step.changed("keyed %d embeddings by message, dropped %d of deleted conversations or inactive branches", moved, dropped)
+	}
+	return nil
+}
@@ -0,0 +1,419 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const (
+	masterKeySize int = 32
+	dataKeySize   int = 32
+	keyIDSize     int = 4
+	// values are rewritten in transactions of this many records while rotating keys
+	rotationBatchSize int = 500
+)
+
+var (
+	// envelopeMagic starts every encrypted value, JSON records never start with a zero byte
+	envelopeMagic = []byte("\x00enc1")
+
+	ErrInvalidEncryptionKey = errors.New("encryption key must be 32 bytes encoded in base64")
+	ErrUnknownEncryptionKey = errors.New("value is encrypted with an unknown key")
+	ErrCorruptEnvelope      = errors.New("encrypted value is corrupt")
+)
+
+// Keyring holds the master keys. New values are encrypted with the first key,
+// the others are only kept to read values written before a rotation.
+type Keyring struct {
+	current *masterKey
+	keys    map[string]*masterKey
+}
+
+type masterKey struct {
+	id   string
+	aead cipher.AEAD
+}
+
+// envelope is an encrypted value: the data is sealed with a random data key,
+// which is in turn sealed with a master key.
+type envelope struct {
+	keyID      string
+	wrapNonce  []byte
+	wrappedKey []byte
+	dataNonce  []byte
+	data       []byte
+}
+
+// ParseKeyring reads base64 encoded 32 byte keys separated by commas or new lines, current key first.
+// Blank lines and lines starting with # are skipped. An empty string gives a nil keyring.
+func ParseKeyring(text string) (*Keyring, error) {
+	keyring := &Keyring{keys: make(map[string]*masterKey)}
+	fields := strings.FieldsFunc(text, func(r rune) bool { return r == ',' || r == '\n' })
+	for _, field := range fields {
+		field = strings.TrimSpace(field)
+		if field == "" || strings.HasPrefix(field, "#") {
+			continue
+		}
+
+		raw, err := base64.StdEncoding.DecodeString(field)
+		if err != nil || len(raw) != masterKeySize {
+			return nil, ErrInvalidEncryptionKey
+		}
+		key, err := newMasterKey(raw)
+		if err != nil {
+			return nil, err
+		}
+
+		if keyring.current == nil {
+			keyring.current = key
+		}
+		keyring.keys[key.id] = key
+	}
+
+	if keyring.current == nil {
+		return nil, nil
+	}
+	return keyring, nil
+}
+
+// CurrentKeyID identifies the key new values are encrypted with.
+func (k *Keyring) CurrentKeyID() string {
+	return k.current.id
+}
+
+func newMasterKey(raw []byte) (*masterKey, error) {
+	aead, err := newAEAD(raw)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(raw)
+	return &masterKey{id: hex.EncodeToString(sum[:keyIDSize]), aead: aead}, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// seal encrypts the value, aad binds it to its bucket and key so it cannot be moved to another record.
+func (k *Keyring) seal(aad, value []byte) ([]byte, error) {
+	dataKey := make([]byte, dataKeySize)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, err
+	}
+	dataAEAD, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	e := &envelope{keyID: k.current.id, dataNonce: make([]byte, dataAEAD.NonceSize())}
+	if _, err := rand.Read(e.dataNonce); err != nil {
+		return nil, err
+	}
+	e.data = dataAEAD.Seal(nil, e.dataNonce, value, aad)
+
+	if err := k.wrap(e, dataKey); err != nil {
+		return nil, err
+	}
+	return e.marshal(), nil
+}
+
+// open decrypts the value, values stored before encryption was enabled are returned as they are.
+func (k *Keyring) open(aad, value []byte) ([]byte, error) {
+	if !bytes.HasPrefix(value, envelopeMagic) {
+		return value, nil
+	}
+
+	e, err := unmarshalEnvelope(value)
+	if err != nil {
+		return nil, err
+	}
+	dataKey, err := k.unwrap(e)
+	if err != nil {
+		return nil, err
+	}
+	dataAEAD, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	// a nil result would read as a missing key
+	plaintext, err := dataAEAD.Open([]byte{}, e.dataNonce, e.data, aad)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrCorruptEnvelope, err)
+	}
+	return plaintext, nil
+}
+
+// rotate returns the value encrypted with the current key, or nil if it already is.
+// Only the data key is sealed again, the data itself is left as it is.
+func (k *Keyring) rotate(aad, value []byte) ([]byte, error) {
+	if !bytes.HasPrefix(value, envelopeMagic) {
+		return k.seal(aad, value)
+	}
+
+	e, err := unmarshalEnvelope(value)
+	if err != nil {
+		return nil, err
+	}
+	if e.keyID == k.current.id {
+		return nil, nil
+	}
+
+	dataKey, err := k.unwrap(e)
+	if err != nil {
+		return nil, err
+	}
+	e.keyID = k.current.id
+	if err := k.wrap(e, dataKey); err != nil {
+		return nil, err
+	}
+	return e.marshal(), nil
+}
+
+// stale reports whether the value is not encrypted with the current key.
+func (k *Keyring) stale(value []byte) bool {
+	if !bytes.HasPrefix(value, envelopeMagic) {
+		return true
+	}
+	e, err := unmarshalEnvelope(value)
+	// corrupt values are left to rotate to report
+	return err != nil || e.keyID != k.current.id
+}
+
+func (k *Keyring) wrap(e *envelope, dataKey []byte) error {
+	e.wrapNonce = make([]byte, k.current.aead.NonceSize())
+	if _, err := rand.Read(e.wrapNonce); err != nil {
+		return err
+	}
+	e.wrappedKey = k.current.aead.Seal(nil, e.wrapNonce, dataKey, []byte(e.keyID))
+	return nil
+}
+
+func (k *Keyring) unwrap(e *envelope) ([]byte, error) {
+	key, ok := k.keys[e.keyID]
+	if !ok {
+		return nil, fmt.Errorf("%w %s", ErrUnknownEncryptionKey, e.keyID)
+	}
+	dataKey, err := key.aead.Open(nil, e.wrapNonce, e.wrappedKey, []byte(e.keyID))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrCorruptEnvelope, err)
+	}
+	return dataKey, nil
+}
+
+// marshal lays the envelope out as the magic, then the key ID, the nonces and
+// the wrapped key each prefixed with a length byte, then the data.
+func (e *envelope) marshal() []byte {
+	var buf bytes.Buffer
+	buf.Write(envelopeMagic)
+	for _, field := range [][]byte{[]byte(e.keyID), e.wrapNonce, e.wrappedKey, e.dataNonce} {
+		buf.WriteByte(byte(len(field)))
+		buf.Write(field)
+	}
+	buf.Write(e.data)
+	return buf.Bytes()
+}
+
+func unmarshalEnvelope(value []byte) (*envelope, error) {
+	rest := value[len(envelopeMagic):]
+	fields := make([][]byte, 4)
+	for i := range fields {
+		if len(rest) == 0 || len(rest) < 1+int(rest[0]) {
+			return nil, ErrCorruptEnvelope
+		}
+		fields[i], rest = rest[1:1+int(rest[0])], rest[1+int(rest[0]):]
+	}
+
+	return &envelope{
+		keyID:      string(fields[0]),
+		wrapNonce:  fields[1],
+		wrappedKey: fields[2],
+		dataNonce:  fields[3],
+		data:       rest,
+	}, nil
+}
+
+func recordAAD(bucket, key []byte) []byte {
+	aad := make([]byte, 0, len(bucket)+1+len(key))
+	aad = append(aad, bucket...)
+	aad = append(aad, 0)
+	return append(aad, key...)
+}
+
+// encryptedEngine encrypts the values of another engine, keys stay readable for lookups and prefix scans.
+type encryptedEngine struct {
+	Engine
+	keyring *Keyring
+}
+
+type encryptedTx struct {
+	tx      Tx
+	keyring *Keyring
+	// err keeps the first value that failed to decrypt in Get, the transaction fails with it
+	err error
+}
+
+type encryptedBucket struct {
+	tx     *encryptedTx
+	bucket Bucket
+	name   []byte
+}
+
+// NewEncryptedEngine wraps the engine so that values are encrypted with the keyring.
+func NewEncryptedEngine(engine Engine, keyring *Keyring) Engine {
+	return &encryptedEngine{Engine: engine, keyring: keyring}
+}
+
+func (e *encryptedEngine) View(fn func(tx Tx) error) error {
+	return e.Engine.View(e.wrap(fn))
+}
+
+func (e *encryptedEngine) Update(fn func(tx Tx) error) error {
+	return e.Engine.Update(e.wrap(fn))
+}
+
+func (e *encryptedEngine) wrap(fn func(tx Tx) error) func(tx Tx) error {
+	return func(tx Tx) error {
+		wrapped := &encryptedTx{tx: tx, keyring: e.keyring}
+		err := fn(wrapped)
+		// fn sees a value that failed to decrypt as missing, which is not the cause to report
+		if wrapped.err != nil {
+			return wrapped.err
+		}
+		return err
+	}
+}
+
+// rotateKeys encrypts the values of the buckets with the current key, including
+// the ones stored in plaintext, and returns the number of rewritten values.
+func (e *encryptedEngine) rotateKeys(ctx context.Context, bucketNames []string) (int, error) {
+	rotated := 0
+	for _, name := range bucketNames {
+		var keys [][]byte
+		if err := e.Engine.View(func(tx Tx) error {
+			bucket := tx.Bucket([]byte(name))
+			if bucket == nil {
+				return nil
+			}
+			return bucket.ForEachPrefix(nil, func(k, v []byte) error {
+				if e.keyring.stale(v) {
+					keys = append(keys, bytes.Clone(k))
+				}
+				return nil
+			})
+		}); err != nil {
+			return rotated, err
+		}
+
+		for start := 0; start < len(keys); start += rotationBatchSize {
+			if err := ctx.Err(); err != nil {
+				return rotated, err
+			}
+
+			batch := keys[start:min(start+rotationBatchSize, len(keys))]
+			if err := e.Engine.Update(func(tx Tx) error {
+				bucket := tx.Bucket([]byte(name))
+				for _, k := range batch {
+					// the record may have changed since it was listed
+					value := bucket.Get(k)
+					if value == nil {
+						continue
+					}
+					sealed, err := e.keyring.rotate(recordAAD([]byte(name), k), value)
+					if err != nil {
+						return fmt.Errorf("failed to rotate key of %s in bucket %s: %w", k, name, err)
+					}
+					if sealed == nil {
+						continue
+					}
+					if err := bucket.Put(k, sealed); err != nil {
+						return err
+					}
+					rotated++
+				}
+				return nil
+			}); err != nil {
+				return rotated, err
+			}
+		}
+	}
+
+	return rotated, nil
+}
+
+func (t *encryptedTx) Bucket(name []byte) Bucket {
+	bucket := t.tx.Bucket(name)
+	if bucket == nil {
+		return nil
+	}
+	return &encryptedBucket{tx: t, bucket: bucket, name: bytes.Clone(name)}
+}
+
+func (t *encryptedTx) CreateBucketIfNotExists(name []byte) (Bucket, error) {
+	bucket, err := t.tx.CreateBucketIfNotExists(name)
+	if err != nil {
+		return nil, err
+	}
+	return &encryptedBucket{tx: t, bucket: bucket, name: bytes.Clone(name)}, nil
+}
+
+func (b *encryptedBucket) Get(key []byte) []byte {
+	value := b.bucket.Get(key)
+	if value == nil {
+		return nil
+	}
+
+	plaintext, err := b.tx.keyring.open(recordAAD(b.name, key), value)
+	if err != nil {
+		if b.tx.err == nil {
+			b.tx.err = fmt.Errorf("failed to decrypt %s in bucket %s: %w", key, b.name, err)
+		}
+		return nil
+	}
+	return plaintext
+}
+
+func (b *encryptedBucket) Put(key, value []byte) error {
+	sealed, err := b.tx.keyring.seal(recordAAD(b.name, key), value)
+	if err != nil {
+		return fmt.Errorf("failed to encrypt %s in bucket %s: %w", key, b.name, err)
+	}
+	return b.bucket.Put(key, sealed)
+}
+
+func (b *encryptedBucket) Delete(key []byte) error {
+	return b.bucket.Delete(key)
+}
+
+func (b *encryptedBucket) ForEachPrefix(prefix []byte, fn func(k, v []byte) error) error {
+	return b.bucket.ForEachPrefix(prefix, func(k, v []byte) error {
+		plaintext, err := b.tx.keyring.open(recordAAD(b.name, k), v)
+		if err != nil {
+			return fmt.Errorf("failed to decrypt %s in bucket %s: %w", k, b.name, err)
+		}
+		return fn(k, plaintext)
+	})
+}
+
+func (b *encryptedBucket) ForEachRange(start, end []byte, fn func(k, v []byte) error) error {
+	return b.bucket.ForEachRange(start, end, func(k, v []byte) error {
+		plaintext, err := b.tx.keyring.open(recordAAD(b.name, k), v)
+		if err != nil {
+			return fmt.Errorf("failed to decrypt %s in bucket %s: %w", k, b.name, err)
+		}
+		return fn(k, plaintext)
+	})
+}
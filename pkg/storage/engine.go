@@ -0,0 +1,70 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+)
+
+const (
+	BackendBolt   string = "bolt"
+	BackendMemory string = "memory"
+	BackendSQLite string = "sqlite"
+)
+
+var (
+	Backends = []string{BackendBolt, BackendMemory, BackendSQLite}
+
+	ErrUnknownBackend = errors.New("unknown storage backend")
+)
+
+// Engine is a transactional key-value store with named buckets of keys kept in byte order.
+// Storage keeps its records on top of it, so every backend behaves the same.
+type Engine interface {
+	// View runs fn in a read-only transaction.
+	View(fn func(tx Tx) error) error
+	// Update runs fn in a read-write transaction, which is rolled back if fn returns an error.
+	Update(fn func(tx Tx) error) error
+	// Size returns the space taken by the data in bytes.
+	Size() (int64, error)
+	// Path is the database file, empty if nothing is kept on disk.
+	Path() string
+	// Snapshot writes a consistent copy of the database to path, which the same backend can open.
+	Snapshot(path string) error
+	// Compact rewrites the database so that it takes no more space than the data needs.
+	Compact() error
+	Close() error
+}
+
+type Tx interface {
+	// Bucket returns nil if the bucket does not exist.
+	Bucket(name []byte) Bucket
+	CreateBucketIfNotExists(name []byte) (Bucket, error)
+}
+
+// Bucket values are only valid until the end of the transaction.
+type Bucket interface {
+	// Get returns nil if the key does not exist.
+	Get(key []byte) []byte
+	Put(key, value []byte) error
+	Delete(key []byte) error
+	// ForEachPrefix calls fn for every key starting with prefix in byte order, an empty prefix visits the whole bucket.
+	// The bucket may be modified from fn.
+	ForEachPrefix(prefix []byte, fn func(k, v []byte) error) error
+	// ForEachRange calls fn for every key from start up to but not including end in byte order,
+	// a nil end runs to the last key. The bucket may be modified from fn.
+	ForEachRange(start, end []byte, fn func(k, v []byte) error) error
+}
+
+// OpenEngine opens the backend at path, the memory backend ignores the path.
+func OpenEngine(backend, path string) (Engine, error) {
+	switch backend {
+	case BackendBolt:
+		return NewBoltEngine(path)
+	case BackendMemory:
+		return NewMemoryEngine(), nil
+	case BackendSQLite:
+		return NewSQLiteEngine(path)
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrUnknownBackend, backend)
+	}
+}
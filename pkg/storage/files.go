@@ -0,0 +1,129 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const (
+	filesBucket string = "files"
+)
+
+var ErrFileNotFound = errors.New("file not found")
+
+// RemoteFile is a file uploaded through the Gemini Files API on behalf of a user.
+type RemoteFile struct {
+	UserID      int64
+	Name        string
+	DisplayName string
+	URI         string
+	MIMEType    string
+	SizeBytes   int64
+	// KeyID identifies the API key the file was uploaded with, other keys cannot read it.
+	KeyID     string
+	CreatedAt time.Time
+	ExpiresAt time.Time
+}
+
+func (s *Storage) SaveRemoteFile(file *RemoteFile) error {
+	return s.db.Update(func(tx Tx) error {
+		bucket := tx.Bucket([]byte(filesBucket))
+		if bucket == nil {
+			return fmt.Errorf("bucket %s not found", filesBucket)
+		}
+
+		data, err := json.Marshal(file)
+		if err != nil {
+			return fmt.Errorf("failed to marshal file: %w", err)
+		}
+
+		key := remoteFileKey(file.UserID, file.Name)
+		if err := bucket.Put(key, data); err != nil {
+			return fmt.Errorf("failed to save file %s: %w", key, err)
+		}
+
+		return nil
+	})
+}
+
+func (s *Storage) GetRemoteFile(userID int64, name string) (*RemoteFile, error) {
+	file := &RemoteFile{}
+	err := s.db.View(func(tx Tx) error {
+		bucket := tx.Bucket([]byte(filesBucket))
+		if bucket == nil {
+			return fmt.Errorf("bucket %s not found", filesBucket)
+		}
+
+		data := bucket.Get(remoteFileKey(userID, name))
+		if data == nil {
+			return ErrFileNotFound
+		}
+
+		if err := json.Unmarshal(data, file); err != nil {
+			return fmt.Errorf("failed to unmarshal file %s: %w", name, err)
+		}
+
+		return nil
+	})
+
+	return file, err
+}
+
+// ListRemoteFiles returns the user's files, oldest first.
+func (s *Storage) ListRemoteFiles(userID int64) ([]RemoteFile, error) {
+	var files []RemoteFile
+	err := s.db.View(func(tx Tx) error {
+		bucket := tx.Bucket([]byte(filesBucket))
+		if bucket == nil {
+			return fmt.Errorf("bucket %s not found", filesBucket)
+		}
+
+		prefix := []byte(strconv.FormatInt(userID, 10) + "/")
+		if err := bucket.ForEachPrefix(prefix, func(k, v []byte) error {
+			var file RemoteFile
+			if err := json.Unmarshal(v, &file); err != nil {
+				return fmt.Errorf("failed to unmarshal file %s: %w", k, err)
+			}
+			files = append(files, file)
+			return nil
+		}); err != nil {
+			return err
+		}
+
+		return nil
+	})
+
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].CreatedAt.Before(files[j].CreatedAt)
+	})
+
+	return files, err
+}
+
+func (s *Storage) DeleteRemoteFile(userID int64, name string) error {
+	return s.db.Update(func(tx Tx) error {
+		bucket := tx.Bucket([]byte(filesBucket))
+		if bucket == nil {
+			return fmt.Errorf("bucket %s not found", filesBucket)
+		}
+
+		key := remoteFileKey(userID, name)
+		if bucket.Get(key) == nil {
+			return ErrFileNotFound
+		}
+
+		if err := bucket.Delete(key); err != nil {
+			return fmt.Errorf("failed to delete file %s: %w", key, err)
+		}
+
+		return nil
+	})
+}
+
+func remoteFileKey(userID int64, name string) []byte {
+	return []byte(strconv.FormatInt(userID, 10) + "/" + name)
+}
@@ -0,0 +1,88 @@
+package storage
+
+import (
+	"slices"
+)
+
+const noNode int = -1
+
+// HistoryTree keeps every message of a conversation. Editing an earlier message
+// forks the conversation, so a node can have several children, one per branch.
+type HistoryTree struct {
+	Nodes []HistoryNode
+	// Head is the last node of the active branch
+	Head int
+}
+
+type HistoryNode struct {
+	Parent  int
+	Message Message
+}
+
+// Branch is a path from the root to a leaf of the tree.
+type Branch struct {
+	Leaf     int
+	Messages []Message
+	Active   bool
+}
+
+func newHistoryTree() HistoryTree {
+	return HistoryTree{Head: noNode}
+}
+
+// Path returns the messages from the root to the node.
+func (t *HistoryTree) Path(node int) []Message {
+	var messages []Message
+	for ; node != noNode && node < len(t.Nodes); node = t.Nodes[node].Parent {
+		messages = append(messages, t.Nodes[node].Message)
+	}
+	slices.Reverse(messages)
+	return messages
+}
+
+// Merge makes the messages the active branch. The longest common prefix with the
+// existing nodes is reused, the rest is added as a new branch.
+func (t *HistoryTree) Merge(messages []Message) {
+	children := make(map[int][]int, len(t.Nodes))
+	for i, node := range t.Nodes {
+		children[node.Parent] = append(children[node.Parent], i)
+	}
+
+	parent := noNode
+	for _, message := range messages {
+		child := slices.IndexFunc(children[parent], func(i int) bool {
+			return SameMessage(t.Nodes[i].Message, message)
+		})
+		if child == -1 {
+			t.Nodes = append(t.Nodes, HistoryNode{Parent: parent, Message: message})
+			children[parent] = append(children[parent], len(t.Nodes)-1)
+			parent = len(t.Nodes) - 1
+			continue
+		}
+		parent = children[parent][child]
+	}
+	t.Head = parent
+}
+
+// Branches returns every branch of the tree in creation order.
+func (t *HistoryTree) Branches() []Branch {
+	hasChildren := make([]bool, len(t.Nodes))
+	for _, node := range t.Nodes {
+		if node.Parent != noNode {
+			hasChildren[node.Parent] = true
+		}
+	}
+
+	var branches []Branch
+	for i := range t.Nodes {
+		if !hasChildren[i] {
+			branches = append(branches, Branch{Leaf: i, Messages: t.Path(i), Active: i == t.Head})
+		}
+	}
+	return branches
+}
+
+// SameMessage tells if a and b are the same message of a conversation, attachment data is not compared.
+func SameMessage(a, b Message) bool {
+	return a.Role == b.Role && a.Text == b.Text && a.MessageID == b.MessageID && len(a.Attachments) == len(b.Attachments)
+}
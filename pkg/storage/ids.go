@@ -0,0 +1,113 @@
+package storage
+
+import (
+	"crypto/rand"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Record IDs are ULIDs: a 48-bit millisecond timestamp followed by 80 random bits, written in
+// Crockford's base32 so that the IDs sort in the order they were created.
+const (
+	idLength     int    = 26
+	idTimeLength int    = 10
+	idAlphabet   string = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+)
+
+var ids = &idGenerator{}
+
+type idGenerator struct {
+	mu     sync.Mutex
+	lastMs int64
+	last   [16]byte
+}
+
+// newID returns a new ID for the current time.
+func newID() string {
+	return ids.at(time.Now())
+}
+
+// at returns a new ID for t. IDs of the same millisecond increment the random part of the
+// previous one, so they still sort in the order they were generated.
+func (g *idGenerator) at(t time.Time) string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	ms := t.UnixMilli()
+	if ms == g.lastMs && increment(g.last[6:]) {
+		return encodeID(g.last)
+	}
+
+	var id [16]byte
+	putTime(id[:6], ms)
+	rand.Read(id[6:])
+	g.lastMs, g.last = ms, id
+	return encodeID(id)
+}
+
+// idPrefix is the time part of the IDs created at t, every ID of an earlier millisecond sorts before it.
+func idPrefix(t time.Time) string {
+	var id [16]byte
+	putTime(id[:6], t.UnixMilli())
+	return encodeID(id)[:idTimeLength]
+}
+
+// idTime returns the creation time of an ID, ok is false if id is not one.
+func idTime(id string) (t time.Time, ok bool) {
+	if !isID(id) {
+		return time.Time{}, false
+	}
+
+	var ms int64
+	for _, c := range id[:idTimeLength] {
+		ms = ms<<5 | int64(strings.IndexRune(idAlphabet, c))
+	}
+	return time.UnixMilli(ms), true
+}
+
+func isID(s string) bool {
+	if len(s) != idLength {
+		return false
+	}
+	for _, c := range s {
+		if !strings.ContainsRune(idAlphabet, c) {
+			return false
+		}
+	}
+	// 26 characters hold 130 bits, the first one has only 3
+	return s[0] <= '7'
+}
+
+func putTime(b []byte, ms int64) {
+	for i := range 6 {
+		b[i] = byte(ms >> (8 * (5 - i)))
+	}
+}
+
+// increment adds one to the big-endian number in b, it returns false on overflow.
+func increment(b []byte) bool {
+	for i := len(b) - 1; i >= 0; i-- {
+		b[i]++
+		if b[i] != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// encodeID writes the 128 bits of id as 26 characters, the two extra leading bits are zero.
+func encodeID(id [16]byte) string {
+	var out [idLength]byte
+	for i := range out {
+		var v byte
+		for j := range 5 {
+			bit := i*5 + j - 2
+			if bit >= 0 && id[bit/8]&(0x80>>(bit%8)) != 0 {
+				v |= 1 << (4 - j)
+			}
+		}
+		out[i] = idAlphabet[v]
+	}
+	return string(out[:])
+}
@@ -0,0 +1,182 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"slices"
+	"strings"
+	"sync"
+)
+
+var (
+	errReadOnlyTx = errors.New("transaction is read-only")
+	errNoSnapshot = errors.New("the memory backend cannot be copied to a file")
+)
+
+// memoryEngine keeps everything in maps, it is meant for tests and throwaway runs.
+type memoryEngine struct {
+	mu      sync.RWMutex
+	buckets map[string]map[string][]byte
+}
+
+type memoryTx struct {
+	engine   *memoryEngine
+	writable bool
+	// undo restores the state changed by the transaction if it fails
+	undo []func()
+}
+
+type memoryBucket struct {
+	tx   *memoryTx
+	name string
+}
+
+func NewMemoryEngine() Engine {
+	return &memoryEngine{buckets: make(map[string]map[string][]byte)}
+}
+
+func (e *memoryEngine) View(fn func(tx Tx) error) error {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return fn(&memoryTx{engine: e})
+}
+
+func (e *memoryEngine) Update(fn func(tx Tx) error) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	tx := &memoryTx{engine: e, writable: true}
+	if err := fn(tx); err != nil {
+		for i := len(tx.undo) - 1; i >= 0; i-- {
+			tx.undo[i]()
+		}
+		return err
+	}
+	return nil
+}
+
+func (e *memoryEngine) Size() (int64, error) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	var size int64
+	for _, bucket := range e.buckets {
+		for k, v := range bucket {
+			size += int64(len(k) + len(v))
+		}
+	}
+	return size, nil
+}
+
+func (e *memoryEngine) Path() string {
+	return ""
+}
+
+func (e *memoryEngine) Snapshot(path string) error {
+	return errNoSnapshot
+}
+
+func (e *memoryEngine) Compact() error {
+	return nil
+}
+
+func (e *memoryEngine) Close() error {
+	return nil
+}
+
+func (t *memoryTx) Bucket(name []byte) Bucket {
+	if _, ok := t.engine.buckets[string(name)]; !ok {
+		return nil
+	}
+	return &memoryBucket{tx: t, name: string(name)}
+}
+
+func (t *memoryTx) CreateBucketIfNotExists(name []byte) (Bucket, error) {
+	if !t.writable {
+		return nil, errReadOnlyTx
+	}
+	if _, ok := t.engine.buckets[string(name)]; !ok {
+		t.engine.buckets[string(name)] = make(map[string][]byte)
+		t.undo = append(t.undo, func() { delete(t.engine.buckets, string(name)) })
+	}
+	return &memoryBucket{tx: t, name: string(name)}, nil
+}
+
+func (b *memoryBucket) Get(key []byte) []byte {
+	return b.tx.engine.buckets[b.name][string(key)]
+}
+
+func (b *memoryBucket) Put(key, value []byte) error {
+	if !b.tx.writable {
+		return errReadOnlyTx
+	}
+	b.remember(string(key))
+	b.tx.engine.buckets[b.name][string(key)] = bytes.Clone(value)
+	return nil
+}
+
+func (b *memoryBucket) Delete(key []byte) error {
+	if !b.tx.writable {
+		return errReadOnlyTx
+	}
+	b.remember(string(key))
+	delete(b.tx.engine.buckets[b.name], string(key))
+	return nil
+}
+
+func (b *memoryBucket) ForEachPrefix(prefix []byte, fn func(k, v []byte) error) error {
+	// like bolt, fn sees the bucket as it was when the iteration started
+	bucket := b.tx.engine.buckets[b.name]
+	var keys []string
+	for k := range bucket {
+		if strings.HasPrefix(k, string(prefix)) {
+			keys = append(keys, k)
+		}
+	}
+	slices.Sort(keys)
+	values := make([][]byte, len(keys))
+	for i, k := range keys {
+		values[i] = bucket[k]
+	}
+
+	for i, k := range keys {
+		if err := fn([]byte(k), values[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *memoryBucket) ForEachRange(start, end []byte, fn func(k, v []byte) error) error {
+	bucket := b.tx.engine.buckets[b.name]
+	var keys []string
+	for k := range bucket {
+		if k >= string(start) && (end == nil || k < string(end)) {
+			keys = append(keys, k)
+		}
+	}
+	slices.Sort(keys)
+	values := make([][]byte, len(keys))
+	for i, k := range keys {
+		values[i] = bucket[k]
+	}
+
+	for i, k := range keys {
+		if err := fn([]byte(k), values[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *memoryBucket) remember(key string) {
+	bucket := b.tx.engine.buckets[b.name]
+	previous, existed := bucket[key]
+	b.tx.undo = append(b.tx.undo, func() {
+		if existed {
+			bucket[key] = previous
+		} else {
+			delete(bucket, key)
+		}
+	})
+}
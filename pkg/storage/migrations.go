@@ -0,0 +1,240 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/go-multierror"
+)
+
+const (
+	metaBucket       string = "meta"
+	schemaVersionKey string = "schemaVersion"
+	backupTimeLayout string = "20060102-150405"
+)
+
+var (
+	buckets = []string{usersBucket, responseBucket, geminiErrorsBucket, embeddingsBucket, promptsBucket, filesBucket,
+		conversationsBucket, messagesBucket, responseIndexBucket, errorIndexBucket, legacyKeysBucket, auditBucket, metaBucket}
+
+	errDryRun = errors.New("dry run")
+)
+
+// migration upgrades the stored records to its version. Migrations run in order of
+// version, the ones above the stored schema version run once at startup.
+type migration struct {
+	version int
+	name    string
+	// destructive migrations drop data, a backup of the database is taken before they run
+	destructive bool
+	run         func(tx Tx, step *MigrationStep) error
+}
+
+// Append new migrations at the end with the next version, never change the released ones.
+var migrations = []migration{
+	{version: 1, name: "move history into conversations", destructive: true, run: migrateHistory},
+	{version: 2, name: "timestamp responses", run: timestampResponses},
+	// records written by this version are not readable by older builds
+	{version: 3, name: "split conversations into messages", destructive: true, run: splitConversations},
+	{version: 4, name: "order responses and errors by time", run: orderRecords},
+	// embeddings that are not on the active branch of a stored conversation are dropped
+	{version: 5, name: "key embeddings by message", destructive: true, run: keyEmbeddings},
+	// logged requests with inline attachments can no longer be replayed with them
+	{version: 6, name: "hash attachments of error logs", destructive: true, run: hashLoggedAttachments},
+}
+
+// MigrationReport describes the migrations run, or the ones that would run in a dry run.
+type MigrationReport struct {
+	From   int
+	To     int
+	DryRun bool
+	// Backup is the copy of the database taken before destructive migrations
+	Backup string
+	Steps  []MigrationStep
+}
+
+type MigrationStep struct {
+	Version int
+	Name    string
+	Changes []string
+}
+
+func (s *MigrationStep) changed(format string, args ...any) {
+	s.Changes = append(s.Changes, fmt.Sprintf(format, args...))
+}
+
+func (r *MigrationReport) String() string {
+	var sb strings.Builder
+	if r.From == r.To {
+		fmt.Fprintf(&sb, "schema is up to date at version %d", r.To)
+		return sb.String()
+	}
+
+	verb := "migrated"
+	if r.DryRun {
+		verb = "would migrate"
+	}
+	fmt.Fprintf(&sb, "%s schema from version %d to %d", verb, r.From, r.To)
+	if r.Backup != "" {
+		fmt.Fprintf(&sb, ", backup at %s", r.Backup)
+	}
+	for _, step := range r.Steps {
+		fmt.Fprintf(&sb, "\n%d. %s: %d changes", step.Version, step.Name, len(step.Changes))
+		for _, change := range step.Changes {
+			fmt.Fprintf(&sb, "\n   - %s", change)
+		}
+	}
+	return sb.String()
+}
+
+// PlanMigrations reports what the startup migrations would change without changing anything.
+func PlanMigrations(db Engine) (*MigrationReport, error) {
+	return migrate(db, true)
+}
+
+// migrate creates the buckets and runs the pending migrations in a single transaction.
+func migrate(db Engine, dryRun bool) (*MigrationReport, error) {
+	current, fresh, err := schemaVersion(db)
+	if err != nil {
+		return nil, err
+	}
+
+	pending := slices.DeleteFunc(slices.Clone(migrations), func(m migration) bool {
+		return m.version <= current
+	})
+	report := &MigrationReport{From: current, To: current, DryRun: dryRun}
+
+	// a new database has nothing to lose
+	if !dryRun && !fresh && slices.ContainsFunc(pending, func(m migration) bool { return m.destructive }) {
+		if report.Backup, err = backup(db, current); err != nil {
+			return nil, fmt.Errorf("failed to back up the database before migrating: %w", err)
+		}
+	}
+
+	err = db.Update(func(tx Tx) error {
+		var multiErr error
+		for _, bucketName := range buckets {
+			if _, err := tx.CreateBucketIfNotExists([]byte(bucketName)); err != nil {
+				multiErr = multierror.Append(multiErr, fmt.Errorf("failed to create %s bucket: %w", bucketName, err))
+			}
+		}
+		if multiErr != nil {
+			return multiErr
+		}
+
+		for _, m := range pending {
+			step := MigrationStep{Version: m.version, Name: m.name}
+			if err := m.run(tx, &step); err != nil {
+				return fmt.Errorf("migration %d (%s) failed: %w", m.version, m.name, err)
+			}
+			report.Steps = append(report.Steps, step)
+			report.To = m.version
+		}
+
+		meta := tx.Bucket([]byte(metaBucket))
+		if err := meta.Put([]byte(schemaVersionKey), []byte(strconv.Itoa(report.To))); err != nil {
+			return fmt.Errorf("failed to save schema version: %w", err)
+		}
+
+		if dryRun {
+			return errDryRun
+		}
+		return nil
+	})
+	if dryRun && errors.Is(err, errDryRun) {
+		err = nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return report, nil
+}
+
+// schemaVersion returns the stored schema version, fresh is set if the database has no data yet.
+func schemaVersion(db Engine) (version int, fresh bool, err error) {
+	err = db.View(func(tx Tx) error {
+		meta := tx.Bucket([]byte(metaBucket))
+		if meta == nil {
+			// stored before versioning, or nothing stored yet
+			fresh = tx.Bucket([]byte(usersBucket)) == nil
+			return nil
+		}
+
+		data := meta.Get([]byte(schemaVersionKey))
+		if data == nil {
+			return nil
+		}
+
+		var err error
+		if version, err = strconv.Atoi(string(data)); err != nil {
+			return fmt.Errorf("invalid schema version %q: %w", data, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, false, err
+	}
+
+	if latest := migrations[len(migrations)-1].version; version > latest {
+		return 0, false, fmt.Errorf("schema version %d is newer than %d supported by this build", version, latest)
+	}
+	return version, fresh, nil
+}
+
+// backup copies the database next to it, backends without a file are not backed up.
+func backup(db Engine, version int) (string, error) {
+	if db.Path() == "" {
+		return "", nil
+	}
+
+	path := fmt.Sprintf("%s.v%d-%s.bak", db.Path(), version, time.Now().Format(backupTimeLayout))
+	if err := db.Snapshot(path); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// timestampResponses dates the responses saved without a creation time to the migration,
+// so retention by age starts counting for them now.
+func timestampResponses(tx Tx, step *MigrationStep) error {
+	bucket := tx.Bucket([]byte(responseBucket))
+	if bucket == nil {
+		return fmt.Errorf("bucket %s not found", responseBucket)
+	}
+
+	now := time.Now()
+	dated := 0
+	if err := bucket.ForEachPrefix(nil, func(k, v []byte) error {
+		var response Response
+		if err := json.Unmarshal(v, &response); err != nil {
+			return fmt.Errorf("failed to unmarshal response %s: %w", k, err)
+		}
+		if !response.CreatedAt.IsZero() {
+			return nil
+		}
+
+		response.CreatedAt = now
+		data, err := json.Marshal(response)
+		if err != nil {
+			return fmt.Errorf("failed to marshal response: %w", err)
+		}
+		if err := bucket.Put(k, data); err != nil {
+			return fmt.Errorf("failed to save response %s: %w", k, err)
+		}
+		dated++
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	if dated > 0 {
+		step.changed("dated %d responses saved without a creation time", dated)
+	}
+	return nil
+}
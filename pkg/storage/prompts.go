@@ -0,0 +1,225 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const (
+	promptsBucket      string = "prompts"
+	sharedPromptsOwner string = "shared"
+)
+
+var (
+	ErrPromptNotFound  = errors.New("prompt template not found")
+	ErrPromptNameTaken = errors.New("a shared prompt template of another user has this name")
+)
+
+// PromptTemplate is a reusable prompt with {{placeholders}}.
+type PromptTemplate struct {
+	Name    string
+	Text    string
+	OwnerID int64
+	Shared  bool
+	// Command exposes a personal template as a /name slash command.
+	Command   bool
+	CreatedAt time.Time
+}
+
+// SavePrompt stores a personal template, or a shared one if template.Shared is set.
+func (s *Storage) SavePrompt(template *PromptTemplate) error {
+	return s.db.Update(func(tx Tx) error {
+		bucket := tx.Bucket([]byte(promptsBucket))
+		if bucket == nil {
+			return fmt.Errorf("bucket %s not found", promptsBucket)
+		}
+
+		data, err := json.Marshal(template)
+		if err != nil {
+			return fmt.Errorf("failed to marshal prompt template: %w", err)
+		}
+
+		key := promptKey(template.OwnerID, template.Shared, template.Name)
+		if template.Shared {
+			if err := checkSharedOwner(bucket, key, template.OwnerID); err != nil {
+				return err
+			}
+		}
+		if err := bucket.Put(key, data); err != nil {
+			return fmt.Errorf("failed to save prompt template %s: %w", key, err)
+		}
+
+		return nil
+	})
+}
+
+// GetPrompt looks the name up in the user's templates first and in the shared ones then.
+func (s *Storage) GetPrompt(userID int64, name string) (*PromptTemplate, error) {
+	template := &PromptTemplate{}
+	err := s.db.View(func(tx Tx) error {
+		bucket := tx.Bucket([]byte(promptsBucket))
+		if bucket == nil {
+			return fmt.Errorf("bucket %s not found", promptsBucket)
+		}
+
+		data := bucket.Get(promptKey(userID, false, name))
+		if data == nil {
+			data = bucket.Get(promptKey(0, true, name))
+		}
+		if data == nil {
+			return ErrPromptNotFound
+		}
+
+		if err := json.Unmarshal(data, template); err != nil {
+			return fmt.Errorf("failed to unmarshal prompt template %s: %w", name, err)
+		}
+
+		return nil
+	})
+
+	return template, err
+}
+
+// ListPrompts returns the user's templates followed by the shared ones, both sorted by name.
+func (s *Storage) ListPrompts(userID int64) ([]PromptTemplate, error) {
+	var templates []PromptTemplate
+	err := s.db.View(func(tx Tx) error {
+		bucket := tx.Bucket([]byte(promptsBucket))
+		if bucket == nil {
+			return fmt.Errorf("bucket %s not found", promptsBucket)
+		}
+
+		for _, prefix := range [][]byte{promptPrefix(userID, false), promptPrefix(0, true)} {
+			if err := bucket.ForEachPrefix(prefix, func(k, v []byte) error {
+				var template PromptTemplate
+				if err := json.Unmarshal(v, &template); err != nil {
+					return fmt.Errorf("failed to unmarshal prompt template %s: %w", k, err)
+				}
+				templates = append(templates, template)
+				return nil
+			}); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+
+	sort.SliceStable(templates, func(i, j int) bool {
+		if templates[i].Shared != templates[j].Shared {
+			return !templates[i].Shared
+		}
+		return templates[i].Name < templates[j].Name
+	})
+
+	return templates, err
+}
+
+// SharePrompt moves a personal template of the user to the shared ones, it is no longer a command.
+func (s *Storage) SharePrompt(userID int64, name string) (*PromptTemplate, error) {
+	template := &PromptTemplate{}
+	err := s.db.Update(func(tx Tx) error {
+		bucket := tx.Bucket([]byte(promptsBucket))
+		if bucket == nil {
+			return fmt.Errorf("bucket %s not found", promptsBucket)
+		}
+
+		personalKey := promptKey(userID, false, name)
+		data := bucket.Get(personalKey)
+		if data == nil {
+			return ErrPromptNotFound
+		}
+		if err := json.Unmarshal(data, template); err != nil {
+			return fmt.Errorf("failed to unmarshal prompt template %s: %w", name, err)
+		}
+
+		sharedKey := promptKey(0, true, name)
+		if err := checkSharedOwner(bucket, sharedKey, userID); err != nil {
+			return err
+		}
+
+		template.Shared = true
+		template.Command = false
+		shared, err := json.Marshal(template)
+		if err != nil {
+			return fmt.Errorf("failed to marshal prompt template: %w", err)
+		}
+		if err := bucket.Put(sharedKey, shared); err != nil {
+			return fmt.Errorf("failed to save prompt template %s: %w", sharedKey, err)
+		}
+		if err := bucket.Delete(personalKey); err != nil {
+			return fmt.Errorf("failed to delete prompt template %s: %w", personalKey, err)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return template, nil
+}
+
+// checkSharedOwner fails if the shared template under key belongs to another user.
+func checkSharedOwner(bucket Bucket, key []byte, userID int64) error {
+	data := bucket.Get(key)
+	if data == nil {
+		return nil
+	}
+
+	var existing PromptTemplate
+	if err := json.Unmarshal(data, &existing); err != nil {
+		return fmt.Errorf("failed to unmarshal prompt template %s: %w", key, err)
+	}
+	if existing.OwnerID != userID {
+		return ErrPromptNameTaken
+	}
+	return nil
+}
+
+// DeletePrompt removes a personal template, or a shared one if the user shared it.
+func (s *Storage) DeletePrompt(userID int64, name string) error {
+	return s.db.Update(func(tx Tx) error {
+		bucket := tx.Bucket([]byte(promptsBucket))
+		if bucket == nil {
+			return fmt.Errorf("bucket %s not found", promptsBucket)
+		}
+
+		key := promptKey(userID, false, name)
+		if bucket.Get(key) == nil {
+			key = promptKey(0, true, name)
+			data := bucket.Get(key)
+			if data == nil {
+				return ErrPromptNotFound
+			}
+
+			var template PromptTemplate
+			if err := json.Unmarshal(data, &template); err != nil {
+				return fmt.Errorf("failed to unmarshal prompt template %s: %w", name, err)
+			}
+			if template.OwnerID != userID {
+				return ErrPromptNotFound
+			}
+		}
+
+		if err := bucket.Delete(key); err != nil {
+			return fmt.Errorf("failed to delete prompt template %s: %w", key, err)
+		}
+
+		return nil
+	})
+}
+
+func promptPrefix(userID int64, shared bool) []byte {
+	if shared {
+		return []byte(sharedPromptsOwner + "/")
+	}
+	return []byte(strconv.FormatInt(userID, 10) + "/")
+}
+
+func promptKey(userID int64, shared bool, name string) []byte {
+	return append(promptPrefix(userID, shared), name...)
+}
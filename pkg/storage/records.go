@@ -0,0 +1,323 @@
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Responses and error logs are stored under time ordered IDs, see newID. The index buckets hold
+// a `userID/ID` key without a value for each of them, so the records of a user sort by time too.
+const (
+	responseIndexBucket string = "responsesByUser"
+	errorIndexBucket    string = "errorsByUser"
+	// legacyKeysBucket maps the md5 keys of the records saved before IDs, see orderRecords
+	legacyKeysBucket string = "legacyKeys"
+)
+
+// RecordQuery selects responses or error logs, zero values do not restrict.
+type RecordQuery struct {
+	// UserID zero selects the records of every user
+	UserID int64
+	// From and To bound the creation time, To is excluded
+	From time.Time
+	To   time.Time
+	// Limit keeps the newest records only
+	Limit int
+}
+
+type recordKind struct {
+	bucket string
+	index  string
+	// parse returns the owner and the creation time of a record
+	parse func(data []byte) (int64, time.Time, error)
+}
+
+var (
+	responseRecords = recordKind{responseBucket, responseIndexBucket, func(data []byte) (int64, time.Time, error) {
+		var response Response
+		err := json.Unmarshal(data, &response)
+		return response.UserID, response.CreatedAt, err
+	}}
+	errorRecords = recordKind{geminiErrorsBucket, errorIndexBucket, func(data []byte) (int64, time.Time, error) {
+		var errorLog ErrorLog
+		err := json.Unmarshal(data, &errorLog)
+		return errorLog.UserID, errorLog.Timestamp, err
+	}}
+)
+
+// ListResponses returns the responses selected by query, newest first.
+func (s *Storage) ListResponses(query RecordQuery) ([]Response, error) {
+	var responses []Response
+	err := s.db.View(func(tx Tx) error {
+		return responseRecords.list(tx, query, func(id string, data []byte) error {
+			response := Response{ID: id}
+			if err := json.Unmarshal(data, &response); err != nil {
+				return fmt.Errorf("failed to unmarshal response %s: %w", id, err)
+			}
+			responses = append(responses, response)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return responses, nil
+}
+
+// ListErrors returns the error logs selected by query, newest first.
+func (s *Storage) ListErrors(query RecordQuery) ([]ErrorLog, error) {
+	var errorLogs []ErrorLog
+	err := s.db.View(func(tx Tx) error {
+		return errorRecords.list(tx, query, func(id string, data []byte) error {
+			errorLog := ErrorLog{ID: id}
+			if err := json.Unmarshal(data, &errorLog); err != nil {
+				return fmt.Errorf("failed to unmarshal error log %s: %w", id, err)
+			}
+			errorLogs = append(errorLogs, errorLog)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return errorLogs, nil
+}
+
+func (k recordKind) buckets(tx Tx) (records, index Bucket, err error) {
+	if records = tx.Bucket([]byte(k.bucket)); records == nil {
+		return nil, nil, fmt.Errorf("bucket %s not found", k.bucket)
+	}
+	if index = tx.Bucket([]byte(k.index)); index == nil {
+		return nil, nil, fmt.Errorf("bucket %s not found", k.index)
+	}
+	return records, index, nil
+}
+
+func (k recordKind) put(tx Tx, userID int64, id string, v any) error {
+	records, index, err := k.buckets(tx)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("failed to marshal %s record: %w", k.bucket, err)
+	}
+	if err := records.Put([]byte(id), data); err != nil {
+		return fmt.Errorf("failed to save %s record %s: %w", k.bucket, id, err)
+	}
+	return index.Put([]byte(indexKey(userID, id)), []byte{})
+}
+
+// get unmarshals the record under key into v and returns its ID, keys saved before IDs are looked up first.
+func (k recordKind) get(tx Tx, key string, notFound error, v any) (string, error) {
+	id := key
+	if !isID(key) {
+		legacy := tx.Bucket([]byte(legacyKeysBucket))
+		if legacy == nil {
+			return "", fmt.Errorf("bucket %s not found", legacyKeysBucket)
+		}
+		stored := legacy.Get([]byte(legacyKey(k.bucket, key)))
+		if stored == nil {
+			return "", notFound
+		}
+		id = string(stored)
+	}
+
+	if err := getRecordByKey(tx, k.bucket, id, notFound, v); err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+// list calls fn for the records selected by query, newest first.
+func (k recordKind) list(tx Tx, query RecordQuery, fn func(id string, data []byte) error) error {
+	records, index, err := k.buckets(tx)
+	if err != nil {
+		return err
+	}
+
+	type entry struct {
+		id   string
+		data []byte
+	}
+	var entries []entry
+	if query.UserID == 0 {
+		start, end := query.bounds("")
+		err = records.ForEachRange(start, end, func(key, v []byte) error {
+			entries = append(entries, entry{id: string(key), data: v})
+			return nil
+		})
+	} else {
+		prefix := indexKey(query.UserID, "")
+		start, end := query.bounds(prefix)
+		err = index.ForEachRange(start, end, func(key, _ []byte) error {
+			entries = append(entries, entry{id: strings.TrimPrefix(string(key), prefix)})
+			return nil
+		})
+	}
+	if err != nil {
+		return err
+	}
+
+	if query.Limit > 0 && len(entries) > query.Limit {
+		entries = entries[len(entries)-query.Limit:]
+	}
+	for i := len(entries) - 1; i >= 0; i-- {
+		data := entries[i].data
+		if data == nil {
+			if data = records.Get([]byte(entries[i].id)); data == nil {
+				continue
+			}
+		}
+		if err := fn(entries[i].id, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// prune deletes the records older than MaxAge and all but the MaxPerUser newest ones of every user.
+func (k recordKind) prune(tx Tx, policy RetentionPolicy, now time.Time) (int, error) {
+	records, index, err := k.buckets(tx)
+	if err != nil {
+		return 0, err
+	}
+
+	// the index keys of a user follow each other, oldest first
+	var users [][]string
+	lastUser := ""
+	if err := index.ForEachPrefix(nil, func(key, _ []byte) error {
+		user, _, _ := strings.Cut(string(key), "/")
+		if len(users) == 0 || user != lastUser {
+			users = append(users, nil)
+			lastUser = user
+		}
+		users[len(users)-1] = append(users[len(users)-1], string(key))
+		return nil
+	}); err != nil {
+		return 0, err
+	}
+
+	pruned := make(map[string]bool)
+	for _, keys := range users {
+		for i, key := range keys {
+			_, id, _ := strings.Cut(key, "/")
+			createdAt, ok := idTime(id)
+			tooOld := policy.MaxAge > 0 && ok && now.Sub(createdAt) > policy.MaxAge
+			tooMany := policy.MaxPerUser > 0 && len(keys)-i > policy.MaxPerUser
+			if !tooOld && !tooMany {
+				continue
+			}
+
+			if err := records.Delete([]byte(id)); err != nil {
+				return 0, fmt.Errorf("failed to delete record %s of bucket %s: %w", id, k.bucket, err)
+			}
+			if err := index.Delete([]byte(key)); err != nil {
+				return 0, fmt.Errorf("failed to delete index key %s of bucket %s: %w", key, k.index, err)
+			}
+			pruned[id] = true
+		}
+	}
+	if len(pruned) == 0 {
+		return 0, nil
+	}
+
+	// the md5 keys of pruned records would point at nothing
+	legacy := tx.Bucket([]byte(legacyKeysBucket))
+	if legacy == nil {
+		return 0, fmt.Errorf("bucket %s not found", legacyKeysBucket)
+	}
+	if err := legacy.ForEachPrefix([]byte(legacyKey(k.bucket, "")), func(key, id []byte) error {
+		if !pruned[string(id)] {
+			return nil
+		}
+		if err := legacy.Delete(key); err != nil {
+			return fmt.Errorf("failed to delete legacy key %s: %w", key, err)
+		}
+		return nil
+	}); err != nil {
+		return 0, err
+	}
+	return len(pruned), nil
+}
+
+func (q RecordQuery) bounds(prefix string) (start, end []byte) {
+	start = []byte(prefix)
+	if !q.From.IsZero() {
+		start = append(start, idPrefix(q.From)...)
+	}
+	switch {
+	case !q.To.IsZero():
+		end = append([]byte(prefix), idPrefix(q.To)...)
+	case prefix != "":
+		// IDs only use ASCII, so this is past the last key of the prefix
+		end = append([]byte(prefix), 0xff)
+	}
+	return start, end
+}
+
+func indexKey(userID int64, id string) string {
+	return strconv.FormatInt(userID, 10) + "/" + id
+}
+
+func legacyKey(bucketName, key string) string {
+	return bucketName + "/" + key
+}
+
+// orderRecords moves the responses and error logs saved under md5 keys to IDs of their creation
+// time and indexes them by user. The old keys keep working through the legacy keys bucket.
+func orderRecords(tx Tx, step *MigrationStep) error {
+	legacy := tx.Bucket([]byte(legacyKeysBucket))
+	if legacy == nil {
+		return fmt.Errorf("bucket %s not found", legacyKeysBucket)
+	}
+
+	now := time.Now()
+	for _, kind := range []recordKind{responseRecords, errorRecords} {
+		records, index, err := kind.buckets(tx)
+		if err != nil {
+			return err
+		}
+
+		moved := 0
+		if err := records.ForEachPrefix(nil, func(k, v []byte) error {
+			if isID(string(k)) {
+				return nil
+			}
+			userID, createdAt, err := kind.parse(v)
+			if err != nil {
+				return fmt.Errorf("failed to unmarshal record %s of bucket %s: %w", k, kind.bucket, err)
+			}
+			if createdAt.IsZero() {
+				createdAt = now
+			}
+
+			id := ids.at(createdAt)
+			if err := records.Put([]byte(id), v); err != nil {
+				return fmt.Errorf("failed to save record %s of bucket %s: %w", id, kind.bucket, err)
+			}
+			if err := records.Delete(k); err != nil {
+				return fmt.Errorf("failed to delete record %s of bucket %s: %w", k, kind.bucket, err)
+			}
+			if err := index.Put([]byte(indexKey(userID, id)), []byte{}); err != nil {
+				return fmt.Errorf("failed to index record %s of bucket %s: %w", id, kind.bucket, err)
+			}
+			if err := legacy.Put([]byte(legacyKey(kind.bucket, string(k))), []byte(id)); err != nil {
+				return fmt.Errorf("failed to save legacy key %s of bucket %s: %w", k, kind.bucket, err)
+			}
+			moved++
+			return nil
+		}); err != nil {
+			return err
+		}
+
+		if moved > 0 {
+			step.changed("moved %d records of %s to time ordered IDs", moved, kind.bucket)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,68 @@
+package storage
+
+import (
+	"fmt"
+	"time"
+)
+
+// RetentionPolicy limits how long responses and error logs are kept, zero values keep everything.
+type RetentionPolicy struct {
+	MaxAge     time.Duration
+	MaxPerUser int
+}
+
+type PruneReport struct {
+	Responses int
+	Errors    int
+}
+
+type CompactReport struct {
+	Before int64
+	After  int64
+}
+
+func (p RetentionPolicy) Enabled() bool {
+	return p.MaxAge > 0 || p.MaxPerUser > 0
+}
+
+// Prune deletes the responses and error logs older than MaxAge and all but the
+// MaxPerUser newest ones of every user.
+func (s *Storage) Prune(policy RetentionPolicy) (*PruneReport, error) {
+	report := &PruneReport{}
+	if !policy.Enabled() {
+		return report, nil
+	}
+
+	now := time.Now()
+	err := s.db.Update(func(tx Tx) error {
+		var err error
+		if report.Responses, err = responseRecords.prune(tx, policy, now); err != nil {
+			return err
+		}
+		report.Errors, err = errorRecords.prune(tx, policy, now)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return report, nil
+}
+
+// Compact rewrites the database to give the space of deleted records back to the file system.
+func (s *Storage) Compact() (*CompactReport, error) {
+	report := &CompactReport{}
+
+	var err error
+	if report.Before, err = s.db.Size(); err != nil {
+		return nil, err
+	}
+	if err = s.db.Compact(); err != nil {
+		return nil, fmt.Errorf("failed to compact database: %w", err)
+	}
+	if report.After, err = s.db.Size(); err != nil {
+		return nil, err
+	}
+
+	return report, nil
+}
@@ -0,0 +1,258 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+
+	// registers the pure Go "sqlite" driver
+	_ "modernc.org/sqlite"
+)
+
+const sqliteSchema string = `
+CREATE TABLE IF NOT EXISTS buckets (name BLOB PRIMARY KEY) WITHOUT ROWID;
+CREATE TABLE IF NOT EXISTS entries (
+	bucket BLOB NOT NULL,
+	key BLOB NOT NULL,
+	value BLOB NOT NULL,
+	PRIMARY KEY (bucket, key)
+) WITHOUT ROWID;`
+
+// sqliteEngine keeps the buckets in a single table, keys are BLOBs so they sort in byte order like in bolt.
+type sqliteEngine struct {
+	db   *sql.DB
+	path string
+}
+
+type sqliteTx struct {
+	tx *sql.Tx
+	// the driver does not enforce read-only transactions
+	writable bool
+	// err keeps the first failure of a method that cannot return one, the transaction is rolled back on it
+	err error
+}
+
+type sqliteBucket struct {
+	tx   *sqliteTx
+	name []byte
+}
+
+func NewSQLiteEngine(path string) (Engine, error) {
+	db, err := sql.Open("sqlite", fmt.Sprintf("file:%s?_pragma=busy_timeout(%d)&_pragma=journal_mode(WAL)",
+		path, defaultTimeout.Milliseconds()))
+	if err != nil {
+		return nil, err
+	}
+	// a single connection serializes the transactions like bolt does
+	db.SetMaxOpenConns(1)
+
+	if _, err := db.Exec(sqliteSchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to create schema: %w", err)
+	}
+
+	return &sqliteEngine{db: db, path: path}, nil
+}
+
+func (e *sqliteEngine) View(fn func(tx Tx) error) error {
+	return e.run(false, fn)
+}
+
+func (e *sqliteEngine) Update(fn func(tx Tx) error) error {
+	return e.run(true, fn)
+}
+
+func (e *sqliteEngine) run(writable bool, fn func(tx Tx) error) error {
+	tx, err := e.db.BeginTx(context.Background(), &sql.TxOptions{ReadOnly: !writable})
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+
+	wrapped := &sqliteTx{tx: tx, writable: writable}
+	err = fn(wrapped)
+	if err == nil {
+		err = wrapped.err
+	}
+	if err != nil {
+		if rollbackErr := tx.Rollback(); rollbackErr != nil {
+			return errors.Join(err, rollbackErr)
+		}
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (e *sqliteEngine) Size() (int64, error) {
+	var size int64
+	err := e.db.QueryRow("SELECT page_count * page_size FROM pragma_page_count(), pragma_page_size()").Scan(&size)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get database size: %w", err)
+	}
+	return size, nil
+}
+
+func (e *sqliteEngine) Path() string {
+	return e.path
+}
+
+func (e *sqliteEngine) Snapshot(path string) error {
+	if _, err := e.db.Exec("VACUUM INTO ?", path); err != nil {
+		return fmt.Errorf("failed to copy database to %s: %w", path, err)
+	}
+	return nil
+}
+
+func (e *sqliteEngine) Check() error {
+	var result string
+	if err := e.db.QueryRow("PRAGMA integrity_check(1)").Scan(&result); err != nil {
+		return fmt.Errorf("failed to check database: %w", err)
+	}
+	if result != "ok" {
+		return fmt.Errorf("database is corrupt: %s", result)
+	}
+	return nil
+}
+
+// PageStats reports the pages of the whole file, the buckets share the tables.
+func (e *sqliteEngine) PageStats(bucketNames []string) (*PageStats, error) {
+	stats := &PageStats{}
+	err := e.db.QueryRow("SELECT page_size, page_count, freelist_count FROM pragma_page_size(), pragma_page_count(), pragma_freelist_count()").
+		Scan(&stats.PageSize, &stats.Pages, &stats.FreePages)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get page stats: %w", err)
+	}
+	return stats, nil
+}
+
+func (e *sqliteEngine) Compact() error {
+	_, err := e.db.Exec("VACUUM")
+	return err
+}
+
+func (e *sqliteEngine) Close() error {
+	return e.db.Close()
+}
+
+func (t *sqliteTx) Bucket(name []byte) Bucket {
+	var found int
+	err := t.tx.QueryRow("SELECT 1 FROM buckets WHERE name = ?", name).Scan(&found)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		t.fail(fmt.Errorf("failed to look up bucket %s: %w", name, err))
+		return nil
+	}
+	return &sqliteBucket{tx: t, name: bytes.Clone(name)}
+}
+
+func (t *sqliteTx) CreateBucketIfNotExists(name []byte) (Bucket, error) {
+	if !t.writable {
+		return nil, errReadOnlyTx
+	}
+	if _, err := t.tx.Exec("INSERT OR IGNORE INTO buckets (name) VALUES (?)", name); err != nil {
+		return nil, fmt.Errorf("failed to create bucket %s: %w", name, err)
+	}
+	return &sqliteBucket{tx: t, name: bytes.Clone(name)}, nil
+}
+
+func (t *sqliteTx) fail(err error) {
+	if t.err == nil {
+		t.err = err
+	}
+}
+
+func (b *sqliteBucket) Get(key []byte) []byte {
+	var value []byte
+	err := b.tx.tx.QueryRow("SELECT value FROM entries WHERE bucket = ? AND key = ?", b.name, key).Scan(&value)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		b.tx.fail(fmt.Errorf("failed to get %s from bucket %s: %w", key, b.name, err))
+		return nil
+	}
+	if value == nil {
+		// an empty value is still a stored key
+		value = []byte{}
+	}
+	return value
+}
+
+func (b *sqliteBucket) Put(key, value []byte) error {
+	if !b.tx.writable {
+		return errReadOnlyTx
+	}
+	if value == nil {
+		value = []byte{}
+	}
+	_, err := b.tx.tx.Exec("INSERT OR REPLACE INTO entries (bucket, key, value) VALUES (?, ?, ?)", b.name, key, value)
+	return err
+}
+
+func (b *sqliteBucket) Delete(key []byte) error {
+	if !b.tx.writable {
+		return errReadOnlyTx
+	}
+	_, err := b.tx.tx.Exec("DELETE FROM entries WHERE bucket = ? AND key = ?", b.name, key)
+	return err
+}
+
+func (b *sqliteBucket) ForEachPrefix(prefix []byte, fn func(k, v []byte) error) error {
+	if prefix == nil {
+		prefix = []byte{}
+	}
+	rows, err := b.tx.tx.Query("SELECT key, value FROM entries WHERE bucket = ? AND key >= ? ORDER BY key", b.name, prefix)
+	if err != nil {
+		return err
+	}
+	return b.forEachRow(rows, func(k []byte) bool { return bytes.HasPrefix(k, prefix) }, fn)
+}
+
+func (b *sqliteBucket) ForEachRange(start, end []byte, fn func(k, v []byte) error) error {
+	if start == nil {
+		start = []byte{}
+	}
+	rows, err := b.tx.tx.Query("SELECT key, value FROM entries WHERE bucket = ? AND key >= ? ORDER BY key", b.name, start)
+	if err != nil {
+		return err
+	}
+	return b.forEachRow(rows, func(k []byte) bool { return end == nil || bytes.Compare(k, end) < 0 }, fn)
+}
+
+// forEachRow calls fn for the rows of keys in order until match fails.
+func (b *sqliteBucket) forEachRow(rows *sql.Rows, match func(k []byte) bool, fn func(k, v []byte) error) error {
+	// the rows are read before calling fn, which may write to the same transaction
+	var keys, values [][]byte
+	for rows.Next() {
+		var k, v []byte
+		if err := rows.Scan(&k, &v); err != nil {
+			rows.Close()
+			return err
+		}
+		if !match(k) {
+			break
+		}
+		if v == nil {
+			v = []byte{}
+		}
+		keys = append(keys, k)
+		values = append(values, v)
+	}
+	if err := rows.Close(); err != nil {
+		return err
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for i := range keys {
+		if err := fn(keys[i], values[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,244 @@
+package storage
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// statsKey in the meta bucket keeps the last statistics to report growth
+	statsKey string = "stats"
+	// users with the biggest histories are listed
+	topUsersLimit int = 5
+)
+
+// DBStats describes the database, the page figures are only known for backends that have pages.
+type DBStats struct {
+	At      time.Time
+	Size    int64
+	Buckets []BucketStats
+	Pages   *PageStats `json:",omitempty"`
+	// TopUsers have the largest conversation histories, largest first
+	TopUsers []UserStats `json:",omitempty"`
+	// Previous is the last time statistics were taken, nil the first time
+	Previous *DBStats `json:",omitempty"`
+}
+
+type BucketStats struct {
+	Name string
+	Keys int
+	// Bytes is the size of the keys and values, before encryption
+	Bytes int64
+}
+
+type PageStats struct {
+	PageSize     int
+	Pages        int
+	FreePages    int
+	PendingPages int
+	Buckets      map[string]BucketPages
+}
+
+type BucketPages struct {
+	LeafPages   int
+	BranchPages int
+	// Inuse is the number of bytes of the pages taken by data
+	Inuse int
+	// Inline buckets are small enough to live in the page of their parent
+	Inline bool
+}
+
+type UserStats struct {
+	UserID        int64
+	Conversations int
+	Messages      int
+	Bytes         int64
+}
+
+// pageCounter is implemented by the engines that keep their data in pages.
+type pageCounter interface {
+	PageStats(bucketNames []string) (*PageStats, error)
+}
+
+// Stats counts the keys and bytes of every bucket and remembers them, so the next call reports the growth.
+func (s *Storage) Stats() (*DBStats, error) {
+	stats := &DBStats{At: time.Now()}
+
+	var err error
+	if stats.Size, err = s.db.Size(); err != nil {
+		return nil, err
+	}
+
+	engine := s.db
+	if encrypted, ok := engine.(*encryptedEngine); ok {
+		engine = encrypted.Engine
+	}
+	if counter, ok := engine.(pageCounter); ok {
+		if stats.Pages, err = counter.PageStats(buckets); err != nil {
+			return nil, fmt.Errorf("failed to get page stats: %w", err)
+		}
+	}
+
+	// the scan decrypts every value, it must not hold the write lock
+	users := make(map[int64]*UserStats)
+	err = s.db.View(func(tx Tx) error {
+		for _, name := range buckets {
+			bucket := tx.Bucket([]byte(name))
+			if bucket == nil {
+				continue
+			}
+
+			bucketStats := BucketStats{Name: name}
+			if err := bucket.ForEachPrefix(nil, func(k, v []byte) error {
+				bucketStats.Keys++
+				bucketStats.Bytes += int64(len(k) + len(v))
+				if name == conversationsBucket || name == messagesBucket {
+					countHistory(users, name, k, v)
+				}
+				return nil
+			}); err != nil {
+				return fmt.Errorf("failed to read bucket %s: %w", name, err)
+			}
+			stats.Buckets = append(stats.Buckets, bucketStats)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := json.Marshal(DBStats{At: stats.At, Size: stats.Size, Buckets: stats.Buckets})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal stats: %w", err)
+	}
+	err = s.db.Update(func(tx Tx) error {
+		meta := tx.Bucket([]byte(metaBucket))
+		if meta == nil {
+			return fmt.Errorf("bucket %s not found", metaBucket)
+		}
+		if previous := meta.Get([]byte(statsKey)); previous != nil {
+			stats.Previous = &DBStats{}
+			if err := json.Unmarshal(previous, stats.Previous); err != nil {
+				return fmt.Errorf("failed to unmarshal previous stats: %w", err)
+			}
+		}
+		return meta.Put([]byte(statsKey), data)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, user := range users {
+		stats.TopUsers = append(stats.TopUsers, *user)
+	}
+	slices.SortFunc(stats.TopUsers, func(a, b UserStats) int {
+		return cmp.Or(cmp.Compare(b.Bytes, a.Bytes), cmp.Compare(a.UserID, b.UserID))
+	})
+	if len(stats.TopUsers) > topUsersLimit {
+		stats.TopUsers = stats.TopUsers[:topUsersLimit]
+	}
+
+	return stats, nil
+}
+
+// countHistory adds a conversation record or message to its user, both keys start with the user ID.
+func countHistory(users map[int64]*UserStats, bucket string, k, v []byte) {
+	prefix, _, _ := bytes.Cut(k, []byte("/"))
+	userID, err := strconv.ParseInt(string(prefix), 10, 64)
+	if err != nil {
+		return
+	}
+
+	user, ok := users[userID]
+	if !ok {
+		user = &UserStats{UserID: userID}
+		users[userID] = user
+	}
+	if bucket == conversationsBucket {
+		user.Conversations++
+	} else {
+		user.Messages++
+	}
+	user.Bytes += int64(len(k) + len(v))
+}
+
+func (s *DBStats) String() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "size %s", formatBytes(s.Size))
+	if s.Previous != nil {
+		fmt.Fprintf(&sb, " (%s since %s)", formatGrowth(s.Size-s.Previous.Size), s.Previous.At.Format(time.DateTime))
+	}
+
+	if s.Pages != nil {
+		fmt.Fprintf(&sb, "\npages of %s: %d in the file, %d free, %d pending release",
+			formatBytes(int64(s.Pages.PageSize)), s.Pages.Pages, s.Pages.FreePages, s.Pages.PendingPages)
+	}
+
+	sb.WriteString("\nbuckets:")
+	for _, bucket := range s.Buckets {
+		fmt.Fprintf(&sb, "\n  %s: %d keys", bucket.Name, bucket.Keys)
+		if previous := s.previousBucket(bucket.Name); previous != nil {
+			fmt.Fprintf(&sb, " (%+d)", bucket.Keys-previous.Keys)
+		}
+		fmt.Fprintf(&sb, ", %s", formatBytes(bucket.Bytes))
+
+		if s.Pages == nil {
+			continue
+		}
+		pages, ok := s.Pages.Buckets[bucket.Name]
+		switch {
+		case !ok:
+		case pages.Inline:
+			sb.WriteString(", inline")
+		default:
+			total := pages.LeafPages + pages.BranchPages
+			fmt.Fprintf(&sb, " in %d leaf and %d branch pages, %d%% used",
+				pages.LeafPages, pages.BranchPages, pages.Inuse*100/max(total*s.Pages.PageSize, 1))
+		}
+	}
+
+	if len(s.TopUsers) > 0 {
+		sb.WriteString("\nlargest histories:")
+		for _, user := range s.TopUsers {
+			fmt.Fprintf(&sb, "\n  %d: %d conversations, %d messages, %s",
+				user.UserID, user.Conversations, user.Messages, formatBytes(user.Bytes))
+		}
+	}
+	return sb.String()
+}
+
+func (s *DBStats) previousBucket(name string) *BucketStats {
+	if s.Previous == nil {
+		return nil
+	}
+	for i := range s.Previous.Buckets {
+		if s.Previous.Buckets[i].Name == name {
+			return &s.Previous.Buckets[i]
+		}
+	}
+	return nil
+}
+
+func formatBytes(n int64) string {
+	switch {
+	case n >= bytesInMB:
+		return fmt.Sprintf("%.2fMB", float64(n)/bytesInMB)
+	case n >= bytesInKB:
+		return fmt.Sprintf("%.1fKB", float64(n)/bytesInKB)
+	default:
+		return fmt.Sprintf("%dB", n)
+	}
+}
+
+func formatGrowth(n int64) string {
+	if n < 0 {
+		return "-" + formatBytes(-n)
+	}
+	return "+" + formatBytes(n)
+}
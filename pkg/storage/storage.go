@@ -1,18 +1,16 @@
 package storage
 
 import (
-	"crypto/md5"
+	"context"
+	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"os"
+	"slices"
 	"strconv"
-	"strings"
 	"time"
-
-	"github.com/hashicorp/go-multierror"
-	"go.etcd.io/bbolt"
 )
 
 const (
@@ -26,8 +24,25 @@ const (
 )
 
 type Message struct {
-	Role string
-	Text string
+	Role        string
+	Text        string
+	Attachments []Attachment `json:",omitempty"`
+	// MessageID is the Telegram message of a user prompt, used to fork the conversation on edits and replies
+	MessageID int `json:",omitempty"`
+	// Model is the model that wrote an answer
+	Model     string    `json:",omitempty"`
+	Timestamp time.Time `json:",omitzero"`
+}
+
+// Attachment is a file sent along with a message. Small files are kept inline in Data,
+// larger ones are uploaded through the Gemini Files API and referenced by FileName.
+type Attachment struct {
+	Name     string
+	MIMEType string
+	Data     []byte `json:",omitempty"`
+	FileName string `json:",omitempty"`
+	// Hash is the SHA-256 of Data in hex, records that drop the data keep it instead, see LogGeminiError
+	Hash string `json:",omitempty"`
 }
 
 type ConversationHistory struct {
@@ -38,67 +53,117 @@ type UserSettings struct {
 	UserID         int64
 	ModelName      string
 	FavoriteModels []string
-	History        ConversationHistory
+	SessionID      string
+	PendingPrompt  string
+	VoiceReplies   bool
+	Voice          string
+	VoiceLanguage  string
+	CodeExecution  bool
+	PendingRename  string
+	PendingImport  bool
+	// History is only read to migrate it into a conversation, see migrateHistory.
+	History ConversationHistory
+	// Version is bumped on every save and guards against lost updates.
+	Version uint64
 }
 
+// Storage keeps the bot records on top of any Engine.
 type Storage struct {
-	db *bbolt.DB
+	db        Engine
+	migration *MigrationReport
 }
 
-var ErrUserNotFound = errors.New("user not found")
+var (
+	ErrUserNotFound     = errors.New("user not found")
+	ErrVersionConflict  = errors.New("user settings were modified concurrently")
+	ErrResponseNotFound = errors.New("response not found")
+	ErrErrorLogNotFound = errors.New("error log not found")
+)
 
-func NewStorage(path string) (*Storage, error) {
-	db, err := bbolt.Open(path, defaultFileMode, &bbolt.Options{Timeout: defaultTimeout})
+// Open opens the storage with the given backend, see Backends. Values are encrypted
+// if a keyring is given, those stored in plaintext before are still read.
+func Open(backend, path string, keyring *Keyring) (*Storage, error) {
+	engine, err := OpenEngine(backend, path)
 	if err != nil {
 		return nil, err
 	}
+	if keyring != nil {
+		engine = NewEncryptedEngine(engine, keyring)
+	}
 
-	if err := db.Update(func(tx *bbolt.Tx) error {
-		var multiErr error
-
-		buckets := []string{usersBucket, responseBucket, geminiErrorsBucket}
-		for _, bucketName := range buckets {
-			if _, err := tx.CreateBucketIfNotExists([]byte(bucketName)); err != nil {
-				multiErr = multierror.Append(multiErr, fmt.Errorf("failed to create %s bucket: %w", bucketName, err))
-			}
-		}
+	storage, err := NewStorage(engine)
+	if err != nil {
+		engine.Close()
+		return nil, err
+	}
+	return storage, nil
+}
 
-		return multiErr
-	}); err != nil {
+// NewStorage creates the buckets and runs the pending migrations, see Migration.
+func NewStorage(db Engine) (*Storage, error) {
+	report, err := migrate(db, false)
+	if err != nil {
 		return nil, err
 	}
 
-	return &Storage{db: db}, nil
+	return &Storage{db: db, migration: report}, nil
+}
+
+// Migration reports the migrations run when the storage was opened.
+func (s *Storage) Migration() *MigrationReport {
+	return s.migration
+}
+
+// RotateKeys encrypts every value with the current key of the keyring, it is meant to run in the
+// background after a key is added or encryption is enabled. Without encryption it does nothing.
+func (s *Storage) RotateKeys(ctx context.Context) (int, error) {
+	encrypted, ok := s.db.(*encryptedEngine)
+	if !ok {
+		return 0, nil
+	}
+	return encrypted.rotateKeys(ctx, buckets)
 }
 
 func (s *Storage) Close() error {
 	return s.db.Close()
 }
 
+// SaveUserSettings stores the settings if the stored version still matches
+// settings.Version and bumps the version on success.
 func (s *Storage) SaveUserSettings(userID int64, settings *UserSettings) error {
-	return s.db.Update(func(tx *bbolt.Tx) error {
-		bucket := tx.Bucket([]byte(usersBucket))
-		if bucket == nil {
-			return fmt.Errorf("bucket %s not found", usersBucket)
-		}
+	if err := s.db.Update(func(tx Tx) error {
+		return putUserSettings(tx, userID, settings)
+	}); err != nil {
+		return err
+	}
 
-		data, err := json.Marshal(settings)
-		if err != nil {
-			return fmt.Errorf("failed to marshal user settings: %w", err)
-		}
+	settings.Version++
+	return nil
+}
 
-		userKey := strconv.FormatInt(userID, 10)
-		if err := bucket.Put([]byte(userKey), data); err != nil {
-			return fmt.Errorf("failed to save user settings for ID %s: %w", userKey, err)
+// SaveSession stores the settings like SaveUserSettings and appends the messages to the conversation
+// of settings.SessionID like AppendMessages in the same transaction, so either both are saved or none.
+// It returns the nodes of the conversation tree the messages are stored as.
+func (s *Storage) SaveSession(settings *UserSettings, after int, messages []Message) ([]int, error) {
+	var nodes []int
+	if err := s.db.Update(func(tx Tx) error {
+		if err := putUserSettings(tx, settings.UserID, settings); err != nil {
+			return err
 		}
+		var err error
+		nodes, err = appendMessages(tx, settings.UserID, settings.SessionID, settings.ModelName, after, messages)
+		return err
+	}); err != nil {
+		return nil, err
+	}
 
-		return nil
-	})
+	settings.Version++
+	return nodes, nil
 }
 
 func (s *Storage) GetUserSettings(userID int64) (*UserSettings, error) {
 	settings := &UserSettings{}
-	err := s.db.View(func(tx *bbolt.Tx) error {
+	err := s.db.View(func(tx Tx) error {
 		bucket := tx.Bucket([]byte(usersBucket))
 		if bucket == nil {
 			return fmt.Errorf("bucket %s not found", usersBucket)
@@ -120,90 +185,228 @@ func (s *Storage) GetUserSettings(userID int64) (*UserSettings, error) {
 	return settings, err
 }
 
+// Response is a saved answer, see SaveResponse.
+type Response struct {
+	// ID is the key of the response, it is not part of the stored record
+	ID        string `json:"-"`
+	UserID    int64
+	Text      string
+	CreatedAt time.Time
+}
+
+// SaveResponse stores the answer and returns its ID, see newID.
 func (s *Storage) SaveResponse(userID int64, text string) (string, error) {
-	response := struct {
-		UserID int64
-		Text   string
-	}{
-		UserID: userID,
-		Text:   text,
+	response := Response{
+		UserID:    userID,
+		Text:      text,
+		CreatedAt: time.Now(),
 	}
 
-	key := generateHash(userID, text)
-	err := s.db.Update(func(tx *bbolt.Tx) error {
-		bucket := tx.Bucket([]byte(responseBucket))
-		if bucket == nil {
-			return fmt.Errorf("bucket %s not found", responseBucket)
-		}
-
-		data, err := json.Marshal(response)
-		if err != nil {
-			return fmt.Errorf("failed to marshal response: %w", err)
-		}
+	response.ID = ids.at(response.CreatedAt)
+	err := s.db.Update(func(tx Tx) error {
+		return responseRecords.put(tx, userID, response.ID, response)
+	})
 
-		if err := bucket.Put([]byte(key), data); err != nil {
-			return fmt.Errorf("failed to save response with key %s: %w", key, err)
-		}
+	return response.ID, err
+}
 
-		return nil
+// GetResponse returns the response saved under an ID, or under a key from before IDs.
+func (s *Storage) GetResponse(key string) (*Response, error) {
+	response := &Response{}
+	err := s.db.View(func(tx Tx) error {
+		var err error
+		response.ID, err = responseRecords.get(tx, key, ErrResponseNotFound, response)
+		return err
 	})
-
-	return key, err
+	if err != nil {
+		return nil, err
+	}
+	return response, nil
 }
 
 type ErrorLog struct {
+	// ID is the key of the error log, it is not part of the stored record
+	ID          string `json:"-"`
 	Timestamp   time.Time
 	UserID      int64
 	Model       string
 	RequestText string
+	// Attachments were sent with the request, only the Files API references and the hashes of
+	// inline data are kept, see Unreplayable
+	Attachments []Attachment `json:",omitempty"`
 	Error       string
 	History     []Message
 }
 
-func (s *Storage) LogGeminiError(userID int64, model, requestText, errorMsg string, history []Message) (string, error) {
+// Unreplayable counts the attachments that were sent inline, a replay cannot send them again.
+func (e *ErrorLog) Unreplayable() int {
+	count := 0
+	for _, attachment := range e.Attachments {
+		if attachment.FileName == "" {
+			count++
+		}
+	}
+	return count
+}
+
+// LogGeminiError saves the failed request, the data of inline attachments is replaced with its hash.
+func (s *Storage) LogGeminiError(userID int64, model, requestText string, attachments []Attachment, errorMsg string, history []Message) (string, error) {
 	errorLog := ErrorLog{
 		Timestamp:   time.Now(),
 		UserID:      userID,
 		RequestText: requestText,
+		Attachments: attachments,
 		Error:       errorMsg,
 		Model:       model,
 		History:     history,
 	}
+	hashAttachments(&errorLog)
 
-	key := generateHash(userID, errorMsg)
-	err := s.db.Update(func(tx *bbolt.Tx) error {
-		bucket := tx.Bucket([]byte(geminiErrorsBucket))
-		if bucket == nil {
-			return fmt.Errorf("bucket %s not found", geminiErrorsBucket)
+	errorLog.ID = ids.at(errorLog.Timestamp)
+	err := s.db.Update(func(tx Tx) error {
+		return errorRecords.put(tx, userID, errorLog.ID, errorLog)
+	})
+
+	return errorLog.ID, err
+}
+
+// hashAttachments replaces the inline data of the attachments of the error log with its hash
+// and reports whether there was any. The slices of the caller are left as they are.
+func hashAttachments(errorLog *ErrorLog) bool {
+	hashed := false
+	hash := func(attachments []Attachment) []Attachment {
+		if !slices.ContainsFunc(attachments, func(a Attachment) bool { return len(a.Data) > 0 }) {
+			return attachments
 		}
+		hashed = true
+		attachments = slices.Clone(attachments)
+		for i := range attachments {
+			if len(attachments[i].Data) == 0 {
+				continue
+			}
+			sum := sha256.Sum256(attachments[i].Data)
+			attachments[i].Hash = hex.EncodeToString(sum[:])
+			attachments[i].Data = nil
+		}
+		return attachments
+	}
 
+	errorLog.Attachments = hash(errorLog.Attachments)
+	history := slices.Clone(errorLog.History)
+	for i := range history {
+		history[i].Attachments = hash(history[i].Attachments)
+	}
+	if hashed {
+		errorLog.History = history
+	}
+	return hashed
+}
+
+// hashLoggedAttachments drops the inline data that error logs of older builds kept.
+func hashLoggedAttachments(tx Tx, step *MigrationStep) error {
+	bucket := tx.Bucket([]byte(geminiErrorsBucket))
+	if bucket == nil {
+		return fmt.Errorf("bucket %s not found", geminiErrorsBucket)
+	}
+
+	hashed := make(map[string][]byte)
+	if err := bucket.ForEachPrefix(nil, func(k, v []byte) error {
+		var errorLog ErrorLog
+		if err := json.Unmarshal(v, &errorLog); err != nil {
+			return fmt.Errorf("failed to unmarshal error log %s: %w", k, err)
+		}
+		if !hashAttachments(&errorLog) {
+			return nil
+		}
 		data, err := json.Marshal(errorLog)
 		if err != nil {
-			return fmt.Errorf("failed to marshal error log: %w", err)
+			return fmt.Errorf("failed to marshal error log %s: %w", k, err)
 		}
+		hashed[string(k)] = data
+		return nil
+	}); err != nil {
+		return err
+	}
 
-		if err := bucket.Put([]byte(key), data); err != nil {
-			return fmt.Errorf("failed to save error log: %w", err)
+	for k, data := range hashed {
+		if err := bucket.Put([]byte(k), data); err != nil {
+			return fmt.Errorf("failed to save error log %s: %w", k, err)
 		}
+	}
+	if len(hashed) > 0 {
+		step.changed("dropped the attachment data of %d error logs", len(hashed))
+	}
+	return nil
+}
 
-		return nil
+func (s *Storage) GetErrorLog(key string) (*ErrorLog, error) {
+	errorLog := &ErrorLog{}
+	err := s.db.View(func(tx Tx) error {
+		var err error
+		errorLog.ID, err = errorRecords.get(tx, key, ErrErrorLogNotFound, errorLog)
+		return err
 	})
+	if err != nil {
+		return nil, err
+	}
+	return errorLog, nil
+}
+
+// getRecordByKey unmarshals the record under key into v, or returns notFound.
+func getRecordByKey(tx Tx, bucketName, key string, notFound error, v any) error {
+	bucket := tx.Bucket([]byte(bucketName))
+	if bucket == nil {
+		return fmt.Errorf("bucket %s not found", bucketName)
+	}
 
-	return key, err
+	data := bucket.Get([]byte(key))
+	if data == nil {
+		return notFound
+	}
+
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("failed to unmarshal %s record %s: %w", bucketName, key, err)
+	}
+	return nil
 }
 
 func (s *Storage) GetDBSize() (float64, error) {
-	fileStat, err := os.Stat(s.db.Path())
+	size, err := s.db.Size()
 	if err != nil {
-		return 0, fmt.Errorf("failed to get database file stats: %w", err)
+		return 0, err
 	}
-	sizeMB := float64(fileStat.Size()) / float64(bytesInMB)
+	sizeMB := float64(size) / float64(bytesInMB)
 	return sizeMB, nil
 }
 
-func generateHash(userID int64, text string) string {
-	now := strconv.FormatInt(time.Now().UnixNano(), 10)
-	userIDStr := strconv.FormatInt(userID, 10)
-	md5sum := md5.Sum([]byte(strings.Join([]string{now, userIDStr, text}, "-")))
-	return hex.EncodeToString(md5sum[:])
+// putUserSettings stores the settings with the next version, if the stored one still matches settings.Version.
+func putUserSettings(tx Tx, userID int64, settings *UserSettings) error {
+	bucket := tx.Bucket([]byte(usersBucket))
+	if bucket == nil {
+		return fmt.Errorf("bucket %s not found", usersBucket)
+	}
+
+	userKey := strconv.FormatInt(userID, 10)
+	if current := bucket.Get([]byte(userKey)); current != nil {
+		var stored struct{ Version uint64 }
+		if err := json.Unmarshal(current, &stored); err != nil {
+			return fmt.Errorf("failed to unmarshal user settings for ID %s: %w", userKey, err)
+		}
+		if stored.Version != settings.Version {
+			return ErrVersionConflict
+		}
+	}
+
+	updated := *settings
+	updated.Version++
+	data, err := json.Marshal(updated)
+	if err != nil {
+		return fmt.Errorf("failed to marshal user settings: %w", err)
+	}
+
+	if err := bucket.Put([]byte(userKey), data); err != nil {
+		return fmt.Errorf("failed to save user settings for ID %s: %w", userKey, err)
+	}
+
+	return nil
 }
@@ -0,0 +1,77 @@
+package storage_test
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/vasyvasilie/gemini-chat-tg-bot/pkg/storage"
+	"github.com/vasyvasilie/gemini-chat-tg-bot/pkg/storage/storagetest"
+)
+
+// TestConformance runs the storagetest suite on every backend, as it is and with encrypted values.
+func TestConformance(t *testing.T) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatal(err)
+	}
+	keyring, err := storage.ParseKeyring(base64.StdEncoding.EncodeToString(key))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, backend := range storage.Backends {
+		for _, keyring := range []*storage.Keyring{nil, keyring} {
+			name := backend
+			if keyring != nil {
+				name += " encrypted"
+			}
+
+			t.Run(name, func(t *testing.T) {
+				dir := t.TempDir()
+				opened := 0
+				path := func() string {
+					opened++
+					return filepath.Join(dir, fmt.Sprintf("%d.db", opened))
+				}
+
+				newEngine := func() (storage.Engine, error) {
+					engine, err := storage.OpenEngine(backend, path())
+					if err != nil || keyring == nil {
+						return engine, err
+					}
+					return storage.NewEncryptedEngine(engine, keyring), nil
+				}
+
+				t.Run("engine", func(t *testing.T) {
+					if err := storagetest.TestEngine(newEngine); err != nil {
+						t.Error(err)
+					}
+				})
+				t.Run("store", func(t *testing.T) {
+					if err := storagetest.TestStore(func() (storage.Store, error) {
+						return storage.Open(backend, path(), keyring)
+					}); err != nil {
+						t.Error(err)
+					}
+				})
+				t.Run("migrations", func(t *testing.T) {
+					if err := storagetest.TestMigrations(newEngine); err != nil {
+						t.Error(err)
+					}
+				})
+				if keyring != nil {
+					t.Run("encryption", func(t *testing.T) {
+						if err := storagetest.TestEncryption(func() (storage.Engine, error) {
+							return storage.OpenEngine(backend, path())
+						}); err != nil {
+							t.Error(err)
+						}
+					})
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,243 @@
+package storagetest
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/hashicorp/go-multierror"
+
+	"github.com/vasyvasilie/gemini-chat-tg-bot/pkg/storage"
+)
+
+var encryptionChecks = []engineCheck{
+	{"key rotation", checkKeyRotation},
+	{"plaintext before encryption", checkEncryptPlaintext},
+	{"unknown key", checkUnknownKey},
+}
+
+// TestEncryption runs every encryption check on a fresh engine from newEngine and returns all failures.
+// newEngine must not encrypt, the checks wrap the engine with keyrings of their own.
+func TestEncryption(newEngine func() (storage.Engine, error)) error {
+	var multiErr error
+	for _, check := range encryptionChecks {
+		engine, err := newEngine()
+		if err != nil {
+			return fmt.Errorf("failed to open engine: %w", err)
+		}
+
+		if err := check.run(engine); err != nil {
+			multiErr = multierror.Append(multiErr, fmt.Errorf("%s: %w", check.name, err))
+		}
+		if err := engine.Close(); err != nil {
+			multiErr = multierror.Append(multiErr, fmt.Errorf("%s: failed to close engine: %w", check.name, err))
+		}
+	}
+	return multiErr
+}
+
+// newKey returns a random master key encoded for ParseKeyring.
+func newKey() (string, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(key), nil
+}
+
+// openEncrypted opens a storage on top of engine that encrypts with the first of keys.
+func openEncrypted(engine storage.Engine, keys ...string) (*storage.Storage, error) {
+	keyring, err := storage.ParseKeyring(strings.Join(keys, ","))
+	if err != nil {
+		return nil, err
+	}
+	return storage.NewStorage(storage.NewEncryptedEngine(engine, keyring))
+}
+
+// saveRecords saves settings and a response of the user and returns the response ID.
+func saveRecords(store storage.Store) (string, error) {
+	if err := store.SaveUserSettings(userID, &storage.UserSettings{UserID: userID, ModelName: "models/a"}); err != nil {
+		return "", err
+	}
+	return store.SaveResponse(userID, "answer")
+}
+
+// checkRecords reads back the records of saveRecords.
+func checkRecords(store storage.Store, responseID string) error {
+	settings, err := store.GetUserSettings(userID)
+	if err != nil {
+		return err
+	}
+	if settings.ModelName != "models/a" {
+		return fmt.Errorf("got model %q, want %q", settings.ModelName, "models/a")
+	}
+	response, err := store.GetResponse(responseID)
+	if err != nil {
+		return err
+	}
+	if response.Text != "answer" {
+		return fmt.Errorf("got response %q, want %q", response.Text, "answer")
+	}
+	return nil
+}
+
+// rawSettings returns the stored value of the settings of the user as the engine keeps it.
+func rawSettings(engine storage.Engine) ([]byte, error) {
+	var value []byte
+	err := engine.View(func(tx storage.Tx) error {
+		value = bytes.Clone(tx.Bucket([]byte("users")).Get([]byte("1")))
+		return nil
+	})
+	return value, err
+}
+
+func checkKeyRotation(engine storage.Engine) error {
+	oldKey, err := newKey()
+	if err != nil {
+		return err
+	}
+	newKey, err := newKey()
+	if err != nil {
+		return err
+	}
+
+	store, err := openEncrypted(engine, oldKey)
+	if err != nil {
+		return err
+	}
+	responseID, err := saveRecords(store)
+	if err != nil {
+		return err
+	}
+
+	// the old key is kept to read the values until they are rotated
+	if store, err = openEncrypted(engine, newKey, oldKey); err != nil {
+		return err
+	}
+	if err := checkRecords(store, responseID); err != nil {
+		return fmt.Errorf("before rotating: %w", err)
+	}
+	rotated, err := store.RotateKeys(context.Background())
+	if err != nil {
+		return err
+	}
+	if rotated == 0 {
+		return errors.New("rotated no values")
+	}
+	if rotated, err = store.RotateKeys(context.Background()); err != nil {
+		return err
+	}
+	if rotated != 0 {
+		return fmt.Errorf("rotated %d values again", rotated)
+	}
+
+	// every value, the schema version included, is now readable without the old key
+	if store, err = openEncrypted(engine, newKey); err != nil {
+		return fmt.Errorf("after rotating: %w", err)
+	}
+	if err := checkRecords(store, responseID); err != nil {
+		return fmt.Errorf("after rotating: %w", err)
+	}
+	if _, err := openEncrypted(engine, oldKey); !errors.Is(err, storage.ErrUnknownEncryptionKey) {
+		return fmt.Errorf("got %v opening with the old key only, want %v", err, storage.ErrUnknownEncryptionKey)
+	}
+	return nil
+}
+
+func checkEncryptPlaintext(engine storage.Engine) error {
+	plain, err := storage.NewStorage(engine)
+	if err != nil {
+		return err
+	}
+	responseID, err := saveRecords(plain)
+	if err != nil {
+		return err
+	}
+
+	key, err := newKey()
+	if err != nil {
+		return err
+	}
+	store, err := openEncrypted(engine, key)
+	if err != nil {
+		return err
+	}
+	if err := checkRecords(store, responseID); err != nil {
+		return fmt.Errorf("before rotating: %w", err)
+	}
+	value, err := rawSettings(engine)
+	if err != nil {
+		return err
+	}
+	if !bytes.HasPrefix(value, []byte("{")) {
+		return fmt.Errorf("settings were encrypted before rotating: %q", value)
+	}
+
+	rotated, err := store.RotateKeys(context.Background())
+	if err != nil {
+		return err
+	}
+	if rotated == 0 {
+		return errors.New("rotated no values")
+	}
+	if value, err = rawSettings(engine); err != nil {
+		return err
+	}
+	if bytes.Contains(value, []byte("models/a")) {
+		return fmt.Errorf("settings are still in plaintext after rotating: %q", value)
+	}
+	if err := checkRecords(store, responseID); err != nil {
+		return fmt.Errorf("after rotating: %w", err)
+	}
+
+	// encryption cannot be turned off without decrypting first
+	if _, err := storage.NewStorage(engine); err == nil {
+		return errors.New("opened encrypted values without a keyring")
+	}
+	return nil
+}
+
+func checkUnknownKey(engine storage.Engine) error {
+	key, err := newKey()
+	if err != nil {
+		return err
+	}
+	otherKey, err := newKey()
+	if err != nil {
+		return err
+	}
+
+	store, err := openEncrypted(engine, key)
+	if err != nil {
+		return err
+	}
+	responseID, err := saveRecords(store)
+	if err != nil {
+		return err
+	}
+	if _, err := openEncrypted(engine, otherKey); !errors.Is(err, storage.ErrUnknownEncryptionKey) {
+		return fmt.Errorf("got %v opening with another key, want %v", err, storage.ErrUnknownEncryptionKey)
+	}
+
+	// a value encrypted with a key that was dropped from the keyring
+	other, err := openEncrypted(engine, otherKey, key)
+	if err != nil {
+		return err
+	}
+	otherID, err := other.SaveResponse(userID, "other")
+	if err != nil {
+		return err
+	}
+
+	if _, err := store.GetResponse(otherID); !errors.Is(err, storage.ErrUnknownEncryptionKey) {
+		return fmt.Errorf("got %v reading a value of another key, want %v", err, storage.ErrUnknownEncryptionKey)
+	}
+	if _, err := store.RotateKeys(context.Background()); !errors.Is(err, storage.ErrUnknownEncryptionKey) {
+		return fmt.Errorf("got %v rotating a value of another key, want %v", err, storage.ErrUnknownEncryptionKey)
+	}
+	return checkRecords(store, responseID)
+}
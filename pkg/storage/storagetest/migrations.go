@@ -0,0 +1,409 @@
+package storagetest
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"time"
+
+	"github.com/hashicorp/go-multierror"
+
+	"github.com/vasyvasilie/gemini-chat-tg-bot/pkg/storage"
+)
+
+// legacyBuckets are the buckets of the layout before schema versions
+var legacyBuckets = []string{"users", "conversations", "embeddings"}
+
+var migrationChecks = []engineCheck{
+	{"history and conversations", checkMigrateLegacy},
+	{"md5 keyed records", checkMigrateRecords},
+	{"dry run", checkMigrateDryRun},
+}
+
+// TestMigrations runs every migration check on a fresh engine from newEngine and returns all failures.
+// The checks write records of older layouts through the engine and open a storage on top of it.
+func TestMigrations(newEngine func() (storage.Engine, error)) error {
+	var multiErr error
+	for _, check := range migrationChecks {
+		engine, err := newEngine()
+		if err != nil {
+			return fmt.Errorf("failed to open engine: %w", err)
+		}
+
+		if err := check.run(engine); err != nil {
+			multiErr = multierror.Append(multiErr, fmt.Errorf("%s: %w", check.name, err))
+		}
+		if err := engine.Close(); err != nil {
+			multiErr = multierror.Append(multiErr, fmt.Errorf("%s: failed to close engine: %w", check.name, err))
+		}
+	}
+	return multiErr
+}
+
+// legacyConversation is a conversation record before the messages were split out of it,
+// records written before branching have no tree.
+type legacyConversation struct {
+	ID        string
+	UserID    int64
+	Title     string
+	Model     string
+	Archived  bool
+	CreatedAt time.Time
+	UpdatedAt time.Time
+	History   storage.ConversationHistory
+	Tree      *storage.HistoryTree `json:",omitempty"`
+}
+
+// seedLegacy writes the history of a user into their settings, a conversation with branches and one
+// stored before branching, and embeddings keyed by turn.
+func seedLegacy(engine storage.Engine) error {
+	now := time.Now()
+	records := map[string]map[string]any{
+		"users": {
+			"1": storage.UserSettings{UserID: userID, ModelName: "models/a", History: storage.ConversationHistory{
+				Messages: []storage.Message{{Role: "user", Text: "hi"}, {Role: "model", Text: "hello"}},
+			}},
+			"2": storage.UserSettings{UserID: otherUserID, SessionID: "chat"},
+		},
+		"conversations": {
+			"1/branched": legacyConversation{
+				ID: "branched", UserID: userID, Title: "Branched", CreatedAt: now, UpdatedAt: now,
+				History: storage.ConversationHistory{Messages: []storage.Message{{Role: "user", Text: "q"}, {Role: "model", Text: "a2"}}},
+				Tree: &storage.HistoryTree{Nodes: []storage.HistoryNode{
+					{Parent: -1, Message: storage.Message{Role: "user", Text: "q"}},
+					{Parent: 0, Message: storage.Message{Role: "model", Text: "a1"}},
+					{Parent: 0, Message: storage.Message{Role: "model", Text: "a2"}},
+				}, Head: 2},
+			},
+			"1/flat": legacyConversation{
+				ID: "flat", UserID: userID, Title: "Flat", Archived: true, CreatedAt: now, UpdatedAt: now,
+				History: storage.ConversationHistory{Messages: []storage.Message{{Role: "user", Text: "x"}, {Role: "model", Text: "y"}}},
+			},
+		},
+		"embeddings": {
+			"1/branched/000001": storage.Embedding{UserID: userID, SessionID: "branched", Turn: 1, Role: "model", Text: "a2", Vector: []float32{1, 0}},
+			// the answer was regenerated after it was indexed
+			"1/flat/000001": storage.Embedding{UserID: userID, SessionID: "flat", Turn: 1, Role: "model", Text: "z", Vector: []float32{1, 0}},
+			"1/gone/000000": storage.Embedding{UserID: userID, SessionID: "gone", Role: "user", Text: "q", Vector: []float32{1, 0}},
+		},
+	}
+
+	return engine.Update(func(tx storage.Tx) error {
+		for _, bucketName := range legacyBuckets {
+			bucket, err := tx.CreateBucketIfNotExists([]byte(bucketName))
+			if err != nil {
+				return err
+			}
+			for key, record := range records[bucketName] {
+				data, err := json.Marshal(record)
+				if err != nil {
+					return err
+				}
+				if err := bucket.Put([]byte(key), data); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// dumpBuckets returns the records of the named buckets by bucket and key, missing buckets are left out.
+func dumpBuckets(engine storage.Engine, names ...string) (map[string]map[string]string, error) {
+	dump := make(map[string]map[string]string)
+	err := engine.View(func(tx storage.Tx) error {
+		for _, name := range names {
+			bucket := tx.Bucket([]byte(name))
+			if bucket == nil {
+				continue
+			}
+			dump[name] = make(map[string]string)
+			if err := bucket.ForEachPrefix(nil, func(k, v []byte) error {
+				dump[name][string(k)] = string(v)
+				return nil
+			}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return dump, err
+}
+
+func checkMigrateLegacy(engine storage.Engine) error {
+	if err := seedLegacy(engine); err != nil {
+		return err
+	}
+
+	store, err := storage.NewStorage(engine)
+	if err != nil {
+		return err
+	}
+	if report := store.Migration(); report.From != 0 || report.DryRun || len(report.Steps) == 0 ||
+		report.To != report.Steps[len(report.Steps)-1].Version {
+		return fmt.Errorf("got report %+v, want every migration from version 0", report)
+	}
+
+	// the history of the settings moved into the default conversation
+	settings, err := store.GetUserSettings(userID)
+	if err != nil {
+		return err
+	}
+	if len(settings.History.Messages) != 0 {
+		return fmt.Errorf("settings still hold %d messages", len(settings.History.Messages))
+	}
+	conversations, err := store.ListConversations(userID)
+	if err != nil {
+		return err
+	}
+	if len(conversations) != 3 {
+		return fmt.Errorf("got %d conversations, want 3", len(conversations))
+	}
+	if err := checkMigratedConversation(store, "default", "hi", []string{"hi", "hello"}, 1); err != nil {
+		return err
+	}
+	if err := checkMigratedConversation(store, "branched", "Branched", []string{"q", "a2"}, 2); err != nil {
+		return err
+	}
+	if err := checkMigratedConversation(store, "flat", "Flat", []string{"x", "y"}, 1); err != nil {
+		return err
+	}
+	if flat, err := store.GetConversation(userID, "flat"); err != nil {
+		return err
+	} else if !flat.Archived {
+		return errors.New("archived conversation was restored")
+	}
+
+	settings, err = store.GetUserSettings(otherUserID)
+	if err != nil {
+		return err
+	}
+	if settings.SessionID != "chat" {
+		return fmt.Errorf("got session %q of a user without history, want %q", settings.SessionID, "chat")
+	}
+
+	// only the embedding that matches the active branch is kept, keyed by its node
+	dump, err := dumpBuckets(engine, "embeddings")
+	if err != nil {
+		return err
+	}
+	if keys, want := slices.Sorted(maps.Keys(dump["embeddings"])), []string{"1/branched/0000000002"}; !slices.Equal(keys, want) {
+		return fmt.Errorf("got embeddings %v, want %v", keys, want)
+	}
+	matches, err := store.SearchExchanges(userID, []float32{1, 0}, 10)
+	if err != nil {
+		return err
+	}
+	if len(matches) != 1 || matches[0].SessionID != "branched" || matches[0].Answer != "a2" {
+		return fmt.Errorf("got matches %+v, want the answer a2 of branched", matches)
+	}
+
+	// reopening finds nothing to migrate
+	store, err = storage.NewStorage(engine)
+	if err != nil {
+		return err
+	}
+	if report := store.Migration(); report.From != report.To || len(report.Steps) != 0 {
+		return fmt.Errorf("got report %+v on reopening, want none", report)
+	}
+	return nil
+}
+
+func checkMigratedConversation(store storage.Store, id, title string, want []string, branches int) error {
+	conversation, err := store.GetConversation(userID, id)
+	if err != nil {
+		return fmt.Errorf("conversation %s: %w", id, err)
+	}
+	if conversation.Title != title {
+		return fmt.Errorf("got title %q of conversation %s, want %q", conversation.Title, id, title)
+	}
+	if got := messageTexts(conversation.History.Messages); !slices.Equal(got, want) {
+		return fmt.Errorf("got history %v of conversation %s, want %v", got, id, want)
+	}
+	if got := len(conversation.Tree.Branches()); got != branches {
+		return fmt.Errorf("got %d branches of conversation %s, want %d", got, id, branches)
+	}
+
+	messages, err := store.GetMessages(userID, id, 0, 0)
+	if err != nil {
+		return fmt.Errorf("conversation %s: %w", id, err)
+	}
+	if got := messageTexts(messages); !slices.Equal(got, want) {
+		return fmt.Errorf("got messages %v of conversation %s, want %v", got, id, want)
+	}
+	return nil
+}
+
+// checkMigrateRecords saves responses and error logs under md5 keys, as builds before record IDs did.
+func checkMigrateRecords(engine storage.Engine) error {
+	md5Key := func(text string) string {
+		return fmt.Sprintf("%x", md5.Sum([]byte(text)))
+	}
+	older, old, undated := md5Key("older"), md5Key("old"), md5Key("undated")
+	created := time.Now().Add(-time.Hour)
+	records := map[string]map[string]any{
+		"responses": {
+			older: storage.Response{UserID: userID, Text: "older", CreatedAt: created.Add(-time.Minute)},
+			old:   storage.Response{UserID: userID, Text: "old", CreatedAt: created},
+			// saved before responses were timestamped
+			undated: storage.Response{UserID: otherUserID, Text: "undated"},
+		},
+		"geminiErrors": {
+			old: storage.ErrorLog{UserID: userID, Model: "models/gemini", RequestText: "old", Error: "failed", Timestamp: created,
+				Attachments: []storage.Attachment{{Name: "a.txt", MIMEType: "text/plain", Data: []byte("data")}}},
+		},
+	}
+	if err := engine.Update(func(tx storage.Tx) error {
+		for bucketName, bucketRecords := range records {
+			bucket, err := tx.CreateBucketIfNotExists([]byte(bucketName))
+			if err != nil {
+				return err
+			}
+			for key, record := range bucketRecords {
+				data, err := json.Marshal(record)
+				if err != nil {
+					return err
+				}
+				if err := bucket.Put([]byte(key), data); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	store, err := storage.NewStorage(engine)
+	if err != nil {
+		return err
+	}
+
+	// the old keys still find the records under their new IDs
+	response, err := store.GetResponse(old)
+	if err != nil {
+		return err
+	}
+	if response.Text != "old" || response.ID == old || !response.CreatedAt.Equal(created) {
+		return fmt.Errorf("got response %+v, want the one saved under %s with a new ID", response, old)
+	}
+	errorLog, err := store.GetErrorLog(old)
+	if err != nil {
+		return err
+	}
+	if errorLog.RequestText != "old" || errorLog.ID == old {
+		return fmt.Errorf("got error log %+v, want the one saved under %s with a new ID", errorLog, old)
+	}
+	if len(errorLog.Attachments) != 1 || errorLog.Attachments[0].Data != nil || errorLog.Attachments[0].Hash == "" {
+		return fmt.Errorf("got attachments %+v of the error log, want the hash of the data only", errorLog.Attachments)
+	}
+	if response, err = store.GetResponse(undated); err != nil {
+		return err
+	}
+	if response.CreatedAt.IsZero() {
+		return errors.New("undated response was not given a creation time")
+	}
+
+	responses, err := store.ListResponses(storage.RecordQuery{UserID: userID})
+	if err != nil {
+		return err
+	}
+	if got, want := responseTexts(responses), []string{"old", "older"}; !slices.Equal(got, want) {
+		return fmt.Errorf("got responses %v of the user, want %v", got, want)
+	}
+	errorLogs, err := store.ListErrors(storage.RecordQuery{UserID: userID})
+	if err != nil {
+		return err
+	}
+	if len(errorLogs) != 1 || errorLogs[0].ID != errorLog.ID {
+		return fmt.Errorf("got error logs %+v of the user, want the migrated one", errorLogs)
+	}
+
+	dump, err := dumpBuckets(engine, "responses", "geminiErrors")
+	if err != nil {
+		return err
+	}
+	for bucketName, bucketRecords := range dump {
+		for key := range bucketRecords {
+			if key == older || key == old || key == undated {
+				return fmt.Errorf("record %s of bucket %s kept its md5 key", key, bucketName)
+			}
+		}
+	}
+
+	// pruning a record drops its old key too
+	report, err := store.Prune(storage.RetentionPolicy{MaxPerUser: 1})
+	if err != nil {
+		return err
+	}
+	if report.Responses != 1 {
+		return fmt.Errorf("pruned %+v, want the older response", report)
+	}
+	if _, err := store.GetResponse(older); !errors.Is(err, storage.ErrResponseNotFound) {
+		return fmt.Errorf("got %v for a pruned response, want %v", err, storage.ErrResponseNotFound)
+	}
+	if dump, err = dumpBuckets(engine, "legacyKeys"); err != nil {
+		return err
+	}
+	want := []string{"geminiErrors/" + old, "responses/" + old, "responses/" + undated}
+	slices.Sort(want)
+	if keys := slices.Sorted(maps.Keys(dump["legacyKeys"])); !slices.Equal(keys, want) {
+		return fmt.Errorf("got legacy keys %v after pruning, want %v", keys, want)
+	}
+	return nil
+}
+
+func responseTexts(responses []storage.Response) []string {
+	var texts []string
+	for _, response := range responses {
+		texts = append(texts, response.Text)
+	}
+	return texts
+}
+
+func checkMigrateDryRun(engine storage.Engine) error {
+	if err := seedLegacy(engine); err != nil {
+		return err
+	}
+	before, err := dumpBuckets(engine, legacyBuckets...)
+	if err != nil {
+		return err
+	}
+
+	report, err := storage.PlanMigrations(engine)
+	if err != nil {
+		return err
+	}
+	if !report.DryRun || report.From != 0 || len(report.Steps) == 0 || report.Backup != "" {
+		return fmt.Errorf("got report %+v, want a dry run of every migration without a backup", report)
+	}
+	changes := 0
+	for _, step := range report.Steps {
+		changes += len(step.Changes)
+	}
+	if changes == 0 {
+		return errors.New("dry run reported no changes")
+	}
+
+	// the migrations ran and were rolled back, including the new buckets and the schema version
+	after, err := dumpBuckets(engine, legacyBuckets...)
+	if err != nil {
+		return err
+	}
+	if !maps.EqualFunc(before, after, maps.Equal) {
+		return errors.New("dry run changed the records")
+	}
+	return engine.View(func(tx storage.Tx) error {
+		if tx.Bucket([]byte("meta")) != nil || tx.Bucket([]byte("messages")) != nil {
+			return errors.New("dry run created buckets")
+		}
+		if data := tx.Bucket([]byte("users")).Get([]byte("1")); !bytes.Contains(data, []byte(`"hello"`)) {
+			return fmt.Errorf("dry run moved the history out of the settings: %s", data)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,1017 @@
+// Package storagetest checks that storage backends behave the same, in the spirit of testing/fstest.
+package storagetest
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"time"
+
+	"github.com/hashicorp/go-multierror"
+
+	"github.com/vasyvasilie/gemini-chat-tg-bot/pkg/storage"
+)
+
+const (
+	userID      int64 = 1
+	otherUserID int64 = 2
+)
+
+var errRollback = errors.New("rollback")
+
+type engineCheck struct {
+	name string
+	run  func(engine storage.Engine) error
+}
+
+type storeCheck struct {
+	name string
+	run  func(store storage.Store) error
+}
+
+var engineChecks = []engineCheck{
+	{"put and get", checkPutGet},
+	{"prefix order", checkPrefixOrder},
+	{"range", checkRange},
+	{"rollback", checkRollback},
+	{"read-only view", checkReadOnly},
+}
+
+var storeChecks = []storeCheck{
+	{"user settings", checkUserSettings},
+	{"responses and errors", checkLogs},
+	{"record queries", checkRecordQueries},
+	{"retention", checkRetention},
+	{"conversations", checkConversations},
+	{"branches", checkBranches},
+	{"messages", checkMessages},
+	{"embeddings", checkEmbeddings},
+	{"prompts", checkPrompts},
+	{"remote files", checkRemoteFiles},
+	{"user data", checkUserData},
+	{"stats", checkStats},
+}
+
+// TestEngine runs every engine check on a fresh engine from newEngine and returns all failures.
+func TestEngine(newEngine func() (storage.Engine, error)) error {
+	var multiErr error
+	for _, check := range engineChecks {
+		engine, err := newEngine()
+		if err != nil {
+			return fmt.Errorf("failed to open engine: %w", err)
+		}
+
+		if err := check.run(engine); err != nil {
+			multiErr = multierror.Append(multiErr, fmt.Errorf("%s: %w", check.name, err))
+		}
+		if err := engine.Close(); err != nil {
+			multiErr = multierror.Append(multiErr, fmt.Errorf("%s: failed to close engine: %w", check.name, err))
+		}
+	}
+	return multiErr
+}
+
+// TestStore runs every store check on a fresh store from newStore and returns all failures.
+func TestStore(newStore func() (storage.Store, error)) error {
+	var multiErr error
+	for _, check := range storeChecks {
+		store, err := newStore()
+		if err != nil {
+			return fmt.Errorf("failed to open store: %w", err)
+		}
+
+		if err := check.run(store); err != nil {
+			multiErr = multierror.Append(multiErr, fmt.Errorf("%s: %w", check.name, err))
+		}
+		if err := store.Close(); err != nil {
+			multiErr = multierror.Append(multiErr, fmt.Errorf("%s: failed to close store: %w", check.name, err))
+		}
+	}
+	return multiErr
+}
+
+func checkPutGet(engine storage.Engine) error {
+	bucketName := []byte("bucket")
+	if err := engine.Update(func(tx storage.Tx) error {
+		if tx.Bucket(bucketName) != nil {
+			return errors.New("bucket exists before it is created")
+		}
+		bucket, err := tx.CreateBucketIfNotExists(bucketName)
+		if err != nil {
+			return err
+		}
+		if err := bucket.Put([]byte("key"), []byte("value")); err != nil {
+			return err
+		}
+		return bucket.Put([]byte("empty"), []byte{})
+	}); err != nil {
+		return err
+	}
+
+	return engine.View(func(tx storage.Tx) error {
+		bucket := tx.Bucket(bucketName)
+		if bucket == nil {
+			return errors.New("created bucket not found")
+		}
+		if value := bucket.Get([]byte("key")); !bytes.Equal(value, []byte("value")) {
+			return fmt.Errorf("got %q, want %q", value, "value")
+		}
+		if value := bucket.Get([]byte("empty")); value == nil || len(value) != 0 {
+			return fmt.Errorf("got %q for an empty value, want an empty non-nil slice", value)
+		}
+		if value := bucket.Get([]byte("missing")); value != nil {
+			return fmt.Errorf("got %q for a missing key, want nil", value)
+		}
+		return nil
+	})
+}
+
+func checkPrefixOrder(engine storage.Engine) error {
+	keys := []string{"1/b", "1/a", "10/a", "1/c", "2/a", "1"}
+	if err := engine.Update(func(tx storage.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists([]byte("bucket"))
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			if err := bucket.Put([]byte(key), []byte(key)); err != nil {
+				return err
+			}
+		}
+
+		// deleting while iterating must not skip keys
+		var visited []string
+		if err := bucket.ForEachPrefix([]byte("1/"), func(k, v []byte) error {
+			visited = append(visited, string(k))
+			return bucket.Delete(k)
+		}); err != nil {
+			return err
+		}
+		if want := []string{"1/a", "1/b", "1/c"}; !slices.Equal(visited, want) {
+			return fmt.Errorf("visited %v, want %v", visited, want)
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	return engine.View(func(tx storage.Tx) error {
+		var visited []string
+		if err := tx.Bucket([]byte("bucket")).ForEachPrefix(nil, func(k, v []byte) error {
+			if !bytes.Equal(k, v) {
+				return fmt.Errorf("got value %q for key %q", v, k)
+			}
+			visited = append(visited, string(k))
+			return nil
+		}); err != nil {
+			return err
+		}
+		if want := []string{"1", "10/a", "2/a"}; !slices.Equal(visited, want) {
+			return fmt.Errorf("visited %v, want %v", visited, want)
+		}
+		return nil
+	})
+}
+
+func checkRange(engine storage.Engine) error {
+	return engine.Update(func(tx storage.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists([]byte("bucket"))
+		if err != nil {
+			return err
+		}
+		for _, key := range []string{"d", "b", "a", "c", "bb"} {
+			if err := bucket.Put([]byte(key), []byte{}); err != nil {
+				return err
+			}
+		}
+
+		for _, r := range []struct {
+			start, end []byte
+			want       []string
+		}{
+			{[]byte("b"), []byte("c"), []string{"b", "bb"}},
+			{[]byte("ba"), []byte("d"), []string{"bb", "c"}},
+			{nil, []byte("b"), []string{"a"}},
+			{[]byte("c"), nil, []string{"c", "d"}},
+			{[]byte("e"), nil, nil},
+		} {
+			var visited []string
+			if err := bucket.ForEachRange(r.start, r.end, func(k, v []byte) error {
+				if v == nil {
+					return fmt.Errorf("got a nil value for key %q", k)
+				}
+				visited = append(visited, string(k))
+				return nil
+			}); err != nil {
+				return err
+			}
+			if !slices.Equal(visited, r.want) {
+				return fmt.Errorf("visited %v from %q to %q, want %v", visited, r.start, r.end, r.want)
+			}
+		}
+
+		// deleting while iterating must not skip keys
+		visited := 0
+		if err := bucket.ForEachRange(nil, nil, func(k, v []byte) error {
+			visited++
+			return bucket.Delete(k)
+		}); err != nil {
+			return err
+		}
+		if visited != 5 {
+			return fmt.Errorf("visited %d keys deleting them, want 5", visited)
+		}
+		return nil
+	})
+}
+
+func checkRollback(engine storage.Engine) error {
+	if err := engine.Update(func(tx storage.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists([]byte("bucket"))
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte("kept"), []byte("before"))
+	}); err != nil {
+		return err
+	}
+
+	err := engine.Update(func(tx storage.Tx) error {
+		bucket := tx.Bucket([]byte("bucket"))
+		if err := bucket.Put([]byte("kept"), []byte("after")); err != nil {
+			return err
+		}
+		if err := bucket.Put([]byte("added"), []byte("after")); err != nil {
+			return err
+		}
+		if _, err := tx.CreateBucketIfNotExists([]byte("other")); err != nil {
+			return err
+		}
+		return errRollback
+	})
+	if !errors.Is(err, errRollback) {
+		return fmt.Errorf("got %v from the failed transaction, want %v", err, errRollback)
+	}
+
+	return engine.View(func(tx storage.Tx) error {
+		bucket := tx.Bucket([]byte("bucket"))
+		if value := bucket.Get([]byte("kept")); !bytes.Equal(value, []byte("before")) {
+			return fmt.Errorf("got %q after rollback, want %q", value, "before")
+		}
+		if value := bucket.Get([]byte("added")); value != nil {
+			return fmt.Errorf("got %q for a key added by the rolled back transaction", value)
+		}
+		if tx.Bucket([]byte("other")) != nil {
+			return errors.New("bucket created by the rolled back transaction exists")
+		}
+		return nil
+	})
+}
+
+func checkReadOnly(engine storage.Engine) error {
+	if err := engine.Update(func(tx storage.Tx) error {
+		_, err := tx.CreateBucketIfNotExists([]byte("bucket"))
+		return err
+	}); err != nil {
+		return err
+	}
+
+	_ = engine.View(func(tx storage.Tx) error {
+		return tx.Bucket([]byte("bucket")).Put([]byte("key"), []byte("value"))
+	})
+
+	return engine.View(func(tx storage.Tx) error {
+		if value := tx.Bucket([]byte("bucket")).Get([]byte("key")); value != nil {
+			return fmt.Errorf("got %q written in a read-only transaction", value)
+		}
+		return nil
+	})
+}
+
+func checkUserSettings(store storage.Store) error {
+	if _, err := store.GetUserSettings(userID); !errors.Is(err, storage.ErrUserNotFound) {
+		return fmt.Errorf("got %v for a new user, want %v", err, storage.ErrUserNotFound)
+	}
+
+	settings := &storage.UserSettings{UserID: userID, ModelName: "models/gemini", FavoriteModels: []string{"a", "b"}}
+	if err := store.SaveUserSettings(userID, settings); err != nil {
+		return err
+	}
+	if settings.Version != 1 {
+		return fmt.Errorf("got version %d after the first save, want 1", settings.Version)
+	}
+
+	stored, err := store.GetUserSettings(userID)
+	if err != nil {
+		return err
+	}
+	if stored.ModelName != settings.ModelName || !slices.Equal(stored.FavoriteModels, settings.FavoriteModels) ||
+		stored.Version != settings.Version {
+		return fmt.Errorf("got %+v, want %+v", stored, settings)
+	}
+
+	stale := *stored
+	stored.ModelName = "models/other"
+	if err := store.SaveUserSettings(userID, stored); err != nil {
+		return err
+	}
+	if err := store.SaveUserSettings(userID, &stale); !errors.Is(err, storage.ErrVersionConflict) {
+		return fmt.Errorf("got %v saving stale settings, want %v", err, storage.ErrVersionConflict)
+	}
+
+	// a session is saved with its messages or not at all
+	stale = *stored
+	stored.SessionID = "session"
+	if nodes, err := store.SaveSession(stored, 0, []storage.Message{{Role: "user", Text: "hi"}}); err != nil || !slices.Equal(nodes, []int{0}) {
+		return fmt.Errorf("got nodes %v and %v saving a session, want node 0", nodes, err)
+	}
+	stale.SessionID = stored.SessionID
+	if _, err := store.SaveSession(&stale, 1, []storage.Message{{Role: "model", Text: "hello"}}); !errors.Is(err, storage.ErrVersionConflict) {
+		return fmt.Errorf("got %v saving a stale session, want %v", err, storage.ErrVersionConflict)
+	}
+	messages, err := store.GetMessages(userID, "session", 0, 0)
+	if err != nil {
+		return err
+	}
+	if len(messages) != 1 {
+		return fmt.Errorf("got %d messages after saving a stale session, want 1", len(messages))
+	}
+
+	if _, err := store.GetUserSettings(otherUserID); !errors.Is(err, storage.ErrUserNotFound) {
+		return fmt.Errorf("got %v for another user, want %v", err, storage.ErrUserNotFound)
+	}
+	return nil
+}
+
+func checkLogs(store storage.Store) error {
+	responseKey, err := store.SaveResponse(userID, "answer")
+	if err != nil {
+		return err
+	}
+	attachments := []storage.Attachment{
+		{Name: "a.txt", MIMEType: "text/plain", Data: []byte("data")},
+		{Name: "b.pdf", MIMEType: "application/pdf", FileName: "files/b"},
+	}
+	history := []storage.Message{{Role: "user", Text: "earlier", Attachments: attachments[:1]}}
+	errorKey, err := store.LogGeminiError(userID, "models/gemini", "prompt", attachments, "failed", history)
+	if err != nil {
+		return err
+	}
+	if responseKey == "" || errorKey == "" {
+		return errors.New("got an empty key")
+	}
+
+	response, err := store.GetResponse(responseKey)
+	if err != nil {
+		return err
+	}
+	if response.UserID != userID || response.Text != "answer" || response.ID != responseKey {
+		return fmt.Errorf("got response %+v, want the saved one", response)
+	}
+	errorLog, err := store.GetErrorLog(errorKey)
+	if err != nil {
+		return err
+	}
+	if errorLog.RequestText != "prompt" || errorLog.Model != "models/gemini" || len(errorLog.History) != 1 ||
+		len(errorLog.Attachments) != 2 || errorLog.Attachments[1].FileName != "files/b" {
+		return fmt.Errorf("got error log %+v, want the logged one", errorLog)
+	}
+	// inline data is kept as a hash only, file references can still be replayed
+	dataHash := fmt.Sprintf("%x", sha256.Sum256([]byte("data")))
+	for _, attachment := range []storage.Attachment{errorLog.Attachments[0], errorLog.History[0].Attachments[0]} {
+		if attachment.Data != nil || attachment.Hash != dataHash {
+			return fmt.Errorf("got attachment %+v, want the hash of its data only", attachment)
+		}
+	}
+	if unreplayable := errorLog.Unreplayable(); unreplayable != 1 {
+		return fmt.Errorf("got %d unreplayable attachments, want 1", unreplayable)
+	}
+	if !bytes.Equal(attachments[0].Data, []byte("data")) {
+		return errors.New("logging dropped the data of the attachments of the caller")
+	}
+	if _, err := store.GetResponse(errorKey); !errors.Is(err, storage.ErrResponseNotFound) {
+		return fmt.Errorf("got %v for a missing response, want %v", err, storage.ErrResponseNotFound)
+	}
+	if _, err := store.GetErrorLog(responseKey); !errors.Is(err, storage.ErrErrorLogNotFound) {
+		return fmt.Errorf("got %v for a missing error log, want %v", err, storage.ErrErrorLogNotFound)
+	}
+
+	size, err := store.GetDBSize()
+	if err != nil {
+		return err
+	}
+	if size < 0 {
+		return fmt.Errorf("got negative size %f", size)
+	}
+	return nil
+}
+
+func checkRecordQueries(store storage.Store) error {
+	start := time.Now()
+	var responseIDs []string
+	for _, text := range []string{"first", "second", "third"} {
+		id, err := store.SaveResponse(userID, text)
+		if err != nil {
+			return err
+		}
+		responseIDs = append(responseIDs, id)
+		if _, err := store.SaveResponse(otherUserID, text); err != nil {
+			return err
+		}
+	}
+	if !slices.IsSorted(responseIDs) {
+		return fmt.Errorf("got IDs %v, want them in the order they were saved", responseIDs)
+	}
+
+	responses, err := store.ListResponses(storage.RecordQuery{UserID: userID})
+	if err != nil {
+		return err
+	}
+	if len(responses) != 3 || responses[0].Text != "third" || responses[0].ID != responseIDs[2] || responses[2].Text != "first" {
+		return fmt.Errorf("got responses %+v, want the 3 of the user newest first", responses)
+	}
+	if responses, err = store.ListResponses(storage.RecordQuery{Limit: 4}); err != nil {
+		return err
+	}
+	if len(responses) != 4 || responses[0].UserID != otherUserID || responses[0].Text != "third" {
+		return fmt.Errorf("got responses %+v, want the newest 4 of every user", responses)
+	}
+
+	// IDs have millisecond precision
+	time.Sleep(2 * time.Millisecond)
+	middle := time.Now()
+	time.Sleep(2 * time.Millisecond)
+	errorID, err := store.LogGeminiError(userID, "models/gemini", "prompt", nil, "failed", nil)
+	if err != nil {
+		return err
+	}
+
+	errorLogs, err := store.ListErrors(storage.RecordQuery{From: middle})
+	if err != nil {
+		return err
+	}
+	if len(errorLogs) != 1 || errorLogs[0].ID != errorID {
+		return fmt.Errorf("got error logs %+v, want the one logged after %v", errorLogs, middle)
+	}
+	if errorLogs, err = store.ListErrors(storage.RecordQuery{UserID: otherUserID}); err != nil {
+		return err
+	}
+	if len(errorLogs) != 0 {
+		return fmt.Errorf("got error logs %+v of a user without errors", errorLogs)
+	}
+	if responses, err = store.ListResponses(storage.RecordQuery{UserID: userID, From: start, To: middle}); err != nil {
+		return err
+	}
+	if len(responses) != 3 {
+		return fmt.Errorf("got %d responses before %v, want 3", len(responses), middle)
+	}
+	if responses, err = store.ListResponses(storage.RecordQuery{UserID: userID, From: middle}); err != nil {
+		return err
+	}
+	if len(responses) != 0 {
+		return fmt.Errorf("got responses %+v saved after %v", responses, middle)
+	}
+	return nil
+}
+
+func checkRetention(store storage.Store) error {
+	for _, text := range []string{"first", "second", "third"} {
+		if _, err := store.SaveResponse(userID, text); err != nil {
+			return err
+		}
+		if _, err := store.LogGeminiError(userID, "models/gemini", text, nil, "failed", nil); err != nil {
+			return err
+		}
+	}
+	if _, err := store.SaveResponse(otherUserID, "other"); err != nil {
+		return err
+	}
+
+	report, err := store.Prune(storage.RetentionPolicy{})
+	if err != nil {
+		return err
+	}
+	if report.Responses != 0 || report.Errors != 0 {
+		return fmt.Errorf("pruned %+v without a policy", report)
+	}
+
+	if report, err = store.Prune(storage.RetentionPolicy{MaxPerUser: 1}); err != nil {
+		return err
+	}
+	if report.Responses != 2 || report.Errors != 2 {
+		return fmt.Errorf("pruned %+v keeping one record per user, want 2 responses and 2 errors", report)
+	}
+
+	time.Sleep(time.Millisecond)
+	if report, err = store.Prune(storage.RetentionPolicy{MaxAge: time.Nanosecond}); err != nil {
+		return err
+	}
+	if report.Responses != 2 || report.Errors != 1 {
+		return fmt.Errorf("pruned %+v by age, want 2 responses and 1 error", report)
+	}
+
+	if _, err := store.Compact(); err != nil {
+		return err
+	}
+	if _, err := store.SaveResponse(userID, "after compaction"); err != nil {
+		return fmt.Errorf("failed to save after compaction: %w", err)
+	}
+	return nil
+}
+
+func checkConversations(store storage.Store) error {
+	if err := store.AppendMessages(userID, "empty", "models/gemini", 0, nil); err != nil {
+		return err
+	}
+	if _, err := store.GetConversation(userID, "empty"); !errors.Is(err, storage.ErrConversationNotFound) {
+		return fmt.Errorf("got %v for an empty conversation, want %v", err, storage.ErrConversationNotFound)
+	}
+
+	history := []storage.Message{{Role: "user", Text: "hi"}, {Role: "model", Text: "hello"}}
+	if err := store.AppendMessages(userID, "first", "models/gemini", 0, history); err != nil {
+		return err
+	}
+	// ListConversations orders by update time
+	time.Sleep(time.Millisecond)
+	if err := store.AppendMessages(userID, "second", "models/gemini", 0, history[:1]); err != nil {
+		return err
+	}
+	if err := store.AppendMessages(otherUserID, "first", "models/gemini", 0, history); err != nil {
+		return err
+	}
+
+	conversation, err := store.GetConversation(userID, "first")
+	if err != nil {
+		return err
+	}
+	if len(conversation.History.Messages) != len(history) || conversation.History.Messages[1].Text != "hello" {
+		return fmt.Errorf("got history %+v, want %+v", conversation.History.Messages, history)
+	}
+
+	if err := store.RenameConversation(userID, "first", "Greeting"); err != nil {
+		return err
+	}
+	if err := store.RenameConversation(userID, "missing", "Title"); !errors.Is(err, storage.ErrConversationNotFound) {
+		return fmt.Errorf("got %v renaming a missing conversation, want %v", err, storage.ErrConversationNotFound)
+	}
+
+	conversations, err := store.ListConversations(userID)
+	if err != nil {
+		return err
+	}
+	var ids []string
+	for _, conversation := range conversations {
+		ids = append(ids, conversation.ID)
+	}
+	if want := []string{"second", "first"}; !slices.Equal(ids, want) {
+		return fmt.Errorf("listed %v, want %v", ids, want)
+	}
+	if conversations[1].Title != "Greeting" {
+		return fmt.Errorf("got title %q, want %q", conversations[1].Title, "Greeting")
+	}
+
+	if err := store.DeleteConversation(userID, "first"); err != nil {
+		return err
+	}
+	if err := store.DeleteConversation(userID, "first"); !errors.Is(err, storage.ErrConversationNotFound) {
+		return fmt.Errorf("got %v deleting twice, want %v", err, storage.ErrConversationNotFound)
+	}
+	if _, err := store.GetConversation(otherUserID, "first"); err != nil {
+		return fmt.Errorf("conversation of another user: %w", err)
+	}
+	return nil
+}
+
+func checkBranches(store storage.Store) error {
+	prompt := storage.Message{Role: "user", Text: "hi", MessageID: 1}
+	first := []storage.Message{prompt, {Role: "model", Text: "hello"}}
+	second := []storage.Message{prompt, {Role: "model", Text: "hey"}}
+	if err := store.AppendMessages(userID, "tree", "models/gemini", 0, first); err != nil {
+		return err
+	}
+	if err := store.AppendMessages(userID, "tree", "models/gemini", 1, second[1:]); err != nil {
+		return err
+	}
+
+	conversation, err := store.GetConversation(userID, "tree")
+	if err != nil {
+		return err
+	}
+	branches := conversation.Tree.Branches()
+	if len(branches) != 2 || !branches[1].Active {
+		return fmt.Errorf("got branches %+v, want two with the second active", branches)
+	}
+
+	conversation, err = store.SwitchBranch(userID, "tree", branches[0].Leaf)
+	if err != nil {
+		return err
+	}
+	if text := conversation.History.Messages[1].Text; text != "hello" {
+		return fmt.Errorf("got answer %q after switching, want %q", text, "hello")
+	}
+	if _, err := store.SwitchBranch(userID, "tree", len(conversation.Tree.Nodes)); !errors.Is(err, storage.ErrBranchNotFound) {
+		return fmt.Errorf("got %v switching to a missing branch, want %v", err, storage.ErrBranchNotFound)
+	}
+	return nil
+}
+
+func checkMessages(store storage.Store) error {
+	var history []storage.Message
+	for i := range 10 {
+		history = append(history, storage.Message{Role: "user", Text: fmt.Sprint(i), MessageID: i + 1})
+		// one turn at a time, like the bot saves them
+		if err := store.AppendMessages(userID, "long", "models/gemini", i, history[i:]); err != nil {
+			return err
+		}
+	}
+	if err := store.AppendMessages(userID, "long", "models/gemini", 11, history[:1]); err == nil {
+		return fmt.Errorf("appended after more messages than the conversation has")
+	}
+	if all, err := store.GetMessages(userID, "long", 0, 0); err != nil || len(all) != len(history) {
+		return fmt.Errorf("got %d messages, %v without a limit, want %d", len(all), err, len(history))
+	}
+
+	page, err := store.GetMessages(userID, "long", 3, 4)
+	if err != nil {
+		return err
+	}
+	if texts := messageTexts(page); !slices.Equal(texts, []string{"3", "4", "5", "6"}) {
+		return fmt.Errorf("got page %v, want messages 3 to 6", texts)
+	}
+	if page, err = store.GetMessages(userID, "long", 8, 10); err != nil {
+		return err
+	}
+	if texts := messageTexts(page); !slices.Equal(texts, []string{"0", "1"}) {
+		return fmt.Errorf("got last page %v, want messages 0 and 1", texts)
+	}
+	if _, err := store.GetMessages(userID, "missing", 0, 1); !errors.Is(err, storage.ErrConversationNotFound) {
+		return fmt.Errorf("got %v paging a missing conversation, want %v", err, storage.ErrConversationNotFound)
+	}
+
+	// forking at the middle and continuing the old branch after switching back keeps both
+	fork := []storage.Message{{Role: "user", Text: "fork", MessageID: 100}}
+	if err := store.AppendMessages(userID, "long", "models/gemini", 5, fork); err != nil {
+		return err
+	}
+	conversation, err := store.GetConversation(userID, "long")
+	if err != nil {
+		return err
+	}
+	if _, err := store.SwitchBranch(userID, "long", conversation.Tree.Branches()[0].Leaf); err != nil {
+		return err
+	}
+	history = append(history, storage.Message{Role: "user", Text: "10", MessageID: 11})
+	if err := store.AppendMessages(userID, "long", "models/gemini", 10, history[10:]); err != nil {
+		return err
+	}
+
+	conversation, err = store.GetConversation(userID, "long")
+	if err != nil {
+		return err
+	}
+	if branches := conversation.Tree.Branches(); len(branches) != 2 || len(conversation.Tree.Nodes) != 12 {
+		return fmt.Errorf("got %d nodes in %d branches, want 12 in 2", len(conversation.Tree.Nodes), len(branches))
+	}
+	if texts := messageTexts(conversation.History.Messages); len(texts) != 11 || texts[10] != "10" {
+		return fmt.Errorf("got history %v, want messages 0 to 10", texts)
+	}
+
+	conversation.Archived = true
+	if err := store.SaveConversation(conversation); err != nil {
+		return err
+	}
+	if conversation, err = store.GetConversation(userID, "long"); err != nil {
+		return err
+	}
+	if !conversation.Archived || len(conversation.History.Messages) != 11 {
+		return fmt.Errorf("got archived %t with %d messages after saving, want true with 11",
+			conversation.Archived, len(conversation.History.Messages))
+	}
+
+	if err := store.DeleteConversation(userID, "long"); err != nil {
+		return err
+	}
+	if err := store.AppendMessages(userID, "long", "models/gemini", 0, history[:1]); err != nil {
+		return err
+	}
+	if conversation, err = store.GetConversation(userID, "long"); err != nil {
+		return err
+	}
+	if len(conversation.Tree.Nodes) != 1 {
+		return fmt.Errorf("got %d nodes after deleting and starting over, want 1", len(conversation.Tree.Nodes))
+	}
+	return nil
+}
+
+func messageTexts(messages []storage.Message) []string {
+	var texts []string
+	for _, message := range messages {
+		texts = append(texts, message.Text)
+	}
+	return texts
+}
+
+func checkEmbeddings(store storage.Store) error {
+	// the answer of session s is regenerated, both answers follow the same prompt
+	prompt := storage.Message{Role: "user", Text: "prompt"}
+	if err := store.AppendMessages(userID, "s", "models/gemini", 0, []storage.Message{prompt, {Role: "model", Text: "answer"}}); err != nil {
+		return err
+	}
+	if err := store.AppendMessages(userID, "s", "models/gemini", 1, []storage.Message{{Role: "model", Text: "another"}}); err != nil {
+		return err
+	}
+	if err := store.AppendMessages(userID, "t", "models/gemini", 0, []storage.Message{{Role: "user", Text: "other"}}); err != nil {
+		return err
+	}
+
+	embeddings := []storage.Embedding{
+		{UserID: userID, SessionID: "s", Turn: 1, Node: 1, Role: "model", Text: "answer", Vector: []float32{1, 0}},
+		{UserID: userID, SessionID: "s", Turn: 0, Node: 0, Role: "user", Text: "prompt", Vector: []float32{0, 1}},
+		{UserID: userID, SessionID: "s", Turn: 1, Node: 2, Role: "model", Text: "another", Vector: []float32{0.5, 0.5}},
+		{UserID: userID, SessionID: "t", Turn: 0, Node: 0, Role: "user", Text: "other", Vector: []float32{-1, 0}},
+	}
+	if err := store.SaveEmbeddings(userID, embeddings); err != nil {
+		return err
+	}
+	missing := []storage.Embedding{{UserID: userID, SessionID: "s", Node: 3, Role: "user", Text: "missing"}}
+	if err := store.SaveEmbeddings(userID, missing); err == nil {
+		return fmt.Errorf("saved the embedding of a message that is not stored")
+	}
+
+	matches, err := store.SearchExchanges(userID, []float32{1, 0}, 2)
+	if err != nil {
+		return err
+	}
+	if len(matches) != 2 || matches[0].SessionID != "s" || matches[0].Prompt != "prompt" || matches[0].Answer != "answer" ||
+		matches[1].Answer != "another" {
+		return fmt.Errorf("got matches %+v, want both answers of session s", matches)
+	}
+
+	matches, err = store.SearchExchanges(otherUserID, []float32{1, 0}, 1)
+	if err != nil {
+		return err
+	}
+	if len(matches) != 0 {
+		return fmt.Errorf("got matches %+v for another user", matches)
+	}
+
+	// deleting a conversation leaves nothing to find
+	if err := store.DeleteConversation(userID, "s"); err != nil {
+		return err
+	}
+	if matches, err = store.SearchExchanges(userID, []float32{1, 0}, 2); err != nil {
+		return err
+	}
+	if len(matches) != 0 {
+		return fmt.Errorf("got matches %+v of a deleted conversation", matches)
+	}
+	return nil
+}
+
+func checkPrompts(store storage.Store) error {
+	personal := &storage.PromptTemplate{Name: "sum", Text: "Summarize {{text}}", OwnerID: userID}
+	shared := &storage.PromptTemplate{Name: "fix", Text: "Fix {{text}}", OwnerID: otherUserID, Shared: true}
+	for _, template := range []*storage.PromptTemplate{personal, shared} {
+		if err := store.SavePrompt(template); err != nil {
+			return err
+		}
+	}
+
+	template, err := store.GetPrompt(userID, "fix")
+	if err != nil {
+		return err
+	}
+	if template.Text != shared.Text {
+		return fmt.Errorf("got %q for a shared template, want %q", template.Text, shared.Text)
+	}
+	if _, err := store.GetPrompt(otherUserID, "sum"); !errors.Is(err, storage.ErrPromptNotFound) {
+		return fmt.Errorf("got %v for a template of another user, want %v", err, storage.ErrPromptNotFound)
+	}
+
+	templates, err := store.ListPrompts(userID)
+	if err != nil {
+		return err
+	}
+	if len(templates) != 2 || templates[0].Name != "sum" || templates[1].Name != "fix" {
+		return fmt.Errorf("listed %+v, want sum followed by the shared fix", templates)
+	}
+
+	// sharing moves the template, a shared name of another user is not taken over
+	if err := store.SavePrompt(&storage.PromptTemplate{Name: "fix", Text: "Mine", OwnerID: userID}); err != nil {
+		return err
+	}
+	if _, err := store.SharePrompt(userID, "fix"); !errors.Is(err, storage.ErrPromptNameTaken) {
+		return fmt.Errorf("got %v sharing over a template of another user, want %v", err, storage.ErrPromptNameTaken)
+	}
+	if err := store.SavePrompt(&storage.PromptTemplate{Name: "fix", Text: "Mine", OwnerID: userID, Shared: true}); !errors.Is(err, storage.ErrPromptNameTaken) {
+		return fmt.Errorf("got %v saving over a template of another user, want %v", err, storage.ErrPromptNameTaken)
+	}
+	if err := store.DeletePrompt(userID, "fix"); err != nil {
+		return err
+	}
+	if err := store.SavePrompt(&storage.PromptTemplate{Name: "tr", Text: "Translate", OwnerID: userID, Command: true}); err != nil {
+		return err
+	}
+	moved, err := store.SharePrompt(userID, "tr")
+	if err != nil {
+		return err
+	}
+	if !moved.Shared || moved.Command {
+		return fmt.Errorf("got shared template %+v, want it shared and not a command", moved)
+	}
+	if templates, err = store.ListPrompts(userID); err != nil {
+		return err
+	}
+	if len(templates) != 3 || templates[0].Name != "sum" || !templates[2].Shared || templates[2].Name != "tr" {
+		return fmt.Errorf("listed %+v after sharing tr, want it once among the shared", templates)
+	}
+	if err := store.DeletePrompt(userID, "tr"); err != nil {
+		return err
+	}
+
+	if err := store.DeletePrompt(userID, "fix"); !errors.Is(err, storage.ErrPromptNotFound) {
+		return fmt.Errorf("got %v deleting a template shared by another user, want %v", err, storage.ErrPromptNotFound)
+	}
+	if err := store.DeletePrompt(otherUserID, "fix"); err != nil {
+		return err
+	}
+	if err := store.DeletePrompt(userID, "sum"); err != nil {
+		return err
+	}
+	if templates, err = store.ListPrompts(userID); err != nil || len(templates) != 0 {
+		return fmt.Errorf("listed %+v, %v after deleting everything", templates, err)
+	}
+	return nil
+}
+
+func checkRemoteFiles(store storage.Store) error {
+	now := time.Now()
+	files := []*storage.RemoteFile{
+		{UserID: userID, Name: "files/new", CreatedAt: now},
+		{UserID: userID, Name: "files/old", CreatedAt: now.Add(-time.Hour)},
+		{UserID: otherUserID, Name: "files/other", CreatedAt: now},
+	}
+	for _, file := range files {
+		if err := store.SaveRemoteFile(file); err != nil {
+			return err
+		}
+	}
+
+	file, err := store.GetRemoteFile(userID, "files/old")
+	if err != nil {
+		return err
+	}
+	if !file.CreatedAt.Equal(files[1].CreatedAt) {
+		return fmt.Errorf("got %+v, want %+v", file, files[1])
+	}
+	if _, err := store.GetRemoteFile(userID, "files/other"); !errors.Is(err, storage.ErrFileNotFound) {
+		return fmt.Errorf("got %v for a file of another user, want %v", err, storage.ErrFileNotFound)
+	}
+
+	listed, err := store.ListRemoteFiles(userID)
+	if err != nil {
+		return err
+	}
+	if len(listed) != 2 || listed[0].Name != "files/old" {
+		return fmt.Errorf("listed %+v, want two files oldest first", listed)
+	}
+
+	if err := store.DeleteRemoteFile(userID, "files/old"); err != nil {
+		return err
+	}
+	if err := store.DeleteRemoteFile(userID, "files/old"); !errors.Is(err, storage.ErrFileNotFound) {
+		return fmt.Errorf("got %v deleting twice, want %v", err, storage.ErrFileNotFound)
+	}
+	return nil
+}
+
+func checkUserData(store storage.Store) error {
+	history := []storage.Message{{Role: "user", Text: "hi"}, {Role: "model", Text: "hello"}}
+	for _, id := range []int64{userID, otherUserID} {
+		if err := store.SaveUserSettings(id, &storage.UserSettings{UserID: id}); err != nil {
+			return err
+		}
+		if _, err := store.SaveResponse(id, "answer"); err != nil {
+			return err
+		}
+		if _, err := store.LogGeminiError(id, "models/gemini", "prompt", nil, "failed", history); err != nil {
+			return err
+		}
+		if err := store.AppendMessages(id, "first", "models/gemini", 0, history); err != nil {
+			return err
+		}
+		if err := store.SaveEmbeddings(id, []storage.Embedding{{UserID: id, SessionID: "first", Role: "user", Text: "hi"}}); err != nil {
+			return err
+		}
+		if err := store.SavePrompt(&storage.PromptTemplate{Name: "sum", Text: "Summarize", OwnerID: id}); err != nil {
+			return err
+		}
+		if err := store.SaveRemoteFile(&storage.RemoteFile{UserID: id, Name: "files/a"}); err != nil {
+			return err
+		}
+	}
+	if err := store.SavePrompt(&storage.PromptTemplate{Name: "fix", Text: "Fix", OwnerID: userID, Shared: true}); err != nil {
+		return err
+	}
+
+	var archive bytes.Buffer
+	exported, err := store.ExportUserData(userID, &archive)
+	if err != nil {
+		return err
+	}
+	reader, err := zip.NewReader(bytes.NewReader(archive.Bytes()), int64(archive.Len()))
+	if err != nil {
+		return fmt.Errorf("failed to read the export: %w", err)
+	}
+	var names []string
+	for _, f := range reader.File {
+		names = append(names, f.Name)
+	}
+	want := []string{"users.json", "responses.json", "geminiErrors.json", "embeddings.json", "prompts.json",
+		"files.json", "conversations.json", "messages.json"}
+	if !slices.Equal(names, want) {
+		return fmt.Errorf("exported %v, want %v", names, want)
+	}
+	if exported.Records() != 10 {
+		return fmt.Errorf("exported %d records (%s), want 10", exported.Records(), exported)
+	}
+
+	deleted, err := store.DeleteUserData(userID, []string{"files/left"})
+	if err != nil {
+		return err
+	}
+	if deleted.Records() != exported.Records() {
+		return fmt.Errorf("deleted %s, want the exported %s", deleted, exported)
+	}
+	if remaining, err := store.ExportUserData(userID, io.Discard); err != nil || remaining.Records() != 0 {
+		return fmt.Errorf("got %v and %v after deleting the user data, want no records", remaining, err)
+	}
+	if _, err := store.GetUserSettings(userID); !errors.Is(err, storage.ErrUserNotFound) {
+		return fmt.Errorf("got %v for deleted settings, want %v", err, storage.ErrUserNotFound)
+	}
+	if responses, err := store.ListResponses(storage.RecordQuery{UserID: userID}); err != nil || len(responses) != 0 {
+		return fmt.Errorf("got responses %+v and %v after deleting the user data", responses, err)
+	}
+	if messages, err := store.GetMessages(userID, "first", 0, 10); !errors.Is(err, storage.ErrConversationNotFound) {
+		return fmt.Errorf("got messages %+v and %v after deleting the user data, want %v", messages, err, storage.ErrConversationNotFound)
+	}
+
+	// shared templates stay for the others
+	template, err := store.GetPrompt(otherUserID, "fix")
+	if err != nil {
+		return err
+	}
+	if template.OwnerID != 0 {
+		return fmt.Errorf("shared template still belongs to %d", template.OwnerID)
+	}
+	if remaining, err := store.ExportUserData(otherUserID, io.Discard); err != nil || remaining.Records() != 9 {
+		return fmt.Errorf("got %v and %v for the other user, want 9 records", remaining, err)
+	}
+
+	entries, err := store.ListAudit(1)
+	if err != nil {
+		return err
+	}
+	if len(entries) != 1 || entries[0].Action != storage.AuditForgetUser || entries[0].UserID != userID ||
+		!slices.Equal(entries[0].RemoteFiles, []string{"files/left"}) {
+		return fmt.Errorf("got audit entries %+v, want the deletion with the file left", entries)
+	}
+	return nil
+}
+
+func checkStats(store storage.Store) error {
+	first, err := store.Stats()
+	if err != nil {
+		return err
+	}
+	if first.Previous != nil {
+		return fmt.Errorf("got previous stats %+v the first time", first.Previous)
+	}
+
+	if err := store.AppendMessages(userID, "stats", "models/gemini", 0, []storage.Message{
+		{Role: "user", Text: "question"}, {Role: "model", Text: "answer"},
+	}); err != nil {
+		return err
+	}
+	second, err := store.Stats()
+	if err != nil {
+		return err
+	}
+	if second.Previous == nil || !second.Previous.At.Equal(first.At) {
+		return fmt.Errorf("got previous stats %+v, want the first ones", second.Previous)
+	}
+	for _, bucket := range second.Buckets {
+		if bucket.Name == "messages" && bucket.Keys != 2 {
+			return fmt.Errorf("got %d keys in the messages bucket, want 2", bucket.Keys)
+		}
+	}
+	if len(second.TopUsers) != 1 || second.TopUsers[0].UserID != userID ||
+		second.TopUsers[0].Conversations != 1 || second.TopUsers[0].Messages != 2 {
+		return fmt.Errorf("got top users %+v, want the user with 1 conversation of 2 messages", second.TopUsers)
+	}
+	return nil
+}
@@ -0,0 +1,53 @@
+package storage
+
+import "io"
+
+// Store is everything the bot and the Gemini client keep between restarts.
+type Store interface {
+	SaveUserSettings(userID int64, settings *UserSettings) error
+	SaveSession(settings *UserSettings, after int, messages []Message) ([]int, error)
+	GetUserSettings(userID int64) (*UserSettings, error)
+
+	SaveResponse(userID int64, text string) (string, error)
+	GetResponse(key string) (*Response, error)
+	LogGeminiError(userID int64, model, requestText string, attachments []Attachment, errorMsg string, history []Message) (string, error)
+	GetErrorLog(key string) (*ErrorLog, error)
+	ListResponses(query RecordQuery) ([]Response, error)
+	ListErrors(query RecordQuery) ([]ErrorLog, error)
+	GetDBSize() (float64, error)
+	Prune(policy RetentionPolicy) (*PruneReport, error)
+	Compact() (*CompactReport, error)
+	Stats() (*DBStats, error)
+	Backup(w io.Writer) error
+
+	ExportUserData(userID int64, w io.Writer) (*UserDataReport, error)
+	DeleteUserData(userID int64, remoteFiles []string) (*UserDataReport, error)
+	ListAudit(limit int) ([]AuditEntry, error)
+
+	SaveConversation(conversation *Conversation) error
+	AppendMessages(userID int64, id, model string, after int, messages []Message) error
+	GetConversation(userID int64, id string) (*Conversation, error)
+	GetMessages(userID int64, id string, offset, limit int) ([]Message, error)
+	ListConversations(userID int64) ([]Conversation, error)
+	RenameConversation(userID int64, id, title string) error
+	SwitchBranch(userID int64, id string, leaf int) (*Conversation, error)
+	DeleteConversation(userID int64, id string) error
+
+	SaveEmbeddings(userID int64, embeddings []Embedding) error
+	SearchExchanges(userID int64, query []float32, limit int) ([]ExchangeMatch, error)
+
+	SavePrompt(template *PromptTemplate) error
+	GetPrompt(userID int64, name string) (*PromptTemplate, error)
+	ListPrompts(userID int64) ([]PromptTemplate, error)
+	SharePrompt(userID int64, name string) (*PromptTemplate, error)
+	DeletePrompt(userID int64, name string) error
+
+	SaveRemoteFile(file *RemoteFile) error
+	GetRemoteFile(userID int64, name string) (*RemoteFile, error)
+	ListRemoteFiles(userID int64) ([]RemoteFile, error)
+	DeleteRemoteFile(userID int64, name string) error
+
+	Close() error
+}
+
+var _ Store = (*Storage)(nil)
@@ -0,0 +1,334 @@
+package storage
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// auditBucket keeps an entry under a time ordered ID for every deletion of user data
+	auditBucket string = "audit"
+
+	AuditForgetUser string = "forget user"
+)
+
+// UserDataReport counts the records of a user by bucket, the indexes are left out.
+type UserDataReport struct {
+	Buckets []BucketStats
+}
+
+type AuditEntry struct {
+	// ID is the key of the entry, it is not part of the stored record
+	ID     string `json:"-"`
+	At     time.Time
+	Action string
+	UserID int64
+	// Records counts the records the action touched by bucket
+	Records []BucketStats `json:",omitempty"`
+	// RemoteFiles are the files uploaded to Gemini that could not be deleted there, they expire on their own
+	RemoteFiles []string `json:",omitempty"`
+}
+
+// userBucket tells which records of a bucket belong to a user. Every bucket in buckets needs one,
+// so that the export and deletion of user data cannot miss the buckets added later.
+type userBucket struct {
+	// records calls fn with the records of the user, nil if the bucket holds none
+	records func(tx Tx, bucket Bucket, userID int64, fn func(k, v []byte) error) error
+	// index buckets only point at other records, they are deleted but not exported
+	index bool
+	// forget removes a record of the user, nil deletes it
+	forget func(bucket Bucket, k, v []byte) error
+}
+
+var userBuckets = map[string]userBucket{
+	usersBucket: {records: func(tx Tx, bucket Bucket, userID int64, fn func(k, v []byte) error) error {
+		key := []byte(strconv.FormatInt(userID, 10))
+		if data := bucket.Get(key); data != nil {
+			return fn(key, data)
+		}
+		return nil
+	}},
+	responseBucket:      {records: responseRecords.ownedBy},
+	geminiErrorsBucket:  {records: errorRecords.ownedBy},
+	embeddingsBucket:    {records: userPrefixRecords},
+	promptsBucket:       {records: userPrompts, forget: forgetPrompt},
+	filesBucket:         {records: userPrefixRecords},
+	conversationsBucket: {records: userPrefixRecords},
+	messagesBucket:      {records: userPrefixRecords},
+	responseIndexBucket: {records: userPrefixRecords, index: true},
+	errorIndexBucket:    {records: userPrefixRecords, index: true},
+	legacyKeysBucket:    {records: userLegacyKeys, index: true},
+	auditBucket:         {},
+	metaBucket:          {},
+}
+
+type userRecord struct {
+	bucket string
+	key    []byte
+	value  []byte
+}
+
+type exportedRecord struct {
+	Key   string
+	Value json.RawMessage
+}
+
+// ExportUserData writes a zip archive with a JSON file per bucket holding the records of the user.
+func (s *Storage) ExportUserData(userID int64, w io.Writer) (*UserDataReport, error) {
+	var records []userRecord
+	err := s.db.View(func(tx Tx) error {
+		var err error
+		records, err = userRecords(tx, userID)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	report := &UserDataReport{}
+	archive := zip.NewWriter(w)
+	for _, name := range buckets {
+		var exported []exportedRecord
+		for _, record := range records {
+			if record.bucket != name || userBuckets[name].index {
+				continue
+			}
+			value := json.RawMessage(record.value)
+			if !json.Valid(value) {
+				value, _ = json.Marshal(string(record.value))
+			}
+			exported = append(exported, exportedRecord{Key: string(record.key), Value: value})
+			report.add(name, record)
+		}
+		if len(exported) == 0 {
+			continue
+		}
+
+		data, err := json.MarshalIndent(exported, "", "  ")
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal records of bucket %s: %w", name, err)
+		}
+		f, err := archive.Create(name + ".json")
+		if err != nil {
+			return nil, err
+		}
+		if _, err := f.Write(data); err != nil {
+			return nil, err
+		}
+	}
+	if err := archive.Close(); err != nil {
+		return nil, err
+	}
+
+	return report, nil
+}
+
+// DeleteUserData deletes every record of the user and saves an audit entry of the deletion, listing
+// the remote files left on Gemini. Shared prompt templates stay for the other users without naming
+// the user as their owner.
+func (s *Storage) DeleteUserData(userID int64, remoteFiles []string) (*UserDataReport, error) {
+	report := &UserDataReport{}
+	err := s.db.Update(func(tx Tx) error {
+		// the records are found first, some are found through the indexes deleted with them
+		records, err := userRecords(tx, userID)
+		if err != nil {
+			return err
+		}
+
+		for _, record := range records {
+			owner := userBuckets[record.bucket]
+			bucket := tx.Bucket([]byte(record.bucket))
+			if owner.forget != nil {
+				err = owner.forget(bucket, record.key, record.value)
+			} else {
+				err = bucket.Delete(record.key)
+			}
+			if err != nil {
+				return fmt.Errorf("failed to delete record %s of bucket %s: %w", record.key, record.bucket, err)
+			}
+			if !owner.index {
+				report.add(record.bucket, record)
+			}
+		}
+
+		return putAuditEntry(tx, &AuditEntry{
+			At:          time.Now(),
+			Action:      AuditForgetUser,
+			UserID:      userID,
+			Records:     report.Buckets,
+			RemoteFiles: remoteFiles,
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return report, nil
+}
+
+// ListAudit returns the newest audit entries first, limit zero returns all of them.
+func (s *Storage) ListAudit(limit int) ([]AuditEntry, error) {
+	var entries []AuditEntry
+	err := s.db.View(func(tx Tx) error {
+		bucket := tx.Bucket([]byte(auditBucket))
+		if bucket == nil {
+			return fmt.Errorf("bucket %s not found", auditBucket)
+		}
+
+		return bucket.ForEachPrefix(nil, func(k, v []byte) error {
+			entry := AuditEntry{ID: string(k)}
+			if err := json.Unmarshal(v, &entry); err != nil {
+				return fmt.Errorf("failed to unmarshal audit entry %s: %w", k, err)
+			}
+			entries = append(entries, entry)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if limit > 0 && len(entries) > limit {
+		entries = entries[len(entries)-limit:]
+	}
+	for i, j := 0, len(entries)-1; i < j; i, j = i+1, j-1 {
+		entries[i], entries[j] = entries[j], entries[i]
+	}
+	return entries, nil
+}
+
+func putAuditEntry(tx Tx, entry *AuditEntry) error {
+	bucket := tx.Bucket([]byte(auditBucket))
+	if bucket == nil {
+		return fmt.Errorf("bucket %s not found", auditBucket)
+	}
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("failed to marshal audit entry: %w", err)
+	}
+	entry.ID = ids.at(entry.At)
+	return bucket.Put([]byte(entry.ID), data)
+}
+
+// userRecords returns the records of the user in every bucket.
+func userRecords(tx Tx, userID int64) ([]userRecord, error) {
+	var records []userRecord
+	for _, name := range buckets {
+		owner, ok := userBuckets[name]
+		if !ok {
+			return nil, fmt.Errorf("bucket %s does not tell which records belong to a user", name)
+		}
+		if owner.records == nil {
+			continue
+		}
+
+		bucket := tx.Bucket([]byte(name))
+		if bucket == nil {
+			return nil, fmt.Errorf("bucket %s not found", name)
+		}
+		if err := owner.records(tx, bucket, userID, func(k, v []byte) error {
+			records = append(records, userRecord{bucket: name, key: k, value: v})
+			return nil
+		}); err != nil {
+			return nil, fmt.Errorf("failed to read records of bucket %s: %w", name, err)
+		}
+	}
+	return records, nil
+}
+
+func (r *UserDataReport) add(bucket string, record userRecord) {
+	if n := len(r.Buckets); n == 0 || r.Buckets[n-1].Name != bucket {
+		r.Buckets = append(r.Buckets, BucketStats{Name: bucket})
+	}
+	stats := &r.Buckets[len(r.Buckets)-1]
+	stats.Keys++
+	stats.Bytes += int64(len(record.key) + len(record.value))
+}
+
+// Records is the number of records of the user in all buckets.
+func (r *UserDataReport) Records() int {
+	total := 0
+	for _, bucket := range r.Buckets {
+		total += bucket.Keys
+	}
+	return total
+}
+
+func (r *UserDataReport) String() string {
+	if len(r.Buckets) == 0 {
+		return "no records"
+	}
+
+	parts := make([]string, len(r.Buckets))
+	for i, bucket := range r.Buckets {
+		parts[i] = fmt.Sprintf("%s: %d", bucket.Name, bucket.Keys)
+	}
+	return strings.Join(parts, ", ")
+}
+
+func userPrefixRecords(tx Tx, bucket Bucket, userID int64, fn func(k, v []byte) error) error {
+	return bucket.ForEachPrefix([]byte(strconv.FormatInt(userID, 10)+"/"), fn)
+}
+
+// ownedBy finds the records of the user through the index.
+func (k recordKind) ownedBy(tx Tx, bucket Bucket, userID int64, fn func(k, v []byte) error) error {
+	return k.list(tx, RecordQuery{UserID: userID}, func(id string, data []byte) error {
+		return fn([]byte(id), data)
+	})
+}
+
+// userLegacyKeys finds the legacy keys of the records indexed for the user.
+func userLegacyKeys(tx Tx, bucket Bucket, userID int64, fn func(k, v []byte) error) error {
+	return bucket.ForEachPrefix(nil, func(k, v []byte) error {
+		for _, kind := range []recordKind{responseRecords, errorRecords} {
+			if !bytes.HasPrefix(k, []byte(kind.bucket+"/")) {
+				continue
+			}
+			if index := tx.Bucket([]byte(kind.index)); index != nil && index.Get([]byte(indexKey(userID, string(v)))) != nil {
+				return fn(k, v)
+			}
+		}
+		return nil
+	})
+}
+
+// userPrompts returns the personal templates of the user and the shared ones they wrote.
+func userPrompts(tx Tx, bucket Bucket, userID int64, fn func(k, v []byte) error) error {
+	if err := bucket.ForEachPrefix(promptPrefix(userID, false), fn); err != nil {
+		return err
+	}
+	return bucket.ForEachPrefix(promptPrefix(0, true), func(k, v []byte) error {
+		var template PromptTemplate
+		if err := json.Unmarshal(v, &template); err != nil {
+			return fmt.Errorf("failed to unmarshal prompt template %s: %w", k, err)
+		}
+		if template.OwnerID != userID {
+			return nil
+		}
+		return fn(k, v)
+	})
+}
+
+func forgetPrompt(bucket Bucket, k, v []byte) error {
+	var template PromptTemplate
+	if err := json.Unmarshal(v, &template); err != nil {
+		return fmt.Errorf("failed to unmarshal prompt template %s: %w", k, err)
+	}
+	if !template.Shared {
+		return bucket.Delete(k)
+	}
+
+	template.OwnerID = 0
+	data, err := json.Marshal(template)
+	if err != nil {
+		return fmt.Errorf("failed to marshal prompt template: %w", err)
+	}
+	return bucket.Put(k, data)
+}
@@ -0,0 +1,12 @@
+package storage
+
+import "testing"
+
+// TestUserBuckets checks that the export and deletion of user data know every bucket.
+func TestUserBuckets(t *testing.T) {
+	for _, name := range buckets {
+		if _, ok := userBuckets[name]; !ok {
+			t.Errorf("bucket %s has no entry in userBuckets", name)
+		}
+	}
+}